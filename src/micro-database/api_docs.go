@@ -0,0 +1,474 @@
+package main
+
+import (
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Answers shared by several routes
+var (
+	conflictResponses = map[int]apiResponse{
+		409: {Description: "Modified in the meantime, the current state of the pictures", Body: []Picture{}},
+		412: {Description: "Modified since the version of If-Match, the current state of the picture", Body: []Picture{}},
+	}
+	pictureResponse = apiResponse{Description: "The picture, its version is the ETag", Body: Picture{}}
+	noContent       = apiResponse{Description: "Done"}
+	notFound        = apiResponse{Description: "No such picture", ContentType: "text/plain"}
+)
+
+var imageQuery = map[string]string{
+	"location":  "Id of the location to crop to, the whole image by default",
+	"mask":      "true to make what is outside of the polygon of the location transparent",
+	"maxWidth":  "Largest width in pixels",
+	"maxHeight": "Largest height in pixels",
+	"thumbnail": "true for a cached thumbnail",
+	"ticket":    "Ticket of purpose images (POST /api/v1/tickets), for the clients which can't set headers",
+}
+
+var amountQuery = map[string]string{
+	"amount": fmt.Sprintf("Number of pictures, from 1 to %v, %v by default", maxAmount, defaultQueueAmount),
+}
+
+var statsQuery = map[string]string{
+	"from":   "Start of the range, RFC 3339 or 2006-01-02",
+	"to":     "End of the range, now by default",
+	"format": "csv for a CSV file, JSON otherwise",
+}
+
+var periodQuery = map[string]string{
+	"from":   statsQuery["from"],
+	"to":     statsQuery["to"],
+	"format": statsQuery["format"],
+	"period": "day or week",
+}
+
+func withConflicts(responses map[int]apiResponse) map[int]apiResponse {
+	for status, response := range conflictResponses {
+		responses[status] = response
+	}
+	return responses
+}
+
+/**
+Description of the routes, by method and path template of the router
+Every route of newRouter has an entry, which is checked by the tests
+*/
+var apiOperations = map[string]apiOperation{
+	"GET /openapi.json": {
+		Summary:   "This document",
+		Responses: map[int]apiResponse{200: {Description: "OpenAPI 3 document", Body: map[string]interface{}{}}},
+		Public:    true,
+	},
+	"GET /docs": {
+		Summary:   "Documentation of the API, browsing this document",
+		Responses: map[int]apiResponse{200: {Description: "HTML page", ContentType: "text/html"}},
+		Public:    true,
+	},
+
+	"GET /api/v1/pictures": {
+		Summary: "List the pictures, or those with a flag",
+		Query: map[string]string{
+			"flag":  "Only the pictures with this flag, built-in or custom. Without it, only the administrators can list every picture",
+			"value": "Value of the flag, true by default",
+		},
+		Responses: map[int]apiResponse{200: {Description: "The pictures", Body: []Picture{}}},
+	},
+	"POST /api/v1/pictures": {
+		Summary: "Create pictures, their custom flags must be declared in the settings",
+		Body:    []Picture{},
+		Responses: map[int]apiResponse{
+			201: {Description: "Ids of the created pictures", Body: []primitive.ObjectID{}},
+			400: {Description: "A custom flag is not declared, nothing was inserted", ContentType: "text/plain"},
+		},
+	},
+	"DELETE /api/v1/pictures": {
+		Summary: "Empty the collection, with the X-Confirmation-Token of POST /db/delete/all/confirmation",
+		Responses: map[int]apiResponse{
+			200: {Description: "Name of the snapshot of the collection", Body: map[string]string{}},
+			428: {Description: "No confirmation token", ContentType: "text/plain"},
+		},
+		Admin: true,
+	},
+	"GET /api/v1/pictures/{id}": {
+		Summary:   "Get a picture",
+		Responses: map[int]apiResponse{200: pictureResponse, 404: notFound},
+	},
+	"PATCH /api/v1/pictures/{id}": {
+		Summary:   "Replace the Url, Filename or PiFF of a picture",
+		Body:      PicturePatch{},
+		Responses: withConflicts(map[int]apiResponse{200: pictureResponse, 404: notFound}),
+		Admin:     true,
+	},
+	"DELETE /api/v1/pictures/{id}": {
+		Summary:   "Move a picture to the trash",
+		Responses: map[int]apiResponse{204: noContent, 404: notFound},
+		Admin:     true,
+	},
+	"GET /api/v1/pictures/{id}/image": {
+		Summary: "Image of a picture, or of one of its locations",
+		Query:   imageQuery,
+		Responses: map[int]apiResponse{
+			200: {Description: "The image, PNG or JPEG as its file", ContentType: "image/*"},
+			304: {Description: "Not modified since the ETag of If-None-Match"},
+			404: notFound,
+		},
+	},
+	"POST /api/v1/pictures/{id}/annotations": {
+		Summary:   "Annotate a picture, as the authenticated user or as the recognizer",
+		Body:      Annotation{},
+		Responses: withConflicts(map[int]apiResponse{201: pictureResponse, 404: notFound}),
+	},
+	"PATCH /api/v1/pictures/{id}/flags": {
+		Summary:   "Set flags of a picture",
+		Body:      map[Flag]bool{},
+		Responses: withConflicts(map[int]apiResponse{200: pictureResponse, 404: notFound}),
+	},
+	"GET /api/v1/queues/annotation": {
+		Summary:   "Next pictures to annotate, suggested by the recognizer first",
+		Query:     amountQuery,
+		Responses: map[int]apiResponse{200: {Description: "The pictures", Body: []Picture{}}},
+	},
+	"POST /api/v1/queues/recognizer": {
+		Summary:   "Take the next pictures to send to the recognizer, with the password of the cluster",
+		Query:     amountQuery,
+		Responses: map[int]apiResponse{200: {Description: "The pictures, marked as sent", Body: []Picture{}}},
+	},
+	"POST /api/v1/queues/recognizer/stream": {
+		Summary: "Stream of pictures for the recognizer, with the password of the cluster : " +
+			"the request and the answer are lines of StreamMessage, sent on the same HTTP/1.1 connection",
+		BodyType: "application/x-ndjson",
+		Responses: map[int]apiResponse{
+			200: {
+				Description: "Pictures up to the declared capacity, and the acknowledgements of the results",
+				ContentType: "application/x-ndjson",
+			},
+			505: {Description: "The stream needs HTTP/1.1", ContentType: "text/plain"},
+		},
+	},
+	"POST /api/v1/tickets": {
+		Summary:   "Short-lived ticket of the authenticated user, sent as ?ticket= by the clients which can't set headers",
+		Body:      TicketRequest{},
+		Responses: map[int]apiResponse{201: {Description: "The ticket and its expiry", Body: TicketResponse{}}},
+	},
+
+	"GET /db/": {
+		Summary:   "Check that the service is running",
+		Responses: map[int]apiResponse{200: {Description: "Message", ContentType: "text/plain"}},
+		Public:    true,
+	},
+	"POST /db/auth/invalidate": {
+		Summary:   "Forget a token on logout, called by the auth microservice with the cluster password",
+		Body:      InvalidateRequest{},
+		Responses: map[int]apiResponse{204: noContent},
+	},
+	"GET /db/select/{id}": {
+		Summary:    "Get a picture",
+		Responses:  map[int]apiResponse{200: pictureResponse, 404: notFound},
+		Deprecated: true,
+	},
+	"GET /db/retrieve/all": {
+		Summary:    "List every picture",
+		Responses:  map[int]apiResponse{200: {Description: "The pictures", Body: []Picture{}}},
+		Deprecated: true,
+		Admin:      true,
+	},
+	"GET /db/retrieve/snippets/{amount}": {
+		Summary:    "Next pictures to annotate",
+		Responses:  map[int]apiResponse{200: {Description: "The pictures", Body: []Picture{}}},
+		Deprecated: true,
+	},
+	"GET /db/retrieve/recognizer/{amount}": {
+		Summary:    "Take the next pictures to send to the recognizer",
+		Responses:  map[int]apiResponse{200: {Description: "The pictures, marked as sent", Body: []Picture{}}},
+		Deprecated: true,
+	},
+	"GET /db/retrieve/flag/{flag}": {
+		Summary:    "Pictures with a flag",
+		Query:      map[string]string{"value": "Value of the flag, true by default"},
+		Responses:  map[int]apiResponse{200: {Description: "The pictures", Body: []Picture{}}},
+		Deprecated: true,
+	},
+	"GET /db/picture/{id}/image": {
+		Summary: "Image of a picture, or of one of its locations",
+		Query:   imageQuery,
+		Responses: map[int]apiResponse{
+			200: {Description: "The image, PNG or JPEG as its file", ContentType: "image/*"},
+			304: {Description: "Not modified since the ETag of If-None-Match"},
+			404: notFound,
+		},
+		Deprecated: true,
+	},
+	"GET /db/status": {
+		Summary: "Counts of the pictures",
+		Query:   map[string]string{"by": "annotator for the counts of each annotator"},
+		Responses: map[int]apiResponse{
+			200: {Description: "The counts", Body: Status{}},
+			400: {Description: "Unknown breakdown, only annotator is supported", ContentType: "text/plain"},
+		},
+	},
+	"GET /db/settings": {
+		Summary:   "Settings of the project",
+		Responses: map[int]apiResponse{200: {Description: "The settings", Body: Settings{}}},
+	},
+	"POST /db/insert": {
+		Summary: "Create pictures, their custom flags must be declared in the settings",
+		Body:    []Picture{},
+		Responses: map[int]apiResponse{
+			201: {Description: "Ids of the created pictures", Body: []primitive.ObjectID{}},
+			400: {Description: "A custom flag is not declared, nothing was inserted", ContentType: "text/plain"},
+		},
+		Deprecated: true,
+	},
+	"POST /db/upload": {
+		Summary:  "Upload images, each one becomes a picture unless the same file was already uploaded",
+		BodyType: "multipart/form-data",
+		Responses: map[int]apiResponse{
+			201: {Description: "At least one picture was created", Body: []UploadResult{}},
+			409: {Description: "Every file was already uploaded", Body: []UploadResult{}},
+			415: {Description: "Unsupported image format", ContentType: "text/plain"},
+		},
+	},
+	"PUT /db/update/flags": {
+		Summary:    "Set flags of pictures",
+		Body:       []Modification{},
+		Responses:  withConflicts(map[int]apiResponse{204: noContent}),
+		Deprecated: true,
+	},
+	"PUT /db/update/value": {
+		Summary:    "Annotate pictures",
+		Body:       []Annotation{},
+		Responses:  withConflicts(map[int]apiResponse{204: noContent}),
+		Deprecated: true,
+	},
+	"PUT /db/update/value/{annotator}": {
+		Summary:    "Annotate pictures in the name of an annotator",
+		Body:       []Annotation{},
+		Responses:  withConflicts(map[int]apiResponse{204: noContent}),
+		Deprecated: true,
+	},
+	"PUT /db/settings/flags": {
+		Summary:   "Declare the custom flags, the ones no longer declared are removed from the pictures",
+		Body:      []Flag{},
+		Responses: map[int]apiResponse{204: noContent},
+		Admin:     true,
+	},
+	"DELETE /db/delete/all": {
+		Summary: "Empty the collection, with the X-Confirmation-Token of POST /db/delete/all/confirmation",
+		Responses: map[int]apiResponse{
+			200: {Description: "Name of the snapshot of the collection", Body: map[string]string{}},
+			428: {Description: "No confirmation token", ContentType: "text/plain"},
+		},
+		Deprecated: true,
+		Admin:      true,
+	},
+	"POST /db/delete/all/confirmation": {
+		Summary:   "Token to empty the collection",
+		Responses: map[int]apiResponse{201: {Description: "The token, valid a few minutes", Body: Confirmation{}}},
+		Admin:     true,
+	},
+	"DELETE /db/delete/picture/{id}": {
+		Summary:    "Move a picture to the trash",
+		Responses:  map[int]apiResponse{204: noContent, 404: notFound},
+		Deprecated: true,
+		Admin:      true,
+	},
+	"POST /db/delete/filter": {
+		Summary:   "Move the pictures matching a filter to the trash",
+		Body:      DeleteFilter{},
+		Responses: map[int]apiResponse{200: {Description: "Ids of the deleted pictures", Body: []primitive.ObjectID{}}},
+		Admin:     true,
+	},
+	"GET /db/trash": {
+		Summary:   "Pictures in the trash",
+		Responses: map[int]apiResponse{200: {Description: "The pictures", Body: []TrashedPicture{}}},
+		Admin:     true,
+	},
+	"POST /db/trash/{id}/restore": {
+		Summary: "Restore a picture from the trash",
+		Responses: map[int]apiResponse{
+			204: noContent,
+			404: notFound,
+			409: {Description: "A picture with this id is already in the collection, it stays in the trash", ContentType: "text/plain"},
+		},
+		Admin: true,
+	},
+	"GET /db/stats/annotators": {
+		Summary:   "Statistics of the annotators",
+		Query:     statsQuery,
+		Responses: map[int]apiResponse{200: {Description: "The statistics", Body: []AnnotatorStats{}, ContentType: "text/csv"}},
+		Admin:     true,
+	},
+	"GET /db/stats/annotators/activity": {
+		Summary:   "Annotations of each annotator by period",
+		Query:     periodQuery,
+		Responses: map[int]apiResponse{200: {Description: "The activity", Body: []ActivityStats{}, ContentType: "text/csv"}},
+		Admin:     true,
+	},
+	"GET /db/stats/recognizer": {
+		Summary: "Error rates of the models of the recognizer",
+		Query: map[string]string{
+			"from":      statsQuery["from"],
+			"to":        statsQuery["to"],
+			"format":    statsQuery["format"],
+			"period":    "day or week, the whole range by default",
+			"validated": "true to only count the suggestions validated by a review",
+		},
+		Responses: map[int]apiResponse{200: {Description: "The metrics", Body: []RecognizerMetric{}, ContentType: "text/csv"}},
+		Admin:     true,
+	},
+	"GET /db/duplicates": {
+		Summary:   "Groups of duplicates",
+		Responses: map[int]apiResponse{200: {Description: "The groups", Body: []DuplicateGroup{}}},
+		Admin:     true,
+	},
+	"POST /db/duplicates/scan": {
+		Summary:   "Fingerprint the pictures and link the duplicates now",
+		Responses: map[int]apiResponse{200: {Description: "What the scan did", Body: DuplicatesReport{}}},
+		Admin:     true,
+	},
+	"DELETE /db/duplicates/{id}": {
+		Summary:   "Unlink a picture from its group of duplicates",
+		Responses: map[int]apiResponse{204: noContent, 404: notFound},
+		Admin:     true,
+	},
+	"GET /db/fsck": {
+		Summary:   "Check the consistency of the pictures",
+		Responses: map[int]apiResponse{200: {Description: "The issues found", Body: FsckReport{}}},
+		Admin:     true,
+	},
+	"POST /db/fsck": {
+		Summary:   "Check the consistency of the pictures and repair the safe issues",
+		Query:     map[string]string{"fix": "Must be true"},
+		Responses: map[int]apiResponse{200: {Description: "The issues found and fixed", Body: FsckReport{}}},
+		Admin:     true,
+	},
+	"GET /db/indexes": {
+		Summary:   "Indexes of the collections and their usage",
+		Responses: map[int]apiResponse{200: {Description: "The indexes", Body: []IndexStatus{}}},
+		Admin:     true,
+	},
+	"PUT /db/indexes": {
+		Summary:   "Create the missing indexes and drop the obsolete ones",
+		Responses: map[int]apiResponse{200: {Description: "Names of the created and dropped indexes", Body: map[string][]string{}}},
+		Admin:     true,
+	},
+	"GET /db/backup": {
+		Summary:   "Archive of the collection and its companion collections",
+		Query:     map[string]string{"collection": "Another collection of the database"},
+		Responses: map[int]apiResponse{200: {Description: "Gzipped archive", ContentType: "application/gzip"}},
+		Admin:     true,
+	},
+	"POST /db/restore": {
+		Summary:  "Restore an archive of GET /db/backup",
+		BodyType: "application/gzip",
+		Query: map[string]string{
+			"mode":       "merge (default) or replace",
+			"collection": "Another collection of the database",
+		},
+		Responses: map[int]apiResponse{200: {Description: "Manifest of the restored archive", Body: ArchiveManifest{}}},
+		Admin:     true,
+	},
+	"GET /db/events": {
+		Summary: "Stream of the events of the pictures",
+		Query: map[string]string{
+			"types":  "Comma separated types of events, all of them by default",
+			"ticket": "Ticket of purpose events (POST /api/v1/tickets), for the clients which can't set headers",
+		},
+		Responses: map[int]apiResponse{200: {Description: "Server-Sent Events, each data is an Event", ContentType: "text/event-stream"}},
+	},
+	"GET /db/webhooks": {
+		Summary:   "Registered webhooks, without their secret",
+		Responses: map[int]apiResponse{200: {Description: "The webhooks", Body: []Webhook{}}},
+		Admin:     true,
+	},
+	"POST /db/webhooks": {
+		Summary:   "Register a webhook",
+		Body:      Webhook{},
+		Responses: map[int]apiResponse{201: {Description: "The webhook", Body: Webhook{}}},
+		Admin:     true,
+	},
+	"GET /db/webhooks/deadletters": {
+		Summary:   "Events which could not be delivered",
+		Responses: map[int]apiResponse{200: {Description: "The dead letters", Body: []DeadLetter{}}},
+		Admin:     true,
+	},
+	"POST /db/webhooks/deadletters/{id}/retry": {
+		Summary:   "Deliver a dead letter again",
+		Responses: map[int]apiResponse{202: {Description: "Delivery started"}, 404: {Description: "No such dead letter", ContentType: "text/plain"}},
+		Admin:     true,
+	},
+	"DELETE /db/webhooks/{id}": {
+		Summary:   "Unregister a webhook",
+		Responses: map[int]apiResponse{204: noContent, 404: {Description: "No such webhook", ContentType: "text/plain"}},
+		Admin:     true,
+	},
+}
+
+/**
+Page of GET /docs, it renders /openapi.json in the browser
+It is served by the service itself, nothing is loaded from elsewhere
+*/
+const apiDocsPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Taliesin micro-database API</title>
+<style>
+body { font-family: sans-serif; margin: 2em auto; max-width: 60em; color: #222; }
+details { border: 1px solid #ccc; border-radius: 4px; margin: 0.4em 0; padding: 0.4em 0.8em; }
+summary { cursor: pointer; }
+.method { display: inline-block; width: 5em; font-weight: bold; text-transform: uppercase; }
+.deprecated summary { text-decoration: line-through; color: #888; }
+pre { background: #f4f4f4; padding: 0.6em; overflow-x: auto; }
+</style>
+</head>
+<body>
+<h1>Taliesin micro-database API</h1>
+<p>Generated from the routes of the service, also available as <a href="openapi.json">OpenAPI 3</a>.</p>
+<div id="operations">Loading...</div>
+<h2>Schemas</h2>
+<div id="schemas"></div>
+<script>
+function element(tag, text) {
+  var e = document.createElement(tag);
+  if (text) e.textContent = text;
+  return e;
+}
+function block(title, value) {
+  var d = element("div");
+  d.appendChild(element("h4", title));
+  d.appendChild(element("pre", JSON.stringify(value, null, 2)));
+  return d;
+}
+fetch("openapi.json").then(function (r) { return r.json(); }).then(function (spec) {
+  var operations = document.getElementById("operations");
+  operations.textContent = "";
+  Object.keys(spec.paths).sort().forEach(function (path) {
+    Object.keys(spec.paths[path]).forEach(function (method) {
+      var op = spec.paths[path][method];
+      var d = element("details");
+      if (op.deprecated) d.className = "deprecated";
+      var s = element("summary");
+      s.appendChild(element("span", method)).className = "method";
+      s.appendChild(element("code", path));
+      s.appendChild(document.createTextNode(" " + (op.summary || "")));
+      d.appendChild(s);
+      if (op.parameters) d.appendChild(block("Parameters", op.parameters));
+      if (op.requestBody) d.appendChild(block("Request body", op.requestBody.content));
+      d.appendChild(block("Responses", op.responses));
+      operations.appendChild(d);
+    });
+  });
+  var schemas = document.getElementById("schemas");
+  Object.keys(spec.components.schemas).sort().forEach(function (name) {
+    var d = element("details");
+    d.id = name;
+    d.appendChild(element("summary", name));
+    d.appendChild(element("pre", JSON.stringify(spec.components.schemas[name], null, 2)));
+    schemas.appendChild(d);
+  });
+});
+</script>
+</body>
+</html>
+`
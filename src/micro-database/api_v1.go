@@ -0,0 +1,455 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	lib_auth "github.com/taliesin-insa/lib-auth"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Prefix of the resource-oriented API, the routes under /db are kept for the existing clients
+const apiV1 = "/api/v1"
+
+// Pictures given by the queues when no amount is asked
+const defaultQueueAmount = 10
+
+var (
+	deprecatedRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "deprecated_requests_total",
+		Help: "Number of HTTP requests processed on the deprecated routes, by route",
+	}, []string{"route"})
+)
+
+/**
+Serve a route replaced by the versioned API, the answer tells the client where the route moved
+successor : template of the new route, its variables are the ones of the deprecated route
+Empty when the route is replaced by one route per picture, only the Deprecation header is sent
+*/
+func deprecated(handler http.HandlerFunc, successor string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		route := r.URL.Path
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		deprecatedRequestsTotal.WithLabelValues(r.Method + " " + route).Inc()
+
+		w.Header().Set("Deprecation", "true")
+		if successor != "" {
+			link := successor
+			for name, value := range mux.Vars(r) {
+				link = strings.Replace(link, "{"+name+"}", value, -1)
+			}
+			w.Header().Set("Link", fmt.Sprintf("<%v>; rel=\"successor-version\"", link))
+		}
+		handler(w, r)
+	}
+}
+
+// Answer with the current state of a picture
+func writePicture(w http.ResponseWriter, r *http.Request, status int, pic Picture) {
+	body, err := json.Marshal(pic)
+	if err != nil {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("[MICRO-DATABASE] Could not marshal answer data"))
+		return
+	}
+
+	w.Header().Set("ETag", ETag(pic.Version))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+/**
+Answer an error of a modification of a single picture
+*/
+func writePictureError(w http.ResponseWriter, r *http.Request, err error, ifMatch *int64) {
+	var conflict *ConflictError
+	if errors.As(err, &conflict) {
+		writeConflict(w, r, conflict, ifMatch != nil)
+		return
+	}
+
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrPictureNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrEmptyPatch), errors.Is(err, ErrUnknownFlag):
+		status = http.StatusBadRequest
+	}
+	writeDatabaseError(w, r, err, status)
+}
+
+// Amount of pictures asked to a queue, ?amount=
+func queueAmount(r *http.Request) (int, error) {
+	rawAmount := r.URL.Query().Get("amount")
+	if rawAmount == "" {
+		return defaultQueueAmount, nil
+	}
+	return parseAmount(rawAmount)
+}
+
+func listPictures(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.Inc() // incrementing the httpRequestsTotal counter
+
+	user, err, authStatusCode := authenticateUser(r)
+
+	// check if there was an error during the authentication or if the user wasn't authenticated
+	if err != nil {
+		logf(r.Context(), "[ERROR] Check authentication: %v", err.Error())
+		w.WriteHeader(authStatusCode)
+		w.Write([]byte("[MICRO-DATABASE] Couldn't verify identity"))
+		return
+	}
+
+	var pictures []Picture
+	if flag := r.URL.Query().Get("flag"); flag != "" {
+		// the value defaults to true, ?value=false selects the pictures without the flag
+		value := true
+		if rawValue := r.URL.Query().Get("value"); rawValue != "" {
+			value, err = strconv.ParseBool(rawValue)
+			if err != nil {
+				logf(r.Context(), "[ERROR] : %v", err.Error())
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("[MICRO-DATABASE] Could not read specified value"))
+				return
+			}
+		}
+		pictures, err = FindManyByFlag(r.Context(), Flag(flag), value, Database)
+	} else {
+		// check if the authenticated user has sufficient permissions to list everything
+		if user.Role != lib_auth.RoleAdmin {
+			logf(r.Context(), "[WRONG_ROLE] Insufficient permission: want %v, was %v", lib_auth.RoleAdmin, user.Role)
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("[MICRO-DATABASE] Insufficient permissions to list the pictures"))
+			return
+		}
+		pictures, err = FindAll(r.Context(), Database)
+	}
+	if errors.Is(err, ErrUnknownFlag) {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("[MICRO-DATABASE] %v", err.Error())))
+		return
+	} else if err != nil {
+		writeDatabaseError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	body, err := json.Marshal(pictures)
+	if err != nil {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("[MICRO-DATABASE] Could not marshal answer data"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+func getPicture(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.Inc() // incrementing the httpRequestsTotal counter
+
+	_, err, authStatusCode := authenticateUser(r)
+
+	// check if there was an error during the authentication or if the user wasn't authenticated
+	if err != nil {
+		logf(r.Context(), "[ERROR] Check authentication: %v", err.Error())
+		w.WriteHeader(authStatusCode)
+		w.Write([]byte("[MICRO-DATABASE] Couldn't verify identity"))
+		return
+	}
+
+	entryId, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("[MICRO-DATABASE] Could not decode ID"))
+		return
+	}
+
+	entry, err := FindOne(r.Context(), entryId, Database)
+	if err != nil {
+		writeDatabaseError(w, r, err, http.StatusNotFound)
+		return
+	}
+
+	writePicture(w, r, http.StatusOK, entry)
+}
+
+func patchPicture(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.Inc() // incrementing the httpRequestsTotal counter
+
+	user, err, authStatusCode := authenticateUser(r)
+
+	// check if there was an error during the authentication or if the user wasn't authenticated
+	if err != nil {
+		logf(r.Context(), "[ERROR] Check authentication: %v", err.Error())
+		w.WriteHeader(authStatusCode)
+		w.Write([]byte("[MICRO-DATABASE] Couldn't verify identity"))
+		return
+	}
+
+	// check if the authenticated user has sufficient permissions to modify a picture
+	if user.Role != lib_auth.RoleAdmin {
+		logf(r.Context(), "[WRONG_ROLE] Insufficient permission: want %v, was %v", lib_auth.RoleAdmin, user.Role)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("[MICRO-DATABASE] Insufficient permissions to modify a picture"))
+		return
+	}
+
+	entryId, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("[MICRO-DATABASE] Could not decode ID"))
+		return
+	}
+
+	ifMatch, err := ParseIfMatch(r.Header.Get("If-Match"))
+	if err != nil {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("[MICRO-DATABASE] %v", err.Error())))
+		return
+	}
+
+	var patch PicturePatch
+	_, err = decodeBody(r, maxBodyBytes, &patch)
+	if err != nil {
+		writeRequestError(w, r, err)
+		return
+	}
+
+	err = UpdatePicture(r.Context(), entryId, patch, ifMatch, Database, user.Username)
+	if err != nil {
+		writePictureError(w, r, err, ifMatch)
+		return
+	}
+
+	entry, err := FindOne(r.Context(), entryId, Database)
+	if err != nil {
+		writePictureError(w, r, err, ifMatch)
+		return
+	}
+	writePicture(w, r, http.StatusOK, entry)
+}
+
+func addAnnotation(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.Inc() // incrementing the httpRequestsTotal counter
+
+	// the recognizer annotates with the password of the cluster, the users under their own name
+	annotator := RecognizerAnnotator
+	if !isClusterPassword(r.Header.Get("Authorization")) {
+		user, err, authStatusCode := authenticateUser(r)
+
+		// check if there was an error during the authentication or if the user wasn't authenticated
+		if err != nil {
+			logf(r.Context(), "[ERROR] Check authentication: %v", err.Error())
+			w.WriteHeader(authStatusCode)
+			w.Write([]byte("[MICRO-DATABASE] Couldn't verify identity"))
+			return
+		}
+		annotator = user.Username
+	}
+
+	entryId, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("[MICRO-DATABASE] Could not decode ID"))
+		return
+	}
+
+	ifMatch, err := ParseIfMatch(r.Header.Get("If-Match"))
+	if err != nil {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("[MICRO-DATABASE] %v", err.Error())))
+		return
+	}
+
+	var annotation Annotation
+	_, err = decodeBody(r, maxBodyBytes, &annotation)
+	if err != nil {
+		writeRequestError(w, r, err)
+		return
+	}
+
+	// the picture is the one of the route, whatever the body says
+	annotation.Id = entryId
+	if _, err := FindOne(r.Context(), entryId, Database); err != nil {
+		writePictureError(w, r, ErrPictureNotFound, ifMatch)
+		return
+	}
+
+	annotations, err := json.Marshal([1]Annotation{annotation})
+	if err != nil {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("[MICRO-DATABASE] Could not marshal data"))
+		return
+	}
+	err = UpdateValue(r.Context(), annotations, Database, annotator, ifMatch)
+	if err != nil {
+		writePictureError(w, r, err, ifMatch)
+		return
+	}
+
+	entry, err := FindOne(r.Context(), entryId, Database)
+	if err != nil {
+		writePictureError(w, r, err, ifMatch)
+		return
+	}
+	writePicture(w, r, http.StatusCreated, entry)
+}
+
+func patchFlags(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.Inc() // incrementing the httpRequestsTotal counter
+
+	user, err, authStatusCode := authenticateUser(r)
+
+	// check if there was an error during the authentication or if the user wasn't authenticated
+	if err != nil {
+		logf(r.Context(), "[ERROR] Check authentication: %v", err.Error())
+		w.WriteHeader(authStatusCode)
+		w.Write([]byte("[MICRO-DATABASE] Couldn't verify identity"))
+		return
+	}
+
+	entryId, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("[MICRO-DATABASE] Could not decode ID"))
+		return
+	}
+
+	ifMatch, err := ParseIfMatch(r.Header.Get("If-Match"))
+	if err != nil {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("[MICRO-DATABASE] %v", err.Error())))
+		return
+	}
+
+	var flags map[Flag]bool
+	_, err = decodeBody(r, maxBodyBytes, &flags)
+	if err != nil {
+		writeRequestError(w, r, err)
+		return
+	}
+
+	err = SetFlags(r.Context(), entryId, flags, ifMatch, Database, user.Username)
+	if err != nil {
+		writePictureError(w, r, err, ifMatch)
+		return
+	}
+
+	entry, err := FindOne(r.Context(), entryId, Database)
+	if err != nil {
+		writePictureError(w, r, err, ifMatch)
+		return
+	}
+	writePicture(w, r, http.StatusOK, entry)
+}
+
+/**
+Next pictures to annotate : the suggestions of the recognizer first, then the pictures nobody annotated
+*/
+func annotationQueue(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.Inc() // incrementing the httpRequestsTotal counter
+
+	_, err, authStatusCode := authenticateUser(r)
+
+	// check if there was an error during the authentication or if the user wasn't authenticated
+	if err != nil {
+		logf(r.Context(), "[ERROR] Check authentication: %v", err.Error())
+		w.WriteHeader(authStatusCode)
+		w.Write([]byte("[MICRO-DATABASE] Couldn't verify identity"))
+		return
+	}
+
+	amount, err := queueAmount(r)
+	if err != nil {
+		writeRequestError(w, r, err)
+		return
+	}
+
+	entry, err := FindManyWithSuggestion(r.Context(), amount, Database)
+	if err != nil {
+		writeDatabaseError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	if len(entry) < amount {
+		unused, err := FindManyUnused(r.Context(), amount-len(entry), Database)
+		if err != nil {
+			writeDatabaseError(w, r, err, http.StatusInternalServerError)
+			return
+		}
+		entry = append(entry, unused...)
+	}
+
+	body, err := json.Marshal(entry)
+	if err != nil {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("[MICRO-DATABASE] Could not marshal answer data"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+/**
+Take the next pictures to send to the recognizer, they are marked as sent and not given again
+There is no lease : they stay sent until they are annotated, only the pictures of a recognizer stream are put back in the queue when it ends
+*/
+func recognizerQueue(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.Inc() // incrementing the httpRequestsTotal counter
+
+	if !isClusterPassword(r.Header.Get("Authorization")) {
+		logf(r.Context(), "[ERROR] : Wrong password for the recognizer queue")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("[MICRO-DATABASE] Recognizer didn't have correct password"))
+		return
+	}
+
+	amount, err := queueAmount(r)
+	if err != nil {
+		writeRequestError(w, r, err)
+		return
+	}
+
+	entry, err := FindManyForSuggestion(r.Context(), amount, Database)
+	if err != nil {
+		writeDatabaseError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	body, err := json.Marshal(entry)
+	if err != nil {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("[MICRO-DATABASE] Could not marshal answer data"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPicturesV1(t *testing.T) {
+	Database = Client.Database("taliesin_test").Collection("test_api_v1")
+	router := newRouter()
+
+	doc0 := Picture{Id: primitive.NewObjectID(), PiFF: EmptyPiFF, Url: "/temp/none0"}
+	b, _ := json.Marshal([1]Picture{doc0})
+	request, _ := http.NewRequest("POST", "/api/v1/pictures", bytes.NewBuffer(b))
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	var ids []primitive.ObjectID
+	json.Unmarshal(recorder.Body.Bytes(), &ids)
+	id := ids[0].Hex()
+
+	request, _ = http.NewRequest("GET", "/api/v1/pictures/"+id, nil)
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, `"0"`, recorder.Header().Get("ETag"))
+	assert.Equal(t, "", recorder.Header().Get("Deprecation"))
+
+	// annotated by the authenticated user, under the version just read
+	request, _ = http.NewRequest("POST", "/api/v1/pictures/"+id+"/annotations", bytes.NewBufferString(`{"Value": "Annotated"}`))
+	request.Header.Set("If-Match", `"0"`)
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	assert.Equal(t, `"1"`, recorder.Header().Get("ETag"))
+	var pic Picture
+	json.Unmarshal(recorder.Body.Bytes(), &pic)
+	assert.Equal(t, "Annotated", pic.PiFF.Data[0].Value)
+	assert.Equal(t, "morpheus", pic.Annotator)
+	assert.True(t, pic.Annotated)
+
+	request, _ = http.NewRequest("PATCH", "/api/v1/pictures/"+id+"/flags", bytes.NewBufferString(`{"Unreadable": true, "Corrected": true}`))
+	request.Header.Set("If-Match", `"0"`)
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusPreconditionFailed, recorder.Code)
+
+	request, _ = http.NewRequest("PATCH", "/api/v1/pictures/"+id+"/flags", bytes.NewBufferString(`{"Unreadable": true, "Corrected": true}`))
+	request.Header.Set("If-Match", `"1"`)
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	json.Unmarshal(recorder.Body.Bytes(), &pic)
+	assert.True(t, pic.Unreadable)
+	assert.True(t, pic.Corrected)
+	assert.Equal(t, int64(2), pic.Version)
+
+	request, _ = http.NewRequest("PATCH", "/api/v1/pictures/"+id+"/flags", bytes.NewBufferString(`{"Blurry": true}`))
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	// only the administrators modify the picture itself
+	request, _ = http.NewRequest("PATCH", "/api/v1/pictures/"+id, bytes.NewBufferString(`{"Filename": "page_1.png"}`))
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+
+	request, _ = http.NewRequest("PATCH", "/api/v1/pictures/"+id, bytes.NewBufferString(`{"Filename": "page_1.png"}`))
+	request.Header.Set("Authorization", "admin_token")
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	json.Unmarshal(recorder.Body.Bytes(), &pic)
+	assert.Equal(t, "page_1.png", pic.Filename)
+	assert.Equal(t, "/temp/none0", pic.Url)
+
+	request, _ = http.NewRequest("PATCH", "/api/v1/pictures/"+primitive.NewObjectID().Hex(), bytes.NewBufferString(`{"Filename": "page_2.png"}`))
+	request.Header.Set("Authorization", "admin_token")
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
+
+func TestDeprecatedRoutes(t *testing.T) {
+	Database = Client.Database("taliesin_test").Collection("test_api_deprecated")
+	router := newRouter()
+
+	doc0 := Picture{Id: primitive.NewObjectID(), PiFF: EmptyPiFF, Url: "/temp/none0"}
+	b, _ := json.Marshal([1]Picture{doc0})
+	res, _ := InsertMany(context.Background(), b, Database, "test")
+	id := res[0].(primitive.ObjectID).Hex()
+
+	// the old route still answers, and points to its successor
+	request, _ := http.NewRequest("GET", "/db/select/"+id, nil)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "true", recorder.Header().Get("Deprecation"))
+	assert.Equal(t, `</api/v1/pictures/`+id+`>; rel="successor-version"`, recorder.Header().Get("Link"))
+
+	request, _ = http.NewRequest("GET", "/db/retrieve/snippets/5", nil)
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, `</api/v1/queues/annotation?amount=5>; rel="successor-version"`, recorder.Header().Get("Link"))
+
+	// the batches have no single successor
+	request, _ = http.NewRequest("PUT", "/db/update/flags", bytes.NewBufferString("[]"))
+	request.Header.Set("Authorization", "invalid_token")
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	assert.Equal(t, "true", recorder.Header().Get("Deprecation"))
+	assert.Equal(t, "", recorder.Header().Get("Link"))
+
+	// the routes without a successor are not deprecated
+	request, _ = http.NewRequest("GET", "/db/status", nil)
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	assert.Equal(t, "", recorder.Header().Get("Deprecation"))
+}
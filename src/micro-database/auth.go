@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	lib_auth "github.com/taliesin-insa/lib-auth"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Users verified by the auth microservice are trusted for a minute unless AUTH_CACHE_SECONDS is set
+var authCacheTTL = time.Minute
+
+// Invalid tokens are remembered for less time, a token can become valid just after being refused
+const authNegativeTTL = 10 * time.Second
+
+// After this many failed calls in a row to the auth microservice, it isn't called for authBreakerCooldown
+const (
+	authBreakerFailures = 5
+	authBreakerCooldown = 30 * time.Second
+)
+
+// A call to the auth microservice taking longer than AUTH_TIMEOUT_SECONDS is a failure
+var authTimeout = 5 * time.Second
+
+var ErrAuthUnavailable = errors.New("Authentication service unavailable")
+
+// Answer of the auth microservice when it refuses a token
+var errTokenRefused = errors.New("error response from auth")
+
+var authClient = &http.Client{}
+
+var (
+	authRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "auth_requests_total",
+		Help: "Number of token verifications, by result : hit, miss, or unavailable",
+	}, []string{"result"})
+)
+
+func init() {
+	if seconds, err := strconv.Atoi(os.Getenv("AUTH_CACHE_SECONDS")); err == nil && seconds >= 0 {
+		authCacheTTL = time.Duration(seconds) * time.Second
+	}
+	if seconds, err := strconv.Atoi(os.Getenv("AUTH_TIMEOUT_SECONDS")); err == nil && seconds > 0 {
+		authTimeout = time.Duration(seconds) * time.Second
+	}
+	authClient.Timeout = authTimeout
+}
+
+type authEntry struct {
+	// nil for a token refused by the auth microservice
+	user    *lib_auth.UserData
+	expires time.Time
+}
+
+/**
+Answers of the auth microservice by hash of the token, and the circuit breaker protecting it
+When the auth microservice fails authBreakerFailures times in a row, the tokens which are not cached are refused
+with a status 503 until authBreakerCooldown has passed, then a single call tells whether it is back
+*/
+type AuthCache struct {
+	mutex     sync.Mutex
+	entries   map[string]authEntry
+	lastSweep time.Time
+	failures  int
+	openUntil time.Time
+	now       func() time.Time
+	verify    func(r *http.Request) (*lib_auth.UserData, error, int)
+}
+
+var Auth = NewAuthCache()
+
+func NewAuthCache() *AuthCache {
+	return &AuthCache{entries: map[string]authEntry{}, now: time.Now, verify: verifyToken}
+}
+
+// Same default as lib_auth, read on each call as lib_auth does
+func authAPIUrl() string {
+	if url, ok := os.LookupEnv("AUTH_API_URL"); ok {
+		return url
+	}
+	return "http://auth-api.gitlab-managed-apps.svc.cluster.local:8080"
+}
+
+/**
+Ask the auth microservice who the token of the request belongs to, as lib_auth.AuthenticateUser with a timeout
+Only a refusal of the token (400, 401 or 403) is answered with a status 400, the other statuses and the failed calls
+are failures of the service : 500 when it can't be reached, 502 when it answers anything else
+*/
+func verifyToken(r *http.Request) (*lib_auth.UserData, error, int) {
+	ctx, span := tracer().Start(r.Context(), "POST /auth/verifyToken", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+
+	body, _ := json.Marshal(lib_auth.VerifyRequest{Token: r.Header.Get("Authorization")})
+	// the verification is bounded by the timeout of the client, not canceled with the request
+	request, err := http.NewRequestWithContext(detachedContext(ctx), "POST", authAPIUrl()+"/auth/verifyToken", bytes.NewReader(body))
+	if err != nil {
+		return nil, err, http.StatusInternalServerError
+	}
+	request.Header.Set("Content-Type", "application/json")
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(request.Header))
+
+	response, err := authClient.Do(request)
+	if err != nil {
+		// without the URL, whose path would be taken for a token in the logs
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err
+		}
+		span.SetStatus(codes.Error, err.Error())
+		logf(r.Context(), "[ERROR] Auth microservice unreachable : %v", err.Error())
+		return nil, errors.New("error in request to auth/verifyToken"), http.StatusInternalServerError
+	}
+	defer response.Body.Close()
+	span.SetAttributes(attribute.Int("http.response.status_code", response.StatusCode))
+
+	switch response.StatusCode {
+	case http.StatusOK:
+	case http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden:
+		return nil, errTokenRefused, http.StatusBadRequest
+	default:
+		span.SetStatus(codes.Error, response.Status)
+		return nil, fmt.Errorf("auth/verifyToken answered %v", response.Status), http.StatusBadGateway
+	}
+
+	user := new(lib_auth.UserData)
+	if err := json.NewDecoder(response.Body).Decode(user); err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return nil, errors.New("error parsing auth/verifyToken"), http.StatusBadGateway
+	}
+	return user, nil, http.StatusOK
+}
+
+// The tokens are not kept in memory
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+/**
+Whether a password is the one of the services of the cluster, CLUSTER_INTERNAL_PASSWORD
+When it is not configured no password is, not even an empty Authorization header
+*/
+func isClusterPassword(password string) bool {
+	expected := os.Getenv("CLUSTER_INTERNAL_PASSWORD")
+	return expected != "" && subtle.ConstantTimeCompare([]byte(password), []byte(expected)) == 1
+}
+
+/**
+Same answers as lib_auth.AuthenticateUser, the handlers call it to authenticate their requests
+*/
+func authenticateUser(r *http.Request) (*lib_auth.UserData, error, int) {
+	return Auth.Authenticate(r)
+}
+
+/**
+Authenticate a token which doesn't come with an HTTP request, for the gRPC API
+*/
+func (c *AuthCache) AuthenticateToken(token string) (*lib_auth.UserData, error, int) {
+	r, _ := http.NewRequest("POST", "/", nil)
+	r.Header.Set("Authorization", token)
+	return c.Authenticate(r)
+}
+
+func (c *AuthCache) Authenticate(r *http.Request) (*lib_auth.UserData, error, int) {
+	key := tokenHash(r.Header.Get("Authorization"))
+
+	c.mutex.Lock()
+	now := c.now()
+	if entry, ok := c.entries[key]; ok && now.Before(entry.expires) {
+		c.mutex.Unlock()
+		authRequestsTotal.WithLabelValues("hit").Inc()
+		if entry.user == nil {
+			return nil, errTokenRefused, http.StatusBadRequest
+		}
+		user := *entry.user
+		return &user, nil, http.StatusOK
+	}
+	if now.Before(c.openUntil) {
+		c.mutex.Unlock()
+		authRequestsTotal.WithLabelValues("unavailable").Inc()
+		return nil, fmt.Errorf("%w : retry after %v", ErrAuthUnavailable, c.openUntil.Format(time.RFC3339)), http.StatusServiceUnavailable
+	}
+	if c.failures >= authBreakerFailures {
+		// half-open : the other requests wait for this one to know if the service is back
+		c.openUntil = now.Add(authBreakerCooldown)
+	}
+	c.mutex.Unlock()
+
+	authRequestsTotal.WithLabelValues("miss").Inc()
+	user, err, status := c.verify(r)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now = c.now()
+	switch {
+	case err == nil:
+		c.failures, c.openUntil = 0, time.Time{}
+		cached := *user
+		c.store(key, authEntry{user: &cached, expires: now.Add(authCacheTTL)}, now)
+	case status == http.StatusBadRequest:
+		// the service answered, the token is invalid
+		c.failures, c.openUntil = 0, time.Time{}
+		c.store(key, authEntry{expires: now.Add(authNegativeTTL)}, now)
+	default:
+		c.failures++
+		if c.failures >= authBreakerFailures {
+			logf(r.Context(), "[ERROR] Authentication service failed %v times in a row, not called for %v", c.failures, authBreakerCooldown)
+			c.openUntil = now.Add(authBreakerCooldown)
+			return nil, fmt.Errorf("%w : %v", ErrAuthUnavailable, err.Error()), http.StatusServiceUnavailable
+		}
+	}
+	return user, err, status
+}
+
+// Called with the mutex, the expired entries are removed once per TTL to bound the memory
+func (c *AuthCache) store(key string, entry authEntry, now time.Time) {
+	if authCacheTTL <= 0 {
+		return
+	}
+	if now.Sub(c.lastSweep) > authCacheTTL {
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		c.lastSweep = now
+	}
+	c.entries[key] = entry
+}
+
+/**
+Forget a token, the next request using it is verified by the auth microservice
+*/
+func (c *AuthCache) Invalidate(token string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.entries, tokenHash(token))
+}
+
+type InvalidateRequest struct {
+	Token string `validate:"required"`
+}
+
+/**
+Called by the auth microservice when a user logs out, so that the token is refused before the end of its cache
+Each replica has its own cache, the token is still accepted by the others for at most AUTH_CACHE_SECONDS
+*/
+func invalidateToken(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.Inc() // incrementing the httpRequestsTotal counter
+
+	if !isClusterPassword(r.Header.Get("Authorization")) {
+		logf(r.Context(), "[ERROR] : Wrong password for token invalidation")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("[MICRO-DATABASE] Auth service didn't have correct password"))
+		return
+	}
+
+	var request InvalidateRequest
+	if _, err := decodeBody(r, maxBodyBytes, &request); err != nil {
+		writeRequestError(w, r, err)
+		return
+	}
+
+	Auth.Invalidate(request.Token)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	lib_auth "github.com/taliesin-insa/lib-auth"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func authRequest(token string) *http.Request {
+	request, _ := http.NewRequest("GET", "/db/status", nil)
+	request.Header.Set("Authorization", token)
+	return request
+}
+
+func TestAuthCache(t *testing.T) {
+	cache := NewAuthCache()
+	clock := time.Now()
+	cache.now = func() time.Time { return clock }
+	calls := atomic.LoadInt64(&authServerCalls)
+
+	for i := 0; i < 3; i++ {
+		user, err, status := cache.Authenticate(authRequest("admin_token"))
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, lib_auth.RoleAdmin, user.Role)
+	}
+	assert.Equal(t, calls+1, atomic.LoadInt64(&authServerCalls))
+
+	// the refused tokens are cached too, for less time
+	for i := 0; i < 3; i++ {
+		_, err, status := cache.Authenticate(authRequest("invalid_token"))
+		assert.NotNil(t, err)
+		assert.Equal(t, http.StatusBadRequest, status)
+	}
+	assert.Equal(t, calls+2, atomic.LoadInt64(&authServerCalls))
+
+	clock = clock.Add(authNegativeTTL + time.Second)
+	cache.Authenticate(authRequest("invalid_token"))
+	cache.Authenticate(authRequest("admin_token"))
+	assert.Equal(t, calls+3, atomic.LoadInt64(&authServerCalls))
+
+	// logout
+	cache.Invalidate("admin_token")
+	cache.Authenticate(authRequest("admin_token"))
+	assert.Equal(t, calls+4, atomic.LoadInt64(&authServerCalls))
+}
+
+func TestAuthCircuitBreaker(t *testing.T) {
+	cache := NewAuthCache()
+	clock := time.Now()
+	cache.now = func() time.Time { return clock }
+	_, err, _ := cache.Authenticate(authRequest("admin_token"))
+	assert.Nil(t, err)
+
+	// the auth microservice goes down
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	previousAuthUrl := os.Getenv("AUTH_API_URL")
+	os.Setenv("AUTH_API_URL", down.URL)
+	defer os.Setenv("AUTH_API_URL", previousAuthUrl)
+
+	for i := 1; i < authBreakerFailures; i++ {
+		_, err, status := cache.Authenticate(authRequest("annotator_token"))
+		assert.NotNil(t, err)
+		assert.Equal(t, http.StatusInternalServerError, status)
+	}
+	_, err, status := cache.Authenticate(authRequest("annotator_token"))
+	assert.True(t, errors.Is(err, ErrAuthUnavailable))
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+
+	// open : refused without calling, but the cached users are still known
+	calls := atomic.LoadInt64(&authServerCalls)
+	_, err, status = cache.Authenticate(authRequest("annotator_token"))
+	assert.True(t, errors.Is(err, ErrAuthUnavailable))
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	user, err, _ := cache.Authenticate(authRequest("admin_token"))
+	assert.Nil(t, err)
+	assert.Equal(t, "morpheus", user.Username)
+
+	// back after the cooldown
+	os.Setenv("AUTH_API_URL", previousAuthUrl)
+	clock = clock.Add(authBreakerCooldown + time.Second)
+	_, err, status = cache.Authenticate(authRequest("annotator_token"))
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, calls+1, atomic.LoadInt64(&authServerCalls))
+}
+
+func TestAuthServiceErrors(t *testing.T) {
+	cache := NewAuthCache()
+	status := http.StatusServiceUnavailable
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if status == http.StatusOK {
+			w.Write([]byte(`{"Username": "morpheus", "Role": 1}`))
+			return
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	previousAuthUrl := os.Getenv("AUTH_API_URL")
+	os.Setenv("AUTH_API_URL", server.URL)
+	defer os.Setenv("AUTH_API_URL", previousAuthUrl)
+
+	// a failure of the service doesn't refuse the token
+	_, err, code := cache.Authenticate(authRequest("annotator_token"))
+	assert.NotNil(t, err)
+	assert.Equal(t, http.StatusBadGateway, code)
+	assert.Equal(t, 1, cache.failures)
+
+	status = http.StatusOK
+	user, err, code := cache.Authenticate(authRequest("annotator_token"))
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "morpheus", user.Username)
+
+	status = http.StatusForbidden
+	_, err, code = cache.Authenticate(authRequest("expired_token"))
+	assert.NotNil(t, err)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, 0, cache.failures)
+}
+
+func TestAuthTimeout(t *testing.T) {
+	cache := NewAuthCache()
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+	previousAuthUrl := os.Getenv("AUTH_API_URL")
+	os.Setenv("AUTH_API_URL", server.URL)
+	defer os.Setenv("AUTH_API_URL", previousAuthUrl)
+	previousTimeout := authClient.Timeout
+	authClient.Timeout = 50 * time.Millisecond
+	defer func() { authClient.Timeout = previousTimeout }()
+
+	_, err, code := cache.Authenticate(authRequest("annotator_token"))
+	assert.NotNil(t, err)
+	assert.Equal(t, http.StatusInternalServerError, code)
+	assert.Equal(t, 1, cache.failures)
+}
+
+func TestInvalidateToken(t *testing.T) {
+	previousPassword := os.Getenv("CLUSTER_INTERNAL_PASSWORD")
+	os.Setenv("CLUSTER_INTERNAL_PASSWORD", "cluster_password")
+	defer os.Setenv("CLUSTER_INTERNAL_PASSWORD", previousPassword)
+	router := newRouter()
+
+	Auth.Authenticate(authRequest("logout_token"))
+
+	request, _ := http.NewRequest("POST", "/db/auth/invalidate", bytes.NewBufferString(`{"Token": "logout_token"}`))
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+
+	request, _ = http.NewRequest("POST", "/db/auth/invalidate", bytes.NewBufferString(`{"Token": "logout_token"}`))
+	request.Header.Set("Authorization", "cluster_password")
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+
+	calls := atomic.LoadInt64(&authServerCalls)
+	Auth.Authenticate(authRequest("logout_token"))
+	assert.Equal(t, calls+1, atomic.LoadInt64(&authServerCalls))
+
+	// without a configured password, an empty one is not the password of the cluster
+	os.Unsetenv("CLUSTER_INTERNAL_PASSWORD")
+	request, _ = http.NewRequest("POST", "/db/auth/invalidate", bytes.NewBufferString(`{"Token": "logout_token"}`))
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+}
+
+func TestIsClusterPassword(t *testing.T) {
+	previousPassword := os.Getenv("CLUSTER_INTERNAL_PASSWORD")
+	defer os.Setenv("CLUSTER_INTERNAL_PASSWORD", previousPassword)
+
+	os.Unsetenv("CLUSTER_INTERNAL_PASSWORD")
+	assert.False(t, isClusterPassword(""))
+	assert.False(t, isClusterPassword("cluster_password"))
+
+	os.Setenv("CLUSTER_INTERNAL_PASSWORD", "cluster_password")
+	assert.True(t, isClusterPassword("cluster_password"))
+	assert.False(t, isClusterPassword(""))
+	assert.False(t, isClusterPassword("cluster_passwor"))
+}
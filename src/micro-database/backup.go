@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	lib_auth "github.com/taliesin-insa/lib-auth"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"io"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+/**
+Archives are gzipped JSON lines : a manifest, then one record per document, then a trailer with the count of each part.
+Documents are in canonical Extended JSON so that ObjectIDs and dates are restored with their type.
+*/
+const archiveFormatVersion = 1
+
+// Parts of an archive, the pictures are the collection itself and the others its companion collections
+// The applied migrations are archived so that a restored collection is migrated again when needed
+var archiveParts = []string{"pictures", "settings", "trash", "events", "migrations", "recognitions"}
+
+const archiveEndPart = "$end"
+
+type RestoreMode string
+
+const (
+	// Documents of the archive replace the documents having the same id, the others are kept
+	RestoreMerge RestoreMode = "merge"
+	// The collections are emptied and only contain the documents of the archive
+	RestoreReplace RestoreMode = "replace"
+)
+
+type ArchiveManifest struct {
+	FormatVersion int            `json:"FormatVersion"`
+	Collection    string         `json:"Collection"`
+	Created       time.Time      `json:"Created"`
+	Counts        map[string]int `json:"Counts,omitempty"`
+}
+
+type archiveRecord struct {
+	Part     string          `json:"Part"`
+	Document json.RawMessage `json:"Document,omitempty"`
+	Counts   map[string]int  `json:"Counts,omitempty"`
+}
+
+var ErrInvalidArchive = errors.New("Invalid archive")
+var ErrInvalidCollectionName = errors.New("Invalid collection name")
+
+var collectionNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// Documents of a picture can be large, with their PiFF
+const maxArchiveLine = 16 * 1024 * 1024
+
+func archivePartCollection(collection *mongo.Collection, part string) *mongo.Collection {
+	if part == "pictures" {
+		return collection
+	}
+	return companionCollection(collection, part)
+}
+
+func isArchivePart(part string) bool {
+	for _, p := range archiveParts {
+		if p == part {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+Collection of the same database, the name is checked as it usually comes from a request
+*/
+func NamedCollection(name string, collection *mongo.Collection) (*mongo.Collection, error) {
+	if !collectionNameRegexp.MatchString(name) {
+		return nil, fmt.Errorf("%w : %q", ErrInvalidCollectionName, name)
+	}
+	return collection.Database().Collection(name), nil
+}
+
+/**
+Write an archive of the collection, its settings, trash, events, applied migrations and recognizer suggestions
+*/
+func WriteArchive(ctx context.Context, w io.Writer, collection *mongo.Collection) (ArchiveManifest, error) {
+	ctx, cancel := withTimeout(ctx, OperationScan)
+	defer cancel()
+
+	zipper := gzip.NewWriter(w)
+	encoder := json.NewEncoder(zipper)
+
+	manifest := ArchiveManifest{
+		FormatVersion: archiveFormatVersion,
+		Collection:    collection.Name(),
+		Created:       time.Now().UTC(),
+		Counts:        make(map[string]int),
+	}
+	if err := encoder.Encode(ArchiveManifest{FormatVersion: manifest.FormatVersion, Collection: manifest.Collection, Created: manifest.Created}); err != nil {
+		return manifest, err
+	}
+
+	for _, part := range archiveParts {
+		cur, err := archivePartCollection(collection, part).Find(ctx, bson.D{}, options.Find().SetSort(bson.D{{"_id", 1}}))
+		if err != nil {
+			return manifest, mongoError(ctx, err, "Error during MongoDB selection")
+		}
+
+		for cur.Next(ctx) {
+			doc, err := bson.MarshalExtJSON(cur.Current, true, false)
+			if err != nil {
+				cur.Close(ctx)
+				logf(ctx, "[EXTJSON] %v", err)
+				return manifest, errors.New("Could not convert a document to JSON")
+			}
+			if err := encoder.Encode(archiveRecord{Part: part, Document: doc}); err != nil {
+				cur.Close(ctx)
+				return manifest, err
+			}
+			manifest.Counts[part]++
+		}
+
+		err = cur.Err()
+		cur.Close(ctx)
+		if err != nil {
+			logf(ctx, "[CURSOR] %v", err)
+			return manifest, errors.New("Error while iterating results")
+		}
+	}
+
+	if err := encoder.Encode(archiveRecord{Part: archiveEndPart, Counts: manifest.Counts}); err != nil {
+		return manifest, err
+	}
+	if err := zipper.Close(); err != nil {
+		return manifest, err
+	}
+
+	logf(ctx, "Archived %v : %v\n", collection.Name(), manifest.Counts)
+	return manifest, nil
+}
+
+/**
+Restore an archive into a collection, which can be different from the archived one
+In replace mode the archive is loaded in staging collections which only replace the current ones once it was fully read.
+The swaps can't be rolled back : the pictures are swapped last, so that they are left as they were when a swap fails,
+and the error tells which parts were replaced. The indexes are reconciled after the swaps, as the swapped collections
+come with the indexes of the staging ones
+*/
+func RestoreArchive(ctx context.Context, r io.Reader, collection *mongo.Collection, mode RestoreMode) (ArchiveManifest, error) {
+	parent := ctx
+	ctx, cancel := withTimeout(ctx, OperationScan)
+	defer cancel()
+
+	if mode != RestoreMerge && mode != RestoreReplace {
+		return ArchiveManifest{}, fmt.Errorf("%w : unknown restore mode %q", ErrInvalidArchive, mode)
+	}
+
+	unzipper, err := gzip.NewReader(r)
+	if err != nil {
+		return ArchiveManifest{}, fmt.Errorf("%w : %v", ErrInvalidArchive, err.Error())
+	}
+	scanner := bufio.NewScanner(unzipper)
+	scanner.Buffer(make([]byte, 64*1024), maxArchiveLine)
+
+	var manifest ArchiveManifest
+	if !scanner.Scan() || json.Unmarshal(scanner.Bytes(), &manifest) != nil || manifest.FormatVersion == 0 {
+		return manifest, fmt.Errorf("%w : missing manifest", ErrInvalidArchive)
+	}
+	if manifest.FormatVersion > archiveFormatVersion {
+		return manifest, fmt.Errorf("%w : format version %v is newer than %v", ErrInvalidArchive, manifest.FormatVersion, archiveFormatVersion)
+	}
+
+	// in replace mode the documents go to staging collections
+	destinations := make(map[string]*mongo.Collection)
+	for _, part := range archiveParts {
+		destinations[part] = archivePartCollection(collection, part)
+		if mode == RestoreReplace {
+			destinations[part] = companionCollection(destinations[part], "restore")
+			destinations[part].Drop(ctx)
+		}
+	}
+	dropStaging := func() {
+		if mode == RestoreReplace {
+			for _, staging := range destinations {
+				staging.Drop(ctx)
+			}
+		}
+	}
+
+	counts := make(map[string]int)
+	var trailer *archiveRecord
+	for scanner.Scan() {
+		var record archiveRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			dropStaging()
+			return manifest, fmt.Errorf("%w : %v", ErrInvalidArchive, err.Error())
+		}
+		if record.Part == archiveEndPart {
+			trailer = &record
+			break
+		}
+		if !isArchivePart(record.Part) {
+			dropStaging()
+			return manifest, fmt.Errorf("%w : unknown part %q", ErrInvalidArchive, record.Part)
+		}
+
+		var doc bson.D
+		if err := bson.UnmarshalExtJSON(record.Document, true, &doc); err != nil {
+			dropStaging()
+			return manifest, fmt.Errorf("%w : %v", ErrInvalidArchive, err.Error())
+		}
+		if err := restoreDocument(ctx, doc, destinations[record.Part], mode); err != nil {
+			dropStaging()
+			return manifest, err
+		}
+		counts[record.Part]++
+	}
+
+	if err := scanner.Err(); err != nil {
+		dropStaging()
+		return manifest, fmt.Errorf("%w : %v", ErrInvalidArchive, err.Error())
+	}
+	if trailer == nil {
+		dropStaging()
+		return manifest, fmt.Errorf("%w : the archive is truncated", ErrInvalidArchive)
+	}
+	for _, part := range archiveParts {
+		if counts[part] != trailer.Counts[part] {
+			dropStaging()
+			return manifest, fmt.Errorf("%w : %v %v documents read instead of %v", ErrInvalidArchive, counts[part], part, trailer.Counts[part])
+		}
+	}
+	manifest.Counts = counts
+
+	if mode == RestoreReplace {
+		// checked before swapping anything
+		for _, part := range archiveParts {
+			staged, err := destinations[part].CountDocuments(ctx, bson.D{})
+			if err != nil {
+				dropStaging()
+				return manifest, mongoError(ctx, err, "Error during MongoDB counting")
+			}
+			if int(staged) != counts[part] {
+				dropStaging()
+				return manifest, fmt.Errorf("%w : %v %v documents staged instead of %v", ErrInvalidArchive, staged, part, counts[part])
+			}
+		}
+
+		replaced := []string{}
+		for i := len(archiveParts) - 1; i >= 0; i-- {
+			part := archiveParts[i]
+			if err := replaceCollection(ctx, destinations[part], archivePartCollection(collection, part)); err != nil {
+				dropStaging()
+				return manifest, fmt.Errorf("%w (already replaced : %v)", err, replaced)
+			}
+			replaced = append(replaced, part)
+		}
+
+		// with their own timeouts, the restore may have used most of its own
+		if _, _, err := EnsureIndexes(parent, collection); err != nil {
+			return manifest, fmt.Errorf("restored, but the indexes were not reconciled : %w", err)
+		}
+		if err := EnsureEventsRetention(parent, collection); err != nil {
+			return manifest, fmt.Errorf("restored, but the events will not expire : %w", err)
+		}
+		if err := EnsureEventsCounter(parent, collection); err != nil {
+			return manifest, fmt.Errorf("restored, but the events may not be streamed : %w", err)
+		}
+	}
+
+	logf(ctx, "Restored archive of %v into %v (%v) : %v\n", manifest.Collection, collection.Name(), mode, counts)
+	return manifest, nil
+}
+
+func restoreDocument(ctx context.Context, doc bson.D, destination *mongo.Collection, mode RestoreMode) error {
+	var id interface{}
+	for _, elem := range doc {
+		if elem.Key == "_id" {
+			id = elem.Value
+		}
+	}
+
+	var err error
+	if mode == RestoreMerge && id != nil {
+		opts := options.Replace().SetUpsert(true)
+		_, err = destination.ReplaceOne(ctx, bson.D{{"_id", id}}, doc, opts)
+	} else {
+		_, err = destination.InsertOne(ctx, doc)
+	}
+	if err != nil {
+		return mongoError(ctx, err, "Error during MongoDB insertion")
+	}
+	return nil
+}
+
+/**
+Replace a collection by another one of the same database
+*/
+func replaceCollection(ctx context.Context, from *mongo.Collection, to *mongo.Collection) error {
+	// a collection which was never written to does not exist and can't be renamed
+	count, err := from.CountDocuments(ctx, bson.D{})
+	if err != nil {
+		return mongoError(ctx, err, "Error during MongoDB counting")
+	}
+	if count == 0 {
+		_, err := to.DeleteMany(ctx, bson.D{})
+		if err != nil {
+			return mongoError(ctx, err, "Error during MongoDB deletion")
+		}
+		return nil
+	}
+
+	database := from.Database()
+	command := bson.D{
+		{"renameCollection", database.Name() + "." + from.Name()},
+		{"to", database.Name() + "." + to.Name()},
+		{"dropTarget", true},
+	}
+	err = database.Client().Database("admin").RunCommand(ctx, command).Err()
+	if err != nil {
+		return mongoError(ctx, err, "Error while replacing the collection")
+	}
+	return nil
+}
+
+func backup(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.Inc() // incrementing the httpRequestsTotal counter
+
+	user, err, authStatusCode := authenticateUser(r)
+
+	// check if there was an error during the authentication or if the user wasn't authenticated
+	if err != nil {
+		logf(r.Context(), "[ERROR] Check authentication: %v", err.Error())
+		w.WriteHeader(authStatusCode)
+		w.Write([]byte("[MICRO-DATABASE] Couldn't verify identity"))
+		return
+	}
+
+	// check if the authenticated user has sufficient permissions to
+	if user.Role != lib_auth.RoleAdmin {
+		logf(r.Context(), "[WRONG_ROLE] Insufficient permission: want %v, was %v", lib_auth.RoleAdmin, user.Role)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("[MICRO-DATABASE] Insufficient permissions to backup"))
+		return
+	}
+
+	collection := Database
+	if name := r.URL.Query().Get("collection"); name != "" {
+		collection, err = NamedCollection(name, Database)
+		if err != nil {
+			logf(r.Context(), "[ERROR] : %v", err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("[MICRO-DATABASE] %v", err.Error())))
+			return
+		}
+	}
+
+	filename := fmt.Sprintf("%v-%v.jsonl.gz", collection.Name(), time.Now().UTC().Format("20060102T150405Z"))
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.WriteHeader(http.StatusOK)
+
+	// the status is already sent, a failure can only be seen as a truncated archive
+	_, err = WriteArchive(r.Context(), w, collection)
+	if err != nil {
+		logf(r.Context(), "[ERROR] Backup of %v interrupted : %v", collection.Name(), err.Error())
+	}
+}
+
+func restore(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.Inc() // incrementing the httpRequestsTotal counter
+
+	user, err, authStatusCode := authenticateUser(r)
+
+	// check if there was an error during the authentication or if the user wasn't authenticated
+	if err != nil {
+		logf(r.Context(), "[ERROR] Check authentication: %v", err.Error())
+		w.WriteHeader(authStatusCode)
+		w.Write([]byte("[MICRO-DATABASE] Couldn't verify identity"))
+		return
+	}
+
+	// check if the authenticated user has sufficient permissions to
+	if user.Role != lib_auth.RoleAdmin {
+		logf(r.Context(), "[WRONG_ROLE] Insufficient permission: want %v, was %v", lib_auth.RoleAdmin, user.Role)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("[MICRO-DATABASE] Insufficient permissions to restore"))
+		return
+	}
+
+	collection := Database
+	if name := r.URL.Query().Get("collection"); name != "" {
+		collection, err = NamedCollection(name, Database)
+		if err != nil {
+			logf(r.Context(), "[ERROR] : %v", err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("[MICRO-DATABASE] %v", err.Error())))
+			return
+		}
+	}
+
+	mode := RestoreMode(r.URL.Query().Get("mode"))
+	if mode == "" {
+		mode = RestoreMerge
+	}
+
+	manifest, err := RestoreArchive(r.Context(), r.Body, collection, mode)
+	if errors.Is(err, ErrInvalidArchive) {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("[MICRO-DATABASE] %v", err.Error())))
+		return
+	} else if err != nil {
+		writeDatabaseError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	body, err := json.Marshal(manifest)
+	if err != nil {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("[MICRO-DATABASE] Could not marshal answer data"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"testing"
+)
+
+func TestBackupRestore(t *testing.T) {
+	source := Client.Database("taliesin_test").Collection("test_backup_source")
+	target := Client.Database("taliesin_test").Collection("test_backup_target")
+	DeleteAll(context.Background(), source, "test")
+	DeleteAll(context.Background(), target, "test")
+
+	doc0 := Picture{Id: primitive.NewObjectID(), PiFF: EmptyPiFF, Url: "/temp/none0"}
+	doc1 := Picture{Id: primitive.NewObjectID(), PiFF: EmptyPiFF, Url: "/temp/none1"}
+	b, _ := json.Marshal([2]Picture{doc0, doc1})
+	res, _ := InsertMany(context.Background(), b, source, "test")
+	UpdateCustomFlags(context.Background(), []Flag{"Blurry"}, source)
+
+	var archive bytes.Buffer
+	manifest, err := WriteArchive(context.Background(), &archive, source)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, manifest.Counts["pictures"])
+	assert.Equal(t, 1, manifest.Counts["settings"])
+
+	// merge keeps the pictures which are not in the archive
+	other := Picture{Id: primitive.NewObjectID(), PiFF: EmptyPiFF, Url: "/temp/other"}
+	b, _ = json.Marshal([1]Picture{other})
+	InsertMany(context.Background(), b, target, "test")
+
+	_, err = RestoreArchive(context.Background(), bytes.NewReader(archive.Bytes()), target, RestoreMerge)
+	assert.Nil(t, err)
+	pics, _ := FindAll(context.Background(), target)
+	assert.Equal(t, 3, len(pics))
+
+	pic, err := FindOne(context.Background(), res[0].(primitive.ObjectID), target)
+	assert.Nil(t, err)
+	assert.Equal(t, "/temp/none0", pic.Url)
+	settings, _ := GetSettings(context.Background(), target)
+	assert.Equal(t, []Flag{"Blurry"}, settings.CustomFlags)
+
+	// merging twice does not duplicate anything
+	_, err = RestoreArchive(context.Background(), bytes.NewReader(archive.Bytes()), target, RestoreMerge)
+	assert.Nil(t, err)
+	pics, _ = FindAll(context.Background(), target)
+	assert.Equal(t, 3, len(pics))
+
+	_, err = RestoreArchive(context.Background(), bytes.NewReader(archive.Bytes()), target, RestoreReplace)
+	assert.Nil(t, err)
+	pics, _ = FindAll(context.Background(), target)
+	assert.Equal(t, 2, len(pics))
+	_, err = FindOne(context.Background(), res[1].(primitive.ObjectID), target)
+	assert.Nil(t, err)
+
+	// the swapped collections have the indexes of the service
+	indexes, err := listIndexes(context.Background(), target)
+	assert.Nil(t, err)
+	names := []string{}
+	for _, index := range indexes {
+		names = append(names, index.Name)
+	}
+	assert.Contains(t, names, managedIndexPrefix+"image_hash")
+}
+
+func TestRestoreInvalidArchive(t *testing.T) {
+	source := Client.Database("taliesin_test").Collection("test_backup_invalid")
+	target := Client.Database("taliesin_test").Collection("test_backup_invalid_target")
+
+	doc0 := Picture{Id: primitive.NewObjectID(), PiFF: EmptyPiFF, Url: "/temp/none0"}
+	b, _ := json.Marshal([1]Picture{doc0})
+	InsertMany(context.Background(), b, target, "test")
+
+	var archive bytes.Buffer
+	WriteArchive(context.Background(), &archive, source)
+
+	_, err := RestoreArchive(context.Background(), bytes.NewReader([]byte("not an archive")), target, RestoreReplace)
+	assert.True(t, errors.Is(err, ErrInvalidArchive))
+
+	// a truncated archive leaves the collection untouched
+	_, err = RestoreArchive(context.Background(), bytes.NewReader(archive.Bytes()[:archive.Len()/2]), target, RestoreReplace)
+	assert.True(t, errors.Is(err, ErrInvalidArchive))
+	pics, _ := FindAll(context.Background(), target)
+	assert.Equal(t, 1, len(pics))
+
+	_, err = RestoreArchive(context.Background(), bytes.NewReader(archive.Bytes()), target, "overwrite")
+	assert.True(t, errors.Is(err, ErrInvalidArchive))
+
+	_, err = NamedCollection("prod; drop", source)
+	assert.True(t, errors.Is(err, ErrInvalidCollectionName))
+}
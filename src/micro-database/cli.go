@@ -0,0 +1,536 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+/**
+Options of the command line, --name or --name=value anywhere after the command
+--json and --collection are accepted by every command
+*/
+type cliOptions map[string]string
+
+var ErrUsage = errors.New("usage")
+
+/**
+An administration command, it returns its result for the JSON output and its human-readable output
+*/
+type cliCommand struct {
+	Name  string
+	Usage string
+	// Options accepted besides the global ones
+	Options []string
+	run     func(args []string, options cliOptions, env cliEnv) (interface{}, string, error)
+}
+
+type cliEnv struct {
+	collection *mongo.Collection
+	stdin      io.Reader
+	// Name of the user running the command, recorded in the events
+	actor string
+}
+
+var cliCommands []cliCommand
+
+func init() {
+	// set in init as help lists the commands
+	cliCommands = []cliCommand{
+		{"import", "import <file.json|->", nil, cliImport},
+		{"export", "export [file.json]", nil, cliExport},
+		{"status", "status [--by-annotator]", []string{"by-annotator"}, cliStatus},
+		{"reset-flags", "reset-flags <flag> [--ids=id,...] [--flags=Flag[=false],...] [--annotator=name]", []string{"ids", "flags", "annotator"}, cliResetFlags},
+		{"delete", "delete [--ids=id,...] [--flags=Flag[=false],...] [--annotator=name]", []string{"ids", "flags", "annotator"}, cliDelete},
+		{"reindex", "reindex", nil, cliReindex},
+		{"migrate", "migrate [--dry-run]", []string{"dry-run"}, cliMigrate},
+		{"backup", "backup <file> [collection]", nil, cliBackup},
+		{"restore", "restore <file> [merge|replace] [collection]", nil, cliRestore},
+		{"fsck", "fsck [--fix]", []string{"fix"}, cliFsck},
+		{"stats", "stats [--from=day] [--to=day] [--activity [--period=day|week]]", []string{"from", "to", "activity", "period"}, cliStats},
+		{"help", "help", nil, cliHelp},
+	}
+}
+
+func parseCommandLine(args []string) ([]string, cliOptions) {
+	var positional []string
+	options := cliOptions{}
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "--") && len(arg) > 2 {
+			name := strings.TrimPrefix(arg, "--")
+			value := ""
+			if i := strings.Index(name, "="); i >= 0 {
+				name, value = name[:i], name[i+1:]
+			}
+			options[name] = value
+		} else {
+			positional = append(positional, arg)
+		}
+	}
+	return positional, options
+}
+
+func (options cliOptions) has(name string) bool {
+	_, ok := options[name]
+	return ok
+}
+
+func cliActor() string {
+	if current, err := user.Current(); err == nil {
+		return "cli:" + current.Username
+	}
+	return "cli"
+}
+
+/**
+Run the subcommand given on the command line instead of the server
+The configuration is the one of the server : the collection is the one chosen by Connect() from MICRO_ENVIRONMENT, unless --collection is given
+*/
+func runCommand(args []string, stdin io.Reader, stdout io.Writer) error {
+	positional, options := parseCommandLine(args)
+	if len(positional) == 0 {
+		positional = []string{"help"}
+	}
+
+	var command *cliCommand
+	for i := range cliCommands {
+		if cliCommands[i].Name == positional[0] {
+			command = &cliCommands[i]
+		}
+	}
+	if command == nil {
+		names := make([]string, 0, len(cliCommands))
+		for _, c := range cliCommands {
+			names = append(names, c.Name)
+		}
+		return fmt.Errorf("unknown command %q, expected one of %v", positional[0], strings.Join(names, ", "))
+	}
+
+	for name := range options {
+		known := name == "json" || name == "collection"
+		for _, option := range command.Options {
+			known = known || name == option
+		}
+		if !known {
+			return fmt.Errorf("unknown option --%v, usage: micro-database %v", name, command.Usage)
+		}
+	}
+
+	env := cliEnv{collection: Database, stdin: stdin, actor: cliActor()}
+	if name := options["collection"]; name != "" {
+		named, err := NamedCollection(name, Database)
+		if err != nil {
+			return err
+		}
+		env.collection = named
+	}
+
+	result, human, err := command.run(positional[1:], options, env)
+	if err == ErrUsage {
+		return fmt.Errorf("usage: micro-database %v", command.Usage)
+	} else if err != nil {
+		return err
+	}
+
+	if options.has("json") {
+		b, err := json.MarshalIndent(result, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(stdout, string(b))
+		return err
+	}
+	_, err = fmt.Fprint(stdout, human)
+	return err
+}
+
+/**
+Selection of the pictures given by --ids, --flags and --annotator, nil without any
+*/
+func cliSelection(options cliOptions) (*DeleteFilter, error) {
+	if !options.has("ids") && !options.has("flags") && !options.has("annotator") {
+		return nil, nil
+	}
+	selection := &DeleteFilter{}
+	if raw := options["ids"]; raw != "" {
+		for _, hex := range strings.Split(raw, ",") {
+			id, err := primitive.ObjectIDFromHex(strings.TrimSpace(hex))
+			if err != nil {
+				return nil, fmt.Errorf("invalid id %q : %v", hex, err.Error())
+			}
+			selection.Ids = append(selection.Ids, id)
+		}
+	}
+	if raw := options["flags"]; raw != "" {
+		selection.Flags = map[Flag]bool{}
+		for _, flag := range strings.Split(raw, ",") {
+			name, value := flag, true
+			if i := strings.Index(flag, "="); i >= 0 {
+				name, value = flag[:i], flag[i+1:] != "false"
+			}
+			selection.Flags[Flag(strings.TrimSpace(name))] = value
+		}
+	}
+	if options.has("annotator") {
+		annotator := options["annotator"]
+		selection.Annotator = &annotator
+	}
+	return selection, nil
+}
+
+func cliImport(args []string, options cliOptions, env cliEnv) (interface{}, string, error) {
+	if len(args) != 1 {
+		return nil, "", ErrUsage
+	}
+	var b []byte
+	var err error
+	if args[0] == "-" {
+		b, err = ioutil.ReadAll(env.stdin)
+	} else {
+		b, err = ioutil.ReadFile(args[0])
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	ids, err := InsertMany(context.Background(), b, env.collection, env.actor)
+	if err != nil {
+		return nil, "", err
+	}
+	// the command exits once they are linked to their duplicates
+	WaitDuplicateChecks()
+	result := struct {
+		Inserted []interface{} `json:"Inserted"`
+	}{ids}
+	return result, fmt.Sprintf("Inserted %v pictures into %v\n", len(ids), env.collection.Name()), nil
+}
+
+func cliExport(args []string, options cliOptions, env cliEnv) (interface{}, string, error) {
+	if len(args) > 1 {
+		return nil, "", ErrUsage
+	}
+	pics, err := FindAll(context.Background(), env.collection)
+	if err != nil {
+		return nil, "", err
+	}
+	if pics == nil {
+		pics = []Picture{}
+	}
+	b, err := json.MarshalIndent(pics, "", "  ")
+	if err != nil {
+		return nil, "", err
+	}
+
+	// without file, the pictures are the output
+	if len(args) == 0 {
+		return pics, string(b) + "\n", nil
+	}
+	if err := ioutil.WriteFile(args[0], b, 0644); err != nil {
+		return nil, "", err
+	}
+	result := struct {
+		File     string `json:"File"`
+		Exported int    `json:"Exported"`
+	}{args[0], len(pics)}
+	return result, fmt.Sprintf("Exported %v pictures of %v into %v\n", len(pics), env.collection.Name(), args[0]), nil
+}
+
+func formatStatusCounts(w io.Writer, indent string, counts StatusCounts) {
+	fmt.Fprintf(w, "%vtotal\t%v\n", indent, counts.Total)
+	fmt.Fprintf(w, "%vannotated\t%v\n", indent, counts.Annotated)
+	fmt.Fprintf(w, "%vsuggested\t%v\n", indent, counts.Suggested)
+	fmt.Fprintf(w, "%vpending for recognizer\t%v\n", indent, counts.PendingForRecognizer)
+	fmt.Fprintf(w, "%vleased\t%v\n", indent, counts.Leased)
+	fmt.Fprintf(w, "%vunreadable\t%v\n", indent, counts.Unreadable)
+	fmt.Fprintf(w, "%vcorrected\t%v\n", indent, counts.Corrected)
+	flags := make([]string, 0, len(counts.CustomFlags))
+	for flag := range counts.CustomFlags {
+		flags = append(flags, string(flag))
+	}
+	sort.Strings(flags)
+	for _, flag := range flags {
+		fmt.Fprintf(w, "%v%v\t%v\n", indent, flag, counts.CustomFlags[Flag(flag)])
+	}
+}
+
+func cliStatus(args []string, options cliOptions, env cliEnv) (interface{}, string, error) {
+	if len(args) != 0 {
+		return nil, "", ErrUsage
+	}
+	settings, err := GetSettings(context.Background(), env.collection)
+	if err != nil {
+		return nil, "", err
+	}
+	res := Status{DbUp: true}
+	res.StatusCounts, res.Annotators, err = ComputeStatus(context.Background(), env.collection, settings.CustomFlags, options.has("by-annotator"))
+	if err != nil {
+		return nil, "", err
+	}
+
+	var b bytes.Buffer
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	formatStatusCounts(w, "", res.StatusCounts)
+	annotators := make([]string, 0, len(res.Annotators))
+	for annotator := range res.Annotators {
+		annotators = append(annotators, annotator)
+	}
+	sort.Strings(annotators)
+	for _, annotator := range annotators {
+		name := annotator
+		if name == "" {
+			name = "(none)"
+		}
+		fmt.Fprintf(w, "%v\n", name)
+		formatStatusCounts(w, "  ", res.Annotators[annotator])
+	}
+	w.Flush()
+	return res, b.String(), nil
+}
+
+func cliResetFlags(args []string, options cliOptions, env cliEnv) (interface{}, string, error) {
+	if len(args) != 1 {
+		return nil, "", ErrUsage
+	}
+	selection, err := cliSelection(options)
+	if err != nil {
+		return nil, "", err
+	}
+	modified, err := ResetFlag(context.Background(), Flag(args[0]), selection, env.collection, env.actor)
+	if err != nil {
+		return nil, "", err
+	}
+	result := struct {
+		Flag     Flag  `json:"Flag"`
+		Modified int64 `json:"Modified"`
+	}{Flag(args[0]), modified}
+	return result, fmt.Sprintf("Reset %v on %v pictures\n", args[0], modified), nil
+}
+
+func cliDelete(args []string, options cliOptions, env cliEnv) (interface{}, string, error) {
+	if len(args) != 0 {
+		return nil, "", ErrUsage
+	}
+	selection, err := cliSelection(options)
+	if err != nil {
+		return nil, "", err
+	}
+	if selection == nil {
+		// emptying the whole collection needs the confirmation of DELETE /db/delete/all
+		return nil, "", ErrEmptyFilter
+	}
+	deleted, err := SoftDelete(context.Background(), *selection, env.collection, env.actor)
+	if err != nil {
+		return nil, "", err
+	}
+	result := struct {
+		Deleted []primitive.ObjectID `json:"Deleted"`
+	}{deleted}
+	return result, fmt.Sprintf("Moved %v pictures to the trash, they can be restored for %v\n", len(deleted), trashRetention), nil
+}
+
+func cliReindex(args []string, options cliOptions, env cliEnv) (interface{}, string, error) {
+	if len(args) != 0 {
+		return nil, "", ErrUsage
+	}
+	created, dropped, err := EnsureIndexes(context.Background(), env.collection)
+	if err != nil {
+		return nil, "", err
+	}
+	result := struct {
+		Created []string `json:"Created"`
+		Dropped []string `json:"Dropped"`
+	}{created, dropped}
+
+	var b strings.Builder
+	for _, name := range created {
+		fmt.Fprintf(&b, "created %v\n", name)
+	}
+	for _, name := range dropped {
+		fmt.Fprintf(&b, "dropped %v\n", name)
+	}
+	if len(created) == 0 && len(dropped) == 0 {
+		b.WriteString("Indexes are up to date\n")
+	}
+	return result, b.String(), nil
+}
+
+func cliMigrate(args []string, options cliOptions, env cliEnv) (interface{}, string, error) {
+	if len(args) != 0 {
+		return nil, "", ErrUsage
+	}
+	dryRun := options.has("dry-run")
+	records, err := Migrate(context.Background(), env.collection, dryRun)
+	if err != nil {
+		return nil, "", err
+	}
+	if records == nil {
+		records = []MigrationRecord{}
+	}
+
+	var b strings.Builder
+	for _, record := range records {
+		if dryRun {
+			fmt.Fprintf(&b, "%v %v : %v documents to modify, %v can't be migrated\n", record.Version, record.Name, record.Modified, record.Skipped)
+		} else {
+			fmt.Fprintf(&b, "%v %v : %v documents modified\n", record.Version, record.Name, record.Modified)
+		}
+	}
+	if len(records) == 0 {
+		b.WriteString("No pending migration\n")
+	}
+	return records, b.String(), nil
+}
+
+func cliBackup(args []string, options cliOptions, env cliEnv) (interface{}, string, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, "", ErrUsage
+	}
+	collection := env.collection
+	if len(args) > 1 {
+		named, err := NamedCollection(args[1], Database)
+		if err != nil {
+			return nil, "", err
+		}
+		collection = named
+	}
+
+	file, err := os.Create(args[0])
+	if err != nil {
+		return nil, "", err
+	}
+	manifest, err := WriteArchive(context.Background(), file, collection)
+	if err != nil {
+		file.Close()
+		return nil, "", err
+	}
+	if err := file.Close(); err != nil {
+		return nil, "", err
+	}
+	return manifest, fmt.Sprintf("Archived %v into %v : %v\n", manifest.Collection, args[0], manifest.Counts), nil
+}
+
+func cliRestore(args []string, options cliOptions, env cliEnv) (interface{}, string, error) {
+	if len(args) < 1 || len(args) > 3 {
+		return nil, "", ErrUsage
+	}
+	mode := RestoreMerge
+	if len(args) > 1 {
+		mode = RestoreMode(args[1])
+	}
+	collection := env.collection
+	if len(args) > 2 {
+		named, err := NamedCollection(args[2], Database)
+		if err != nil {
+			return nil, "", err
+		}
+		collection = named
+	}
+
+	file, err := os.Open(args[0])
+	if err != nil {
+		return nil, "", err
+	}
+	defer file.Close()
+	manifest, err := RestoreArchive(context.Background(), file, collection, mode)
+	if err != nil {
+		return nil, "", err
+	}
+	return manifest, fmt.Sprintf("Restored %v into %v (%v) : %v\n", manifest.Collection, collection.Name(), mode, manifest.Counts), nil
+}
+
+func cliFsck(args []string, options cliOptions, env cliEnv) (interface{}, string, error) {
+	if len(args) != 0 {
+		return nil, "", ErrUsage
+	}
+	report, err := Fsck(context.Background(), env.collection, options.has("fix"))
+	if err != nil {
+		return nil, "", err
+	}
+
+	var b strings.Builder
+	for _, issue := range report.Issues {
+		fixed := ""
+		if issue.Fixed {
+			fixed = " (fixed)"
+		}
+		fmt.Fprintf(&b, "%v %v : %v%v\n", issue.PictureId.Hex(), issue.Kind, issue.Detail, fixed)
+	}
+	b.WriteString(report.Summary())
+	return report, b.String(), nil
+}
+
+func cliStats(args []string, options cliOptions, env cliEnv) (interface{}, string, error) {
+	if len(args) != 0 {
+		return nil, "", ErrUsage
+	}
+	to := time.Now().UTC()
+	from := to.Add(-eventsRetention)
+	var err error
+	if raw := options["from"]; raw != "" {
+		if from, err = parseStatsDate(raw, false); err != nil {
+			return nil, "", err
+		}
+	}
+	if raw := options["to"]; raw != "" {
+		if to, err = parseStatsDate(raw, true); err != nil {
+			return nil, "", err
+		}
+	}
+	if !from.Before(to) {
+		return nil, "", fmt.Errorf("%w : from must be before to", ErrInvalidRange)
+	}
+
+	var b bytes.Buffer
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	if options.has("activity") {
+		period := options["period"]
+		if period == "" {
+			period = PeriodDay
+		}
+		activity, err := AnnotatorActivity(context.Background(), from, to, period, env.collection)
+		if err != nil {
+			return nil, "", err
+		}
+		fmt.Fprintln(w, "ANNOTATOR\tPERIOD\tANNOTATED")
+		for _, a := range activity {
+			fmt.Fprintf(w, "%v\t%v\t%v\n", a.Annotator, a.Period, a.Annotated)
+		}
+		w.Flush()
+		return activity, b.String(), nil
+	}
+
+	stats, err := AnnotatorStatistics(context.Background(), from, to, env.collection)
+	if err != nil {
+		return nil, "", err
+	}
+	fmt.Fprintln(w, "ANNOTATOR\tANNOTATED\tMEDIAN INTERVAL (s)\tACCEPTANCE\tAGREEMENT\tREJECTION\tREVIEWS")
+	for _, s := range stats {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n", s.Annotator, s.Annotated, formatRate(s.MedianIntervalSeconds),
+			formatRate(s.AcceptanceRate), formatRate(s.AgreementRate), formatRate(s.RejectionRate), s.Reviews)
+	}
+	w.Flush()
+	return stats, b.String(), nil
+}
+
+func cliHelp(args []string, options cliOptions, env cliEnv) (interface{}, string, error) {
+	var b strings.Builder
+	usages := make([]string, 0, len(cliCommands))
+	b.WriteString("usage: micro-database <command> [--json] [--collection=name]\n")
+	for _, command := range cliCommands {
+		fmt.Fprintf(&b, "  micro-database %v\n", command.Usage)
+		usages = append(usages, command.Usage)
+	}
+	return usages, b.String(), nil
+}
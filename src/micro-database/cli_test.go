@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseCommandLine(t *testing.T) {
+	args, options := parseCommandLine([]string{"reset-flags", "--json", "SentToReco", "--annotator=morpheus", "--flags=Unreadable=false"})
+	assert.Equal(t, []string{"reset-flags", "SentToReco"}, args)
+	assert.Equal(t, cliOptions{"json": "", "annotator": "morpheus", "flags": "Unreadable=false"}, options)
+
+	selection, err := cliSelection(options)
+	assert.Nil(t, err)
+	assert.Equal(t, "morpheus", *selection.Annotator)
+	assert.Equal(t, map[Flag]bool{FlagUnreadable: false}, selection.Flags)
+}
+
+func TestRunCommand(t *testing.T) {
+	Database = Client.Database("taliesin_test").Collection("test_cli")
+	Database.Drop(context.TODO())
+	settingsCollection(Database).Drop(context.TODO())
+	dir, _ := ioutil.TempDir("", "cli")
+	defer os.RemoveAll(dir)
+
+	run := func(args ...string) (string, error) {
+		var stdout bytes.Buffer
+		err := runCommand(args, strings.NewReader(""), &stdout)
+		return stdout.String(), err
+	}
+
+	pics := [2]Picture{
+		{Url: "/snippets/a.png", SentToReco: true, Annotator: "morpheus"},
+		{Url: "/snippets/b.png", SentToReco: true, Unreadable: true},
+	}
+	b, _ := json.Marshal(pics)
+	ioutil.WriteFile(filepath.Join(dir, "import.json"), b, 0644)
+	out, err := run("import", filepath.Join(dir, "import.json"))
+	assert.Nil(t, err)
+	assert.Equal(t, "Inserted 2 pictures into test_cli\n", out)
+
+	out, err = run("status", "--json")
+	assert.Nil(t, err)
+	var status Status
+	assert.Nil(t, json.Unmarshal([]byte(out), &status))
+	assert.Equal(t, int64(2), status.Total)
+	assert.Equal(t, int64(1), status.Unreadable)
+
+	out, err = run("reset-flags", "SentToReco", "--annotator=morpheus")
+	assert.Nil(t, err)
+	assert.Equal(t, "Reset SentToReco on 1 pictures\n", out)
+
+	out, err = run("delete", "--flags=Unreadable", "--json")
+	assert.Nil(t, err)
+	assert.Contains(t, out, `"Deleted"`)
+
+	out, err = run("export")
+	assert.Nil(t, err)
+	var exported []Picture
+	assert.Nil(t, json.Unmarshal([]byte(out), &exported))
+	assert.Equal(t, 1, len(exported))
+	assert.False(t, exported[0].SentToReco)
+
+	// the whole collection can't be deleted by mistake
+	_, err = run("delete")
+	assert.Equal(t, ErrEmptyFilter, err)
+	_, err = run("status", "--fix")
+	assert.NotNil(t, err)
+	_, err = run("unknown")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"strconv"
+	"strings"
+)
+
+// Returned when an If-Match header is used with a request modifying more than one picture
+var ErrPreconditionScope = errors.New("If-Match can only be used when modifying a single picture")
+
+var ErrInvalidETag = errors.New("Invalid ETag in If-Match")
+
+/**
+Returned when the version expected by a writer is not the stored one anymore.
+Pictures holds the current state of every picture that could not be modified.
+*/
+type ConflictError struct {
+	Pictures []Picture
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%v picture(s) were modified by someone else", len(e.Pictures))
+}
+
+/**
+ETag of a picture, derived from its version
+*/
+func ETag(version int64) string {
+	return strconv.Quote(strconv.FormatInt(version, 10))
+}
+
+/**
+Read the version expected by an If-Match header
+A missing header or "*" returns nil as any version matches
+*/
+func ParseIfMatch(header string) (*int64, error) {
+	header = strings.TrimSpace(header)
+	if header == "" || header == "*" {
+		return nil, nil
+	}
+	header = strings.TrimPrefix(header, "W/")
+	unquoted, err := strconv.Unquote(header)
+	if err != nil {
+		return nil, ErrInvalidETag
+	}
+	version, err := strconv.ParseInt(unquoted, 10, 64)
+	if err != nil {
+		return nil, ErrInvalidETag
+	}
+	return &version, nil
+}
+
+/**
+Filter matching a picture only if it still has the given version
+Documents created before versioning have no Version field and are considered at version 0
+*/
+func versionFilter(id primitive.ObjectID, version *int64) bson.D {
+	if version == nil {
+		return bson.D{{"_id", id}}
+	}
+	if *version == 0 {
+		return bson.D{{"_id", id}, {"Version", bson.D{{"$in", bson.A{0, nil}}}}}
+	}
+	return bson.D{{"_id", id}, {"Version", *version}}
+}
+
+/**
+Every modification of a picture increments its version
+*/
+func incrementVersion() bson.E {
+	return bson.E{"$inc", bson.D{{"Version", int64(1)}}}
+}
+
+/**
+An If-Match header only makes sense for a request modifying a single picture
+count : number of pictures modified by the request
+*/
+func checkIfMatchScope(count int, ifMatch *int64) error {
+	if ifMatch != nil && count != 1 {
+		return ErrPreconditionScope
+	}
+	return nil
+}
+
+/**
+Conditionally update a picture, the current state is added to the conflicts if its version changed
+Returns whether the picture was updated
+*/
+func updateVersioned(ctx context.Context, collection *mongo.Collection, id primitive.ObjectID, version *int64, update bson.D, conflicts *ConflictError) (bool, error) {
+	update = append(update, incrementVersion())
+	updateResult, err := collection.UpdateOne(ctx, versionFilter(id, version), update)
+	if err != nil {
+		return false, mongoError(ctx, err, "Error during MongoDB update")
+	}
+	logf(ctx, "Matched %v documents and updated %v documents.\n", updateResult.MatchedCount, updateResult.ModifiedCount)
+
+	if updateResult.MatchedCount == 0 && version != nil {
+		current, err := FindOne(ctx, id, collection)
+		if err != nil {
+			// the picture does not exist, there is nothing to conflict with
+			return false, nil
+		}
+		logf(ctx, "[CONFLICT] Picture %v expected at version %v but is at version %v", id.Hex(), *version, current.Version)
+		conflicts.Pictures = append(conflicts.Pictures, current)
+	}
+	return updateResult.MatchedCount > 0, nil
+}
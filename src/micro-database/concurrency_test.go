@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseIfMatch(t *testing.T) {
+	version, err := ParseIfMatch("")
+	assert.Nil(t, err)
+	assert.Nil(t, version)
+
+	version, err = ParseIfMatch("*")
+	assert.Nil(t, err)
+	assert.Nil(t, version)
+
+	version, err = ParseIfMatch(ETag(3))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), *version)
+
+	version, err = ParseIfMatch(`W/"4"`)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), *version)
+
+	_, err = ParseIfMatch("4")
+	assert.Equal(t, ErrInvalidETag, err)
+}
+
+func TestSelectByIdETag(t *testing.T) {
+	Database = Client.Database("taliesin_test").Collection("test_select_etag")
+	doc0 := Picture{Id: primitive.NewObjectID(), PiFF: EmptyPiFF, Url: "/temp/none0"}
+	b, _ := json.Marshal([1]Picture{doc0})
+	res, _ := InsertMany(context.Background(), b, Database, "test")
+	doc0.Id = res[0].(primitive.ObjectID)
+
+	request, _ := http.NewRequest("GET", "/db/select/"+doc0.Id.Hex(), nil)
+	request = mux.SetURLVars(request, map[string]string{"id": doc0.Id.Hex()})
+	recorder := httptest.NewRecorder()
+	selectById(recorder, request)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, `"0"`, recorder.Header().Get("ETag"))
+
+	body, _ := json.Marshal([1]Modification{{Id: doc0.Id, Flag: FlagCorrected, Value: true}})
+	request, _ = http.NewRequest("PUT", "/db/update/flags", bytes.NewBuffer(body))
+	recorder = httptest.NewRecorder()
+	updateFlags(recorder, request)
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+
+	pic, _ := FindOne(context.Background(), doc0.Id, Database)
+	assert.Equal(t, int64(1), pic.Version)
+}
+
+func TestUpdateValueIfMatch(t *testing.T) {
+	Database = Client.Database("taliesin_test").Collection("test_update_value_if_match")
+	doc0 := Picture{Id: primitive.NewObjectID(), PiFF: EmptyPiFF, Url: "/temp/none0"}
+	b, _ := json.Marshal([1]Picture{doc0})
+	res, _ := InsertMany(context.Background(), b, Database, "test")
+	doc0.Id = res[0].(primitive.ObjectID)
+
+	// first writer succeeds
+	body, _ := json.Marshal([1]Annotation{{Id: doc0.Id, Value: "First"}})
+	request, _ := http.NewRequest("PUT", "/db/update/value", bytes.NewBuffer(body))
+	request.Header.Set("If-Match", ETag(0))
+	recorder := httptest.NewRecorder()
+	updateValue(recorder, request)
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+
+	// second writer still has version 0
+	body, _ = json.Marshal([1]Annotation{{Id: doc0.Id, Value: "Second"}})
+	request, _ = http.NewRequest("PUT", "/db/update/value", bytes.NewBuffer(body))
+	request.Header.Set("If-Match", ETag(0))
+	recorder = httptest.NewRecorder()
+	updateValue(recorder, request)
+	assert.Equal(t, http.StatusPreconditionFailed, recorder.Code)
+	assert.Equal(t, ETag(1), recorder.Header().Get("ETag"))
+
+	var current []Picture
+	err := json.Unmarshal(recorder.Body.Bytes(), &current)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(current))
+	assert.Equal(t, "First", current[0].PiFF.Data[0].Value)
+
+	pic, _ := FindOne(context.Background(), doc0.Id, Database)
+	assert.Equal(t, "First", pic.PiFF.Data[0].Value)
+	assert.Equal(t, int64(1), pic.Version)
+}
+
+func TestUpdateFlagsVersionConflict(t *testing.T) {
+	Database = Client.Database("taliesin_test").Collection("test_update_flags_conflict")
+	doc0 := Picture{Id: primitive.NewObjectID(), PiFF: EmptyPiFF, Url: "/temp/none0"}
+	doc1 := Picture{Id: primitive.NewObjectID(), PiFF: EmptyPiFF, Url: "/temp/none1"}
+	b, _ := json.Marshal([2]Picture{doc0, doc1})
+	res, _ := InsertMany(context.Background(), b, Database, "test")
+	doc0.Id = res[0].(primitive.ObjectID)
+	doc1.Id = res[1].(primitive.ObjectID)
+
+	stale := int64(5)
+	current := int64(0)
+	body, _ := json.Marshal([2]Modification{
+		{Id: doc0.Id, Flag: FlagUnreadable, Value: true, Version: &stale},
+		{Id: doc1.Id, Flag: FlagUnreadable, Value: true, Version: &current},
+	})
+	request, _ := http.NewRequest("PUT", "/db/update/flags", bytes.NewBuffer(body))
+	recorder := httptest.NewRecorder()
+	updateFlags(recorder, request)
+	assert.Equal(t, http.StatusConflict, recorder.Code)
+
+	var conflicts []Picture
+	err := json.Unmarshal(recorder.Body.Bytes(), &conflicts)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(conflicts))
+	assert.Equal(t, doc0.Id, conflicts[0].Id)
+
+	pic, _ := FindOne(context.Background(), doc0.Id, Database)
+	assert.False(t, pic.Unreadable)
+	pic, _ = FindOne(context.Background(), doc1.Id, Database)
+	assert.True(t, pic.Unreadable)
+
+	// If-Match can't be used on several pictures
+	request, _ = http.NewRequest("PUT", "/db/update/flags", bytes.NewBuffer(body))
+	request.Header.Set("If-Match", ETag(0))
+	recorder = httptest.NewRecorder()
+	updateFlags(recorder, request)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
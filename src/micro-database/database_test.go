@@ -13,9 +13,13 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"sync/atomic"
 	"testing"
 )
 
+// Number of calls to the mocked authentication server
+var authServerCalls int64
+
 var EmptyPiFF = PiFFStruct{
 	Meta: Meta{
 		Type: "line",
@@ -54,6 +58,7 @@ func TestMain(m *testing.M) {
 	mockedAuthServer := httptest.NewServer(
 		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			if r.URL.Path == "/auth/verifyToken" {
+				atomic.AddInt64(&authServerCalls, 1)
 				reqBody, err := ioutil.ReadAll(r.Body)
 				if err != nil {
 					log.Printf("[TEST_ERROR] Create authentication mocked server (read body): %v", err.Error())
@@ -67,6 +72,11 @@ func TestMain(m *testing.M) {
 					panic(m)
 				}
 
+				if reqData.Token == "invalid_token" {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+
 				var result []byte
 				if reqData.Token == "admin_token" {
 					result, err = json.Marshal(lib_auth.UserData{Username: "morpheus", Role: lib_auth.RoleAdmin})
@@ -88,6 +98,9 @@ func TestMain(m *testing.M) {
 	previousAuthUrl := os.Getenv("AUTH_API_URL")
 	os.Setenv("AUTH_API_URL", mockedAuthServer.URL)
 
+	// the tests call the routes faster than the limits allow, the limits are tested on their own
+	rateLimits = map[callerClass]map[routeBudget]RateLimit{}
+
 	errSetup := setupDB()
 	if errSetup != nil {
 		log.Println("Could not drop database on test start")
@@ -137,7 +150,7 @@ func TestInsert(t *testing.T) {
 		Children: nil,
 		Parent:   0,
 	}
-	doc0 := Picture{primitive.NewObjectID(), p0, "/temp/none0", "", false, false, false, false, ""}
+	doc0 := Picture{Id: primitive.NewObjectID(), PiFF: p0, Url: "/temp/none0"}
 
 	p1 := PiFFStruct{
 		Meta:     Meta{},
@@ -146,18 +159,18 @@ func TestInsert(t *testing.T) {
 		Children: nil,
 		Parent:   0,
 	}
-	doc1 := Picture{primitive.NewObjectID(), p1, "/temp/none1", "", false, false, false, false, ""}
+	doc1 := Picture{Id: primitive.NewObjectID(), PiFF: p1, Url: "/temp/none1"}
 
 	tab := [2]Picture{doc0, doc1}
 
 	b, _ := json.Marshal(tab)
-	_, err := InsertMany(b, coll)
+	_, err := InsertMany(context.Background(), b, coll, "test")
 	assert.Nil(t, err)
 }
 
 func TestFindFail(t *testing.T) {
 	coll := Client.Database("taliesin_test").Collection("test_find_fail")
-	_, err := FindOne(primitive.NewObjectID(), coll)
+	_, err := FindOne(context.Background(), primitive.NewObjectID(), coll)
 	assert.NotNil(t, err)
 }
 
@@ -171,15 +184,15 @@ func TestFind(t *testing.T) {
 		Parent:   0,
 	}
 
-	doc0 := Picture{primitive.NewObjectID(), p0, "/temp/none0", "", false, false, false, false, ""}
+	doc0 := Picture{Id: primitive.NewObjectID(), PiFF: p0, Url: "/temp/none0"}
 
 	tab := [1]Picture{doc0}
 	b, _ := json.Marshal(tab)
-	res, _ := InsertMany(b, coll)
+	res, _ := InsertMany(context.Background(), b, coll, "test")
 
 	id := res[0].(primitive.ObjectID)
 
-	pic, err := FindOne(id, coll)
+	pic, err := FindOne(context.Background(), id, coll)
 	assert.Nil(t, err)
 
 	doc0.Id = id
@@ -196,7 +209,7 @@ func TestFindAll(t *testing.T) {
 		Children: nil,
 		Parent:   0,
 	}
-	doc0 := Picture{primitive.NewObjectID(), p0, "/temp/none0", "", false, false, false, false, ""}
+	doc0 := Picture{Id: primitive.NewObjectID(), PiFF: p0, Url: "/temp/none0"}
 	p1 := PiFFStruct{
 		Meta:     Meta{},
 		Location: nil,
@@ -204,12 +217,12 @@ func TestFindAll(t *testing.T) {
 		Children: nil,
 		Parent:   0,
 	}
-	doc1 := Picture{primitive.NewObjectID(), p1, "/temp/none1", "", false, false, false, false, ""}
+	doc1 := Picture{Id: primitive.NewObjectID(), PiFF: p1, Url: "/temp/none1"}
 	tab := [2]Picture{doc0, doc1}
 	b, _ := json.Marshal(tab)
-	InsertMany(b, coll)
+	InsertMany(context.Background(), b, coll, "test")
 
-	pics, err := FindAll(coll)
+	pics, err := FindAll(context.Background(), coll)
 
 	assert.Nil(t, err)
 	assert.Equal(t, 2, len(pics))
@@ -227,7 +240,7 @@ func TestFindManyUnused(t *testing.T) {
 		Children: nil,
 		Parent:   0,
 	}
-	doc0 := Picture{primitive.NewObjectID(), p0, "/temp/none0", "", false, false, false, false, ""}
+	doc0 := Picture{Id: primitive.NewObjectID(), PiFF: p0, Url: "/temp/none0"}
 	p1 := PiFFStruct{
 		Meta:     Meta{},
 		Location: nil,
@@ -235,17 +248,17 @@ func TestFindManyUnused(t *testing.T) {
 		Children: nil,
 		Parent:   0,
 	}
-	doc1 := Picture{primitive.NewObjectID(), p1, "/temp/none1", "", false, false, false, false, ""}
+	doc1 := Picture{Id: primitive.NewObjectID(), PiFF: p1, Url: "/temp/none1"}
 	tab := [2]Picture{doc0, doc1}
 	b, _ := json.Marshal(tab)
-	InsertMany(b, coll)
+	InsertMany(context.Background(), b, coll, "test")
 
-	picsTest1, err := FindManyUnused(1, coll)
+	picsTest1, err := FindManyUnused(context.Background(), 1, coll)
 
 	assert.Nil(t, err)
 	assert.Equal(t, 1, len(picsTest1))
 
-	picsTest2, err := FindManyUnused(2, coll)
+	picsTest2, err := FindManyUnused(context.Background(), 2, coll)
 	assert.Nil(t, err)
 	assert.Equal(t, 2, len(picsTest2))
 
@@ -260,7 +273,7 @@ func TestFindManyForSuggestion(t *testing.T) {
 		Children: nil,
 		Parent:   0,
 	}
-	doc0 := Picture{primitive.NewObjectID(), p0, "/temp/none0", "", false, false, false, false, ""}
+	doc0 := Picture{Id: primitive.NewObjectID(), PiFF: p0, Url: "/temp/none0"}
 	p1 := PiFFStruct{
 		Meta:     Meta{},
 		Location: nil,
@@ -268,26 +281,26 @@ func TestFindManyForSuggestion(t *testing.T) {
 		Children: nil,
 		Parent:   0,
 	}
-	doc1 := Picture{primitive.NewObjectID(), p1, "/temp/none1", "", false, false, false, false, ""}
+	doc1 := Picture{Id: primitive.NewObjectID(), PiFF: p1, Url: "/temp/none1"}
 	tab := [2]Picture{doc0, doc1}
 	b, _ := json.Marshal(tab)
-	InsertMany(b, coll)
+	InsertMany(context.Background(), b, coll, "test")
 
-	picsTest1, err := FindManyForSuggestion(1, coll)
+	picsTest1, err := FindManyForSuggestion(context.Background(), 1, coll)
 
 	assert.Nil(t, err)
 	assert.Equal(t, 1, len(picsTest1))
 
 	picTest1 := picsTest1[0]
 
-	picsTest2, err := FindManyForSuggestion(2, coll)
+	picsTest2, err := FindManyForSuggestion(context.Background(), 2, coll)
 	assert.Nil(t, err)
 	assert.Equal(t, 1, len(picsTest2))
 
 	picTest2 := picsTest2[0]
 	assert.NotEqual(t, picTest1, picTest2)
 
-	picsTest3, err := FindManyForSuggestion(1, coll)
+	picsTest3, err := FindManyForSuggestion(context.Background(), 1, coll)
 	assert.Nil(t, err)
 	assert.Equal(t, 0, len(picsTest3))
 }
@@ -303,7 +316,7 @@ func TestUpdateFlags(t *testing.T) {
 		Parent:   0,
 	}
 	fakeid, _ := primitive.ObjectIDFromHex("face")
-	doc0 := Picture{fakeid, p0, "/temp/none0", "", false, false, false, false, ""}
+	doc0 := Picture{Id: fakeid, PiFF: p0, Url: "/temp/none0"}
 	p1 := PiFFStruct{
 		Meta:     Meta{},
 		Location: nil,
@@ -311,10 +324,10 @@ func TestUpdateFlags(t *testing.T) {
 		Children: nil,
 		Parent:   0,
 	}
-	doc1 := Picture{fakeid, p1, "/temp/none1", "", false, false, false, false, ""}
+	doc1 := Picture{Id: fakeid, PiFF: p1, Url: "/temp/none1"}
 	tab := [2]Picture{doc0, doc1}
 	b, _ := json.Marshal(tab)
-	res, _ := InsertMany(b, Database)
+	res, _ := InsertMany(context.Background(), b, Database, "test")
 	doc0.Id = res[0].(primitive.ObjectID)
 	doc1.Id = res[1].(primitive.ObjectID)
 
@@ -336,13 +349,13 @@ func TestUpdateFlags(t *testing.T) {
 	updateFlags(recorder0, request)
 	assert.Equal(t, http.StatusNoContent, recorder0.Code)
 
-	pic, _ := FindOne(doc0.Id, Database)
+	pic, _ := FindOne(context.Background(), doc0.Id, Database)
 	assert.False(t, pic.Annotated)
 	assert.True(t, pic.Unreadable)
 	assert.False(t, pic.Corrected)
 	assert.False(t, pic.SentToReco)
 
-	pic, _ = FindOne(doc1.Id, Database)
+	pic, _ = FindOne(context.Background(), doc1.Id, Database)
 	assert.False(t, pic.Annotated)
 	assert.False(t, pic.Unreadable)
 	assert.True(t, pic.Corrected)
@@ -361,7 +374,7 @@ func TestUpdateValue(t *testing.T) {
 		Parent:   0,
 	}
 	fakeid, _ := primitive.ObjectIDFromHex("face")
-	doc0 := Picture{fakeid, p0, "/temp/none0", "", false, false, false, false, ""}
+	doc0 := Picture{Id: fakeid, PiFF: p0, Url: "/temp/none0"}
 	p1 := PiFFStruct{
 		Meta:     Meta{},
 		Location: nil,
@@ -369,10 +382,10 @@ func TestUpdateValue(t *testing.T) {
 		Children: nil,
 		Parent:   0,
 	}
-	doc1 := Picture{fakeid, p1, "/temp/none1", "", false, false, false, false, ""}
+	doc1 := Picture{Id: fakeid, PiFF: p1, Url: "/temp/none1"}
 	tab := [2]Picture{doc0, doc1}
 	b, _ := json.Marshal(tab)
-	res, _ := InsertMany(b, Database)
+	res, _ := InsertMany(context.Background(), b, Database, "test")
 	doc0.Id = res[0].(primitive.ObjectID)
 	doc1.Id = res[1].(primitive.ObjectID)
 
@@ -401,11 +414,11 @@ func TestUpdateValue(t *testing.T) {
 	updateValueWithAnnotator(recorder1, request)
 	assert.Equal(t, http.StatusNoContent, recorder1.Code)
 
-	pic, _ := FindOne(doc0.Id, Database)
+	pic, _ := FindOne(context.Background(), doc0.Id, Database)
 	assert.Equal(t, pic.PiFF.Data[0].Value, "Test without annotator")
 	assert.True(t, pic.Annotated)
 
-	pic, _ = FindOne(doc1.Id, Database)
+	pic, _ = FindOne(context.Background(), doc1.Id, Database)
 	assert.Equal(t, pic.PiFF.Data[0].Value, "Test with annotator")
 	assert.True(t, pic.Annotated)
 	assert.Equal(t, "test", pic.Annotator)
@@ -421,7 +434,7 @@ func TestDeleteAll(t *testing.T) {
 		Children: nil,
 		Parent:   0,
 	}
-	doc0 := Picture{primitive.NewObjectID(), p0, "/temp/none0", "", false, false, false, false, ""}
+	doc0 := Picture{Id: primitive.NewObjectID(), PiFF: p0, Url: "/temp/none0"}
 	p1 := PiFFStruct{
 		Meta:     Meta{},
 		Location: nil,
@@ -429,17 +442,19 @@ func TestDeleteAll(t *testing.T) {
 		Children: nil,
 		Parent:   0,
 	}
-	doc1 := Picture{primitive.NewObjectID(), p1, "/temp/none1", "", false, false, false, false, ""}
+	doc1 := Picture{Id: primitive.NewObjectID(), PiFF: p1, Url: "/temp/none1"}
 	tab := [2]Picture{doc0, doc1}
 	b, _ := json.Marshal(tab)
-	InsertMany(b, coll)
+	InsertMany(context.Background(), b, coll, "test")
 
-	pics, _ := FindAll(coll)
+	pics, _ := FindAll(context.Background(), coll)
 	assert.NotEqual(t, 0, len(pics))
 
-	err := DeleteAll(coll)
+	snapshot, err := DeleteAll(context.Background(), coll, "test")
 	assert.Nil(t, err)
-	pics, _ = FindAll(coll)
+	snapshotPics, _ := FindAll(context.Background(), Client.Database("taliesin_test").Collection(snapshot))
+	assert.Equal(t, len(pics), len(snapshotPics))
+	pics, _ = FindAll(context.Background(), coll)
 	assert.Equal(t, 0, len(pics))
 
 }
@@ -477,7 +492,7 @@ func TestStatusTotal(t *testing.T) {
 		Children: nil,
 		Parent:   0,
 	}
-	doc0 := Picture{primitive.NewObjectID(), p0, "/temp/none0", "", false, false, false, false, ""}
+	doc0 := Picture{Id: primitive.NewObjectID(), PiFF: p0, Url: "/temp/none0"}
 	p1 := PiFFStruct{
 		Meta:     Meta{},
 		Location: nil,
@@ -485,10 +500,10 @@ func TestStatusTotal(t *testing.T) {
 		Children: nil,
 		Parent:   0,
 	}
-	doc1 := Picture{primitive.NewObjectID(), p1, "/temp/none1", "", false, false, false, false, ""}
+	doc1 := Picture{Id: primitive.NewObjectID(), PiFF: p1, Url: "/temp/none1"}
 	tab := [2]Picture{doc0, doc1}
 	b, _ := json.Marshal(tab)
-	InsertMany(b, Database)
+	InsertMany(context.Background(), b, Database, "test")
 
 	request, err := http.NewRequest("GET", "/db/status", nil)
 	assert.Nil(t, err)
@@ -513,7 +528,48 @@ func TestStatusTotal(t *testing.T) {
 
 func TestStatusAnnotated(t *testing.T) {
 	Database = Client.Database("taliesin_test").Collection("test_status_annotated")
+	Database.Drop(context.TODO())
+
+	doc0 := Picture{Id: primitive.NewObjectID(), PiFF: EmptyPiFF, Url: "/temp/none0", Annotated: true, Annotator: "morpheus"}
+	doc1 := Picture{Id: primitive.NewObjectID(), PiFF: EmptyPiFF, Url: "/temp/none1", Annotated: true, Annotator: "morpheus", Corrected: true}
+	doc2 := Picture{Id: primitive.NewObjectID(), PiFF: EmptyPiFF, Url: "/temp/none2", Annotated: true, Annotator: RecognizerAnnotator}
+	doc3 := Picture{Id: primitive.NewObjectID(), PiFF: EmptyPiFF, Url: "/temp/none3"}
+	doc4 := Picture{Id: primitive.NewObjectID(), PiFF: EmptyPiFF, Url: "/temp/none4", Unreadable: true}
+	doc5 := Picture{Id: primitive.NewObjectID(), PiFF: EmptyPiFF, Url: "/temp/none5", SentToReco: true}
+	b, _ := json.Marshal([6]Picture{doc0, doc1, doc2, doc3, doc4, doc5})
+	InsertMany(context.Background(), b, Database, "test")
+
+	request, err := http.NewRequest("GET", "/db/status?by=annotator", nil)
+	assert.Nil(t, err)
+
+	recorder := httptest.NewRecorder()
+	status(recorder, request)
+	assert.Equal(t, http.StatusOK, recorder.Code)
 
+	var status Status
+	err = json.Unmarshal(recorder.Body.Bytes(), &status)
+	assert.Nil(t, err)
+
+	assert.Equal(t, int64(6), status.Total)
+	assert.Equal(t, int64(2), status.Annotated)
+	assert.Equal(t, int64(1), status.Suggested)
+	assert.Equal(t, int64(1), status.PendingForRecognizer)
+	assert.Equal(t, int64(1), status.Leased)
+	assert.Equal(t, int64(1), status.Unreadable)
+	assert.Equal(t, int64(1), status.Corrected)
+
+	assert.Equal(t, 2, len(status.Annotators))
+	assert.Equal(t, int64(2), status.Annotators["morpheus"].Annotated)
+	assert.Equal(t, int64(1), status.Annotators["morpheus"].Corrected)
+	assert.Equal(t, int64(1), status.Annotators[RecognizerAnnotator].Suggested)
+}
+
+func TestStatusBreakdown(t *testing.T) {
+	// a project is a collection, there is no breakdown by project
+	request, _ := http.NewRequest("GET", "/db/status?by=project", nil)
+	recorder := httptest.NewRecorder()
+	status(recorder, request)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
 }
 
 func TestStatusUnreadable(t *testing.T) {
@@ -0,0 +1,881 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	lib_auth "github.com/taliesin-insa/lib-auth"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"log"
+	"math/bits"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type DuplicateReason string
+
+// Why a picture was linked to a group
+const (
+	// Same image file and same location
+	DuplicateHash DuplicateReason = "hash"
+	// Snippets looking the same, like the same page scanned twice
+	DuplicatePerceptual DuplicateReason = "perceptual"
+	// Locations overlapping on the same page, like a line cropped twice
+	DuplicateOverlap DuplicateReason = "overlap"
+)
+
+// Near-duplicates have perceptual hashes differing by at most this many bits
+const perceptualDistance = 4
+
+// and a ratio of width over height differing by at most this fraction, so that lines of different lengths don't match
+const duplicateAspectTolerance = 0.1
+
+// Locations of the same page whose intersection is at least this fraction of their union are the same snippet
+const duplicateOverlap = 0.5
+
+// Actor of the events of the links made by the detection
+const DuplicatesActor = "$taliesin_duplicates"
+
+// Interval of the scan of the pictures which could not be checked when inserted
+var duplicatesScanInterval = 10 * time.Minute
+
+// Checks of inserted pictures in progress
+var duplicateChecks sync.WaitGroup
+
+/**
+What duplicates of a snippet have in common
+Computed once from the image file, it doesn't change the version of the picture
+*/
+type Fingerprint struct {
+	// SHA-256 of the image file
+	Hash string `bson:"Hash" json:"Hash"`
+	// Difference hash of the snippet, 64 bits in hexadecimal
+	Perceptual string `bson:"Perceptual" json:"Perceptual"`
+	// Parts of the perceptual hash, near-duplicates have at least one in common
+	Bands []string `bson:"Bands" json:"-"`
+	// Page the snippet comes from (PiFF.Meta.URL, or Url), and the bounds of its location on it
+	Page   string `bson:"Page" json:"Page"`
+	Bounds [4]int `bson:"Bounds" json:"Bounds"`
+}
+
+type DuplicateGroup struct {
+	// Member of the group which is annotated, the others copy its transcription
+	Root    primitive.ObjectID `json:"Root"`
+	Members []DuplicateMember  `json:"Members"`
+	// Members annotated by a human with another value than the root, the transcription of the root is not copied to them
+	Conflicts []DuplicateConflict `json:"Conflicts,omitempty"`
+}
+
+type DuplicateMember struct {
+	Id     primitive.ObjectID `json:"Id"`
+	Reason DuplicateReason    `json:"Reason"`
+}
+
+type DuplicateConflict struct {
+	Id        primitive.ObjectID `json:"Id"`
+	Value     string             `json:"Value"`
+	Annotator string             `json:"Annotator"`
+}
+
+type DuplicatesReport struct {
+	Fingerprinted int `json:"Fingerprinted"`
+	// Pictures linked to a group
+	Linked int `json:"Linked"`
+	// Pictures whose image could not be read, they are scanned again later
+	Failed int `json:"Failed"`
+	// Groups whose root was deleted, a new root was chosen
+	Repaired int `json:"Repaired"`
+}
+
+func init() {
+	if minutes, err := strconv.Atoi(os.Getenv("DUPLICATES_SCAN_MINUTES")); err == nil && minutes > 0 {
+		duplicatesScanInterval = time.Duration(minutes) * time.Minute
+	}
+}
+
+/**
+Difference hash of a region of an image : the region is reduced to 9x8 gray cells, each bit tells if a cell is darker than the one on its right
+*/
+func differenceHash(img image.Image, region image.Rectangle) uint64 {
+	const columns, rows = 9, 8
+	var cells [rows][columns]float64
+	width, height := region.Dx(), region.Dy()
+
+	for row := 0; row < rows; row++ {
+		y0, y1 := region.Min.Y+row*height/rows, region.Min.Y+(row+1)*height/rows
+		if y1 == y0 && y1 < region.Max.Y {
+			y1++
+		}
+		for column := 0; column < columns; column++ {
+			x0, x1 := region.Min.X+column*width/columns, region.Min.X+(column+1)*width/columns
+			if x1 == x0 && x1 < region.Max.X {
+				x1++
+			}
+			var sum, n float64
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					sum += float64(color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y)
+					n++
+				}
+			}
+			if n > 0 {
+				cells[row][column] = sum / n
+			}
+		}
+	}
+
+	var hash uint64
+	for row := 0; row < rows; row++ {
+		for column := 0; column < columns-1; column++ {
+			hash <<= 1
+			if cells[row][column] < cells[row][column+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+/**
+Split a perceptual hash in perceptualDistance+1 bands, two hashes differing by at most perceptualDistance bits have at least one identical band
+*/
+func perceptualBands(hash uint64) []string {
+	count := perceptualDistance + 1
+	bands := make([]string, 0, count)
+	start := 0
+	for i := 0; i < count; i++ {
+		size := (64 - start) / (count - i)
+		band := (hash >> uint(start)) & (1<<uint(size) - 1)
+		bands = append(bands, fmt.Sprintf("%d:%x", i, band))
+		start += size
+	}
+	return bands
+}
+
+/**
+Fingerprint of the snippet of a picture, from its image file
+The image is cropped to the location of the transcription when it lies inside the image, otherwise the file is the snippet itself
+*/
+func ComputeFingerprint(pic Picture) (Fingerprint, error) {
+	file, err := ResolveSnippetPath(pic.Url)
+	if err != nil {
+		return Fingerprint{}, err
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return Fingerprint{}, err
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return Fingerprint{}, fmt.Errorf("Could not decode the image of %v : %v", pic.Id.Hex(), err.Error())
+	}
+
+	region, bounds := img.Bounds(), img.Bounds()
+	if len(pic.PiFF.Data) > 0 {
+		if location, ok := findLocation(pic, pic.PiFF.Data[0].LocationId); ok && len(location.Polygon) > 0 {
+			bounds = polygonBounds(location.Polygon)
+			if bounds.In(img.Bounds()) {
+				region = bounds
+			}
+		}
+	}
+
+	hash := sha256.Sum256(data)
+	perceptual := differenceHash(img, region)
+	page := pic.PiFF.Meta.URL
+	if page == "" {
+		page = pic.Url
+	}
+	return Fingerprint{
+		Hash:       hex.EncodeToString(hash[:]),
+		Perceptual: fmt.Sprintf("%016x", perceptual),
+		Bands:      perceptualBands(perceptual),
+		Page:       page,
+		Bounds:     [4]int{bounds.Min.X, bounds.Min.Y, bounds.Max.X, bounds.Max.Y},
+	}, nil
+}
+
+func boundsRectangle(bounds [4]int) image.Rectangle {
+	return image.Rect(bounds[0], bounds[1], bounds[2], bounds[3])
+}
+
+/**
+Tell if two fingerprints are of the same snippet, and why
+*/
+func matchFingerprints(a Fingerprint, b Fingerprint) (DuplicateReason, bool) {
+	if a.Hash == b.Hash && a.Bounds == b.Bounds {
+		return DuplicateHash, true
+	}
+
+	ra, rb := boundsRectangle(a.Bounds), boundsRectangle(b.Bounds)
+	if a.Page == b.Page {
+		intersection := ra.Intersect(rb)
+		shared := intersection.Dx() * intersection.Dy()
+		union := ra.Dx()*ra.Dy() + rb.Dx()*rb.Dy() - shared
+		if !intersection.Empty() && float64(shared) >= duplicateOverlap*float64(union) {
+			return DuplicateOverlap, true
+		}
+	}
+
+	pa, errA := strconv.ParseUint(a.Perceptual, 16, 64)
+	pb, errB := strconv.ParseUint(b.Perceptual, 16, 64)
+	if errA != nil || errB != nil || bits.OnesCount64(pa^pb) > perceptualDistance {
+		return "", false
+	}
+	if ra.Dy() == 0 || rb.Dy() == 0 {
+		return "", false
+	}
+	aspectA, aspectB := float64(ra.Dx())/float64(ra.Dy()), float64(rb.Dx())/float64(rb.Dy())
+	if aspectA > aspectB*(1+duplicateAspectTolerance) || aspectB > aspectA*(1+duplicateAspectTolerance) {
+		return "", false
+	}
+	return DuplicatePerceptual, true
+}
+
+// Root of the group of a picture, itself when it is not a duplicate
+func groupRoot(pic Picture) primitive.ObjectID {
+	if pic.DuplicateOf != nil {
+		return *pic.DuplicateOf
+	}
+	return pic.Id
+}
+
+// Corrected pictures come first, then the ones annotated by a human, then the suggestions, then the oldest
+func betterRoot(a Picture, b Picture) bool {
+	score := func(pic Picture) int {
+		switch {
+		case pic.Corrected:
+			return 3
+		case pic.Annotated && pic.Annotator != RecognizerAnnotator:
+			return 2
+		case pic.Annotated:
+			return 1
+		}
+		return 0
+	}
+	if score(a) != score(b) {
+		return score(a) > score(b)
+	}
+	return a.Id.Hex() < b.Id.Hex()
+}
+
+func findPictures(ctx context.Context, filter interface{}, collection *mongo.Collection) ([]Picture, error) {
+	cur, err := collection.Find(ctx, filter)
+	if err != nil {
+		return nil, mongoError(ctx, err, "Error during MongoDB selection")
+	}
+	defer cur.Close(ctx)
+
+	pictures := []Picture{}
+	for cur.Next(ctx) {
+		var pic Picture
+		if err := cur.Decode(&pic); err != nil {
+			logf(ctx, "[DECODE] %v", err)
+			return nil, errors.New("Could not decode data from mongo")
+		}
+		pictures = append(pictures, pic)
+	}
+	if err := cur.Err(); err != nil {
+		logf(ctx, "[CURSOR] %v", err)
+		return nil, errors.New("Error while iterating results")
+	}
+	return pictures, nil
+}
+
+// Members of the groups of the roots, roots included
+func findGroupMembers(ctx context.Context, roots []primitive.ObjectID, collection *mongo.Collection) ([]Picture, error) {
+	return findPictures(ctx, bson.D{{"$or", bson.A{
+		bson.D{{"_id", bson.D{{"$in", roots}}}},
+		bson.D{{"DuplicateOf", bson.D{{"$in", roots}}}},
+	}}}, collection)
+}
+
+// Pictures unlinked by an admin are not linked again to the pictures they were unlinked from
+func distinctGroups(a []Picture, b []Picture) bool {
+	for _, x := range a {
+		for _, y := range b {
+			for _, id := range x.DistinctFrom {
+				if id == y.Id {
+					return true
+				}
+			}
+			for _, id := range y.DistinctFrom {
+				if id == x.Id {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+/**
+Link the members to the root, the root to nothing, and copy the transcription of the root to the other members
+reasons : why the members which were not linked to the root are linked now
+*/
+func relinkGroup(ctx context.Context, root Picture, members []Picture, reasons map[primitive.ObjectID]DuplicateReason, collection *mongo.Collection) (int, error) {
+	linked := 0
+	for _, member := range members {
+		var update bson.D
+		changes := map[string]interface{}{}
+		if member.Id == root.Id {
+			if member.DuplicateOf == nil {
+				continue
+			}
+			update = bson.D{{"$unset", bson.D{{"DuplicateOf", ""}, {"DuplicateReason", ""}}}, incrementVersion()}
+			changes["DuplicateOf"] = nil
+		} else {
+			if member.DuplicateOf != nil && *member.DuplicateOf == root.Id {
+				continue
+			}
+			reason, ok := reasons[member.Id]
+			if !ok {
+				reason = member.DuplicateReason
+			}
+			update = bson.D{{"$set", bson.D{{"DuplicateOf", root.Id}, {"DuplicateReason", reason}}}, incrementVersion()}
+			changes["DuplicateOf"], changes["DuplicateReason"] = root.Id, reason
+			linked++
+		}
+
+		_, err := collection.UpdateOne(ctx, bson.D{{"_id", member.Id}}, update)
+		if err != nil {
+			return linked, mongoError(ctx, err, "Error during MongoDB update")
+		}
+		PublishEvents(ctx, collection, Event{Type: EventLinked, PictureId: member.Id, Actor: DuplicatesActor, Changes: changes})
+	}
+
+	if root.Annotated {
+		return linked, propagateTranscription(ctx, root, collection)
+	}
+	return linked, nil
+}
+
+/**
+Copy the transcription of a picture to the other members of its group which have no transcription of a human :
+the ones not annotated yet, suggested by the recognizer or holding a copy. The other values are conflicts, they are kept
+The events of the copies tell the picture they were copied from, they are not counted in the statistics of the annotator
+*/
+func propagateTranscription(ctx context.Context, source Picture, collection *mongo.Collection) error {
+	if len(source.PiFF.Data) == 0 {
+		return nil
+	}
+	value := source.PiFF.Data[0].Value
+	root := groupRoot(source)
+	filter := bson.D{
+		{"$or", bson.A{bson.D{{"_id", root}}, bson.D{{"DuplicateOf", root}}}},
+		{"_id", bson.D{{"$ne", source.Id}}},
+		{"Corrected", false},
+	}
+	targets, err := findPictures(ctx, filter, collection)
+	if err != nil {
+		return err
+	}
+
+	for _, target := range targets {
+		if target.Annotated && target.Annotator == source.Annotator && len(target.PiFF.Data) > 0 && target.PiFF.Data[0].Value == value {
+			continue
+		}
+		if annotatedByHuman(target) {
+			if transcription(target) != value {
+				logf(ctx, "[WARNING] Duplicate %v of %v has another transcription by %v, it is kept", target.Id.Hex(), source.Id.Hex(), target.Annotator)
+			}
+			continue
+		}
+		update := bson.D{{"$set", bson.D{
+			{"PiFF.Data.0.Value", value},
+			{"Annotated", true},
+			{"Annotator", source.Annotator},
+			{"CopiedFrom", source.Id},
+		}}, incrementVersion()}
+		_, err := collection.UpdateOne(ctx, bson.D{{"_id", target.Id}}, update)
+		if err != nil {
+			return mongoError(ctx, err, "Error during MongoDB update")
+		}
+		PublishEvents(ctx, collection, Event{
+			Type:      EventAnnotated,
+			PictureId: target.Id,
+			Actor:     source.Annotator,
+			Changes:   map[string]interface{}{"Value": value, "Annotator": source.Annotator, "DuplicateOf": source.Id},
+		})
+	}
+	return nil
+}
+
+// Whether the transcription of a picture was written by a human for it, rather than suggested or copied
+func annotatedByHuman(pic Picture) bool {
+	return pic.Annotated && pic.Annotator != RecognizerAnnotator && pic.CopiedFrom == nil
+}
+
+func transcription(pic Picture) string {
+	if len(pic.PiFF.Data) == 0 {
+		return ""
+	}
+	return pic.PiFF.Data[0].Value
+}
+
+/**
+Copy the transcription of an annotated picture to its duplicates
+*/
+func PropagateTranscription(ctx context.Context, id primitive.ObjectID, collection *mongo.Collection) error {
+	ctx, cancel := withTimeout(ctx, OperationWrite)
+	defer cancel()
+
+	var pic Picture
+	err := collection.FindOne(ctx, bson.D{{"_id", id}}).Decode(&pic)
+	if err != nil {
+		return mongoError(ctx, err, "Error during MongoDB selection")
+	}
+	if pic.DuplicateOf == nil {
+		// only a root can have duplicates
+		count, err := collection.CountDocuments(ctx, bson.D{{"DuplicateOf", id}})
+		if err != nil || count == 0 {
+			return err
+		}
+	}
+	return propagateTranscription(ctx, pic, collection)
+}
+
+/**
+Fingerprint a picture if needed and link it to the group of its duplicates, merging the groups it matches
+Returns whether the picture is linked to a group now
+*/
+func CheckDuplicates(ctx context.Context, id primitive.ObjectID, collection *mongo.Collection) (bool, error) {
+	ctx, cancel := withTimeout(ctx, OperationWrite)
+	defer cancel()
+
+	var pic Picture
+	err := collection.FindOne(ctx, bson.D{{"_id", id}}).Decode(&pic)
+	if err != nil {
+		return false, mongoError(ctx, err, "Error during MongoDB selection")
+	}
+
+	if pic.Fingerprint == nil {
+		fingerprint, err := ComputeFingerprint(pic)
+		if err != nil {
+			return false, err
+		}
+		_, err = collection.UpdateOne(ctx, bson.D{{"_id", id}}, bson.D{{"$set", bson.D{{"Fingerprint", fingerprint}}}})
+		if err != nil {
+			return false, mongoError(ctx, err, "Error during MongoDB update")
+		}
+		pic.Fingerprint = &fingerprint
+	}
+
+	candidates, err := findPictures(ctx, bson.D{
+		{"_id", bson.D{{"$ne", id}}},
+		{"$or", bson.A{
+			bson.D{{"Fingerprint.Hash", pic.Fingerprint.Hash}},
+			bson.D{{"Fingerprint.Page", pic.Fingerprint.Page}},
+			bson.D{{"Fingerprint.Bands", bson.D{{"$in", pic.Fingerprint.Bands}}}},
+		}},
+	}, collection)
+	if err != nil {
+		return false, err
+	}
+
+	// roots of the groups matched, with the reason of the first match
+	matched := map[primitive.ObjectID]DuplicateReason{}
+	for _, candidate := range candidates {
+		if candidate.Fingerprint == nil || groupRoot(candidate) == groupRoot(pic) {
+			continue
+		}
+		if reason, ok := matchFingerprints(*pic.Fingerprint, *candidate.Fingerprint); ok {
+			if _, seen := matched[groupRoot(candidate)]; !seen {
+				matched[groupRoot(candidate)] = reason
+			}
+		}
+	}
+	if len(matched) == 0 {
+		return pic.DuplicateOf != nil, nil
+	}
+
+	roots := []primitive.ObjectID{groupRoot(pic)}
+	for root := range matched {
+		roots = append(roots, root)
+	}
+	members, err := findGroupMembers(ctx, roots, collection)
+	if err != nil {
+		return false, err
+	}
+	groups := map[primitive.ObjectID][]Picture{}
+	for _, member := range members {
+		groups[groupRoot(member)] = append(groups[groupRoot(member)], member)
+	}
+
+	// the group of the picture absorbs the groups it matches
+	own := groups[groupRoot(pic)]
+	merged := own
+	reasons := map[primitive.ObjectID]DuplicateReason{}
+	var first DuplicateReason
+	for root, reason := range matched {
+		if distinctGroups(merged, groups[root]) {
+			continue
+		}
+		// the members of the absorbed group keep their reason, its root gets the reason of the match
+		reasons[root] = reason
+		if first == "" {
+			first = reason
+		}
+		merged = append(merged, groups[root]...)
+	}
+	if len(merged) == len(own) {
+		return pic.DuplicateOf != nil, nil
+	}
+	reasons[groupRoot(pic)] = first
+
+	root := merged[0]
+	for _, member := range merged[1:] {
+		if betterRoot(member, root) {
+			root = member
+		}
+	}
+	_, err = relinkGroup(ctx, root, merged, reasons, collection)
+	return true, err
+}
+
+/**
+Check the inserted pictures in the background, with timeouts of their own rather than the one of the insertion
+The request id and the trace of ctx are kept
+*/
+func CheckInsertedDuplicatesLater(ctx context.Context, ids []interface{}, collection *mongo.Collection) {
+	duplicateChecks.Add(1)
+	go func() {
+		defer duplicateChecks.Done()
+		CheckInsertedDuplicates(detachedContext(ctx), ids, collection)
+	}()
+}
+
+// Wait until the checks of the inserted pictures are done
+func WaitDuplicateChecks() {
+	duplicateChecks.Wait()
+}
+
+/**
+Check the inserted pictures, the ones whose file can't be read yet are checked later by the scan
+*/
+func CheckInsertedDuplicates(ctx context.Context, ids []interface{}, collection *mongo.Collection) {
+	failed := 0
+	for _, id := range ids {
+		if oid, ok := id.(primitive.ObjectID); ok {
+			if _, err := CheckDuplicates(ctx, oid, collection); err != nil {
+				failed++
+			}
+		}
+	}
+	if failed > 0 {
+		logf(ctx, "[WARNING] %v inserted pictures could not be checked for duplicates, they will be scanned later", failed)
+	}
+}
+
+/**
+Choose a new root for the groups whose root was deleted
+*/
+func repairGroups(ctx context.Context, collection *mongo.Collection) (int, error) {
+	values, err := collection.Distinct(ctx, "DuplicateOf", bson.D{{"DuplicateOf", bson.D{{"$exists", true}}}})
+	if err != nil {
+		return 0, mongoError(ctx, err, "Error during MongoDB selection")
+	}
+
+	repaired := 0
+	for _, value := range values {
+		root, ok := value.(primitive.ObjectID)
+		if !ok {
+			continue
+		}
+		count, err := collection.CountDocuments(ctx, bson.D{{"_id", root}})
+		if err != nil {
+			return repaired, mongoError(ctx, err, "Error during MongoDB selection")
+		}
+		if count > 0 {
+			continue
+		}
+
+		members, err := findPictures(ctx, bson.D{{"DuplicateOf", root}}, collection)
+		if err != nil || len(members) == 0 {
+			return repaired, err
+		}
+		newRoot := members[0]
+		for _, member := range members[1:] {
+			if betterRoot(member, newRoot) {
+				newRoot = member
+			}
+		}
+		if _, err := relinkGroup(ctx, newRoot, members, nil, collection); err != nil {
+			return repaired, err
+		}
+		repaired++
+	}
+	return repaired, nil
+}
+
+/**
+Check the pictures which have no fingerprint yet, and repair the groups whose root was deleted
+*/
+func ScanDuplicates(ctx context.Context, collection *mongo.Collection) (DuplicatesReport, error) {
+	scanCtx, cancel := withTimeout(ctx, OperationScan)
+	defer cancel()
+
+	report := DuplicatesReport{}
+	repaired, err := repairGroups(scanCtx, collection)
+	report.Repaired = repaired
+	if err != nil {
+		return report, err
+	}
+
+	// the ids first, as checking modifies the pictures
+	cur, err := collection.Find(scanCtx, bson.D{{"Fingerprint", bson.D{{"$exists", false}}}},
+		options.Find().SetProjection(bson.D{{"_id", 1}}))
+	if err != nil {
+		return report, mongoError(scanCtx, err, "Error during MongoDB selection")
+	}
+	var ids []primitive.ObjectID
+	for cur.Next(scanCtx) {
+		var doc struct {
+			Id primitive.ObjectID `bson:"_id"`
+		}
+		if err := cur.Decode(&doc); err != nil {
+			cur.Close(scanCtx)
+			logf(ctx, "[DECODE] %v", err)
+			return report, errors.New("Could not decode data from mongo")
+		}
+		ids = append(ids, doc.Id)
+	}
+	cur.Close(scanCtx)
+
+	// each check has its own timeout, the scan only bounds the listing
+	for _, id := range ids {
+		linked, err := CheckDuplicates(ctx, id, collection)
+		if err != nil {
+			logf(ctx, "[WARNING] Duplicates of %v : %v", id.Hex(), err.Error())
+			report.Failed++
+			continue
+		}
+		report.Fingerprinted++
+		if linked {
+			report.Linked++
+		}
+	}
+	return report, nil
+}
+
+func ScanDuplicatesPeriodically(collection *mongo.Collection) {
+	for {
+		report, err := ScanDuplicates(context.Background(), collection)
+		if err != nil {
+			log.Printf("[ERROR] Duplicates scan : %v", err.Error())
+		} else if report.Linked > 0 || report.Repaired > 0 {
+			log.Printf("Duplicates scan : %+v\n", report)
+		}
+		time.Sleep(duplicatesScanInterval)
+	}
+}
+
+/**
+Remove a picture from its group, it won't be linked again to the pictures of the group
+A root leaves its group to the best of its members
+*/
+func UnlinkDuplicate(ctx context.Context, id primitive.ObjectID, collection *mongo.Collection, actor string) error {
+	ctx, cancel := withTimeout(ctx, OperationWrite)
+	defer cancel()
+
+	var pic Picture
+	err := collection.FindOne(ctx, bson.D{{"_id", id}}).Decode(&pic)
+	if err == mongo.ErrNoDocuments {
+		return fmt.Errorf("No picture %v", id.Hex())
+	} else if err != nil {
+		return mongoError(ctx, err, "Error during MongoDB selection")
+	}
+
+	members, err := findGroupMembers(ctx, []primitive.ObjectID{groupRoot(pic)}, collection)
+	if err != nil {
+		return err
+	}
+	var others []Picture
+	var distinct []primitive.ObjectID
+	for _, member := range members {
+		if member.Id != id {
+			others = append(others, member)
+			distinct = append(distinct, member.Id)
+		}
+	}
+	if len(others) == 0 {
+		return fmt.Errorf("The picture %v has no duplicates", id.Hex())
+	}
+
+	update := bson.D{
+		{"$unset", bson.D{{"DuplicateOf", ""}, {"DuplicateReason", ""}}},
+		{"$addToSet", bson.D{{"DistinctFrom", bson.D{{"$each", distinct}}}}},
+		incrementVersion(),
+	}
+	_, err = collection.UpdateOne(ctx, bson.D{{"_id", id}}, update)
+	if err != nil {
+		return mongoError(ctx, err, "Error during MongoDB update")
+	}
+	PublishEvents(ctx, collection, Event{Type: EventLinked, PictureId: id, Actor: actor, Changes: map[string]interface{}{"DuplicateOf": nil}})
+
+	if pic.DuplicateOf == nil && len(others) > 0 {
+		root := others[0]
+		for _, member := range others[1:] {
+			if betterRoot(member, root) {
+				root = member
+			}
+		}
+		_, err = relinkGroup(ctx, root, others, nil, collection)
+	}
+	return err
+}
+
+/**
+The groups of duplicates, with their members and the ones whose transcription conflicts with the root
+*/
+func FindDuplicateGroups(ctx context.Context, collection *mongo.Collection) ([]DuplicateGroup, error) {
+	ctx, cancel := withTimeout(ctx, OperationRead)
+	defer cancel()
+
+	members, err := findPictures(ctx, bson.D{{"DuplicateOf", bson.D{{"$exists", true}}}}, collection)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := []DuplicateGroup{}
+	index := map[primitive.ObjectID]int{}
+	for _, member := range members {
+		i, ok := index[*member.DuplicateOf]
+		if !ok {
+			i = len(groups)
+			index[*member.DuplicateOf] = i
+			groups = append(groups, DuplicateGroup{Root: *member.DuplicateOf})
+		}
+		groups[i].Members = append(groups[i].Members, DuplicateMember{Id: member.Id, Reason: member.DuplicateReason})
+	}
+
+	roots := make([]primitive.ObjectID, len(groups))
+	for i, group := range groups {
+		roots[i] = group.Root
+	}
+	annotatedRoots, err := findPictures(ctx, bson.D{{"_id", bson.D{{"$in", roots}}}, {"Annotated", true}}, collection)
+	if err != nil {
+		return nil, err
+	}
+	values := map[primitive.ObjectID]string{}
+	for _, root := range annotatedRoots {
+		values[root.Id] = transcription(root)
+	}
+	for _, member := range members {
+		value, ok := values[*member.DuplicateOf]
+		if ok && annotatedByHuman(member) && transcription(member) != value {
+			i := index[*member.DuplicateOf]
+			groups[i].Conflicts = append(groups[i].Conflicts, DuplicateConflict{Id: member.Id, Value: transcription(member), Annotator: member.Annotator})
+		}
+	}
+	return groups, nil
+}
+
+// the duplicates are managed by the admins
+func authenticateDuplicatesAdmin(w http.ResponseWriter, r *http.Request) (*lib_auth.UserData, bool) {
+	user, err, authStatusCode := authenticateUser(r)
+
+	// check if there was an error during the authentication or if the user wasn't authenticated
+	if err != nil {
+		logf(r.Context(), "[ERROR] Check authentication: %v", err.Error())
+		w.WriteHeader(authStatusCode)
+		w.Write([]byte("[MICRO-DATABASE] Couldn't verify identity"))
+		return user, false
+	}
+
+	// check if the authenticated user has sufficient permissions to
+	if user.Role != lib_auth.RoleAdmin {
+		logf(r.Context(), "[WRONG_ROLE] Insufficient permission: want %v, was %v", lib_auth.RoleAdmin, user.Role)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("[MICRO-DATABASE] Insufficient permissions to manage duplicates"))
+		return user, false
+	}
+	return user, true
+}
+
+func getDuplicates(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.Inc() // incrementing the httpRequestsTotal counter
+
+	if _, ok := authenticateDuplicatesAdmin(w, r); !ok {
+		return
+	}
+
+	groups, err := FindDuplicateGroups(r.Context(), Database)
+	if err != nil {
+		writeDatabaseError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	body, err := json.Marshal(groups)
+	if err != nil {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("[MICRO-DATABASE] Could not marshal answer data"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+func scanDuplicates(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.Inc() // incrementing the httpRequestsTotal counter
+
+	if _, ok := authenticateDuplicatesAdmin(w, r); !ok {
+		return
+	}
+
+	report, err := ScanDuplicates(r.Context(), Database)
+	if err != nil {
+		writeDatabaseError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	body, err := json.Marshal(report)
+	if err != nil {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("[MICRO-DATABASE] Could not marshal answer data"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+func unlinkDuplicate(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.Inc() // incrementing the httpRequestsTotal counter
+
+	user, ok := authenticateDuplicatesAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	entryId, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("[MICRO-DATABASE] Could not decode ID"))
+		return
+	}
+
+	err = UnlinkDuplicate(r.Context(), entryId, Database, user.Username)
+	if err != nil {
+		writeDatabaseError(w, r, err, http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A line of "text" : dark strokes on a light background, changed pixels make near-duplicates
+func writeLine(t *testing.T, name string, changed int) {
+	line := image.NewGray(image.Rect(0, 0, 180, 40))
+	for y := 0; y < 40; y++ {
+		for x := 0; x < 180; x++ {
+			line.SetGray(x, y, color.Gray{Y: uint8(230 - (x*7+y*3)%97)})
+		}
+	}
+	for x := 0; x < changed; x++ {
+		line.SetGray(x, 0, color.Gray{Y: 0})
+	}
+	f, err := os.Create(filepath.Join(snippetsRoot, name))
+	assert.Nil(t, err)
+	png.Encode(f, line)
+	f.Close()
+}
+
+func TestDuplicates(t *testing.T) {
+	defer setupSnippets(t)()
+	Database = Client.Database("taliesin_test").Collection("test_duplicates")
+	Database.Drop(context.TODO())
+
+	writeLine(t, "a.png", 0)
+	writeLine(t, "b.png", 0)
+	writeLine(t, "c.png", 3)
+	data := []Data{{Type: "line", LocationId: "loc_0", Value: "", Id: "0"}}
+	pics := [3]Picture{
+		{PiFF: PiFFStruct{Data: data}, Url: "/snippets/a.png"},
+		{PiFF: PiFFStruct{Data: data}, Url: "/snippets/b.png"},
+		{PiFF: PiFFStruct{Data: data}, Url: "/snippets/c.png"},
+	}
+	b, _ := json.Marshal(pics)
+	ids, err := InsertMany(context.Background(), b, Database, "test")
+	assert.Nil(t, err)
+	WaitDuplicateChecks()
+	root := ids[0].(primitive.ObjectID)
+
+	// the same file, then a few different pixels
+	copy, _ := FindOne(context.Background(), ids[1].(primitive.ObjectID), Database)
+	assert.Equal(t, root, *copy.DuplicateOf)
+	assert.Equal(t, DuplicateHash, copy.DuplicateReason)
+	near, _ := FindOne(context.Background(), ids[2].(primitive.ObjectID), Database)
+	assert.Equal(t, root, *near.DuplicateOf)
+	assert.Equal(t, DuplicatePerceptual, near.DuplicateReason)
+
+	// only the root is in the queue
+	unused, _ := FindManyUnused(context.Background(), 10, Database)
+	assert.Equal(t, 1, len(unused))
+	assert.Equal(t, root, unused[0].Id)
+
+	// the value of a duplicate is copied to the group until the root is annotated
+	annotation, _ := json.Marshal([]Annotation{{Id: near.Id, Value: "Au clair de la lune, mon ami"}})
+	assert.Nil(t, UpdateValue(context.Background(), annotation, Database, "trinity", nil))
+	copy, _ = FindOne(context.Background(), copy.Id, Database)
+	assert.Equal(t, near.Id, *copy.CopiedFrom)
+
+	annotation, _ = json.Marshal([]Annotation{{Id: root, Value: "Au clair de la lune"}})
+	assert.Nil(t, UpdateValue(context.Background(), annotation, Database, "morpheus", nil))
+	copy, _ = FindOne(context.Background(), copy.Id, Database)
+	assert.True(t, copy.Annotated)
+	assert.Equal(t, "morpheus", copy.Annotator)
+	assert.Equal(t, "Au clair de la lune", copy.PiFF.Data[0].Value)
+	assert.Equal(t, root, *copy.CopiedFrom)
+
+	// the work of an annotator is not overwritten, it is reported
+	near, _ = FindOne(context.Background(), near.Id, Database)
+	assert.Equal(t, "trinity", near.Annotator)
+	assert.Nil(t, near.CopiedFrom)
+	groups, _ := FindDuplicateGroups(context.Background(), Database)
+	if assert.Len(t, groups, 1) {
+		assert.Equal(t, []DuplicateConflict{{Id: near.Id, Value: "Au clair de la lune, mon ami", Annotator: "trinity"}}, groups[0].Conflicts)
+	}
+
+	// an admin knows better, the picture is not linked again
+	assert.Nil(t, UnlinkDuplicate(context.Background(), near.Id, Database, "morpheus"))
+	linked, err := CheckDuplicates(context.Background(), near.Id, Database)
+	assert.Nil(t, err)
+	assert.False(t, linked)
+
+	groups, _ = FindDuplicateGroups(context.Background(), Database)
+	assert.Equal(t, []DuplicateGroup{{Root: root, Members: []DuplicateMember{{Id: copy.Id, Reason: DuplicateHash}}}}, groups)
+}
+
+func TestInsertServerManagedFields(t *testing.T) {
+	coll := Client.Database("taliesin_test").Collection("test_insert_managed")
+	coll.Drop(context.TODO())
+	defer coll.Drop(context.TODO())
+
+	root := primitive.NewObjectID()
+	pics := [1]Picture{{
+		PiFF:            EmptyPiFF,
+		Url:             "/temp/none",
+		Version:         7,
+		Fingerprint:     &Fingerprint{Hash: "forged"},
+		DuplicateOf:     &root,
+		DuplicateReason: DuplicateHash,
+		DistinctFrom:    []primitive.ObjectID{root},
+		Image:           &ImageInfo{Hash: "forged"},
+	}}
+	b, _ := json.Marshal(pics)
+	ids, err := InsertMany(context.Background(), b, coll, "test")
+	assert.Nil(t, err)
+	WaitDuplicateChecks()
+
+	// the detection computes its own fingerprint, and the picture is not hidden from the queues
+	pic, err := FindOne(context.Background(), ids[0].(primitive.ObjectID), coll)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), pic.Version)
+	assert.Nil(t, pic.Fingerprint)
+	assert.Nil(t, pic.DuplicateOf)
+	assert.Empty(t, pic.DuplicateReason)
+	assert.Nil(t, pic.DistinctFrom)
+	assert.Nil(t, pic.Image)
+}
+
+func TestMatchFingerprints(t *testing.T) {
+	line := Fingerprint{Hash: "page", Perceptual: "00ff00ff00ff00ff", Page: "/snippets/page.png", Bounds: [4]int{10, 10, 110, 30}}
+
+	// cropped again a bit larger
+	recropped := Fingerprint{Hash: "page", Perceptual: "ff00ff00ff00ff00", Page: "/snippets/page.png", Bounds: [4]int{8, 9, 112, 31}}
+	reason, ok := matchFingerprints(line, recropped)
+	assert.True(t, ok)
+	assert.Equal(t, DuplicateOverlap, reason)
+
+	// the next line of the page
+	next := Fingerprint{Hash: "page", Perceptual: "ff00ff00ff00ff00", Page: "/snippets/page.png", Bounds: [4]int{10, 30, 110, 50}}
+	_, ok = matchFingerprints(line, next)
+	assert.False(t, ok)
+
+	// looking the same but much longer
+	longer := Fingerprint{Hash: "other", Perceptual: "00ff00ff00ff00fe", Page: "/snippets/other.png", Bounds: [4]int{0, 0, 300, 20}}
+	_, ok = matchFingerprints(line, longer)
+	assert.False(t, ok)
+	longer.Bounds = [4]int{0, 0, 104, 21}
+	reason, ok = matchFingerprints(line, longer)
+	assert.True(t, ok)
+	assert.Equal(t, DuplicatePerceptual, reason)
+}
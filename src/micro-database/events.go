@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type EventType string
+
+// Lifecycle events of a snippet
+const (
+	EventInserted  EventType = "inserted"
+	EventAnnotated EventType = "annotated"
+	EventUpdated   EventType = "updated"
+	EventFlagged   EventType = "flagged"
+	EventReviewed  EventType = "reviewed"
+	EventDeleted   EventType = "deleted"
+	EventRestored  EventType = "restored"
+	EventLinked    EventType = "linked"
+)
+
+/**
+Something that happened to a picture
+A deleted event without PictureId means the whole collection was flushed
+*/
+type Event struct {
+	Id primitive.ObjectID `bson:"_id" json:"Id"`
+	// Position of the event in the collection, given by a counter shared by the replicas, used to resume a stream
+	Seq       int64                  `bson:"Seq" json:"Seq"`
+	Type      EventType              `bson:"Type" json:"Type"`
+	PictureId primitive.ObjectID     `bson:"PictureId" json:"PictureId"`
+	Actor     string                 `bson:"Actor" json:"Actor"`
+	Changes   map[string]interface{} `bson:"Changes,omitempty" json:"Changes,omitempty"` // changed fields and their new value
+	Time      time.Time              `bson:"Time" json:"Time"`
+}
+
+// Events are kept for a week unless EVENTS_RETENTION_DAYS is set, consumers which are late for more than that should resynchronize from the snippets
+// The events are also the history used by the statistics
+var eventsRetention = 7 * 24 * time.Hour
+
+// Delay between two reads of the events collection by an event stream
+var eventsPollInterval = time.Second
+
+// Idle streams send a comment at this interval so that proxies don't close them
+const eventsKeepAlive = 15 * time.Second
+
+// Counter of the sequence of the events, in the counters of the collection
+const eventsCounterId = "events"
+
+// Margin for the clocks of the replicas when waiting for a missing event, see FindEventsAfter
+const eventsClockSkew = 5 * time.Second
+
+func init() {
+	if days, err := strconv.Atoi(os.Getenv("EVENTS_RETENTION_DAYS")); err == nil && days > 0 {
+		eventsRetention = time.Duration(days) * 24 * time.Hour
+	}
+}
+
+func eventsCollection(collection *mongo.Collection) *mongo.Collection {
+	return companionCollection(collection, "events")
+}
+
+func countersCollection(collection *mongo.Collection) *mongo.Collection {
+	return companionCollection(collection, "counters")
+}
+
+/**
+Reserve the next n numbers of the sequence of the events
+Returns the first one, the counter starts at 1
+*/
+func nextEventSeqs(ctx context.Context, collection *mongo.Collection, n int) (int64, error) {
+	filter := bson.D{{"_id", eventsCounterId}}
+	update := bson.D{{"$inc", bson.D{{"Seq", int64(n)}}}}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+	var counter struct {
+		Seq int64 `bson:"Seq"`
+	}
+	err := countersCollection(collection).FindOneAndUpdate(ctx, filter, update, opts).Decode(&counter)
+	if err != nil {
+		return 0, mongoError(ctx, err, "Error during MongoDB update")
+	}
+	return counter.Seq - int64(n) + 1, nil
+}
+
+/**
+Move the counter of the events after the most recent event, as after restoring events from an archive
+*/
+func EnsureEventsCounter(ctx context.Context, collection *mongo.Collection) error {
+	ctx, cancel := withTimeout(ctx, OperationWrite)
+	defer cancel()
+
+	last, err := LastEventSeq(ctx, collection)
+	if err != nil {
+		return err
+	}
+	filter := bson.D{{"_id", eventsCounterId}}
+	update := bson.D{{"$max", bson.D{{"Seq", last}}}}
+	_, err = countersCollection(collection).UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if err != nil {
+		return mongoError(ctx, err, "Error during MongoDB update")
+	}
+	return nil
+}
+
+/**
+Record events on the collection and send them to the webhooks
+A failure is only logged as the modification the events describe already happened
+The events are recorded even if the request which made the modification was canceled since,
+they stay in its trace and the webhooks receive its trace context
+*/
+func PublishEvents(ctx context.Context, collection *mongo.Collection, events ...Event) {
+	if len(events) == 0 {
+		return
+	}
+
+	detached := detachedContext(ctx)
+	insertCtx, cancel := withTimeout(detached, OperationWrite)
+	defer cancel()
+
+	first, err := nextEventSeqs(insertCtx, collection, len(events))
+	if err != nil {
+		logf(detached, "[MONGO-DRIVER] Could not number %v events : %v", len(events), err.Error())
+	}
+	// the time is taken once numbered, FindEventsAfter relies on it
+	now := time.Now().UTC()
+	docs := make([]interface{}, len(events))
+	for i := range events {
+		events[i].Id = primitive.NewObjectID()
+		events[i].Time = now
+		docs[i] = events[i]
+	}
+
+	// events without a number can't be streamed, they are still sent to the webhooks
+	if err == nil {
+		for i := range events {
+			events[i].Seq = first + int64(i)
+			docs[i] = events[i]
+		}
+		_, err = eventsCollection(collection).InsertMany(insertCtx, docs)
+		if err != nil {
+			logf(detached, "[MONGO-DRIVER] Could not record %v events : %v", len(events), err.Error())
+		}
+	}
+
+	Webhooks.Dispatch(detached, collection, events)
+}
+
+/**
+Events published after the given one, in the order of their sequence
+An event numbered but not inserted yet by another replica leaves a gap : the events after it are only returned
+once it is inserted, or once it can't be anymore (the write timeout of its insertion has passed)
+after : sequence of the last event already known, 0 to start from the oldest event still kept
+types : only return these types of events, all of them if empty
+Returns the events and the sequence to resume after, which also passes the events of the other types
+*/
+func FindEventsAfter(ctx context.Context, after int64, types []EventType, limit int64, collection *mongo.Collection) ([]Event, int64, error) {
+	ctx, cancel := withTimeout(ctx, OperationRead)
+	defer cancel()
+
+	// every type, to see the gaps
+	filter := bson.D{{"Seq", bson.D{{"$gt", after}}}}
+	opts := options.Find().SetSort(bson.D{{"Seq", 1}}).SetLimit(limit)
+
+	cur, err := eventsCollection(collection).Find(ctx, filter, opts)
+	if err != nil {
+		return nil, after, mongoError(ctx, err, "Error during MongoDB selection")
+	}
+	defer cur.Close(ctx)
+
+	wanted := make(map[EventType]bool)
+	for _, t := range types {
+		wanted[t] = true
+	}
+	// an event is numbered before its time is taken, so the missing ones are inserted before this
+	settled := time.Now().Add(-mongoTimeouts[OperationWrite] - eventsClockSkew)
+
+	results := []Event{}
+	for cur.Next(ctx) {
+		var elem Event
+		if err := cur.Decode(&elem); err != nil {
+			logf(ctx, "[DECODE] %v", err)
+			return nil, after, errors.New("Error while iterating results")
+		}
+		if elem.Seq != after+1 && elem.Time.After(settled) {
+			break
+		}
+		after = elem.Seq
+		if len(types) == 0 || wanted[elem.Type] {
+			results = append(results, elem)
+		}
+	}
+
+	if err := cur.Err(); err != nil {
+		logf(ctx, "[CURSOR] %v", err)
+		return nil, after, errors.New("Error while iterating results")
+	}
+
+	return results, after, nil
+}
+
+/**
+Sequence of the most recent event, 0 if there is none
+*/
+func LastEventSeq(ctx context.Context, collection *mongo.Collection) (int64, error) {
+	ctx, cancel := withTimeout(ctx, OperationRead)
+	defer cancel()
+
+	opts := options.FindOne().SetSort(bson.D{{"Seq", -1}})
+	var last Event
+
+	err := eventsCollection(collection).FindOne(ctx, bson.D{}, opts).Decode(&last)
+	if err == mongo.ErrNoDocuments {
+		return 0, nil
+	} else if err != nil {
+		return 0, mongoError(ctx, err, "Error during MongoDB selection")
+	}
+	return last.Seq, nil
+}
+
+/**
+Remove the events older than the retention period
+*/
+func EnsureEventsRetention(ctx context.Context, collection *mongo.Collection) error {
+	ctx, cancel := withTimeout(ctx, OperationWrite)
+	defer cancel()
+
+	index := mongo.IndexModel{
+		Keys:    bson.D{{"Time", 1}},
+		Options: options.Index().SetExpireAfterSeconds(int32(eventsRetention.Seconds())),
+	}
+	_, err := eventsCollection(collection).Indexes().CreateOne(ctx, index)
+	var commandErr mongo.CommandError
+	if errors.As(err, &commandErr) && commandErr.Code == indexOptionsConflict {
+		// the retention changed, the existing index is modified
+		command := bson.D{
+			{"collMod", eventsCollection(collection).Name()},
+			{"index", bson.D{{"keyPattern", bson.D{{"Time", 1}}}, {"expireAfterSeconds", int32(eventsRetention.Seconds())}}},
+		}
+		err = collection.Database().RunCommand(ctx, command).Err()
+	}
+	if err != nil {
+		return mongoError(ctx, err, "Error during MongoDB index creation")
+	}
+	return nil
+}
+
+func parseEventTypes(raw string) []EventType {
+	var types []EventType
+	for _, t := range strings.Split(raw, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			types = append(types, EventType(t))
+		}
+	}
+	return types
+}
+
+/**
+Server-Sent Events stream of the snippet lifecycle
+The events are read from the database so that every replica sends the events of all the others
+*/
+func streamEvents(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.Inc() // incrementing the httpRequestsTotal counter
+
+	password := r.Header.Get("Authorization")
+
+	if password == "" && r.URL.Query().Get("ticket") != "" {
+		// EventSource can't set headers, browsers ask for a ticket first
+		if _, ok := authenticateTicket(w, r, TicketEvents); !ok {
+			return
+		}
+	} else if !isClusterPassword(password) {
+		_, err, authStatusCode := authenticateUser(r)
+
+		// check if there was an error during the authentication or if the user wasn't authenticated
+		if err != nil {
+			logf(r.Context(), "[ERROR] Check authentication: %v", err.Error())
+			w.WriteHeader(authStatusCode)
+			w.Write([]byte("[MICRO-DATABASE] Couldn't verify identity"))
+			return
+		}
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		logf(r.Context(), "[ERROR] : Streaming is not supported by the response writer")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("[MICRO-DATABASE] Streaming unsupported"))
+		return
+	}
+
+	collection := Database
+	types := parseEventTypes(r.URL.Query().Get("types"))
+
+	// resume after the last event received by the client, or only send the new events
+	last, err := LastEventSeq(r.Context(), collection)
+	if err != nil {
+		writeDatabaseError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	if lastEventId := r.Header.Get("Last-Event-ID"); lastEventId != "" {
+		// the ids sent before the events were numbered can't be resumed, EventSource doesn't reconnect after an error
+		if seq, err := strconv.ParseInt(lastEventId, 10, 64); err == nil && seq >= 0 {
+			last = seq
+		} else {
+			logf(r.Context(), "[WARNING] Last-Event-ID %q is not a sequence, only the new events are sent", lastEventId)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ticker := time.NewTicker(eventsPollInterval)
+	defer ticker.Stop()
+	lastWrite := time.Now()
+
+	for {
+		var events []Event
+		events, last, err = FindEventsAfter(r.Context(), last, types, 100, collection)
+		if err != nil {
+			logf(r.Context(), "[ERROR] : %v", err.Error())
+			return
+		}
+
+		for _, event := range events {
+			data, err := json.Marshal(event)
+			if err != nil {
+				logf(r.Context(), "[ERROR] : %v", err.Error())
+				return
+			}
+			fmt.Fprintf(w, "id: %v\nevent: %v\ndata: %s\n\n", event.Seq, event.Type, data)
+			lastWrite = time.Now()
+		}
+		if time.Since(lastWrite) > eventsKeepAlive {
+			fmt.Fprint(w, ": keep-alive\n\n")
+			lastWrite = time.Now()
+		}
+		flusher.Flush()
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestEventsPublished(t *testing.T) {
+	Database = Client.Database("taliesin_test").Collection("test_events")
+	doc0 := Picture{Id: primitive.NewObjectID(), PiFF: EmptyPiFF, Url: "/temp/none0"}
+	b, _ := json.Marshal([1]Picture{doc0})
+	res, _ := InsertMany(context.Background(), b, Database, "test")
+	doc0.Id = res[0].(primitive.ObjectID)
+
+	body, _ := json.Marshal([1]Annotation{{Id: doc0.Id, Value: "Annotated"}})
+	err := UpdateValue(context.Background(), body, Database, "morpheus", nil)
+	assert.Nil(t, err)
+
+	body, _ = json.Marshal([1]Modification{{Id: doc0.Id, Flag: FlagCorrected, Value: true}})
+	err = UpdateFlags(context.Background(), body, Database, nil, "trinity")
+	assert.Nil(t, err)
+
+	events, last, err := FindEventsAfter(context.Background(), 0, nil, 100, Database)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(events))
+	assert.Equal(t, events[2].Seq, last)
+
+	assert.Equal(t, EventInserted, events[0].Type)
+	assert.Equal(t, "/temp/none0", events[0].Changes["Url"])
+
+	assert.Equal(t, EventAnnotated, events[1].Type)
+	assert.Equal(t, doc0.Id, events[1].PictureId)
+	assert.Equal(t, "morpheus", events[1].Actor)
+	assert.Equal(t, "Annotated", events[1].Changes["Value"])
+
+	assert.Equal(t, EventReviewed, events[2].Type)
+	assert.Equal(t, "trinity", events[2].Actor)
+
+	reviewed, last, err := FindEventsAfter(context.Background(), events[0].Seq, []EventType{EventReviewed}, 100, Database)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(reviewed))
+	assert.Equal(t, events[2].Id, reviewed[0].Id)
+	assert.Equal(t, events[2].Seq, last)
+}
+
+func TestEventsGap(t *testing.T) {
+	coll := Client.Database("taliesin_test").Collection("test_events_gap")
+	eventsCollection(coll).Drop(context.TODO())
+	old := time.Now().Add(-time.Hour).UTC()
+	eventsCollection(coll).InsertMany(context.TODO(), []interface{}{
+		Event{Id: primitive.NewObjectID(), Seq: 1, Type: EventInserted, Time: old},
+		Event{Id: primitive.NewObjectID(), Seq: 3, Type: EventInserted, Time: old},
+		Event{Id: primitive.NewObjectID(), Seq: 5, Type: EventInserted, Time: time.Now().UTC()},
+	})
+
+	// 2 was never inserted, 4 may still be
+	events, last, err := FindEventsAfter(context.Background(), 0, nil, 100, coll)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(events))
+	assert.Equal(t, int64(3), last)
+
+	eventsCollection(coll).InsertOne(context.TODO(), Event{Id: primitive.NewObjectID(), Seq: 4, Type: EventAnnotated, Time: old})
+	events, last, err = FindEventsAfter(context.Background(), last, nil, 100, coll)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(events))
+	assert.Equal(t, int64(5), last)
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	Database = Client.Database("taliesin_test").Collection("test_webhook_delivery")
+
+	received := make(chan Event, 10)
+	consumer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get(signatureHeader) != SignPayload("shared_secret", payload) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var event Event
+		json.Unmarshal(payload, &event)
+		received <- event
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer consumer.Close()
+
+	body, _ := json.Marshal(Webhook{URL: consumer.URL, Secret: "shared_secret", Types: []EventType{EventInserted}})
+	request, _ := http.NewRequest("POST", "/db/webhooks", bytes.NewBuffer(body))
+	request.Header.Set("Authorization", "admin_token")
+	recorder := httptest.NewRecorder()
+	registerWebhook(recorder, request)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+
+	doc0 := Picture{Id: primitive.NewObjectID(), PiFF: EmptyPiFF, Url: "/temp/none0"}
+	b, _ := json.Marshal([1]Picture{doc0})
+	res, _ := InsertMany(context.Background(), b, Database, "test")
+	Webhooks.Wait()
+
+	select {
+	case event := <-received:
+		assert.Equal(t, EventInserted, event.Type)
+		assert.Equal(t, res[0].(primitive.ObjectID), event.PictureId)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the webhook was not called")
+	}
+
+	letters, err := FindDeadLetters(context.Background(), Database)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(letters))
+}
+
+func TestWebhookDeadLetter(t *testing.T) {
+	Database = Client.Database("taliesin_test").Collection("test_webhook_dead_letter")
+	previousDelay, previousAttempts := Webhooks.retryDelay, Webhooks.maxAttempts
+	Webhooks.retryDelay, Webhooks.maxAttempts = time.Millisecond, 3
+	defer func() { Webhooks.retryDelay, Webhooks.maxAttempts = previousDelay, previousAttempts }()
+
+	calls := make(chan bool, 10)
+	consumer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls <- true
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer consumer.Close()
+
+	webhook, err := InsertWebhook(context.Background(), Webhook{URL: consumer.URL}, Database)
+	assert.Nil(t, err)
+	assert.NotEqual(t, "", webhook.Secret)
+
+	doc0 := Picture{Id: primitive.NewObjectID(), PiFF: EmptyPiFF, Url: "/temp/none0"}
+	b, _ := json.Marshal([1]Picture{doc0})
+	InsertMany(context.Background(), b, Database, "test")
+	Webhooks.Wait()
+
+	assert.Equal(t, 3, len(calls))
+	letters, err := FindDeadLetters(context.Background(), Database)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(letters))
+	assert.Equal(t, webhook.Id, letters[0].WebhookId)
+	assert.Equal(t, EventInserted, letters[0].Event.Type)
+	assert.Equal(t, 3, letters[0].Attempts)
+}
+
+func TestWebhooksCache(t *testing.T) {
+	coll := Client.Database("taliesin_test").Collection("test_webhooks_cache")
+	webhooksCollection(coll).Drop(context.TODO())
+
+	webhooks, err := Webhooks.webhooksOf(context.Background(), coll)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(webhooks))
+
+	// registered by another replica, seen once the cache expires
+	webhooksCollection(coll).InsertOne(context.TODO(), Webhook{Id: primitive.NewObjectID(), URL: "http://localhost:1/other"})
+	webhooks, _ = Webhooks.webhooksOf(context.Background(), coll)
+	assert.Equal(t, 0, len(webhooks))
+
+	// registered by this one, seen right away
+	_, err = InsertWebhook(context.Background(), Webhook{URL: "http://localhost:1/hook"}, coll)
+	assert.Nil(t, err)
+	webhooks, _ = Webhooks.webhooksOf(context.Background(), coll)
+	assert.Equal(t, 2, len(webhooks))
+}
+
+func TestWebhookQueueFull(t *testing.T) {
+	coll := Client.Database("taliesin_test").Collection("test_webhook_queue_full")
+	deadLettersCollection(coll).Drop(context.TODO())
+	previousWorkers, previousSize := webhookWorkers, webhookQueueSize
+	webhookWorkers, webhookQueueSize = 1, 1
+	defer func() { webhookWorkers, webhookQueueSize = previousWorkers, previousSize }()
+
+	release := make(chan bool)
+	consumer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer consumer.Close()
+	dispatcher := &WebhookDispatcher{client: &http.Client{Timeout: 5 * time.Second}, maxAttempts: 1, cached: map[string]cachedWebhooks{}}
+	webhook := Webhook{Id: primitive.NewObjectID(), URL: consumer.URL}
+
+	// one delivery for the worker, one waiting, the third one doesn't fit
+	for i := 0; i < 3; i++ {
+		dispatcher.enqueue(context.Background(), coll, webhook, Event{Id: primitive.NewObjectID(), Type: EventInserted})
+		time.Sleep(50 * time.Millisecond)
+	}
+	letters, err := FindDeadLetters(context.Background(), coll)
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(letters)) {
+		assert.Equal(t, 0, letters[0].Attempts)
+		assert.Equal(t, errWebhookQueueFull.Error(), letters[0].LastError)
+	}
+
+	close(release)
+	dispatcher.Wait()
+}
+
+func TestRegisterWebhookInvalid(t *testing.T) {
+	_, err := InsertWebhook(context.Background(), Webhook{URL: "ftp://example.com"}, Client.Database("taliesin_test").Collection("test_webhook_invalid"))
+	assert.NotNil(t, err)
+}
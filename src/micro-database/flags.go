@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"regexp"
+	"sort"
+)
+
+// A Flag is the name of a boolean attribute of a Picture that can be set through UpdateFlags
+type Flag string
+
+// Built-in flags, stored as top-level fields of a Picture
+const (
+	FlagAnnotated  Flag = "Annotated"
+	FlagCorrected  Flag = "Corrected"
+	FlagSentToReco Flag = "SentToReco"
+	FlagUnreadable Flag = "Unreadable"
+)
+
+var BuiltinFlags = []Flag{FlagAnnotated, FlagCorrected, FlagSentToReco, FlagUnreadable}
+
+// Custom flags are stored in this sub-document of a Picture
+const customFlagsField = "Flags"
+
+var ErrUnknownFlag = errors.New("Unknown flag")
+var ErrInvalidFlagName = errors.New("Invalid flag name")
+var ErrInvalidFlagValue = errors.New("Flag values must be booleans")
+
+var flagNameRegexp = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9]{0,63}$`)
+
+// Settings of the project using the collection
+type Settings struct {
+	CustomFlags []Flag `bson:"CustomFlags" json:"CustomFlags"`
+}
+
+// There is a single settings document per collection
+const settingsId = "settings"
+
+func (f Flag) IsBuiltin() bool {
+	for _, builtin := range BuiltinFlags {
+		if f == builtin {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+Name of the document field holding the flag
+*/
+func (f Flag) Field() string {
+	if f.IsBuiltin() {
+		return string(f)
+	}
+	return customFlagsField + "." + string(f)
+}
+
+/**
+Check the flag is either built-in or declared in the settings
+*/
+func (s Settings) ValidateFlag(f Flag) error {
+	if f.IsBuiltin() {
+		return nil
+	}
+	for _, custom := range s.CustomFlags {
+		if f == custom {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w : %q", ErrUnknownFlag, f)
+}
+
+/**
+Check the custom flags of a picture being inserted are declared in the settings, and are booleans
+The built-in flags are fields of the picture, they can't be custom flags
+*/
+func (s Settings) ValidateCustomFlags(flags map[string]interface{}) error {
+	for name, value := range flags {
+		if f := Flag(name); f.IsBuiltin() || s.ValidateFlag(f) != nil {
+			return fmt.Errorf("%w : %q", ErrUnknownFlag, name)
+		}
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%w : %q is %v", ErrInvalidFlagValue, name, value)
+		}
+	}
+	return nil
+}
+
+/**
+Every flag that can be used on the collection, built-in ones first
+*/
+func (s Settings) Flags() []Flag {
+	flags := append([]Flag{}, BuiltinFlags...)
+	return append(flags, s.CustomFlags...)
+}
+
+/**
+The settings are kept next to the collection they describe, so that each environment has its own
+*/
+func settingsCollection(collection *mongo.Collection) *mongo.Collection {
+	return companionCollection(collection, "settings")
+}
+
+func GetSettings(ctx context.Context, collection *mongo.Collection) (Settings, error) {
+	ctx, cancel := withTimeout(ctx, OperationRead)
+	defer cancel()
+
+	filter := bson.D{{"_id", settingsId}}
+	var result Settings
+
+	err := settingsCollection(collection).FindOne(ctx, filter).Decode(&result)
+	if err == mongo.ErrNoDocuments {
+		return Settings{}, nil
+	} else if err != nil {
+		return Settings{}, mongoError(ctx, err, "Error during MongoDB selection")
+	}
+
+	return result, nil
+}
+
+/**
+Replace the custom flags declared for the collection
+The flags no longer declared are removed from the pictures, so that declaring them again doesn't bring back their former values
+flags : names of the custom flags, they can't shadow a built-in flag
+*/
+func UpdateCustomFlags(ctx context.Context, flags []Flag, collection *mongo.Collection) error {
+	parent := ctx
+	ctx, cancel := withTimeout(ctx, OperationWrite)
+	defer cancel()
+
+	seen := make(map[Flag]bool)
+	for _, f := range flags {
+		if !flagNameRegexp.MatchString(string(f)) || f.IsBuiltin() || seen[f] {
+			return fmt.Errorf("%w : %q", ErrInvalidFlagName, f)
+		}
+		seen[f] = true
+	}
+	if flags == nil {
+		flags = []Flag{}
+	}
+
+	previous, err := GetSettings(ctx, collection)
+	if err != nil {
+		return err
+	}
+
+	filter := bson.D{{"_id", settingsId}}
+	update := bson.D{{"$set", bson.D{{"CustomFlags", flags}}}}
+	opts := options.Update().SetUpsert(true)
+
+	_, err = settingsCollection(collection).UpdateOne(ctx, filter, update, opts)
+	if err != nil {
+		return mongoError(ctx, err, "Error during MongoDB update")
+	}
+	logf(ctx, "Custom flags are now %v\n", flags)
+
+	// the flag can't be set anymore, it is removed from the pictures having it
+	unset := bson.D{}
+	exists := bson.A{}
+	for _, f := range previous.CustomFlags {
+		if !seen[f] {
+			unset = append(unset, bson.E{f.Field(), ""})
+			exists = append(exists, bson.D{{f.Field(), bson.D{{"$exists", true}}}})
+		}
+	}
+	if len(unset) == 0 {
+		return nil
+	}
+
+	// it goes through the whole collection, with its own timeout instead of the one of the settings
+	scanCtx, cancelScan := withTimeout(parent, OperationScan)
+	defer cancelScan()
+	result, err := collection.UpdateMany(scanCtx, bson.D{{"$or", exists}}, bson.D{{"$unset", unset}, incrementVersion()})
+	if err != nil {
+		return mongoError(scanCtx, err, "Error during MongoDB update")
+	}
+	logf(ctx, "Removed the flags no longer declared from %v documents\n", result.ModifiedCount)
+	return nil
+}
+
+/**
+Select the pictures having the given value for a flag
+*/
+func FindManyByFlag(ctx context.Context, flag Flag, value bool, collection *mongo.Collection) ([]Picture, error) {
+	ctx, cancel := withTimeout(ctx, OperationRead)
+	defer cancel()
+
+	settings, err := GetSettings(ctx, collection)
+	if err != nil {
+		return nil, err
+	}
+	if err := settings.ValidateFlag(flag); err != nil {
+		return nil, err
+	}
+
+	var filter bson.D
+	if value {
+		filter = bson.D{{flag.Field(), true}}
+	} else {
+		// custom flags are absent until they are set for the first time
+		filter = bson.D{{flag.Field(), bson.D{{"$ne", true}}}}
+	}
+
+	cur, err := collection.Find(ctx, filter, options.Find())
+	if err != nil {
+		return nil, mongoError(ctx, err, "Error during MongoDB selection")
+	}
+	defer cur.Close(ctx)
+
+	results := []Picture{}
+	for cur.Next(ctx) {
+		var elem Picture
+		if err := cur.Decode(&elem); err != nil {
+			logf(ctx, "[DECODE] %v", err)
+			return nil, errors.New("Error while iterating results")
+		}
+		results = append(results, elem)
+	}
+
+	if err := cur.Err(); err != nil {
+		logf(ctx, "[CURSOR] %v", err)
+		return nil, errors.New("Error while iterating results")
+	}
+
+	return results, nil
+}
+
+/**
+Set a flag back to false on the pictures having it
+selection : narrows the pictures, nil for all of them
+actor : user resetting the flag
+Returns the number of modified pictures
+*/
+func ResetFlag(ctx context.Context, flag Flag, selection *DeleteFilter, collection *mongo.Collection, actor string) (int64, error) {
+	ctx, cancel := withTimeout(ctx, OperationWrite)
+	defer cancel()
+
+	settings, err := GetSettings(ctx, collection)
+	if err != nil {
+		return 0, err
+	}
+	if err := settings.ValidateFlag(flag); err != nil {
+		return 0, err
+	}
+
+	filter := bson.D{{flag.Field(), true}}
+	if selection != nil {
+		criteria, err := selection.bson(settings)
+		if err != nil {
+			return 0, err
+		}
+		filter = append(filter, criteria...)
+	}
+
+	// the ids first, for the events
+	cur, err := collection.Find(ctx, filter, options.Find().SetProjection(bson.D{{"_id", 1}}))
+	if err != nil {
+		return 0, mongoError(ctx, err, "Error during MongoDB selection")
+	}
+	var ids []primitive.ObjectID
+	for cur.Next(ctx) {
+		var doc struct {
+			Id primitive.ObjectID `bson:"_id"`
+		}
+		if err := cur.Decode(&doc); err != nil {
+			cur.Close(ctx)
+			logf(ctx, "[DECODE] %v", err)
+			return 0, errors.New("Error while iterating results")
+		}
+		ids = append(ids, doc.Id)
+	}
+	cur.Close(ctx)
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	update := bson.D{{"$set", bson.D{{flag.Field(), false}}}, incrementVersion()}
+	result, err := collection.UpdateMany(ctx, bson.D{{"_id", bson.D{{"$in", ids}}}, {flag.Field(), true}}, update)
+	if err != nil {
+		return 0, mongoError(ctx, err, "Error during MongoDB update")
+	}
+
+	events := make([]Event, 0, len(ids))
+	for _, id := range ids {
+		events = append(events, Event{
+			Type:      EventFlagged,
+			PictureId: id,
+			Actor:     actor,
+			Changes:   map[string]interface{}{string(flag): false},
+		})
+	}
+	PublishEvents(ctx, collection, events...)
+
+	logf(ctx, "Reset %v on %v documents\n", flag, result.ModifiedCount)
+	return result.ModifiedCount, nil
+}
+
+/**
+Event of a modified flag
+A correction is the validation of an annotation by a reviewer, it is recorded for the recognizer metrics
+*/
+func flagEvent(ctx context.Context, id primitive.ObjectID, flag Flag, value bool, actor string, collection *mongo.Collection) Event {
+	event := Event{
+		Type:      EventFlagged,
+		PictureId: id,
+		Actor:     actor,
+		Changes:   map[string]interface{}{string(flag): value},
+	}
+	if flag == FlagCorrected && value {
+		event.Type = EventReviewed
+		if err := RecordValidation(ctx, id, collection); err != nil {
+			logf(ctx, "[ERROR] Recognizer metrics : %v", err.Error())
+		}
+	}
+	return event
+}
+
+/**
+Set several flags of a picture at once, either all of them are set or none
+ifMatch : expected version of the picture, nil for any
+actor : user modifying the flags
+*/
+func SetFlags(ctx context.Context, id primitive.ObjectID, flags map[Flag]bool, ifMatch *int64, collection *mongo.Collection, actor string) error {
+	ctx, cancel := withTimeout(ctx, OperationWrite)
+	defer cancel()
+
+	if len(flags) == 0 {
+		return fmt.Errorf("%w : no flag", ErrEmptyPatch)
+	}
+	settings, err := GetSettings(ctx, collection)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(flags))
+	for flag := range flags {
+		if err := settings.ValidateFlag(flag); err != nil {
+			return err
+		}
+		names = append(names, string(flag))
+	}
+	sort.Strings(names)
+
+	set := bson.D{}
+	for _, name := range names {
+		set = append(set, bson.E{Flag(name).Field(), flags[Flag(name)]})
+	}
+	conflicts := &ConflictError{}
+	updated, err := updateVersioned(ctx, collection, id, ifMatch, bson.D{{"$set", set}}, conflicts)
+	if err != nil {
+		return err
+	} else if len(conflicts.Pictures) > 0 {
+		return conflicts
+	} else if !updated {
+		return ErrPictureNotFound
+	}
+
+	events := make([]Event, 0, len(names))
+	for _, name := range names {
+		events = append(events, flagEvent(ctx, id, Flag(name), flags[Flag(name)], actor, collection))
+	}
+	PublishEvents(ctx, collection, events...)
+	return nil
+}
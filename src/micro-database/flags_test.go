@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Drop a collection of the tests and its settings
+func dropWithSettings(collection *mongo.Collection) {
+	settingsCollection(collection).Drop(context.Background())
+	collection.Drop(context.Background())
+}
+
+func TestUpdateFlagsUnknown(t *testing.T) {
+	Database = Client.Database("taliesin_test").Collection("test_update_flags_unknown")
+	defer dropWithSettings(Database)
+	doc0 := Picture{Id: primitive.NewObjectID(), PiFF: EmptyPiFF, Url: "/temp/none0"}
+	b, _ := json.Marshal([1]Picture{doc0})
+	res, _ := InsertMany(context.Background(), b, Database, "test")
+	doc0.Id = res[0].(primitive.ObjectID)
+
+	for _, flag := range []Flag{"PiFF", "_id", "Flags", "ContainsNumber"} {
+		body, _ := json.Marshal([1]Modification{{Id: doc0.Id, Flag: flag, Value: true}})
+		request, _ := http.NewRequest("PUT", "/db/update/flags", bytes.NewBuffer(body))
+
+		recorder := httptest.NewRecorder()
+		updateFlags(recorder, request)
+		assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	}
+
+	pic, err := FindOne(context.Background(), doc0.Id, Database)
+	assert.Nil(t, err)
+	assert.Equal(t, EmptyPiFF, pic.PiFF)
+	assert.Nil(t, pic.Flags)
+}
+
+func TestUpdateCustomFlagsInvalid(t *testing.T) {
+	coll := Client.Database("taliesin_test").Collection("test_custom_flags_invalid")
+	defer dropWithSettings(coll)
+
+	assert.NotNil(t, UpdateCustomFlags(context.Background(), []Flag{"Unreadable"}, coll))
+	assert.NotNil(t, UpdateCustomFlags(context.Background(), []Flag{"Damaged", "Damaged"}, coll))
+	assert.NotNil(t, UpdateCustomFlags(context.Background(), []Flag{"PiFF.Meta"}, coll))
+	assert.NotNil(t, UpdateCustomFlags(context.Background(), []Flag{""}, coll))
+
+	settings, err := GetSettings(context.Background(), coll)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(settings.CustomFlags))
+}
+
+func TestCustomFlags(t *testing.T) {
+	Database = Client.Database("taliesin_test").Collection("test_custom_flags")
+	defer dropWithSettings(Database)
+	doc0 := Picture{Id: primitive.NewObjectID(), PiFF: EmptyPiFF, Url: "/temp/none0"}
+	doc1 := Picture{Id: primitive.NewObjectID(), PiFF: EmptyPiFF, Url: "/temp/none1"}
+	b, _ := json.Marshal([2]Picture{doc0, doc1})
+	res, _ := InsertMany(context.Background(), b, Database, "test")
+	doc0.Id = res[0].(primitive.ObjectID)
+	doc1.Id = res[1].(primitive.ObjectID)
+
+	body, _ := json.Marshal([]Flag{"ContainsNumber", "Damaged"})
+	request, _ := http.NewRequest("PUT", "/db/settings/flags", bytes.NewBuffer(body))
+	request.Header.Set("Authorization", "admin_token")
+	recorder := httptest.NewRecorder()
+	updateCustomFlags(recorder, request)
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+
+	body, _ = json.Marshal([2]Modification{
+		{Id: doc0.Id, Flag: "ContainsNumber", Value: true},
+		{Id: doc1.Id, Flag: FlagUnreadable, Value: true},
+	})
+	request, _ = http.NewRequest("PUT", "/db/update/flags", bytes.NewBuffer(body))
+	recorder = httptest.NewRecorder()
+	updateFlags(recorder, request)
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+
+	pic, _ := FindOne(context.Background(), doc0.Id, Database)
+	assert.True(t, pic.Flags["ContainsNumber"])
+	assert.False(t, pic.Unreadable)
+
+	pics, err := FindManyByFlag(context.Background(), "ContainsNumber", true, Database)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(pics))
+	assert.Equal(t, doc0.Id, pics[0].Id)
+
+	pics, err = FindManyByFlag(context.Background(), "ContainsNumber", false, Database)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(pics))
+	assert.Equal(t, doc1.Id, pics[0].Id)
+
+	count, err := CountFlag(context.Background(), Database, "Damaged")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), count)
+
+	request, _ = http.NewRequest("GET", "/db/status", nil)
+	recorder = httptest.NewRecorder()
+	status(recorder, request)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var res0 Status
+	err = json.Unmarshal(recorder.Body.Bytes(), &res0)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), res0.Unreadable)
+	assert.Equal(t, int64(1), res0.CustomFlags["ContainsNumber"])
+	assert.Equal(t, int64(0), res0.CustomFlags["Damaged"])
+}
+
+func TestRemovedCustomFlags(t *testing.T) {
+	coll := Client.Database("taliesin_test").Collection("test_removed_custom_flags")
+	defer dropWithSettings(coll)
+	assert.Nil(t, UpdateCustomFlags(context.Background(), []Flag{"ContainsNumber", "Damaged"}, coll))
+
+	doc0 := Picture{Id: primitive.NewObjectID(), PiFF: EmptyPiFF, Url: "/temp/none0", Flags: map[Flag]bool{"ContainsNumber": true, "Damaged": true}}
+	b, _ := json.Marshal([1]Picture{doc0})
+	_, err := InsertMany(context.Background(), b, coll, "test")
+	assert.Nil(t, err)
+
+	assert.Nil(t, UpdateCustomFlags(context.Background(), []Flag{"Damaged"}, coll))
+	pic, _ := FindOne(context.Background(), doc0.Id, coll)
+	assert.Equal(t, map[Flag]bool{"Damaged": true}, pic.Flags)
+	assert.Equal(t, int64(1), pic.Version)
+
+	// declared again, the flag doesn't get its former value back
+	assert.Nil(t, UpdateCustomFlags(context.Background(), []Flag{"Damaged", "ContainsNumber"}, coll))
+	pics, err := FindManyByFlag(context.Background(), "ContainsNumber", true, coll)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(pics))
+}
+
+func TestInsertUndeclaredFlags(t *testing.T) {
+	Database = Client.Database("taliesin_test").Collection("test_insert_undeclared_flags")
+	defer dropWithSettings(Database)
+	assert.Nil(t, UpdateCustomFlags(context.Background(), []Flag{"Damaged"}, Database))
+
+	insert := func(flags map[Flag]bool) int {
+		body, _ := json.Marshal([2]Picture{
+			{Id: primitive.NewObjectID(), PiFF: EmptyPiFF, Url: "/temp/none0"},
+			{Id: primitive.NewObjectID(), PiFF: EmptyPiFF, Url: "/temp/none1", Flags: flags},
+		})
+		request, _ := http.NewRequest("POST", "/db/insert", bytes.NewBuffer(body))
+		recorder := httptest.NewRecorder()
+		createEntry(recorder, request)
+		return recorder.Code
+	}
+	assert.Equal(t, http.StatusBadRequest, insert(map[Flag]bool{"ContainsNumber": true}))
+	assert.Equal(t, http.StatusBadRequest, insert(map[Flag]bool{FlagUnreadable: true}))
+	// nothing was inserted
+	pics, _ := FindAll(context.Background(), Database)
+	assert.Equal(t, 0, len(pics))
+
+	// the cli inserts the JSON without decoding it into pictures
+	_, err := InsertMany(context.Background(), []byte(`[{"Url":"/temp/none2","Flags":{"Damaged":"yes"}}]`), Database, "test")
+	assert.True(t, errors.Is(err, ErrInvalidFlagValue))
+	_, err = InsertMany(context.Background(), []byte(`[{"Url":"/temp/none2","Flags":["Damaged"]}]`), Database, "test")
+	assert.True(t, errors.Is(err, ErrInvalidFlagValue))
+	pics, _ = FindAll(context.Background(), Database)
+	assert.Equal(t, 0, len(pics))
+
+	assert.Equal(t, http.StatusCreated, insert(map[Flag]bool{"Damaged": true}))
+}
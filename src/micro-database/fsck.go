@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	lib_auth "github.com/taliesin-insa/lib-auth"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type FsckKind string
+
+// Inconsistencies found by the checker
+const (
+	// Url doesn't lead to a file of the snippets volume
+	FsckMissingFile FsckKind = "missing_file"
+	// The PiFF has no Data, there is nothing to transcribe
+	FsckNoData FsckKind = "no_data"
+	// A Data references a LocationId absent from the Location of the PiFF
+	FsckUnknownLocation FsckKind = "unknown_location"
+	// Annotated with an empty value, and not unreadable (fixable)
+	FsckEmptyAnnotation FsckKind = "empty_annotation"
+	// Sent to the recognizer longer than recognizerTimeout ago without a suggestion (fixable)
+	FsckStuckRecognition FsckKind = "stuck_recognition"
+	// Duplicate of a picture which doesn't exist anymore, the duplicates scan repairs it
+	FsckOrphanDuplicate FsckKind = "orphan_duplicate"
+)
+
+// Inconsistencies having a safe repair
+var fsckFixable = map[FsckKind]bool{FsckEmptyAnnotation: true, FsckStuckRecognition: true}
+
+// Actor of the events of the repairs made by the checker
+const FsckActor = "$taliesin_fsck"
+
+// A recognizer which didn't send a suggestion after this delay won't send it
+var recognizerTimeout = time.Hour
+
+func init() {
+	if minutes, err := strconv.Atoi(os.Getenv("RECOGNIZER_TIMEOUT_MINUTES")); err == nil && minutes > 0 {
+		recognizerTimeout = time.Duration(minutes) * time.Minute
+	}
+}
+
+type FsckIssue struct {
+	PictureId primitive.ObjectID `json:"PictureId"`
+	Kind      FsckKind           `json:"Kind"`
+	Detail    string             `json:"Detail,omitempty"`
+	Fixed     bool               `json:"Fixed"`
+}
+
+type FsckReport struct {
+	Checked int64 `json:"Checked"`
+	// False when the snippets volume is not mounted, the missing files are not reported
+	FilesChecked bool               `json:"FilesChecked"`
+	Counts       map[FsckKind]int64 `json:"Counts"`
+	Fixed        int64              `json:"Fixed"`
+	Issues       []FsckIssue        `json:"Issues"`
+}
+
+func (report *FsckReport) add(issue FsckIssue) {
+	report.Counts[issue.Kind]++
+	report.Issues = append(report.Issues, issue)
+}
+
+/**
+Inconsistencies of a picture which can be seen without the other pictures
+*/
+func checkPicture(pic Picture, filesChecked bool) []FsckIssue {
+	var issues []FsckIssue
+	if filesChecked {
+		if _, err := ResolveSnippetPath(pic.Url); err != nil {
+			issues = append(issues, FsckIssue{PictureId: pic.Id, Kind: FsckMissingFile, Detail: fmt.Sprintf("%q : %v", pic.Url, err.Error())})
+		}
+	}
+
+	if len(pic.PiFF.Data) == 0 {
+		issues = append(issues, FsckIssue{PictureId: pic.Id, Kind: FsckNoData})
+	}
+	for _, data := range pic.PiFF.Data {
+		if data.LocationId == "" {
+			continue
+		}
+		if _, ok := findLocation(pic, data.LocationId); !ok {
+			issues = append(issues, FsckIssue{PictureId: pic.Id, Kind: FsckUnknownLocation, Detail: fmt.Sprintf("Data %q references %q", data.Id, data.LocationId)})
+		}
+	}
+
+	if pic.Annotated && !pic.Unreadable && (len(pic.PiFF.Data) == 0 || strings.TrimSpace(pic.PiFF.Data[0].Value) == "") {
+		issues = append(issues, FsckIssue{PictureId: pic.Id, Kind: FsckEmptyAnnotation, Detail: fmt.Sprintf("annotated by %q", pic.Annotator)})
+	}
+	return issues
+}
+
+/**
+Pictures among the ids which were sent to the recognizer after the time
+*/
+func recentlySentToReco(ctx context.Context, ids []primitive.ObjectID, after time.Time, collection *mongo.Collection) (map[primitive.ObjectID]bool, error) {
+	recent := map[primitive.ObjectID]bool{}
+	if len(ids) == 0 {
+		return recent, nil
+	}
+	filter := bson.D{
+		{"Type", EventFlagged},
+		{"PictureId", bson.D{{"$in", ids}}},
+		{"Changes." + string(FlagSentToReco), true},
+		{"Time", bson.D{{"$gte", after}}},
+	}
+	values, err := eventsCollection(collection).Distinct(ctx, "PictureId", filter)
+	if err != nil {
+		return nil, mongoError(ctx, err, "Error during MongoDB selection")
+	}
+	for _, value := range values {
+		if id, ok := value.(primitive.ObjectID); ok {
+			recent[id] = true
+		}
+	}
+	return recent, nil
+}
+
+/**
+Apply the safe repair of an issue, only if the picture is still in the state which was checked
+*/
+func fixIssue(ctx context.Context, issue FsckIssue, collection *mongo.Collection) (bool, error) {
+	var filter, update bson.D
+	var changes map[string]interface{}
+	switch issue.Kind {
+	case FsckStuckRecognition:
+		filter = bson.D{{"_id", issue.PictureId}, {"SentToReco", true}, {"Annotated", false}}
+		update = bson.D{{"$set", bson.D{{"SentToReco", false}}}, incrementVersion()}
+		changes = map[string]interface{}{string(FlagSentToReco): false}
+	case FsckEmptyAnnotation:
+		filter = bson.D{
+			{"_id", issue.PictureId},
+			{"Annotated", true},
+			{"$or", bson.A{
+				bson.D{{"PiFF.Data.0.Value", primitive.Regex{Pattern: `^\s*$`}}},
+				bson.D{{"PiFF.Data.0", bson.D{{"$exists", false}}}},
+			}},
+		}
+		update = bson.D{{"$set", bson.D{{"Annotated", false}, {"Annotator", ""}}}, incrementVersion()}
+		changes = map[string]interface{}{string(FlagAnnotated): false}
+	default:
+		return false, nil
+	}
+
+	result, err := collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, mongoError(ctx, err, "Error during MongoDB update")
+	}
+	if result.ModifiedCount == 0 {
+		return false, nil
+	}
+	PublishEvents(ctx, collection, Event{Type: EventFlagged, PictureId: issue.PictureId, Actor: FsckActor, Changes: changes})
+	return true, nil
+}
+
+/**
+Scan the whole collection for inconsistencies
+fix : apply the safe repairs, the other inconsistencies are only reported
+*/
+func Fsck(ctx context.Context, collection *mongo.Collection, fix bool) (FsckReport, error) {
+	ctx, cancel := withTimeout(ctx, OperationScan)
+	defer cancel()
+
+	report := FsckReport{Counts: map[FsckKind]int64{}, Issues: []FsckIssue{}}
+	if _, err := os.Stat(snippetsRoot); err == nil {
+		report.FilesChecked = true
+	} else {
+		logf(ctx, "[WARNING] The snippets volume %v can't be read, the files are not checked : %v", snippetsRoot, err.Error())
+	}
+
+	cur, err := collection.Find(ctx, bson.D{})
+	if err != nil {
+		return report, mongoError(ctx, err, "Error during MongoDB selection")
+	}
+	existing := map[primitive.ObjectID]bool{}
+	duplicates := map[primitive.ObjectID]primitive.ObjectID{}
+	var sentToReco []primitive.ObjectID
+	for cur.Next(ctx) {
+		var pic Picture
+		if err := cur.Decode(&pic); err != nil {
+			cur.Close(ctx)
+			logf(ctx, "[DECODE] %v", err)
+			return report, errors.New("Could not decode data from mongo")
+		}
+		report.Checked++
+		existing[pic.Id] = true
+		if pic.DuplicateOf != nil {
+			duplicates[pic.Id] = *pic.DuplicateOf
+		}
+		if pic.SentToReco && !pic.Annotated {
+			sentToReco = append(sentToReco, pic.Id)
+		}
+		for _, issue := range checkPicture(pic, report.FilesChecked) {
+			report.add(issue)
+		}
+	}
+	if err := cur.Err(); err != nil {
+		cur.Close(ctx)
+		logf(ctx, "[CURSOR] %v", err)
+		return report, errors.New("Error while iterating results")
+	}
+	cur.Close(ctx)
+
+	for id, root := range duplicates {
+		if !existing[root] {
+			report.add(FsckIssue{PictureId: id, Kind: FsckOrphanDuplicate, Detail: fmt.Sprintf("duplicate of %v", root.Hex())})
+		}
+	}
+
+	// the events older than the retention are gone, those pictures are stuck anyway
+	recent, err := recentlySentToReco(ctx, sentToReco, time.Now().Add(-recognizerTimeout), collection)
+	if err != nil {
+		return report, err
+	}
+	for _, id := range sentToReco {
+		if !recent[id] {
+			report.add(FsckIssue{PictureId: id, Kind: FsckStuckRecognition, Detail: fmt.Sprintf("no suggestion after %v", recognizerTimeout)})
+		}
+	}
+
+	sort.SliceStable(report.Issues, func(i, j int) bool {
+		return report.Issues[i].PictureId.Hex() < report.Issues[j].PictureId.Hex()
+	})
+
+	if fix {
+		for i, issue := range report.Issues {
+			if !fsckFixable[issue.Kind] {
+				continue
+			}
+			fixed, err := fixIssue(ctx, issue, collection)
+			if err != nil {
+				return report, err
+			}
+			if fixed {
+				report.Issues[i].Fixed = true
+				report.Fixed++
+			}
+		}
+	}
+	return report, nil
+}
+
+/**
+Summary of a report, one line per kind of inconsistency
+*/
+func (report FsckReport) Summary() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Checked %v pictures", report.Checked)
+	if !report.FilesChecked {
+		b.WriteString(", without the files")
+	}
+	b.WriteString("\n")
+
+	kinds := make([]string, 0, len(report.Counts))
+	for kind := range report.Counts {
+		kinds = append(kinds, string(kind))
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		fixable := ""
+		if fsckFixable[FsckKind(kind)] {
+			fixable = " (fixable)"
+		}
+		fmt.Fprintf(&b, "%v : %v%v\n", kind, report.Counts[FsckKind(kind)], fixable)
+	}
+	if len(kinds) == 0 {
+		b.WriteString("No inconsistency\n")
+	}
+	if report.Fixed > 0 {
+		fmt.Fprintf(&b, "Fixed %v pictures\n", report.Fixed)
+	}
+	return b.String()
+}
+
+/**
+GET reports the inconsistencies, POST with fix=true also applies the safe repairs
+*/
+func fsck(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.Inc() // incrementing the httpRequestsTotal counter
+
+	user, err, authStatusCode := authenticateUser(r)
+
+	// check if there was an error during the authentication or if the user wasn't authenticated
+	if err != nil {
+		logf(r.Context(), "[ERROR] Check authentication: %v", err.Error())
+		w.WriteHeader(authStatusCode)
+		w.Write([]byte("[MICRO-DATABASE] Couldn't verify identity"))
+		return
+	}
+
+	// check if the authenticated user has sufficient permissions to
+	if user.Role != lib_auth.RoleAdmin {
+		logf(r.Context(), "[WRONG_ROLE] Insufficient permission: want %v, was %v", lib_auth.RoleAdmin, user.Role)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("[MICRO-DATABASE] Insufficient permissions to check the database"))
+		return
+	}
+
+	fix := false
+	if r.Method == http.MethodPost {
+		fix = r.URL.Query().Get("fix") == "true"
+		if !fix {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("[MICRO-DATABASE] Repairs need fix=true, GET only reports"))
+			return
+		}
+	}
+
+	report, err := Fsck(r.Context(), Database, fix)
+	if err != nil {
+		writeDatabaseError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	body, err := json.Marshal(report)
+	if err != nil {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("[MICRO-DATABASE] Could not marshal answer data"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
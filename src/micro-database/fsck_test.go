@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"testing"
+)
+
+func TestFsck(t *testing.T) {
+	defer setupSnippets(t)()
+	Database = Client.Database("taliesin_test").Collection("test_fsck")
+	Database.Drop(context.TODO())
+	eventsCollection(Database).Drop(context.TODO())
+
+	line := PiFFStruct{
+		Location: []Location{{Type: "line", Id: "loc_0", Polygon: [][2]int{{10, 10}, {79, 10}, {79, 19}, {10, 19}}}},
+		Data:     []Data{{Type: "line", LocationId: "loc_0", Value: "Valjean", Id: "0"}},
+	}
+	pics := [4]Picture{
+		{PiFF: line, Url: "/snippets/page.png", Annotated: true, Annotator: "morpheus"},
+		{PiFF: PiFFStruct{Data: []Data{{LocationId: "loc_9", Id: "0"}}}, Url: "/snippets/page.png"},
+		{PiFF: PiFFStruct{Data: []Data{{Value: " ", Id: "0"}}}, Url: "/snippets/missing.png", Annotated: true, Annotator: "morpheus"},
+		{PiFF: PiFFStruct{Data: []Data{{Id: "0"}}}, Url: "/snippets/stuck.png", SentToReco: true},
+	}
+	b, _ := json.Marshal(pics)
+	ids, err := InsertMany(context.Background(), b, Database, "test")
+	assert.Nil(t, err)
+	WaitDuplicateChecks()
+
+	report, err := Fsck(context.Background(), Database, false)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), report.Checked)
+	assert.True(t, report.FilesChecked)
+	assert.Equal(t, map[FsckKind]int64{
+		FsckMissingFile:      2,
+		FsckUnknownLocation:  1,
+		FsckEmptyAnnotation:  1,
+		FsckStuckRecognition: 1,
+	}, report.Counts)
+	assert.Equal(t, int64(0), report.Fixed)
+
+	// only the safe repairs
+	report, err = Fsck(context.Background(), Database, true)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), report.Fixed)
+	empty, _ := FindOne(context.Background(), ids[2].(primitive.ObjectID), Database)
+	assert.False(t, empty.Annotated)
+	stuck, _ := FindOne(context.Background(), ids[3].(primitive.ObjectID), Database)
+	assert.False(t, stuck.SentToReco)
+
+	report, _ = Fsck(context.Background(), Database, false)
+	assert.Equal(t, map[FsckKind]int64{FsckMissingFile: 2, FsckUnknownLocation: 1}, report.Counts)
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"os"
+)
+
+// Port of the gRPC API, alongside the REST API on 8080
+var grpcPort = "9090"
+
+func init() {
+	if port := os.Getenv("GRPC_PORT"); port != "" {
+		grpcPort = port
+	}
+}
+
+// The Go code of the protocol is committed, regenerated with protoc-gen-go v1.36.11 and protoc-gen-go-grpc v1.5.1
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative pb/database.proto
+
+/**
+Serves the gRPC API of pb/database.proto, set by grpc_server.go
+It is only built with the grpc tag
+*/
+var serveGRPC func(address string) error
@@ -0,0 +1,397 @@
+//go:build grpc
+
+package main
+
+import (
+	"MongoGo/src/micro-database/pb"
+	"context"
+	"encoding/json"
+	"errors"
+	lib_auth "github.com/taliesin-insa/lib-auth"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	grpcstatus "google.golang.org/grpc/status"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+func init() {
+	serveGRPC = func(address string) error {
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			return err
+		}
+		server := newGRPCServer()
+		log.Printf("gRPC API listening on %v", address)
+		return server.Serve(listener)
+	}
+}
+
+func newGRPCServer() *grpc.Server {
+	server := grpc.NewServer(
+		// a span for each call, child of the trace context of the "traceparent" metadata
+		grpc.StatsHandler(otelgrpc.NewServerHandler()),
+		grpc.UnaryInterceptor(grpcAuthUnary),
+		grpc.StreamInterceptor(grpcAuthStream),
+		// the insertions carry the PiFF of many pictures, as on the REST API
+		grpc.MaxRecvMsgSize(int(maxInsertBytes)),
+	)
+	pb.RegisterDatabaseServer(server, &grpcDatabase{})
+	return server
+}
+
+// Who may call a method, the same callers as the REST routes doing the same thing
+type grpcPolicy struct {
+	Users    bool
+	Services bool
+}
+
+var grpcPolicies = map[string]grpcPolicy{
+	"/taliesin.database.v1.Database/Insert":               {Users: true},
+	"/taliesin.database.v1.Database/Get":                  {Users: true},
+	"/taliesin.database.v1.Database/ClaimRecognizerBatch": {Services: true},
+	"/taliesin.database.v1.Database/SubmitSuggestions":    {Services: true},
+	"/taliesin.database.v1.Database/StreamChanges":        {Users: true, Services: true},
+}
+
+type grpcUserKey struct{}
+
+/**
+Authenticate the caller of a method from the "authorization" metadata, with the cache of the REST handlers
+Returns the context given to the method, holding the user when it isn't a service
+*/
+func grpcAuthenticate(ctx context.Context, method string) (context.Context, error) {
+	policy := grpcPolicies[method]
+	var token string
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get("authorization")) > 0 {
+		token = md.Get("authorization")[0]
+	}
+
+	if isClusterPassword(token) {
+		if !policy.Services {
+			return nil, grpcstatus.Error(codes.PermissionDenied, "Only for the users")
+		}
+		return ctx, nil
+	}
+	if !policy.Users {
+		return nil, grpcstatus.Error(codes.PermissionDenied, "Service didn't have correct password")
+	}
+
+	user, err, authStatusCode := Auth.AuthenticateToken(token)
+	if err != nil {
+		logf(ctx, "[ERROR] Check authentication: %v", err.Error())
+		if authStatusCode == http.StatusServiceUnavailable {
+			return nil, grpcstatus.Error(codes.Unavailable, "Couldn't verify identity")
+		}
+		return nil, grpcstatus.Error(codes.Unauthenticated, "Couldn't verify identity")
+	}
+	return context.WithValue(ctx, grpcUserKey{}, user), nil
+}
+
+// Same as the requestContext middleware : the id of the "x-request-id" metadata, or a new one, sent back in the header
+func grpcRequestContext(ctx context.Context) context.Context {
+	var id string
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get("x-request-id")) > 0 {
+		id = md.Get("x-request-id")[0]
+	}
+	if !validRequestId.MatchString(id) {
+		id = newRequestId()
+	}
+	grpc.SetHeader(ctx, metadata.Pairs("x-request-id", id))
+	return withLogContext(ctx, id, false)
+}
+
+func grpcAuthUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	httpRequestsTotal.Inc() // incrementing the httpRequestsTotal counter
+
+	ctx, err := grpcAuthenticate(grpcRequestContext(ctx), info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// Stream whose context holds the request id of the call
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s contextStream) Context() context.Context {
+	return s.ctx
+}
+
+func grpcAuthStream(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	httpRequestsTotal.Inc() // incrementing the httpRequestsTotal counter
+
+	ctx := grpcRequestContext(stream.Context())
+	if _, err := grpcAuthenticate(ctx, info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, contextStream{ServerStream: stream, ctx: ctx})
+}
+
+// Status of a failed call to the data layer, the interrupted operations have their own codes
+func grpcDatabaseError(err error, code codes.Code) error {
+	switch {
+	case errors.Is(err, ErrCanceled):
+		code = codes.Canceled
+	case errors.Is(err, ErrTimeout):
+		code = codes.DeadlineExceeded
+	case errors.Is(err, ErrUnavailable):
+		code = codes.Unavailable
+	}
+	return grpcstatus.Error(code, err.Error())
+}
+
+/**
+Implementation of pb.DatabaseServer on the data layer of the REST handlers
+*/
+type grpcDatabase struct {
+	pb.UnimplementedDatabaseServer
+}
+
+func (s *grpcDatabase) Insert(ctx context.Context, req *pb.InsertRequest) (*pb.InsertResponse, error) {
+	user := ctx.Value(grpcUserKey{}).(*lib_auth.UserData)
+
+	pictures := make([]Picture, 0, len(req.Pictures))
+	for i, p := range req.Pictures {
+		if p.Piff == nil || p.Url == "" {
+			return nil, grpcstatus.Errorf(codes.InvalidArgument, "pictures[%v] : piff and url are required", i)
+		}
+		pic, err := pictureFromProto(p)
+		if err != nil {
+			return nil, grpcstatus.Errorf(codes.InvalidArgument, "pictures[%v] : %v", i, err.Error())
+		}
+		pictures = append(pictures, pic)
+	}
+	b, err := json.Marshal(pictures)
+	if err != nil {
+		return nil, grpcstatus.Error(codes.Internal, err.Error())
+	}
+
+	ids, err := InsertMany(ctx, b, Database, user.Username)
+	if errors.Is(err, ErrUnknownFlag) || errors.Is(err, ErrInvalidFlagValue) {
+		logf(ctx, "[ERROR] : %v", err.Error())
+		return nil, grpcstatus.Error(codes.InvalidArgument, err.Error())
+	} else if err != nil {
+		logf(ctx, "[ERROR] : %v", err.Error())
+		return nil, grpcDatabaseError(err, codes.Internal)
+	}
+
+	res := &pb.InsertResponse{}
+	for _, id := range ids {
+		if oid, ok := id.(primitive.ObjectID); ok {
+			res.Ids = append(res.Ids, oid.Hex())
+		}
+	}
+	return res, nil
+}
+
+func (s *grpcDatabase) Get(ctx context.Context, req *pb.GetRequest) (*pb.Picture, error) {
+	id, err := primitive.ObjectIDFromHex(req.Id)
+	if err != nil {
+		return nil, grpcstatus.Error(codes.InvalidArgument, "Could not decode ID")
+	}
+
+	pic, err := FindOne(ctx, id, Database)
+	if err != nil {
+		return nil, grpcDatabaseError(err, codes.NotFound)
+	}
+	return pictureToProto(pic), nil
+}
+
+func (s *grpcDatabase) ClaimRecognizerBatch(ctx context.Context, req *pb.ClaimRequest) (*pb.PictureBatch, error) {
+	amount := defaultQueueAmount
+	if req.Amount != 0 {
+		var err error
+		amount, err = parseAmount(strconv.Itoa(int(req.Amount)))
+		if err != nil {
+			return nil, grpcstatus.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	pictures, err := FindManyForSuggestion(ctx, amount, Database)
+	if err != nil {
+		logf(ctx, "[ERROR] : %v", err.Error())
+		return nil, grpcDatabaseError(err, codes.Internal)
+	}
+	return &pb.PictureBatch{Pictures: picturesToProto(pictures)}, nil
+}
+
+func (s *grpcDatabase) SubmitSuggestions(ctx context.Context, req *pb.SubmitRequest) (*pb.SubmitResponse, error) {
+	annotations := make([]Annotation, 0, len(req.Suggestions))
+	for i, suggestion := range req.Suggestions {
+		id, err := primitive.ObjectIDFromHex(suggestion.Id)
+		if err != nil {
+			return nil, grpcstatus.Errorf(codes.InvalidArgument, "suggestions[%v] : Could not decode ID", i)
+		}
+		if suggestion.Value == "" {
+			return nil, grpcstatus.Errorf(codes.InvalidArgument, "suggestions[%v] : value is required", i)
+		}
+		annotation := Annotation{Id: id, Value: suggestion.Value, Model: suggestion.Model}
+		if suggestion.Expected != nil {
+			version := suggestion.Expected.Version
+			annotation.Version = &version
+		}
+		annotations = append(annotations, annotation)
+	}
+	b, err := json.Marshal(annotations)
+	if err != nil {
+		return nil, grpcstatus.Error(codes.Internal, err.Error())
+	}
+
+	err = UpdateValue(ctx, b, Database, RecognizerAnnotator, nil)
+	var conflict *ConflictError
+	if errors.As(err, &conflict) {
+		return &pb.SubmitResponse{Conflicts: picturesToProto(conflict.Pictures)}, nil
+	} else if err != nil {
+		logf(ctx, "[ERROR] : %v", err.Error())
+		return nil, grpcDatabaseError(err, codes.Internal)
+	}
+	return &pb.SubmitResponse{}, nil
+}
+
+func (s *grpcDatabase) StreamChanges(req *pb.StreamRequest, stream pb.Database_StreamChangesServer) error {
+	types := make([]EventType, 0, len(req.Types))
+	for _, t := range req.Types {
+		types = append(types, EventType(t))
+	}
+
+	last, err := LastEventSeq(stream.Context(), Database)
+	if err != nil {
+		logf(stream.Context(), "[ERROR] : %v", err.Error())
+		return grpcDatabaseError(err, codes.Internal)
+	}
+	if req.AfterId != "" {
+		last, err = strconv.ParseInt(req.AfterId, 10, 64)
+		if err != nil || last < 0 {
+			return grpcstatus.Error(codes.InvalidArgument, "after_id must be the sequence of an event")
+		}
+	}
+
+	ticker := time.NewTicker(eventsPollInterval)
+	defer ticker.Stop()
+
+	for {
+		var events []Event
+		events, last, err = FindEventsAfter(stream.Context(), last, types, 100, Database)
+		if err != nil {
+			logf(stream.Context(), "[ERROR] : %v", err.Error())
+			return grpcDatabaseError(err, codes.Internal)
+		}
+
+		for _, event := range events {
+			changes, err := json.Marshal(event.Changes)
+			if err != nil {
+				return grpcstatus.Error(codes.Internal, err.Error())
+			}
+			err = stream.Send(&pb.Event{
+				Id:        strconv.FormatInt(event.Seq, 10),
+				Type:      string(event.Type),
+				PictureId: event.PictureId.Hex(),
+				Actor:     event.Actor,
+				Changes:   string(changes),
+				Time:      event.Time.Format(time.RFC3339Nano),
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func pictureToProto(pic Picture) *pb.Picture {
+	piff := &pb.PiFF{
+		Meta:   &pb.Meta{Type: pic.PiFF.Meta.Type, Url: pic.PiFF.Meta.URL},
+		Parent: int32(pic.PiFF.Parent),
+	}
+	for _, location := range pic.PiFF.Location {
+		l := &pb.Location{Type: location.Type, Id: location.Id}
+		for _, point := range location.Polygon {
+			l.Polygon = append(l.Polygon, &pb.Point{X: int32(point[0]), Y: int32(point[1])})
+		}
+		piff.Location = append(piff.Location, l)
+	}
+	for _, data := range pic.PiFF.Data {
+		piff.Data = append(piff.Data, &pb.Data{Type: data.Type, LocationId: data.LocationId, Value: data.Value, Id: data.Id})
+	}
+	for _, child := range pic.PiFF.Children {
+		piff.Children = append(piff.Children, int32(child))
+	}
+
+	res := &pb.Picture{
+		Id:         pic.Id.Hex(),
+		Piff:       piff,
+		Url:        pic.Url,
+		Filename:   pic.Filename,
+		Annotated:  pic.Annotated,
+		Corrected:  pic.Corrected,
+		SentToReco: pic.SentToReco,
+		Unreadable: pic.Unreadable,
+		Annotator:  pic.Annotator,
+		Version:    pic.Version,
+	}
+	if len(pic.Flags) > 0 {
+		res.Flags = map[string]bool{}
+		for flag, value := range pic.Flags {
+			res.Flags[string(flag)] = value
+		}
+	}
+	if pic.DuplicateOf != nil {
+		res.DuplicateOf = pic.DuplicateOf.Hex()
+	}
+	return res
+}
+
+func picturesToProto(pictures []Picture) []*pb.Picture {
+	res := make([]*pb.Picture, 0, len(pictures))
+	for _, pic := range pictures {
+		res = append(res, pictureToProto(pic))
+	}
+	return res
+}
+
+// Only what a client may set on a new picture, the flags and versions are managed by the database
+func pictureFromProto(p *pb.Picture) (Picture, error) {
+	pic := Picture{Url: p.Url, Filename: p.Filename}
+	if p.Id != "" {
+		id, err := primitive.ObjectIDFromHex(p.Id)
+		if err != nil {
+			return Picture{}, errors.New("Could not decode ID")
+		}
+		pic.Id = id
+	}
+
+	piff := p.Piff
+	if piff.Meta != nil {
+		pic.PiFF.Meta = Meta{Type: piff.Meta.Type, URL: piff.Meta.Url}
+	}
+	for _, l := range piff.Location {
+		location := Location{Type: l.Type, Id: l.Id}
+		for _, point := range l.Polygon {
+			location.Polygon = append(location.Polygon, [2]int{int(point.X), int(point.Y)})
+		}
+		pic.PiFF.Location = append(pic.PiFF.Location, location)
+	}
+	for _, d := range piff.Data {
+		pic.PiFF.Data = append(pic.PiFF.Data, Data{Type: d.Type, LocationId: d.LocationId, Value: d.Value, Id: d.Id})
+	}
+	for _, child := range piff.Children {
+		pic.PiFF.Children = append(pic.PiFF.Children, int(child))
+	}
+	pic.PiFF.Parent = int(piff.Parent)
+	return pic, nil
+}
@@ -0,0 +1,78 @@
+//go:build grpc
+
+package main
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"os"
+	"testing"
+)
+
+func TestPictureProto(t *testing.T) {
+	root := primitive.NewObjectID()
+	pic := Picture{
+		Id:          primitive.NewObjectID(),
+		PiFF:        EmptyPiFF,
+		Url:         "/snippets/3f/3f.png",
+		Filename:    "scan.png",
+		Annotated:   true,
+		Flags:       map[Flag]bool{"ContainsNumber": true},
+		Annotator:   "morpheus",
+		Version:     3,
+		DuplicateOf: &root,
+	}
+	// EmptyPiFF is shared by the tests
+	pic.PiFF.Location = []Location{{Type: "line", Polygon: [][2]int{{0, 0}, {30, 0}, {30, 20}, {0, 20}}, Id: "loc_0"}}
+
+	p := pictureToProto(pic)
+	assert.Equal(t, pic.Id.Hex(), p.Id)
+	assert.Equal(t, int32(30), p.Piff.Location[0].Polygon[2].X)
+	assert.Equal(t, int32(20), p.Piff.Location[0].Polygon[2].Y)
+	assert.Equal(t, "loc_0", p.Piff.Data[0].LocationId)
+	assert.True(t, p.Flags["ContainsNumber"])
+	assert.Equal(t, root.Hex(), p.DuplicateOf)
+
+	// only what a client may set comes back
+	back, err := pictureFromProto(p)
+	assert.Nil(t, err)
+	assert.Equal(t, pic.Id, back.Id)
+	assert.Equal(t, pic.PiFF, back.PiFF)
+	assert.Equal(t, pic.Url, back.Url)
+	assert.Equal(t, pic.Filename, back.Filename)
+	assert.False(t, back.Annotated)
+	assert.Equal(t, int64(0), back.Version)
+
+	p.Id = "not an id"
+	_, err = pictureFromProto(p)
+	assert.NotNil(t, err)
+}
+
+type testServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s testServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func TestGrpcAuthStream(t *testing.T) {
+	previousPassword := os.Getenv("CLUSTER_INTERNAL_PASSWORD")
+	os.Setenv("CLUSTER_INTERNAL_PASSWORD", "cluster_password")
+	defer os.Setenv("CLUSTER_INTERNAL_PASSWORD", previousPassword)
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "cluster_password", "x-request-id", "recognizer-7"))
+	info := &grpc.StreamServerInfo{FullMethod: "/taliesin.database.v1.Database/StreamChanges"}
+	var requestId string
+	err := grpcAuthStream(nil, testServerStream{ctx: ctx}, info, func(srv interface{}, stream grpc.ServerStream) error {
+		requestId = RequestId(stream.Context())
+		return nil
+	})
+	assert.Nil(t, err)
+	// the streams get the request id of their caller, as the unary calls
+	assert.Equal(t, "recognizer-7", requestId)
+}
@@ -0,0 +1,517 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Root of the shared volume holding the images, Picture.Url is relative to it
+var snippetsRoot = "/snippets/"
+
+// Thumbnails are kept on the disk of the replica
+var imageCacheDir = filepath.Join(os.TempDir(), "taliesin-thumbnails")
+
+/**
+The thumbnails beyond this size are removed, least recently used first, and the ones unused for imageCacheMaxAge
+IMAGE_CACHE_MAX_MB overrides it
+*/
+var imageCacheMaxBytes int64 = 256 << 20
+
+const (
+	imageCacheMaxAge        = 7 * 24 * time.Hour
+	imageCacheEvictInterval = 10 * time.Minute
+)
+
+// Largest side of a thumbnail, and largest side which can be asked for
+const (
+	thumbnailSize     = 256
+	imageMaxDimension = 4096
+)
+
+// Images are private but rarely change, the browser revalidates them with the ETag
+const imageCacheControl = "private, max-age=300"
+
+var ErrOutsideRoot = errors.New("Path outside of the snippets root")
+var ErrUnknownLocation = errors.New("Unknown location")
+var ErrInvalidImageOptions = errors.New("Invalid image options")
+
+func init() {
+	if root := os.Getenv("SNIPPETS_ROOT"); root != "" {
+		snippetsRoot = root
+	}
+	if dir := os.Getenv("IMAGE_CACHE_DIR"); dir != "" {
+		imageCacheDir = dir
+	}
+	if mb, err := strconv.Atoi(os.Getenv("IMAGE_CACHE_MAX_MB")); err == nil && mb > 0 {
+		imageCacheMaxBytes = int64(mb) << 20
+	}
+}
+
+type ImageOptions struct {
+	// Id of the Location of the PiFF to crop to, the whole image if empty
+	Location string
+	// Make the pixels outside the polygon of the location transparent
+	Mask bool
+	// The image is scaled down to fit, 0 for no limit
+	MaxWidth  int
+	MaxHeight int
+	// Thumbnails are at most thumbnailSize wide and high, and cached
+	Thumbnail bool
+}
+
+/**
+Path of the file of a picture, which must be inside the snippets root even after following the symbolic links
+url : Picture.Url, like /snippets/filename.png
+*/
+func ResolveSnippetPath(url string) (string, error) {
+	// cleaning an absolute path removes every .. going above the root
+	clean := path.Clean("/" + url)
+	if clean == "/snippets" || strings.HasPrefix(clean, "/snippets/") {
+		clean = strings.TrimPrefix(clean, "/snippets")
+	}
+
+	root, err := filepath.EvalSymlinks(snippetsRoot)
+	if err != nil {
+		return "", err
+	}
+	file, err := filepath.EvalSymlinks(filepath.Join(root, filepath.FromSlash(clean)))
+	if err != nil {
+		return "", err
+	}
+
+	rel, err := filepath.Rel(root, file)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%w : %q", ErrOutsideRoot, url)
+	}
+	return file, nil
+}
+
+/**
+Identifier of an image rendered from a file, it changes with the file, the picture (whose version changes with its PiFF) and the options
+*/
+func imageKey(pic Picture, info os.FileInfo, opts ImageOptions) string {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%v|%v|%v|%v|%v|%v|%v|%v|%v",
+		pic.Id.Hex(), pic.Version, info.Size(), info.ModTime().UnixNano(),
+		opts.Location, opts.Mask, opts.MaxWidth, opts.MaxHeight, opts.Thumbnail)))
+	return hex.EncodeToString(hash[:16])
+}
+
+func findLocation(pic Picture, id string) (Location, bool) {
+	for _, location := range pic.PiFF.Location {
+		if location.Id == id {
+			return location, true
+		}
+	}
+	return Location{}, false
+}
+
+func polygonBounds(polygon [][2]int) image.Rectangle {
+	if len(polygon) == 0 {
+		return image.Rectangle{}
+	}
+	bounds := image.Rect(polygon[0][0], polygon[0][1], polygon[0][0], polygon[0][1])
+	for _, point := range polygon[1:] {
+		bounds = bounds.Union(image.Rect(point[0], point[1], point[0], point[1]))
+	}
+	// the points are included
+	bounds.Max = bounds.Max.Add(image.Pt(1, 1))
+	return bounds
+}
+
+// Even-odd rule
+func insidePolygon(x float64, y float64, polygon [][2]int) bool {
+	inside := false
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		xi, yi := float64(polygon[i][0]), float64(polygon[i][1])
+		xj, yj := float64(polygon[j][0]), float64(polygon[j][1])
+		if (yi > y) != (yj > y) && x < (xj-xi)*(y-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+func cropToLocation(img image.Image, location Location, mask bool) (image.Image, error) {
+	bounds := polygonBounds(location.Polygon).Intersect(img.Bounds())
+	if bounds.Empty() {
+		return nil, fmt.Errorf("%w : the location %q is outside of the image", ErrInvalidImageOptions, location.Id)
+	}
+
+	cropped := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(cropped, cropped.Bounds(), img, bounds.Min, draw.Src)
+	if mask {
+		for y := 0; y < bounds.Dy(); y++ {
+			for x := 0; x < bounds.Dx(); x++ {
+				// the center of the pixel, in the coordinates of the polygon
+				if !insidePolygon(float64(bounds.Min.X+x)+0.5, float64(bounds.Min.Y+y)+0.5, location.Polygon) {
+					cropped.SetNRGBA(x, y, color.NRGBA{})
+				}
+			}
+		}
+	}
+	return cropped, nil
+}
+
+/**
+Scale the image down to fit in maxWidth x maxHeight, keeping its ratio, each pixel is the mean of the pixels it covers
+*/
+func fitImage(img image.Image, maxWidth int, maxHeight int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	scale := 1.0
+	if maxWidth > 0 && width > maxWidth {
+		scale = float64(maxWidth) / float64(width)
+	}
+	if maxHeight > 0 && float64(height)*scale > float64(maxHeight) {
+		scale = float64(maxHeight) / float64(height)
+	}
+	if scale == 1.0 {
+		return img
+	}
+
+	dstWidth, dstHeight := int(float64(width)*scale+0.5), int(float64(height)*scale+0.5)
+	if dstWidth < 1 {
+		dstWidth = 1
+	}
+	if dstHeight < 1 {
+		dstHeight = 1
+	}
+
+	dst := image.NewRGBA64(image.Rect(0, 0, dstWidth, dstHeight))
+	for y := 0; y < dstHeight; y++ {
+		y0, y1 := bounds.Min.Y+y*height/dstHeight, bounds.Min.Y+(y+1)*height/dstHeight
+		if y1 == y0 {
+			y1++
+		}
+		for x := 0; x < dstWidth; x++ {
+			x0, x1 := bounds.Min.X+x*width/dstWidth, bounds.Min.X+(x+1)*width/dstWidth
+			if x1 == x0 {
+				x1++
+			}
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r, g, b, a, n = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca), n+1
+				}
+			}
+			dst.SetRGBA64(x, y, color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(b / n), A: uint16(a / n)})
+		}
+	}
+	return dst
+}
+
+/**
+Render the image of a picture, cropped and scaled as asked
+Returns the encoded image and its content type, JPEG images stay JPEG unless masked and the others are PNG
+*/
+func RenderImage(pic Picture, file string, opts ImageOptions) ([]byte, string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+
+	img, format, err := image.Decode(f)
+	if err != nil {
+		log.Printf("[DECODE] %v", err)
+		return nil, "", errors.New("Could not decode the image")
+	}
+
+	if opts.Location != "" {
+		location, ok := findLocation(pic, opts.Location)
+		if !ok {
+			return nil, "", fmt.Errorf("%w : %q", ErrUnknownLocation, opts.Location)
+		}
+		if img, err = cropToLocation(img, location, opts.Mask); err != nil {
+			return nil, "", err
+		}
+	}
+	img = fitImage(img, opts.MaxWidth, opts.MaxHeight)
+
+	var buf bytes.Buffer
+	if format == "jpeg" && !opts.Mask {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90})
+		return buf.Bytes(), "image/jpeg", err
+	}
+	err = png.Encode(&buf, img)
+	return buf.Bytes(), "image/png", err
+}
+
+func parseImageOptions(r *http.Request) (ImageOptions, error) {
+	query := r.URL.Query()
+	opts := ImageOptions{Location: query.Get("location")}
+
+	for name, value := range map[string]*bool{"mask": &opts.Mask, "thumbnail": &opts.Thumbnail} {
+		if raw := query.Get(name); raw != "" {
+			parsed, err := strconv.ParseBool(raw)
+			if err != nil {
+				return opts, fmt.Errorf("%w : %v must be a boolean", ErrInvalidImageOptions, name)
+			}
+			*value = parsed
+		}
+	}
+	for name, value := range map[string]*int{"maxWidth": &opts.MaxWidth, "maxHeight": &opts.MaxHeight} {
+		if raw := query.Get(name); raw != "" {
+			parsed, err := strconv.Atoi(raw)
+			if err != nil || parsed < 1 || parsed > imageMaxDimension {
+				return opts, fmt.Errorf("%w : %v must be between 1 and %v", ErrInvalidImageOptions, name, imageMaxDimension)
+			}
+			*value = parsed
+		}
+	}
+
+	if opts.Mask && opts.Location == "" {
+		return opts, fmt.Errorf("%w : mask needs a location", ErrInvalidImageOptions)
+	}
+	if opts.Thumbnail {
+		if opts.MaxWidth == 0 || opts.MaxWidth > thumbnailSize {
+			opts.MaxWidth = thumbnailSize
+		}
+		if opts.MaxHeight == 0 || opts.MaxHeight > thumbnailSize {
+			opts.MaxHeight = thumbnailSize
+		}
+	}
+	return opts, nil
+}
+
+func matchesETag(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func thumbnailPath(key string, contentType string) string {
+	extension := ".png"
+	if contentType == "image/jpeg" {
+		extension = ".jpg"
+	}
+	return filepath.Join(imageCacheDir, key+extension)
+}
+
+// A thumbnail read is marked as used, so that the eviction keeps it
+func cachedThumbnail(key string) ([]byte, string, bool) {
+	for _, contentType := range []string{"image/png", "image/jpeg"} {
+		file := thumbnailPath(key, contentType)
+		if data, err := ioutil.ReadFile(file); err == nil {
+			now := time.Now()
+			os.Chtimes(file, now, now)
+			return data, contentType, true
+		}
+	}
+	return nil, "", false
+}
+
+// Written aside then renamed so that a concurrent request never reads a partial thumbnail
+func cacheThumbnail(key string, contentType string, data []byte) error {
+	if err := os.MkdirAll(imageCacheDir, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(imageCacheDir, key+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), thumbnailPath(key, contentType))
+}
+
+/**
+Remove the thumbnails unused since imageCacheMaxAge, then the least recently used ones until the cache fits in imageCacheMaxBytes
+The temporary files left by an interrupted write are removed too
+Returns the number of files removed
+*/
+func EvictThumbnails(now time.Time) (int, error) {
+	files, err := ioutil.ReadDir(imageCacheDir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	// least recently used first
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().Before(files[j].ModTime()) })
+	var total int64
+	for _, file := range files {
+		total += file.Size()
+	}
+
+	removed := 0
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		age := now.Sub(file.ModTime())
+		if strings.HasSuffix(file.Name(), ".tmp") {
+			// a thumbnail being written
+			if age <= imageCacheEvictInterval {
+				continue
+			}
+		} else if age <= imageCacheMaxAge && total <= imageCacheMaxBytes {
+			continue
+		}
+		if err := os.Remove(filepath.Join(imageCacheDir, file.Name())); err != nil && !os.IsNotExist(err) {
+			return removed, err
+		}
+		total -= file.Size()
+		removed++
+	}
+	return removed, nil
+}
+
+/**
+Evict the thumbnails of the replica, until the program stops
+*/
+func EvictThumbnailsPeriodically() {
+	for {
+		removed, err := EvictThumbnails(time.Now())
+		if err != nil {
+			log.Printf("[ERROR] Thumbnails eviction : %v", err.Error())
+		} else if removed > 0 {
+			log.Printf("Evicted %v thumbnails\n", removed)
+		}
+		time.Sleep(imageCacheEvictInterval)
+	}
+}
+
+func getPictureImage(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.Inc() // incrementing the httpRequestsTotal counter
+
+	password := r.Header.Get("Authorization")
+
+	if password == "" && r.URL.Query().Get("ticket") != "" {
+		// <img> can't set headers, browsers ask for a ticket first
+		if _, ok := authenticateTicket(w, r, TicketImages); !ok {
+			return
+		}
+	} else if !isClusterPassword(password) {
+		_, err, authStatusCode := authenticateUser(r)
+
+		// check if there was an error during the authentication or if the user wasn't authenticated
+		if err != nil {
+			logf(r.Context(), "[ERROR] Check authentication: %v", err.Error())
+			w.WriteHeader(authStatusCode)
+			w.Write([]byte("[MICRO-DATABASE] Couldn't verify identity"))
+			return
+		}
+	}
+
+	entryId, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("[MICRO-DATABASE] Could not decode ID"))
+		return
+	}
+
+	opts, err := parseImageOptions(r)
+	if err != nil {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("[MICRO-DATABASE] %v", err.Error())))
+		return
+	}
+
+	pic, err := FindOne(r.Context(), entryId, Database)
+	if err != nil {
+		writeDatabaseError(w, r, err, http.StatusNotFound)
+		return
+	}
+
+	file, err := ResolveSnippetPath(pic.Url)
+	if errors.Is(err, ErrOutsideRoot) {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("[MICRO-DATABASE] The image is outside of the snippets"))
+		return
+	} else if err != nil {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("[MICRO-DATABASE] Image not found"))
+		return
+	}
+	info, err := os.Stat(file)
+	if err != nil || info.IsDir() {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("[MICRO-DATABASE] Image not found"))
+		return
+	}
+
+	key := imageKey(pic, info, opts)
+	etag := "\"" + key + "\""
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", imageCacheControl)
+	w.Header().Set("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
+	if matchesETag(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	data, contentType, cached := []byte(nil), "", false
+	if opts.Thumbnail {
+		data, contentType, cached = cachedThumbnail(key)
+	}
+	if !cached {
+		start := time.Now()
+		data, contentType, err = RenderImage(pic, file, opts)
+		if errors.Is(err, ErrUnknownLocation) {
+			logf(r.Context(), "[ERROR] : %v", err.Error())
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(fmt.Sprintf("[MICRO-DATABASE] %v", err.Error())))
+			return
+		} else if errors.Is(err, ErrInvalidImageOptions) {
+			logf(r.Context(), "[ERROR] : %v", err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("[MICRO-DATABASE] %v", err.Error())))
+			return
+		} else if err != nil {
+			logf(r.Context(), "[ERROR] : %v", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(fmt.Sprintf("[MICRO-DATABASE] %v", err.Error())))
+			return
+		}
+		logf(r.Context(), "Rendered image of %v in %v\n", pic.Id.Hex(), time.Since(start))
+
+		if opts.Thumbnail {
+			if err := cacheThumbnail(key, contentType, data); err != nil {
+				logf(r.Context(), "[WARNING] Thumbnail not cached : %v", err.Error())
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func setupSnippets(t *testing.T) func() {
+	root, _ := ioutil.TempDir("", "snippets")
+	cache, _ := ioutil.TempDir("", "thumbnails")
+	previousRoot, previousCache := snippetsRoot, imageCacheDir
+	snippetsRoot, imageCacheDir = root, cache
+
+	page := image.NewNRGBA(image.Rect(0, 0, 100, 50))
+	for y := 0; y < 50; y++ {
+		for x := 0; x < 100; x++ {
+			page.SetNRGBA(x, y, color.NRGBA{R: 200, G: 10, B: 10, A: 255})
+		}
+	}
+	f, _ := os.Create(filepath.Join(root, "page.png"))
+	png.Encode(f, page)
+	f.Close()
+
+	return func() {
+		snippetsRoot, imageCacheDir = previousRoot, previousCache
+		os.RemoveAll(root)
+		os.RemoveAll(cache)
+	}
+}
+
+func TestResolveSnippetPath(t *testing.T) {
+	defer setupSnippets(t)()
+
+	file, err := ResolveSnippetPath("/snippets/page.png")
+	assert.Nil(t, err)
+	assert.Equal(t, "page.png", filepath.Base(file))
+
+	// .. can't go above the root
+	_, err = ResolveSnippetPath("/snippets/../../../etc/passwd")
+	assert.True(t, os.IsNotExist(err))
+
+	// nor a symbolic link
+	os.Symlink("/etc", filepath.Join(snippetsRoot, "etc"))
+	_, err = ResolveSnippetPath("/snippets/etc/passwd")
+	assert.True(t, errors.Is(err, ErrOutsideRoot))
+}
+
+func TestGetPictureImage(t *testing.T) {
+	defer setupSnippets(t)()
+	Database = Client.Database("taliesin_test").Collection("test_picture_image")
+
+	piff := PiFFStruct{Location: []Location{{Type: "line", Id: "loc_0", Polygon: [][2]int{{10, 10}, {49, 10}, {10, 29}}}}}
+	doc0 := Picture{Id: primitive.NewObjectID(), PiFF: piff, Url: "/snippets/page.png"}
+	b, _ := json.Marshal([1]Picture{doc0})
+	res, _ := InsertMany(context.Background(), b, Database, "test")
+	id := res[0].(primitive.ObjectID).Hex()
+
+	get := func(query string, header http.Header) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest("GET", "/db/picture/"+id+"/image"+query, nil)
+		for name, values := range header {
+			request.Header[name] = values
+		}
+		request = mux.SetURLVars(request, map[string]string{"id": id})
+		recorder := httptest.NewRecorder()
+		getPictureImage(recorder, request)
+		return recorder
+	}
+
+	recorder := get("?location=loc_0&mask=true", nil)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "image/png", recorder.Header().Get("Content-Type"))
+	img, err := png.Decode(bytes.NewReader(recorder.Body.Bytes()))
+	assert.Nil(t, err)
+	assert.Equal(t, image.Rect(0, 0, 40, 20), img.Bounds())
+	_, _, _, inside := img.At(1, 1).RGBA()
+	_, _, _, outside := img.At(38, 18).RGBA()
+	assert.NotEqual(t, uint32(0), inside)
+	assert.Equal(t, uint32(0), outside)
+
+	recorder = get("?thumbnail=true&maxWidth=25", nil)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	img, _ = png.Decode(bytes.NewReader(recorder.Body.Bytes()))
+	assert.Equal(t, image.Rect(0, 0, 25, 13), img.Bounds())
+	cached, _ := ioutil.ReadDir(imageCacheDir)
+	assert.Equal(t, 1, len(cached))
+
+	etag := recorder.Header().Get("ETag")
+	assert.NotEqual(t, "", etag)
+	recorder = get("?thumbnail=true&maxWidth=25", http.Header{"If-None-Match": {etag}})
+	assert.Equal(t, http.StatusNotModified, recorder.Code)
+	recorder = get("?thumbnail=true&maxWidth=30", http.Header{"If-None-Match": {etag}})
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	assert.Equal(t, http.StatusNotFound, get("?location=loc_9", nil).Code)
+	assert.Equal(t, http.StatusBadRequest, get("?mask=true", nil).Code)
+	assert.Equal(t, http.StatusBadRequest, get("?maxWidth=0", nil).Code)
+}
+
+func TestEvictThumbnails(t *testing.T) {
+	defer setupSnippets(t)()
+	previousMax := imageCacheMaxBytes
+	imageCacheMaxBytes = 350
+	defer func() { imageCacheMaxBytes = previousMax }()
+
+	now := time.Now()
+	write := func(name string, size int, used time.Time) {
+		file := filepath.Join(imageCacheDir, name)
+		ioutil.WriteFile(file, make([]byte, size), 0644)
+		os.Chtimes(file, used, used)
+	}
+	write("old.png", 10, now.Add(-imageCacheMaxAge-time.Hour))
+	write("lru.png", 100, now.Add(-2*time.Hour))
+	write("recent.png", 100, now.Add(-time.Hour))
+	write("new.jpg", 100, now)
+	write("new.jpg.123.tmp", 100, now)
+	write("crashed.png.456.tmp", 100, now.Add(-3*time.Hour))
+
+	removed, err := EvictThumbnails(now)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, removed)
+
+	var kept []string
+	files, _ := ioutil.ReadDir(imageCacheDir)
+	for _, file := range files {
+		kept = append(kept, file.Name())
+	}
+	// the thumbnail being written is kept, and the cache fits again
+	assert.ElementsMatch(t, []string{"recent.png", "new.jpg", "new.jpg.123.tmp"}, kept)
+
+	// a thumbnail read is used again
+	write("lru.png", 10, now.Add(-imageCacheMaxAge-time.Hour))
+	_, _, ok := cachedThumbnail("lru")
+	assert.True(t, ok)
+	removed, _ = EvictThumbnails(now.Add(time.Second))
+	assert.Equal(t, 0, removed)
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	lib_auth "github.com/taliesin-insa/lib-auth"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/**
+Index needed by a query pattern
+Part : collection of the index, "pictures" for the collection itself or the suffix of a companion collection
+*/
+type IndexDefinition struct {
+	Name string
+	Part string
+	Keys bson.D
+	// Unique among the documents having the keys, as the index is sparse
+	Unique bool
+	// Queries using the index, for the status
+	Usage string
+}
+
+// Indexes created by the service are prefixed, the other indexes are never modified
+const managedIndexPrefix = "taliesin_"
+
+var IndexDefinitions = []IndexDefinition{
+	{
+		Name:  managedIndexPrefix + "unused",
+		Part:  "pictures",
+		Keys:  bson.D{{"Annotated", 1}, {"Unreadable", 1}, {"SentToReco", 1}},
+		Usage: "FindManyUnused, FindManyForSuggestion, CountFlag(Annotated)",
+	},
+	{
+		Name:  managedIndexPrefix + "suggestions",
+		Part:  "pictures",
+		Keys:  bson.D{{"Annotated", 1}, {"Unreadable", 1}, {"Annotator", 1}},
+		Usage: "FindManyWithSuggestion, CountAnnotatedIgnoringRecoOrUnreadable",
+	},
+	{
+		Name:  managedIndexPrefix + "unreadable",
+		Part:  "pictures",
+		Keys:  bson.D{{"Unreadable", 1}},
+		Usage: "CountFlag(Unreadable)",
+	},
+	{
+		Name:  managedIndexPrefix + "corrected",
+		Part:  "pictures",
+		Keys:  bson.D{{"Corrected", 1}},
+		Usage: "CountFlag(Corrected), FindManyByFlag(Corrected)",
+	},
+	{
+		Name:   managedIndexPrefix + "image_hash",
+		Part:   "pictures",
+		Keys:   bson.D{{"Image.Hash", 1}},
+		Unique: true,
+		Usage:  "FindByImageHash, duplicate uploads",
+	},
+	{
+		Name:  managedIndexPrefix + "duplicate_of",
+		Part:  "pictures",
+		Keys:  bson.D{{"DuplicateOf", 1}},
+		Usage: "PropagateTranscription, FindDuplicateGroups",
+	},
+	{
+		Name:  managedIndexPrefix + "fingerprint_hash",
+		Part:  "pictures",
+		Keys:  bson.D{{"Fingerprint.Hash", 1}},
+		Usage: "CheckDuplicates",
+	},
+	{
+		Name:  managedIndexPrefix + "fingerprint_page",
+		Part:  "pictures",
+		Keys:  bson.D{{"Fingerprint.Page", 1}},
+		Usage: "CheckDuplicates",
+	},
+	{
+		Name:  managedIndexPrefix + "fingerprint_bands",
+		Part:  "pictures",
+		Keys:  bson.D{{"Fingerprint.Bands", 1}},
+		Usage: "CheckDuplicates",
+	},
+	{
+		Name:  managedIndexPrefix + "deleted_at",
+		Part:  "trash",
+		Keys:  bson.D{{"DeletedAt", 1}},
+		Usage: "PurgeTrash",
+	},
+	{
+		Name:   managedIndexPrefix + "seq",
+		Part:   "events",
+		Keys:   bson.D{{"Seq", 1}},
+		Unique: true,
+		Usage:  "FindEventsAfter, LastEventSeq",
+	},
+	{
+		Name:  managedIndexPrefix + "type_time",
+		Part:  "events",
+		Keys:  bson.D{{"Type", 1}, {"Time", 1}},
+		Usage: "AnnotatorStatistics, AnnotatorActivity",
+	},
+	{
+		Name:  managedIndexPrefix + "corrected_at",
+		Part:  "recognitions",
+		Keys:  bson.D{{"CorrectedAt", 1}},
+		Usage: "RecognizerMetrics",
+	},
+}
+
+type IndexStatus struct {
+	Collection string         `json:"Collection"`
+	Name       string         `json:"Name"`
+	Keys       map[string]int `json:"Keys"`
+	Usage      string         `json:"Usage,omitempty"`
+	// Declared in IndexDefinitions, the other indexes are only listed
+	Declared bool `json:"Declared"`
+	Present  bool `json:"Present"`
+	// Number of operations which used the index since the last restart of MongoDB
+	Ops   int64      `json:"Ops"`
+	Since *time.Time `json:"Since,omitempty"`
+}
+
+func indexPartCollection(collection *mongo.Collection, part string) *mongo.Collection {
+	if part == "pictures" {
+		return collection
+	}
+	return companionCollection(collection, part)
+}
+
+// Parts having indexes, in the order of IndexDefinitions
+func indexParts() []string {
+	parts := []string{}
+	for _, definition := range IndexDefinitions {
+		found := false
+		for _, part := range parts {
+			found = found || part == definition.Part
+		}
+		if !found {
+			parts = append(parts, definition.Part)
+		}
+	}
+	return parts
+}
+
+// MongoDB error codes
+const (
+	namespaceNotFound    = 26
+	indexOptionsConflict = 85
+)
+
+type existingIndex struct {
+	Name   string `bson:"name"`
+	Key    bson.D `bson:"key"`
+	Unique bool   `bson:"unique"`
+}
+
+func (index existingIndex) matches(definition IndexDefinition) bool {
+	return keysSignature(index.Key) == keysSignature(definition.Keys) && index.Unique == definition.Unique
+}
+
+func listIndexes(ctx context.Context, collection *mongo.Collection) ([]existingIndex, error) {
+	cur, err := collection.Indexes().List(ctx)
+	var commandErr mongo.CommandError
+	if errors.As(err, &commandErr) && commandErr.Code == namespaceNotFound {
+		// the collection was never written to
+		return []existingIndex{}, nil
+	} else if err != nil {
+		return nil, mongoError(ctx, err, "Error during MongoDB index listing")
+	}
+	defer cur.Close(ctx)
+
+	indexes := []existingIndex{}
+	for cur.Next(ctx) {
+		var index existingIndex
+		if err := cur.Decode(&index); err != nil {
+			logf(ctx, "[DECODE] %v", err)
+			return nil, errors.New("Could not decode data from mongo")
+		}
+		indexes = append(indexes, index)
+	}
+	if err := cur.Err(); err != nil {
+		logf(ctx, "[CURSOR] %v", err)
+		return nil, errors.New("Error while iterating results")
+	}
+	return indexes, nil
+}
+
+// Keys as a comparable string, the directions can be stored as int32, int64 or double
+func keysSignature(keys bson.D) string {
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		direction, err := toInt(key.Value)
+		if err != nil {
+			parts = append(parts, fmt.Sprintf("%v:%v", key.Key, key.Value))
+		} else {
+			parts = append(parts, fmt.Sprintf("%v:%v", key.Key, direction))
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+func keysMap(keys bson.D) map[string]int {
+	result := make(map[string]int)
+	for _, key := range keys {
+		direction, _ := toInt(key.Value)
+		result[key.Key] = int(direction)
+	}
+	return result
+}
+
+// Name of an index which is not managed and has the keys of the definition
+func coveringIndex(existing []existingIndex, definition IndexDefinition) string {
+	for _, index := range existing {
+		if !strings.HasPrefix(index.Name, managedIndexPrefix) && keysSignature(index.Key) == keysSignature(definition.Keys) {
+			return index.Name
+		}
+	}
+	return ""
+}
+
+/**
+Create the declared indexes, recreate those whose keys or uniqueness changed and drop the managed ones which are no longer declared
+Returns the names of the created and dropped indexes
+*/
+func EnsureIndexes(ctx context.Context, collection *mongo.Collection) ([]string, []string, error) {
+	ctx, cancel := withTimeout(ctx, OperationScan)
+	defer cancel()
+
+	created, dropped := []string{}, []string{}
+
+	for _, part := range indexParts() {
+		coll := indexPartCollection(collection, part)
+		existing, err := listIndexes(ctx, coll)
+		if err != nil {
+			return created, dropped, err
+		}
+
+		declared := make(map[string]IndexDefinition)
+		for _, definition := range IndexDefinitions {
+			if definition.Part == part {
+				declared[definition.Name] = definition
+			}
+		}
+
+		present := make(map[string]bool)
+		for _, index := range existing {
+			definition, isDeclared := declared[index.Name]
+			if isDeclared && index.matches(definition) {
+				present[index.Name] = true
+				continue
+			}
+			if !isDeclared && !strings.HasPrefix(index.Name, managedIndexPrefix) {
+				continue
+			}
+			// keys changed or no longer declared
+			if _, err := coll.Indexes().DropOne(ctx, index.Name); err != nil {
+				return created, dropped, mongoError(ctx, err, "Error during MongoDB index deletion")
+			}
+			dropped = append(dropped, coll.Name()+"."+index.Name)
+		}
+
+		for _, definition := range IndexDefinitions {
+			if definition.Part != part || present[definition.Name] {
+				continue
+			}
+			// MongoDB refuses two indexes with the same keys
+			if covering := coveringIndex(existing, definition); covering != "" {
+				logf(ctx, "[WARNING] Index %v not created, %v has the same keys", definition.Name, covering)
+				continue
+			}
+			model := mongo.IndexModel{
+				Keys:    definition.Keys,
+				Options: options.Index().SetName(definition.Name).SetBackground(true),
+			}
+			if definition.Unique {
+				model.Options.SetUnique(true).SetSparse(true)
+			}
+			if _, err := coll.Indexes().CreateOne(ctx, model); err != nil {
+				return created, dropped, mongoError(ctx, err, "Error during MongoDB index creation")
+			}
+			created = append(created, coll.Name()+"."+definition.Name)
+		}
+	}
+
+	if len(created) > 0 || len(dropped) > 0 {
+		logf(ctx, "Indexes created : %v, dropped : %v\n", created, dropped)
+	}
+	return created, dropped, nil
+}
+
+/**
+Status of the declared indexes and of the other indexes of the same collections, with their usage
+*/
+func IndexesStatus(ctx context.Context, collection *mongo.Collection) ([]IndexStatus, error) {
+	ctx, cancel := withTimeout(ctx, OperationRead)
+	defer cancel()
+
+	results := []IndexStatus{}
+
+	for _, part := range indexParts() {
+		coll := indexPartCollection(collection, part)
+		existing, err := listIndexes(ctx, coll)
+		if err != nil {
+			return nil, err
+		}
+		stats, err := indexStats(ctx, coll)
+		if err != nil {
+			return nil, err
+		}
+
+		listed := make(map[string]bool)
+		for _, definition := range IndexDefinitions {
+			if definition.Part != part {
+				continue
+			}
+			status := IndexStatus{Collection: coll.Name(), Name: definition.Name, Keys: keysMap(definition.Keys), Usage: definition.Usage, Declared: true}
+			for _, index := range existing {
+				if index.Name == definition.Name && index.matches(definition) {
+					status.Present = true
+				}
+			}
+			if stat, ok := stats[definition.Name]; ok {
+				status.Ops, status.Since = stat.Accesses.Ops, &stat.Accesses.Since
+			}
+			listed[definition.Name] = true
+			results = append(results, status)
+		}
+
+		for _, index := range existing {
+			if listed[index.Name] {
+				continue
+			}
+			status := IndexStatus{Collection: coll.Name(), Name: index.Name, Keys: keysMap(index.Key), Present: true}
+			if stat, ok := stats[index.Name]; ok {
+				status.Ops, status.Since = stat.Accesses.Ops, &stat.Accesses.Since
+			}
+			results = append(results, status)
+		}
+	}
+
+	return results, nil
+}
+
+type indexStat struct {
+	Name     string `bson:"name"`
+	Accesses struct {
+		Ops   int64     `bson:"ops"`
+		Since time.Time `bson:"since"`
+	} `bson:"accesses"`
+}
+
+func indexStats(ctx context.Context, collection *mongo.Collection) (map[string]indexStat, error) {
+	cur, err := collection.Aggregate(ctx, mongo.Pipeline{bson.D{{"$indexStats", bson.D{}}}})
+	if err != nil {
+		return nil, mongoError(ctx, err, "Error during MongoDB selection")
+	}
+	defer cur.Close(ctx)
+
+	stats := make(map[string]indexStat)
+	for cur.Next(ctx) {
+		var stat indexStat
+		if err := cur.Decode(&stat); err != nil {
+			logf(ctx, "[DECODE] %v", err)
+			return nil, errors.New("Could not decode data from mongo")
+		}
+		stats[stat.Name] = stat
+	}
+	if err := cur.Err(); err != nil {
+		logf(ctx, "[CURSOR] %v", err)
+		return nil, errors.New("Error while iterating results")
+	}
+	return stats, nil
+}
+
+func getIndexes(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.Inc() // incrementing the httpRequestsTotal counter
+
+	user, err, authStatusCode := authenticateUser(r)
+
+	// check if there was an error during the authentication or if the user wasn't authenticated
+	if err != nil {
+		logf(r.Context(), "[ERROR] Check authentication: %v", err.Error())
+		w.WriteHeader(authStatusCode)
+		w.Write([]byte("[MICRO-DATABASE] Couldn't verify identity"))
+		return
+	}
+
+	// check if the authenticated user has sufficient permissions to
+	if user.Role != lib_auth.RoleAdmin {
+		logf(r.Context(), "[WRONG_ROLE] Insufficient permission: want %v, was %v", lib_auth.RoleAdmin, user.Role)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("[MICRO-DATABASE] Insufficient permissions to see the indexes"))
+		return
+	}
+
+	indexes, err := IndexesStatus(r.Context(), Database)
+	if err != nil {
+		writeDatabaseError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	body, err := json.Marshal(indexes)
+	if err != nil {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("[MICRO-DATABASE] Could not marshal answer data"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+func reconcileIndexes(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.Inc() // incrementing the httpRequestsTotal counter
+
+	user, err, authStatusCode := authenticateUser(r)
+
+	// check if there was an error during the authentication or if the user wasn't authenticated
+	if err != nil {
+		logf(r.Context(), "[ERROR] Check authentication: %v", err.Error())
+		w.WriteHeader(authStatusCode)
+		w.Write([]byte("[MICRO-DATABASE] Couldn't verify identity"))
+		return
+	}
+
+	// check if the authenticated user has sufficient permissions to
+	if user.Role != lib_auth.RoleAdmin {
+		logf(r.Context(), "[WRONG_ROLE] Insufficient permission: want %v, was %v", lib_auth.RoleAdmin, user.Role)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("[MICRO-DATABASE] Insufficient permissions to modify the indexes"))
+		return
+	}
+
+	created, dropped, err := EnsureIndexes(r.Context(), Database)
+	if err != nil {
+		writeDatabaseError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	body, err := json.Marshal(map[string][]string{"Created": created, "Dropped": dropped})
+	if err != nil {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("[MICRO-DATABASE] Could not marshal answer data"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"testing"
+)
+
+func TestEnsureIndexes(t *testing.T) {
+	coll := Client.Database("taliesin_test").Collection("test_indexes")
+	coll.Drop(context.TODO())
+	trashCollection(coll).Drop(context.TODO())
+
+	// a managed index which is no longer declared and an index of someone else
+	coll.Indexes().CreateOne(context.TODO(), mongo.IndexModel{Keys: bson.D{{"Filename", 1}}, Options: options.Index().SetName(managedIndexPrefix + "old")})
+	coll.Indexes().CreateOne(context.TODO(), mongo.IndexModel{Keys: bson.D{{"Url", 1}}, Options: options.Index().SetName("url")})
+
+	created, dropped, err := EnsureIndexes(context.Background(), coll)
+	assert.Nil(t, err)
+	assert.Equal(t, len(IndexDefinitions), len(created))
+	assert.Equal(t, []string{"test_indexes." + managedIndexPrefix + "old"}, dropped)
+
+	// nothing to do the second time
+	created, dropped, err = EnsureIndexes(context.Background(), coll)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(created))
+	assert.Equal(t, 0, len(dropped))
+
+	FindManyUnused(context.Background(), 1, coll)
+
+	indexes, err := IndexesStatus(context.Background(), coll)
+	assert.Nil(t, err)
+	names := make(map[string]IndexStatus)
+	for _, index := range indexes {
+		names[index.Name] = index
+	}
+	for _, definition := range IndexDefinitions {
+		assert.True(t, names[definition.Name].Declared)
+		assert.True(t, names[definition.Name].Present)
+	}
+	assert.False(t, names["url"].Declared)
+	assert.True(t, names["url"].Present)
+	assert.Equal(t, 1, names[managedIndexPrefix+"unused"].Keys["Annotated"])
+}
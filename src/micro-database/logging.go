@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	lib_auth "github.com/taliesin-insa/lib-auth"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+type logLevel int
+
+const (
+	LevelDebug logLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var logLevelNames = map[logLevel]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+// Lines under this level are dropped, set by LOG_LEVEL (debug, info, warn or error)
+var minLogLevel = LevelInfo
+
+/**
+Level of the lines by their tag, the "[TAG]" which starts them
+The lines without a tag or with another one are informations
+*/
+var tagLevels = map[string]logLevel{
+	"DEBUG":        LevelDebug,
+	"WARNING":      LevelWarn,
+	"WRONG_ROLE":   LevelWarn,
+	"THROTTLED":    LevelWarn,
+	"CONFLICT":     LevelWarn,
+	"WEBHOOK":      LevelWarn,
+	"ERROR":        LevelError,
+	"MONGO-DRIVER": LevelError,
+	"DECODE":       LevelError,
+	"ENCODE":       LevelError,
+	"CURSOR":       LevelError,
+	"UNMARSHAL":    LevelError,
+	"EXTJSON":      LevelError,
+	"RAND":         LevelError,
+	"TEST_ERROR":   LevelError,
+}
+
+// Values which must never be written in the logs : tokens, passwords and secrets, in a URL, a header or a JSON document
+var sensitiveValues = regexp.MustCompile(`(?i)((?:token|ticket|password|secret|authorization)"?\s*[=:]\s*"?)(?:bearer\s+)?[^\s&",}]+`)
+
+/**
+Transcriptions, which are never logged either : quoted in JSON or in the errors of MongoDB, or printed from a struct with %+v
+In a struct, the value goes until the next field or the end of the struct
+*/
+var transcriptionValues = regexp.MustCompile(`\b((?:Value|Suggestion)"?\s*[:=]\s*)(?:(")(?:[^"\\]|\\.)*(")|[^"\s}\]][^}\]]*?(\s\w+:|[}\]]|$))`)
+
+const redactedValue = "[REDACTED]"
+
+// A request id is kept from the caller when it is made of at most 64 of these characters
+var validRequestId = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+type logEntry struct {
+	Time      string `json:"time"`
+	Level     string `json:"level"`
+	Tag       string `json:"tag,omitempty"`
+	RequestId string `json:"request_id,omitempty"`
+	TraceId   string `json:"trace_id,omitempty"`
+	Message   string `json:"msg"`
+}
+
+type logContextKey struct{}
+
+// What the logs of a request add to its lines
+type logContext struct {
+	requestId string
+	// the debug lines of the request are written whatever LOG_LEVEL is
+	debug bool
+}
+
+var (
+	logMutex  sync.Mutex
+	logOutput io.Writer = os.Stderr
+)
+
+func init() {
+	for level, name := range logLevelNames {
+		if strings.EqualFold(os.Getenv("LOG_LEVEL"), name) {
+			minLogLevel = level
+		}
+	}
+	// the lines of the standard logger are written as JSON too, without a request id
+	log.SetFlags(0)
+	log.SetOutput(standardLogWriter{})
+}
+
+func withLogContext(ctx context.Context, requestId string, debug bool) context.Context {
+	return context.WithValue(ctx, logContextKey{}, logContext{requestId: requestId, debug: debug})
+}
+
+// Id of the request ctx belongs to, empty outside of a request
+func RequestId(ctx context.Context) string {
+	lc, _ := ctx.Value(logContextKey{}).(logContext)
+	return lc.requestId
+}
+
+// Split a line into its level, its tag and its message : "[ERROR] : message"
+func parseLogLine(line string) (logLevel, string, string) {
+	line = strings.TrimRight(line, "\n")
+	if !strings.HasPrefix(line, "[") || !strings.Contains(line, "]") {
+		return LevelInfo, "", line
+	}
+	end := strings.Index(line, "]")
+	tag := line[1:end]
+	message := strings.TrimPrefix(strings.TrimLeft(line[end+1:], " "), ": ")
+	level, ok := tagLevels[tag]
+	if !ok {
+		level = LevelInfo
+	}
+	return level, tag, message
+}
+
+func redact(message string) string {
+	message = sensitiveValues.ReplaceAllString(message, "${1}"+redactedValue)
+	return transcriptionValues.ReplaceAllString(message, "${1}${2}"+redactedValue+"${3}${4}")
+}
+
+func writeLog(ctx context.Context, level logLevel, tag string, message string) {
+	lc, _ := ctx.Value(logContextKey{}).(logContext)
+	if level < minLogLevel && !lc.debug {
+		return
+	}
+
+	entry := logEntry{
+		Time:      time.Now().UTC().Format(time.RFC3339Nano),
+		Level:     logLevelNames[level],
+		Tag:       tag,
+		RequestId: lc.requestId,
+		Message:   redact(message),
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		entry.TraceId = sc.TraceID().String()
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	logMutex.Lock()
+	defer logMutex.Unlock()
+	logOutput.Write(append(line, '\n'))
+}
+
+/**
+Same as log.Printf, with the request id of ctx
+The level is given by the tag starting the format, as for the standard logger
+*/
+func logf(ctx context.Context, format string, args ...interface{}) {
+	level, tag, message := parseLogLine(fmt.Sprintf(format, args...))
+	writeLog(ctx, level, tag, message)
+}
+
+// Details only written when LOG_LEVEL is debug or when the request asked for them
+func debugf(ctx context.Context, format string, args ...interface{}) {
+	writeLog(ctx, LevelDebug, "DEBUG", fmt.Sprintf(format, args...))
+}
+
+type standardLogWriter struct{}
+
+func (standardLogWriter) Write(p []byte) (int, error) {
+	level, tag, message := parseLogLine(string(p))
+	writeLog(context.Background(), level, tag, message)
+	return len(p), nil
+}
+
+func newRequestId() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+/**
+Only the services of the cluster and the administrators can ask for the debug lines of their requests,
+they are many and could fill the logs
+*/
+func canDebug(r *http.Request) bool {
+	if isClusterPassword(r.Header.Get("Authorization")) {
+		return true
+	}
+	user, err, _ := authenticateUser(r)
+	return err == nil && user.Role == lib_auth.RoleAdmin
+}
+
+/**
+Middleware giving each request an id, the one of the X-Request-Id header if the caller sent one, which is
+sent back in the answer and written in the logs of the request
+X-Debug: true writes the debug lines of the request
+*/
+func requestContext(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-Id")
+		if !validRequestId.MatchString(id) {
+			id = newRequestId()
+		}
+		w.Header().Set("X-Request-Id", id)
+		trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("http.request_id", id))
+
+		debug := r.Header.Get("X-Debug") == "true" && canDebug(r)
+		r = r.WithContext(withLogContext(r.Context(), id, debug))
+		debugf(r.Context(), "%v %v", r.Method, r.URL.Path)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestParseLogLine(t *testing.T) {
+	level, tag, message := parseLogLine("[ERROR] : Could not decode ID\n")
+	assert.Equal(t, LevelError, level)
+	assert.Equal(t, "ERROR", tag)
+	assert.Equal(t, "Could not decode ID", message)
+
+	level, tag, _ = parseLogLine("[WRONG_ROLE] Insufficient permission: want admin, was annotator")
+	assert.Equal(t, LevelWarn, level)
+	assert.Equal(t, "WRONG_ROLE", tag)
+
+	level, tag, message = parseLogLine("Connection successful!\n")
+	assert.Equal(t, LevelInfo, level)
+	assert.Equal(t, "", tag)
+	assert.Equal(t, "Connection successful!", message)
+}
+
+func TestRedact(t *testing.T) {
+	assert.Equal(t, "GET /db/picture/1/image?token=[REDACTED]&thumbnail=true", redact("GET /db/picture/1/image?token=annotator_token&thumbnail=true"))
+	assert.Equal(t, "GET /db/events?ticket=[REDACTED]&types=annotated", redact("GET /db/events?ticket=eyJwIjoiZXZlbnRzIn0.c2ln&types=annotated"))
+	assert.Equal(t, `{"Token": "[REDACTED]"}`, redact(`{"Token": "logout_token"}`))
+	assert.Equal(t, "Authorization: [REDACTED]", redact("Authorization: Bearer admin_token"))
+	assert.Equal(t, "Wrong password for the recognizer queue", redact("Wrong password for the recognizer queue"))
+
+	// the transcriptions
+	assert.Equal(t, `[{"Id":"5e8b","Value":"[REDACTED]","Version":2}]`, redact(`[{"Id":"5e8b","Value":"Au clair de la \"lune\"","Version":2}]`))
+	assert.Equal(t, "{Type:line LocationId:loc_0 Value:[REDACTED] Id:0}", redact("{Type:line LocationId:loc_0 Value:Au clair de la lune Id:0}"))
+	assert.Equal(t, `dup key: { Suggestion: "[REDACTED]" }`, redact(`dup key: { Suggestion: "mon ami Pierrot" }`))
+	assert.Equal(t, "Value of 3 pictures updated", redact("Value of 3 pictures updated"))
+}
+
+func TestRequestContext(t *testing.T) {
+	previousPassword := os.Getenv("CLUSTER_INTERNAL_PASSWORD")
+	os.Setenv("CLUSTER_INTERNAL_PASSWORD", "cluster_password")
+	defer os.Setenv("CLUSTER_INTERNAL_PASSWORD", previousPassword)
+
+	var output bytes.Buffer
+	logMutex.Lock()
+	previousOutput := logOutput
+	logOutput = &output
+	logMutex.Unlock()
+	defer func() {
+		logMutex.Lock()
+		logOutput = previousOutput
+		logMutex.Unlock()
+	}()
+
+	router := mux.NewRouter()
+	router.Use(requestContext)
+	router.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		debugf(r.Context(), "Found %v documents", 3)
+		logf(r.Context(), "[ERROR] : Error during MongoDB selection")
+	})
+	entries := func() []logEntry {
+		var entries []logEntry
+		lines := bufio.NewScanner(&output)
+		for lines.Scan() {
+			var entry logEntry
+			json.Unmarshal(lines.Bytes(), &entry)
+			entries = append(entries, entry)
+		}
+		return entries
+	}
+
+	request, _ := http.NewRequest("GET", "/", nil)
+	request.Header.Set("X-Request-Id", "gateway-42")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	assert.Equal(t, "gateway-42", recorder.Header().Get("X-Request-Id"))
+	logged := entries()
+	if assert.Len(t, logged, 1) {
+		assert.Equal(t, "error", logged[0].Level)
+		assert.Equal(t, "gateway-42", logged[0].RequestId)
+	}
+
+	// an id which can't be trusted is replaced
+	request, _ = http.NewRequest("GET", "/", nil)
+	request.Header.Set("X-Request-Id", "forged\"id")
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	assert.Len(t, recorder.Header().Get("X-Request-Id"), 16)
+	entries()
+
+	// the debug lines are only written for the services and the administrators asking for them
+	request, _ = http.NewRequest("GET", "/", nil)
+	request.Header.Set("X-Debug", "true")
+	request.Header.Set("Authorization", "annotator_token")
+	router.ServeHTTP(httptest.NewRecorder(), request)
+	assert.Len(t, entries(), 1)
+
+	request, _ = http.NewRequest("GET", "/", nil)
+	request.Header.Set("X-Debug", "true")
+	request.Header.Set("Authorization", "cluster_password")
+	router.ServeHTTP(httptest.NewRecorder(), request)
+	logged = entries()
+	if assert.Len(t, logged, 3) {
+		assert.Equal(t, "debug", logged[0].Level)
+		assert.Equal(t, "debug", logged[1].Level)
+		assert.Equal(t, "Found 3 documents", logged[1].Message)
+	}
+}
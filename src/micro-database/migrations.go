@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+/**
+A migration evolves the stored documents, it must be idempotent as it can be run again if it was interrupted
+up : migrates the collection and returns the numbers of modified documents and of documents it can't migrate,
+nothing is written in a dry run
+*/
+type Migration struct {
+	Version int
+	Name    string
+	up      func(ctx context.Context, collection *mongo.Collection, dryRun bool) (MigrationCounts, error)
+}
+
+type MigrationCounts struct {
+	Modified int64
+	Skipped  int64
+}
+
+// Migrations in the order they are applied, a version must never be reused
+var Migrations = []Migration{
+	{Version: 1, Name: "normalize-piff", up: migrateNormalizePiFF},
+}
+
+type MigrationRecord struct {
+	Version int       `bson:"_id" json:"Version"`
+	Name    string    `bson:"Name" json:"Name"`
+	Applied time.Time `bson:"Applied" json:"Applied"`
+	// Number of documents modified
+	Modified int64 `bson:"Modified" json:"Modified"`
+	// Number of documents which can't be migrated, a migration is only recorded without any
+	Skipped int64 `bson:"Skipped,omitempty" json:"Skipped"`
+}
+
+// The documents are updated by batches, each with the timeout of a write
+const migrationBatchSize = 500
+
+var ErrMigrationIncomplete = errors.New("Some documents can't be migrated")
+
+// Migrations are run at startup unless MIGRATE_ON_STARTUP is false
+var migrateOnStartup = true
+
+func init() {
+	if enabled, err := strconv.ParseBool(os.Getenv("MIGRATE_ON_STARTUP")); err == nil {
+		migrateOnStartup = enabled
+	}
+}
+
+func migrationsCollection(collection *mongo.Collection) *mongo.Collection {
+	return companionCollection(collection, "migrations")
+}
+
+func AppliedMigrations(ctx context.Context, collection *mongo.Collection) ([]MigrationRecord, error) {
+	ctx, cancel := withTimeout(ctx, OperationRead)
+	defer cancel()
+
+	cur, err := migrationsCollection(collection).Find(ctx, bson.D{}, options.Find().SetSort(bson.D{{"_id", 1}}))
+	if err != nil {
+		return nil, mongoError(ctx, err, "Error during MongoDB selection")
+	}
+	defer cur.Close(ctx)
+
+	records := []MigrationRecord{}
+	for cur.Next(ctx) {
+		var record MigrationRecord
+		if err := cur.Decode(&record); err != nil {
+			logf(ctx, "[DECODE] %v", err)
+			return nil, errors.New("Could not decode data from mongo")
+		}
+		records = append(records, record)
+	}
+	if err := cur.Err(); err != nil {
+		logf(ctx, "[CURSOR] %v", err)
+		return nil, errors.New("Error while iterating results")
+	}
+
+	return records, nil
+}
+
+/**
+Apply the migrations which were not applied yet, in order, and stop at the first failure
+A migration which skipped documents is not recorded : it fails with ErrMigrationIncomplete, and is run again
+once the documents are repaired
+In a dry run the returned records tell how many documents each pending migration would modify
+The migrations go through the whole collections, only their operations have a timeout
+*/
+func Migrate(ctx context.Context, collection *mongo.Collection, dryRun bool) ([]MigrationRecord, error) {
+	applied, err := AppliedMigrations(ctx, collection)
+	if err != nil {
+		return nil, err
+	}
+	done := make(map[int]bool)
+	for _, record := range applied {
+		done[record.Version] = true
+	}
+
+	results := []MigrationRecord{}
+	for _, migration := range Migrations {
+		if done[migration.Version] {
+			continue
+		}
+
+		counts, err := migration.up(ctx, collection, dryRun)
+		if err != nil {
+			return results, fmt.Errorf("migration %v %v : %w", migration.Version, migration.Name, err)
+		}
+		record := MigrationRecord{Version: migration.Version, Name: migration.Name, Applied: time.Now().UTC(), Modified: counts.Modified, Skipped: counts.Skipped}
+		results = append(results, record)
+
+		if dryRun {
+			logf(ctx, "Migration %v %v would modify %v documents, %v can't be migrated\n", migration.Version, migration.Name, counts.Modified, counts.Skipped)
+			continue
+		}
+		if counts.Skipped > 0 {
+			return results, fmt.Errorf("migration %v %v : %w : %v documents, %v modified", migration.Version, migration.Name, ErrMigrationIncomplete, counts.Skipped, counts.Modified)
+		}
+
+		// another replica may have run the same migration meanwhile, which is harmless as they are idempotent
+		insertCtx, cancel := withTimeout(ctx, OperationWrite)
+		_, err = migrationsCollection(collection).InsertOne(insertCtx, record)
+		cancel()
+		if err != nil && !isDuplicateKey(err) {
+			return results, mongoError(ctx, err, "Error during MongoDB insertion")
+		}
+		logf(ctx, "Migration %v %v modified %v documents\n", migration.Version, migration.Name, counts.Modified)
+	}
+
+	return results, nil
+}
+
+func isDuplicateKey(err error) bool {
+	var writeErr mongo.WriteException
+	if errors.As(err, &writeErr) {
+		for _, e := range writeErr.WriteErrors {
+			if e.Code == 11000 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/**
+Write a batch of updates of a migration, with the timeout of a write
+*/
+func writeMigrationBatch(ctx context.Context, collection *mongo.Collection, updates []mongo.WriteModel) error {
+	if len(updates) == 0 {
+		return nil
+	}
+	ctx, cancel := withTimeout(ctx, OperationWrite)
+	defer cancel()
+
+	_, err := collection.BulkWrite(ctx, updates, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		return mongoError(ctx, err, "Error during MongoDB update")
+	}
+	return nil
+}
+
+/**
+Migration 1 : PiFF stored as in the PiFF files (lower case keys, location_id, coordinates as strings or floats)
+can't be decoded in a PiFFStruct, it is rewritten with the keys of the API and integer coordinates
+The unknown keys are kept, after the known ones. A PiFF whose numbers can't be read is skipped
+*/
+func migrateNormalizePiFF(ctx context.Context, collection *mongo.Collection, dryRun bool) (MigrationCounts, error) {
+	var counts MigrationCounts
+	// the trash holds pictures too, they can be restored
+	for _, coll := range []*mongo.Collection{collection, trashCollection(collection)} {
+		cur, err := coll.Find(ctx, bson.D{}, options.Find().SetProjection(bson.D{{"PiFF", 1}}).SetBatchSize(migrationBatchSize))
+		if err != nil {
+			return counts, mongoError(ctx, err, "Error during MongoDB selection")
+		}
+
+		updates := []mongo.WriteModel{}
+		for cur.Next(ctx) {
+			var doc struct {
+				Id   interface{} `bson:"_id"`
+				PiFF bson.Raw    `bson:"PiFF"`
+			}
+			if err := cur.Decode(&doc); err != nil {
+				cur.Close(ctx)
+				logf(ctx, "[DECODE] %v", err)
+				return counts, errors.New("Could not decode data from mongo")
+			}
+			if doc.PiFF == nil {
+				continue
+			}
+
+			var piff bson.D
+			if err := bson.Unmarshal(doc.PiFF, &piff); err != nil {
+				cur.Close(ctx)
+				logf(ctx, "[DECODE] %v", err)
+				return counts, errors.New("Could not decode data from mongo")
+			}
+			normalized, err := normalizePiFF(piff)
+			if err != nil {
+				logf(ctx, "[WARNING] PiFF of %v can't be migrated : %v", doc.Id, err.Error())
+				counts.Skipped++
+				continue
+			}
+			raw, err := bson.Marshal(normalized)
+			if err != nil {
+				cur.Close(ctx)
+				logf(ctx, "[ENCODE] %v", err)
+				return counts, errors.New("Could not encode data for mongo")
+			}
+			if bytes.Equal(raw, doc.PiFF) {
+				continue
+			}
+
+			counts.Modified++
+			if dryRun {
+				continue
+			}
+			// a PiFF modified since it was read is left to the next run
+			filter := bson.D{{"_id", doc.Id}, {"PiFF", doc.PiFF}}
+			update := bson.D{{"$set", bson.D{{"PiFF", normalized}}}, incrementVersion()}
+			updates = append(updates, mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(update))
+			if len(updates) == migrationBatchSize {
+				if err := writeMigrationBatch(ctx, coll, updates); err != nil {
+					cur.Close(ctx)
+					return counts, err
+				}
+				updates = updates[:0]
+			}
+		}
+
+		err = cur.Err()
+		cur.Close(ctx)
+		if err != nil {
+			logf(ctx, "[CURSOR] %v", err)
+			return counts, errors.New("Error while iterating results")
+		}
+		if err := writeMigrationBatch(ctx, coll, updates); err != nil {
+			return counts, err
+		}
+	}
+
+	return counts, nil
+}
+
+// Known keys of each part of a PiFF, with the names they can have in the PiFF files
+var (
+	piffKeys     = [][]string{{"Meta", "meta"}, {"Location", "location"}, {"Data", "data"}, {"Children", "children"}, {"Parent", "parent"}}
+	metaKeys     = [][]string{{"Type", "type"}, {"URL", "url", "Url"}}
+	locationKeys = [][]string{{"Type", "type"}, {"Polygon", "polygon"}, {"Id", "id"}}
+	dataKeys     = [][]string{{"Type", "type"}, {"LocationId", "location_id", "locationId", "locationid"}, {"Value", "value"}, {"Id", "id"}}
+)
+
+func normalizePiFF(piff bson.D) (bson.D, error) {
+	return normalizeDocument(piff, piffKeys, func(key string, value interface{}) (interface{}, error) {
+		switch key {
+		case "Meta":
+			meta, ok := value.(primitive.D)
+			if !ok {
+				return value, nil
+			}
+			return normalizeDocument(meta, metaKeys, nil)
+		case "Location":
+			return normalizeArray(value, locationKeys, func(key string, value interface{}) (interface{}, error) {
+				if key == "Polygon" {
+					return normalizePolygon(value)
+				}
+				return value, nil
+			})
+		case "Data":
+			return normalizeArray(value, dataKeys, nil)
+		case "Children":
+			children, ok := value.(primitive.A)
+			if !ok {
+				return value, nil
+			}
+			normalized := primitive.A{}
+			for _, child := range children {
+				n, err := toInt(child)
+				if err != nil {
+					return nil, err
+				}
+				normalized = append(normalized, n)
+			}
+			return normalized, nil
+		case "Parent":
+			return toInt(value)
+		}
+		return value, nil
+	})
+}
+
+/**
+Rename the known keys and put them first, in the order of the struct, the other keys are kept in alphabetical order
+convert : optional conversion of the value of the known keys
+*/
+func normalizeDocument(doc bson.D, keys [][]string, convert func(key string, value interface{}) (interface{}, error)) (bson.D, error) {
+	normalized := bson.D{}
+	used := make(map[string]bool)
+
+	for _, names := range keys {
+		for _, name := range names {
+			value, found := lookup(doc, name)
+			if !found || used[name] {
+				continue
+			}
+			used[name] = true
+			if convert != nil && value != nil {
+				var err error
+				value, err = convert(names[0], value)
+				if err != nil {
+					return nil, fmt.Errorf("%v : %w", names[0], err)
+				}
+			}
+			normalized = append(normalized, bson.E{Key: names[0], Value: value})
+			break
+		}
+	}
+
+	others := bson.D{}
+	for _, elem := range doc {
+		if !used[elem.Key] && !isKnownKey(elem.Key, keys) {
+			others = append(others, elem)
+		}
+	}
+	sort.SliceStable(others, func(i, j int) bool { return others[i].Key < others[j].Key })
+
+	return append(normalized, others...), nil
+}
+
+func normalizeArray(value interface{}, keys [][]string, convert func(key string, value interface{}) (interface{}, error)) (interface{}, error) {
+	array, ok := value.(primitive.A)
+	if !ok {
+		return value, nil
+	}
+	normalized := primitive.A{}
+	for _, item := range array {
+		doc, ok := item.(primitive.D)
+		if !ok {
+			normalized = append(normalized, item)
+			continue
+		}
+		n, err := normalizeDocument(doc, keys, convert)
+		if err != nil {
+			return nil, err
+		}
+		normalized = append(normalized, n)
+	}
+	return normalized, nil
+}
+
+func normalizePolygon(value interface{}) (interface{}, error) {
+	points, ok := value.(primitive.A)
+	if !ok {
+		return value, nil
+	}
+	normalized := primitive.A{}
+	for _, point := range points {
+		coordinates, ok := point.(primitive.A)
+		if !ok || len(coordinates) != 2 {
+			return nil, fmt.Errorf("invalid point %v", point)
+		}
+		x, err := toInt(coordinates[0])
+		if err != nil {
+			return nil, err
+		}
+		y, err := toInt(coordinates[1])
+		if err != nil {
+			return nil, err
+		}
+		normalized = append(normalized, primitive.A{x, y})
+	}
+	return normalized, nil
+}
+
+func lookup(doc bson.D, key string) (interface{}, bool) {
+	for _, elem := range doc {
+		if elem.Key == key {
+			return elem.Value, true
+		}
+	}
+	return nil, false
+}
+
+func isKnownKey(key string, keys [][]string) bool {
+	for _, names := range keys {
+		for _, name := range names {
+			if name == key {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Numbers of the PiFF files can be strings or floats, they are rounded
+func toInt(value interface{}) (int64, error) {
+	switch v := value.(type) {
+	case int32:
+		return int64(v), nil
+	case int64:
+		return v, nil
+	case float64:
+		return int64(math.Round(v)), nil
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid number %q", v)
+		}
+		return int64(math.Round(f)), nil
+	}
+	return 0, fmt.Errorf("invalid number %v", value)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"testing"
+)
+
+func TestMigrateNormalizePiFF(t *testing.T) {
+	coll := Client.Database("taliesin_test").Collection("test_migrations")
+	coll.Drop(context.TODO())
+	migrationsCollection(coll).Drop(context.TODO())
+
+	// PiFF as in the PiFF files, which can't be decoded
+	id := primitive.NewObjectID()
+	coll.InsertOne(context.TODO(), bson.M{
+		"_id": id,
+		"Url": "/temp/none0",
+		"PiFF": bson.M{
+			"meta":     bson.M{"type": "line", "url": "", "piff_version": "version 0"},
+			"location": bson.A{bson.M{"type": "line", "polygon": bson.A{bson.A{"0.4", 0.0}, bson.A{261.6, "343"}}, "id": "loc_0"}},
+			"data":     bson.A{bson.M{"type": "line", "location_id": "loc_0", "value": "Arlequin", "id": "0"}},
+		},
+	})
+	_, err := FindOne(context.Background(), id, coll)
+	assert.NotNil(t, err)
+
+	records, err := Migrate(context.Background(), coll, true)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(records))
+	assert.Equal(t, int64(1), records[0].Modified)
+	applied, _ := AppliedMigrations(context.Background(), coll)
+	assert.Equal(t, 0, len(applied))
+
+	records, err = Migrate(context.Background(), coll, false)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), records[0].Modified)
+
+	pic, err := FindOne(context.Background(), id, coll)
+	assert.Nil(t, err)
+	assert.Equal(t, "loc_0", pic.PiFF.Data[0].LocationId)
+	assert.Equal(t, "Arlequin", pic.PiFF.Data[0].Value)
+	assert.Equal(t, [][2]int{{0, 0}, {262, 343}}, pic.PiFF.Location[0].Polygon)
+	assert.Equal(t, int64(1), pic.Version)
+
+	// the unknown keys are kept
+	var raw bson.M
+	coll.FindOne(context.TODO(), bson.D{{"_id", id}}).Decode(&raw)
+	meta := raw["PiFF"].(bson.M)["Meta"].(bson.M)
+	assert.Equal(t, "version 0", meta["piff_version"])
+
+	// the migration is recorded and not run again
+	applied, _ = AppliedMigrations(context.Background(), coll)
+	assert.Equal(t, 1, len(applied))
+	records, err = Migrate(context.Background(), coll, false)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(records))
+
+	// and it is idempotent
+	counts, err := migrateNormalizePiFF(context.Background(), coll, false)
+	assert.Nil(t, err)
+	assert.Equal(t, MigrationCounts{}, counts)
+}
+
+func TestMigrationSkippedDocuments(t *testing.T) {
+	coll := Client.Database("taliesin_test").Collection("test_migrations_skipped")
+	coll.Drop(context.TODO())
+	migrationsCollection(coll).Drop(context.TODO())
+	defer coll.Drop(context.TODO())
+
+	id := primitive.NewObjectID()
+	coll.InsertOne(context.TODO(), bson.M{
+		"_id": id,
+		"Url": "/temp/none0",
+		"PiFF": bson.M{
+			"location": bson.A{bson.M{"type": "line", "polygon": bson.A{bson.A{"left", 0.0}}, "id": "loc_0"}},
+		},
+	})
+
+	records, err := Migrate(context.Background(), coll, true)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), records[0].Skipped)
+
+	// not recorded until the document is repaired
+	records, err = Migrate(context.Background(), coll, false)
+	assert.True(t, errors.Is(err, ErrMigrationIncomplete))
+	assert.Equal(t, int64(1), records[0].Skipped)
+	applied, _ := AppliedMigrations(context.Background(), coll)
+	assert.Equal(t, 0, len(applied))
+
+	coll.UpdateOne(context.TODO(), bson.D{{"_id", id}}, bson.D{{"$set", bson.D{{"PiFF.location.0.polygon", bson.A{bson.A{"4", 0.0}}}}}})
+	records, err = Migrate(context.Background(), coll, false)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), records[0].Modified)
+	applied, _ = AppliedMigrations(context.Background(), coll)
+	assert.Equal(t, 1, len(applied))
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -45,27 +46,72 @@ type Picture struct {
 	// Id in db
 	Id primitive.ObjectID `bson:"_id" json:"Id"`
 	// Piff
-	PiFF     PiFFStruct `json:"PiFF"`
-	Url      string     `json:"Url"`      //The URL on our fileserver
-	Filename string     `json:"Filename"` //The original name of the file
+	PiFF     PiFFStruct `json:"PiFF" validate:"required"`
+	Url      string     `json:"Url" validate:"required"` //The URL on our fileserver
+	Filename string     `json:"Filename"`                //The original name of the file
 	// Flags
 	Annotated  bool `json:"Annotated"`
 	Corrected  bool `json:"Corrected"`
 	SentToReco bool `json:"SentToReco"`
 	Unreadable bool `json:"Unreadable"`
+	// Custom flags declared in the settings
+	Flags map[Flag]bool `bson:"Flags,omitempty" json:"Flags,omitempty"`
 	//
 	Annotator string `json:"Annotator"`
+	// Incremented on every modification, used as ETag
+	Version int64 `json:"Version"`
+	// File of an uploaded picture
+	Image *ImageInfo `bson:"Image,omitempty" json:"Image,omitempty"`
+	// Set once the image was read by the duplicate detection
+	Fingerprint *Fingerprint `bson:"Fingerprint,omitempty" json:"Fingerprint,omitempty"`
+	// Root of the group of duplicates of the picture, which is annotated in its place
+	DuplicateOf     *primitive.ObjectID `bson:"DuplicateOf,omitempty" json:"DuplicateOf,omitempty"`
+	DuplicateReason DuplicateReason     `bson:"DuplicateReason,omitempty" json:"DuplicateReason,omitempty"`
+	// Pictures an admin unlinked it from, they are not linked again
+	DistinctFrom []primitive.ObjectID `bson:"DistinctFrom,omitempty" json:"DistinctFrom,omitempty"`
+	// Duplicate whose transcription was copied to it, unset once it is annotated itself
+	CopiedFrom *primitive.ObjectID `bson:"CopiedFrom,omitempty" json:"CopiedFrom,omitempty"`
+}
+
+type ImageInfo struct {
+	// SHA-256 of the file, the file is named after it
+	Hash   string `bson:"Hash" json:"Hash"`
+	Format string `bson:"Format" json:"Format"`
+	Width  int    `bson:"Width" json:"Width"`
+	Height int    `bson:"Height" json:"Height"`
+	Size   int64  `bson:"Size" json:"Size"`
 }
 
 type Modification struct {
-	Id    primitive.ObjectID `json:"Id"`
-	Flag  string             `json:"Flag"`
-	Value bool               `json:"Value"`
+	Id    primitive.ObjectID `json:"Id" validate:"required"`
+	Flag  Flag               `json:"Flag" validate:"required"`
+	Value bool               `json:"Value" validate:"required"`
+	// Expected version of the picture, the modification is rejected if it changed
+	Version *int64 `json:"Version,omitempty"`
+}
+
+/**
+Fields of a picture replaced by a patch, the others are kept
+*/
+type PicturePatch struct {
+	Url      *string     `json:"Url,omitempty"`
+	Filename *string     `json:"Filename,omitempty"`
+	PiFF     *PiFFStruct `json:"PiFF,omitempty"`
 }
 
+var ErrPictureNotFound = errors.New("No picture with this id")
+var ErrEmptyPatch = errors.New("Nothing to modify")
+
+// Annotator of the suggestions made by the recognizer
+const RecognizerAnnotator = "$taliesin_recognizer"
+
 type Annotation struct {
 	Id    primitive.ObjectID `json:"Id"`
-	Value string             `json:"Value"`
+	Value string             `json:"Value" validate:"required"`
+	// Version of the model which made the suggestion, only for the recognizer
+	Model string `json:"Model,omitempty"`
+	// Expected version of the picture, the annotation is rejected if it changed
+	Version *int64 `json:"Version,omitempty"`
 }
 
 func checkError(err error) {
@@ -92,16 +138,17 @@ func Connect() *mongo.Client {
 	}
 
 	// Set client options
-	clientOptions := options.Client().ApplyURI(URI)
+	clientOptions := options.Client().ApplyURI(URI).SetMonitor(newMongoMonitor())
 
 	// Connect to MongoDB
-	client, err := mongo.Connect(context.TODO(), clientOptions)
+	client, err := mongo.Connect(context.Background(), clientOptions)
 	checkError(err)
 
 	log.Printf("Establishing connection to mongodb on %v\n", URI)
 
 	// Check the connection
-	ctx, _ := context.WithTimeout(context.Background(), 2*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
 	err = client.Ping(ctx, readpref.Primary())
 	checkError(err)
 
@@ -118,56 +165,141 @@ func Connect() *mongo.Client {
 	return client
 }
 
+/**
+Collections holding data related to a collection of pictures are named after it,
+so that each environment and each test collection has its own
+*/
+func companionCollection(collection *mongo.Collection, suffix string) *mongo.Collection {
+	return collection.Database().Collection(collection.Name() + "_" + suffix)
+}
+
 func Disconnect(client *mongo.Client) {
 	//Disconnection
-	err := client.Disconnect(context.TODO())
+	ctx, cancel := withTimeout(context.Background(), OperationWrite)
+	defer cancel()
+	err := client.Disconnect(ctx)
 	checkError(err)
 	log.Printf("Connection to MongoDB closed.\n")
 }
 
+// Fields set by the service only, they are removed from the inserted pictures
+var serverManagedFields = []string{"Image", "Fingerprint", "DuplicateOf", "DuplicateReason", "DistinctFrom", "CopiedFrom"}
+
 /**
 From a json flow, insert multiple entries in the database
+The custom flags of the entries must be declared in the settings, otherwise nothing is inserted and an ErrUnknownFlag is returned
+Their values must be booleans, otherwise an ErrInvalidFlagValue is returned
 byte : Flot JSON
+actor : user inserting the entries
 */
-func InsertMany(b []byte, collection *mongo.Collection) ([]interface{}, error) {
+func InsertMany(ctx context.Context, b []byte, collection *mongo.Collection, actor string) ([]interface{}, error) {
+	pics, err := decodePictures(ctx, b)
+	if err != nil {
+		return nil, err
+	}
+	settings, err := GetSettings(ctx, collection)
+	if err != nil {
+		return nil, err
+	}
+	for _, pic := range pics {
+		if doc, ok := pic.(map[string]interface{}); ok {
+			for _, field := range serverManagedFields {
+				delete(doc, field)
+			}
+			// not every caller decodes the pictures first, the cli inserts the file as it is
+			if value, ok := doc[customFlagsField]; ok && value != nil {
+				flags, ok := value.(map[string]interface{})
+				if !ok {
+					return nil, fmt.Errorf("%w : %v is not an object of flags", ErrInvalidFlagValue, customFlagsField)
+				}
+				if err := settings.ValidateCustomFlags(flags); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return insertPictures(ctx, pics, collection, actor)
+}
+
+func decodePictures(ctx context.Context, b []byte) ([]interface{}, error) {
 	var pics []interface{}
 	err := json.Unmarshal(b, &pics)
 	if err != nil {
-		log.Printf("[UNMARSHAL] : %v", err.Error())
+		logf(ctx, "[UNMARSHAL] : %v", err.Error())
 		return nil, errors.New("Could not unmarshal data")
 	}
-	insertManyResult, err := collection.InsertMany(context.TODO(), pics)
+	return pics, nil
+}
+
+/**
+Insert decoded pictures, keeping the fields managed by the service as the uploads do
+Their duplicates are looked for in the background, see WaitDuplicateChecks
+*/
+func insertPictures(ctx context.Context, pics []interface{}, collection *mongo.Collection, actor string) ([]interface{}, error) {
+	insertCtx, cancel := withTimeout(ctx, OperationWrite)
+	defer cancel()
+
+	// versions are managed by the database, new pictures always start at 0
+	for _, pic := range pics {
+		if doc, ok := pic.(map[string]interface{}); ok {
+			doc["Version"] = 0
+		}
+	}
+	insertManyResult, err := collection.InsertMany(insertCtx, pics)
 	if err != nil {
-		log.Printf("[MONGO-DRIVER] : %v", err.Error())
-		return nil, errors.New("Error during MongoDB insertion")
+		return nil, mongoError(ctx, err, "Error during MongoDB insertion")
 	}
 
-	log.Printf("Inserted multiple documents: %v\n", insertManyResult.InsertedIDs)
+	logf(ctx, "Inserted multiple documents: %v\n", insertManyResult.InsertedIDs)
+
+	events := make([]Event, 0, len(pics))
+	for i, id := range insertManyResult.InsertedIDs {
+		event := Event{Type: EventInserted, Actor: actor}
+		event.PictureId, _ = id.(primitive.ObjectID)
+		if doc, ok := pics[i].(map[string]interface{}); ok {
+			event.Changes = map[string]interface{}{"Url": doc["Url"], "Filename": doc["Filename"]}
+		}
+		events = append(events, event)
+	}
+	PublishEvents(ctx, collection, events...)
+	CheckInsertedDuplicatesLater(ctx, insertManyResult.InsertedIDs, collection)
+
 	return insertManyResult.InsertedIDs, nil
 }
 
-func FindOne(id primitive.ObjectID, collection *mongo.Collection) (Picture, error) {
+func FindOne(ctx context.Context, id primitive.ObjectID, collection *mongo.Collection) (Picture, error) {
+	ctx, cancel := withTimeout(ctx, OperationRead)
+	defer cancel()
+
 	filter := bson.D{{"_id", id}}
 	var result Picture
 
-	err := collection.FindOne(context.TODO(), filter).Decode(&result)
+	err := collection.FindOne(ctx, filter).Decode(&result)
 	if err != nil {
-		log.Printf("[MONGO-DRIVER] : %v", err.Error())
-		return Picture{}, errors.New("Error during MongoDB selection")
+		return Picture{}, mongoError(ctx, err, "Error during MongoDB selection")
 	} else {
-		log.Printf("Found a single document: %+v\n", result)
+		debugf(ctx, "Found document %v", result.Id.Hex())
 	}
 
 	return result, nil
 }
 
-func FindManyUnused(amount int, collection *mongo.Collection) ([]Picture, error) {
+// The duplicates are left out of the queues, their root is annotated in their place
+func notDuplicate() bson.D {
+	return bson.D{{"DuplicateOf", bson.D{{"$exists", false}}}}
+}
+
+func FindManyUnused(ctx context.Context, amount int, collection *mongo.Collection) ([]Picture, error) {
+	ctx, cancel := withTimeout(ctx, OperationRead)
+	defer cancel()
+
 	// Pass these options to the Find method
 	pipeline := mongo.Pipeline{
 		bson.D{{"$match", bson.D{{"$and",
 			bson.A{
 				bson.D{{"Annotated", false}},
 				bson.D{{"Unreadable", false}},
+				notDuplicate(),
 			}}}}},
 		bson.D{{"$sample", bson.D{{"size", amount}}}},
 	}
@@ -178,21 +310,20 @@ func FindManyUnused(amount int, collection *mongo.Collection) ([]Picture, error)
 	var results []Picture
 
 	// Passing bson.D{{}} as the filter matches all documents in the collection
-	cur, err := collection.Aggregate(context.TODO(), pipeline, opts)
+	cur, err := collection.Aggregate(ctx, pipeline, opts)
 	if err != nil {
-		log.Printf("[MONGO-DRIVER] : %v", err.Error())
-		return nil, errors.New("Error during MongoDB selection")
+		return nil, mongoError(ctx, err, "Error during MongoDB selection")
 	}
 
 	// Finding multiple documents returns a cursor
 	// Iterating through the cursor allows us to decode documents one at a time
-	for cur.Next(context.TODO()) {
+	for cur.Next(ctx) {
 
 		// create a value into which the single document can be decoded
 		var elem Picture
 		err := cur.Decode(&elem)
 		if err != nil {
-			log.Printf("[DECODE] %v", err)
+			logf(ctx, "[DECODE] %v", err)
 			return nil, errors.New("Error while iterating results")
 		}
 
@@ -200,25 +331,29 @@ func FindManyUnused(amount int, collection *mongo.Collection) ([]Picture, error)
 	}
 
 	if err := cur.Err(); err != nil {
-		log.Printf("[CURSOR] %v", err)
+		logf(ctx, "[CURSOR] %v", err)
 		return nil, errors.New("Error while iterating results")
 	} else {
-		log.Printf("Found multiple documents : %v\n", results)
+		debugf(ctx, "Found %v documents", len(results))
 	}
 	// Close the cursor once finished
-	cur.Close(context.TODO())
+	cur.Close(ctx)
 
 	return results, nil
 }
 
-func FindManyWithSuggestion(amount int, collection *mongo.Collection) ([]Picture, error) {
+func FindManyWithSuggestion(ctx context.Context, amount int, collection *mongo.Collection) ([]Picture, error) {
+	ctx, cancel := withTimeout(ctx, OperationRead)
+	defer cancel()
+
 	// Pass these options to the Find method
 	pipeline := mongo.Pipeline{
 		bson.D{{"$match", bson.D{{"$and",
 			bson.A{
 				bson.D{{"Annotated", true}},
 				bson.D{{"Unreadable", false}},
-				bson.D{{"Annotator", "$taliesin_recognizer"}},
+				bson.D{{"Annotator", RecognizerAnnotator}},
+				notDuplicate(),
 			}}}}},
 		bson.D{{"$sample", bson.D{{"size", amount}}}},
 	}
@@ -229,38 +364,40 @@ func FindManyWithSuggestion(amount int, collection *mongo.Collection) ([]Picture
 	var results []Picture
 
 	// Passing bson.D{{}} as the filter matches all documents in the collection
-	cur, err := collection.Aggregate(context.TODO(), pipeline, opts)
+	cur, err := collection.Aggregate(ctx, pipeline, opts)
 	if err != nil {
-		log.Printf("[MONGO-DRIVER] : %v", err.Error())
-		return nil, errors.New("Error during MongoDB selection")
+		return nil, mongoError(ctx, err, "Error during MongoDB selection")
 	}
 
 	// Finding multiple documents returns a cursor
 	// Iterating through the cursor allows us to decode documents one at a time
-	for cur.Next(context.TODO()) {
+	for cur.Next(ctx) {
 		// create a value into which the single document can be decoded
 		var elem Picture
 		err := cur.Decode(&elem)
 		if err != nil {
-			log.Printf("[DECODE] %v", err)
+			logf(ctx, "[DECODE] %v", err)
 			return nil, errors.New("Error while iterating results")
 		}
 		results = append(results, elem)
 	}
 
 	if err := cur.Err(); err != nil {
-		log.Printf("[CURSOR] %v", err)
+		logf(ctx, "[CURSOR] %v", err)
 		return nil, errors.New("Error while iterating results")
 	} else {
-		log.Printf("Found multiple documents : %v\n", results)
+		debugf(ctx, "Found %v documents", len(results))
 	}
 	// Close the cursor once finished
-	cur.Close(context.TODO())
+	cur.Close(ctx)
 
 	return results, nil
 }
 
-func FindManyForSuggestion(amount int, collection *mongo.Collection) ([]Picture, error) {
+func FindManyForSuggestion(ctx context.Context, amount int, collection *mongo.Collection) ([]Picture, error) {
+	ctx, cancel := withTimeout(ctx, OperationWrite)
+	defer cancel()
+
 	// Pass these options to the Find method
 	pipeline := mongo.Pipeline{
 		bson.D{{"$match", bson.D{{"$and",
@@ -268,6 +405,7 @@ func FindManyForSuggestion(amount int, collection *mongo.Collection) ([]Picture,
 				bson.D{{"Annotated", false}},
 				bson.D{{"Unreadable", false}},
 				bson.D{{"SentToReco", false}},
+				notDuplicate(),
 			}}}}},
 		bson.D{{"$sample", bson.D{{"size", amount}}}},
 	}
@@ -278,15 +416,14 @@ func FindManyForSuggestion(amount int, collection *mongo.Collection) ([]Picture,
 	var results []Picture
 
 	// Passing bson.D{{}} as the filter matches all documents in the collection
-	cur, err := collection.Aggregate(context.TODO(), pipeline, opts)
+	cur, err := collection.Aggregate(ctx, pipeline, opts)
 	if err != nil {
-		log.Printf("[MONGO-DRIVER] : %v", err.Error())
-		return nil, errors.New("Error during MongoDB selection")
+		return nil, mongoError(ctx, err, "Error during MongoDB selection")
 	}
 
 	// Finding multiple documents returns a cursor
 	// Iterating through the cursor allows us to decode documents one at a time
-	for cur.Next(context.TODO()) {
+	for cur.Next(ctx) {
 
 		// create a value into which the single document can be decoded
 		var elem Picture
@@ -295,34 +432,49 @@ func FindManyForSuggestion(amount int, collection *mongo.Collection) ([]Picture,
 			return nil, err
 		}
 
-		filter := bson.D{{"_id", elem.Id}}
+		// another recognizer may have sampled the same picture, only the first one to flag it keeps it
+		filter := bson.D{{"_id", elem.Id}, {"SentToReco", false}}
 		update := bson.D{
 			{"$set", bson.D{
 				{"SentToReco", true},
 			}},
+			incrementVersion(),
 		}
-		_, err = collection.UpdateOne(context.TODO(), filter, update)
+		updateResult, err := collection.UpdateOne(ctx, filter, update)
 		if err != nil {
-			log.Printf("[MONGO-DRIVER] : %v", err.Error())
-			return nil, errors.New("Error during MongoDB update")
+			return nil, mongoError(ctx, err, "Error during MongoDB update")
+		}
+		if updateResult.ModifiedCount != 1 {
+			continue
 		}
+		elem.SentToReco = true
+		elem.Version++
+		PublishEvents(ctx, collection, Event{
+			Type:      EventFlagged,
+			PictureId: elem.Id,
+			Actor:     RecognizerAnnotator,
+			Changes:   map[string]interface{}{string(FlagSentToReco): true},
+		})
 
 		results = append(results, elem)
 	}
 
 	if err := cur.Err(); err != nil {
-		log.Printf("[CURSOR] : %v", err.Error())
+		logf(ctx, "[CURSOR] : %v", err.Error())
 		return nil, errors.New("Error while iterating results")
 	} else {
-		log.Printf("Found multiple documents : %v\n", results)
+		debugf(ctx, "Found %v documents", len(results))
 	}
 	// Close the cursor once finished
-	cur.Close(context.TODO())
+	cur.Close(ctx)
 
 	return results, nil
 }
 
-func FindAll(collection *mongo.Collection) ([]Picture, error) {
+func FindAll(ctx context.Context, collection *mongo.Collection) ([]Picture, error) {
+	ctx, cancel := withTimeout(ctx, OperationScan)
+	defer cancel()
+
 	// Pass these options to the Find method
 	findOptions := options.Find()
 	//findOptions.SetLimit(2)
@@ -331,41 +483,34 @@ func FindAll(collection *mongo.Collection) ([]Picture, error) {
 	var results []Picture
 
 	// Passing bson.D{{}} as the filter matches all documents in the collection
-	cur, err := collection.Find(context.TODO(), bson.D{}, findOptions)
+	cur, err := collection.Find(ctx, bson.D{}, findOptions)
 	if err != nil {
-		log.Printf("[MONGO-DRIVER] : %v", err.Error())
-		return nil, errors.New("Error during MongoDB selection")
+		return nil, mongoError(ctx, err, "Error during MongoDB selection")
 	}
 
 	// Finding multiple documents returns a cursor
 	// Iterating through the cursor allows us to decode documents one at a time
-	for cur.Next(context.TODO()) {
+	for cur.Next(ctx) {
 
 		// create a value into which the single document can be decoded
 		var elem Picture
 		err := cur.Decode(&elem)
 		if err != nil {
-			log.Printf("[DECODE] %v", err)
+			logf(ctx, "[DECODE] %v", err)
 			return nil, errors.New("Error while iterating results")
 		}
 
-		var result bson.D
-		if err := cur.Decode(&result); err != nil {
-			log.Printf("%v\n", err)
-		}
-		log.Printf("%v\n", result)
-
 		results = append(results, elem)
 	}
 
 	if err := cur.Err(); err != nil {
-		log.Printf("[CURSOR] %v", err)
+		logf(ctx, "[CURSOR] %v", err)
 		return nil, errors.New("Error while iterating results")
 	} else {
-		log.Printf("Found multiple documents : %+v\n", results)
+		debugf(ctx, "Found %v documents", len(results))
 	}
 	// Close the cursor once finished
-	cur.Close(context.TODO())
+	cur.Close(ctx)
 
 	return results, nil
 }
@@ -373,29 +518,56 @@ func FindAll(collection *mongo.Collection) ([]Picture, error) {
 /**
 Modify the différents flags
 byte : Flot JSON a list of Modification objects
+ifMatch : expected version of the only modified picture, nil to only use the versions in the body
+actor : user modifying the flags
+Every flag is checked before any modification, an unknown flag returns an ErrUnknownFlag
+Modifications on pictures whose version changed are skipped and returned in a ConflictError
 */
-func UpdateFlags(b []byte, collection *mongo.Collection) error {
+func UpdateFlags(ctx context.Context, b []byte, collection *mongo.Collection, ifMatch *int64, actor string) error {
 	var modifications []Modification
-	var filter, update bson.D
+	var update bson.D
 	err := json.Unmarshal(b, &modifications)
 	if err != nil {
 		return errors.New("Could not unmarshal data")
 	}
 
+	if err := checkIfMatchScope(len(modifications), ifMatch); err != nil {
+		return err
+	} else if ifMatch != nil {
+		modifications[0].Version = ifMatch
+	}
+
+	settings, err := GetSettings(ctx, collection)
+	if err != nil {
+		return err
+	}
+	for _, modif := range modifications {
+		if err := settings.ValidateFlag(modif.Flag); err != nil {
+			return err
+		}
+	}
+
+	conflicts := &ConflictError{}
 	for _, modif := range modifications {
-		filter = bson.D{{"_id", primitive.ObjectID(modif.Id)}}
 		update = bson.D{
 			{"$set", bson.D{
-				{modif.Flag, modif.Value},
+				{modif.Flag.Field(), modif.Value},
 			}},
 		}
-		updateResult, err := collection.UpdateOne(context.TODO(), filter, update)
+		// each picture has its own timeout, as for the annotations
+		updateCtx, cancel := withTimeout(ctx, OperationWrite)
+		updated, err := updateVersioned(updateCtx, collection, modif.Id, modif.Version, update, conflicts)
+		cancel()
 		if err != nil {
-			log.Printf("[MONGO-DRIVER] : %v", err.Error())
-			return errors.New("Error during MongoDB update")
+			return err
+		}
+		if updated {
+			PublishEvents(ctx, collection, flagEvent(ctx, modif.Id, modif.Flag, modif.Value, actor, collection))
 		}
+	}
 
-		log.Printf("Matched %v documents and updated %v documents.\n", updateResult.MatchedCount, updateResult.ModifiedCount)
+	if len(conflicts.Pictures) > 0 {
+		return conflicts
 	}
 	return nil
 }
@@ -404,85 +576,268 @@ func UpdateFlags(b []byte, collection *mongo.Collection) error {
 Annote multiple documents.
 Set the annotated flag to true
 byte : Flot JSON a list of Annotation objects
+ifMatch : expected version of the only annotated picture, nil to only use the versions in the body
+Annotations on pictures whose version changed are skipped and returned in a ConflictError
 */
-func UpdateValue(b []byte, collection *mongo.Collection, annotator string) error {
+func UpdateValue(ctx context.Context, b []byte, collection *mongo.Collection, annotator string, ifMatch *int64) error {
 	var annotations []Annotation
-	var filter, update bson.D
+	var update bson.D
 	err := json.Unmarshal(b, &annotations)
 	if err != nil {
 		return errors.New("Could not unmarshal data")
 	}
 
-	log.Printf("Value : %v\n", annotations)
+	if err := checkIfMatchScope(len(annotations), ifMatch); err != nil {
+		return err
+	} else if ifMatch != nil {
+		annotations[0].Version = ifMatch
+	}
+
+	// the transcriptions are not written in the logs
+	debugf(ctx, "Updating the value of %v pictures", len(annotations))
 
+	conflicts := &ConflictError{}
 	for _, annot := range annotations {
-		filter = bson.D{{"_id", annot.Id}}
+		// a transcription of its own is no longer a copy of its duplicates
 		update = bson.D{{"$set", bson.D{
 			{"PiFF.Data.0.Value", annot.Value},
 			{"Annotated", true},
 			{"Annotator", annotator},
-		}}}
-		updateResult, err := collection.UpdateOne(context.TODO(), filter, update)
+		}}, {"$unset", bson.D{{"CopiedFrom", ""}}}}
+		// each picture has its own timeout, a batch of the recognizer can be large
+		updateCtx, cancel := withTimeout(ctx, OperationWrite)
+		updated, err := updateVersioned(updateCtx, collection, annot.Id, annot.Version, update, conflicts)
+		cancel()
 		if err != nil {
-			log.Printf("[MONGO-DRIVER] : %v", err.Error())
-			return errors.New("Error during MongoDB update")
+			return err
+		}
+		if updated {
+			PublishEvents(ctx, collection, Event{
+				Type:      EventAnnotated,
+				PictureId: annot.Id,
+				Actor:     annotator,
+				Changes:   map[string]interface{}{"Value": annot.Value, "Annotator": annotator},
+			})
+
+			// the metrics are not worth failing an annotation
+			if annotator == RecognizerAnnotator {
+				err = RecordSuggestion(ctx, annot.Id, annot.Model, annot.Value, collection)
+			} else {
+				err = RecordHumanValue(ctx, annot.Id, annotator, annot.Value, collection)
+			}
+			if err != nil {
+				logf(ctx, "[ERROR] Recognizer metrics : %v", err.Error())
+			}
+
+			if err := PropagateTranscription(ctx, annot.Id, collection); err != nil {
+				logf(ctx, "[ERROR] Duplicates of %v : %v", annot.Id.Hex(), err.Error())
+			}
 		}
-		log.Printf("Matched %v documents and updated %v documents.\n", updateResult.MatchedCount, updateResult.ModifiedCount)
 	}
 
+	if len(conflicts.Pictures) > 0 {
+		return conflicts
+	}
 	return nil
 }
 
 /**
-  Flush the database
+Replace some fields of a picture
+ifMatch : expected version of the picture, nil for any
+actor : user modifying the picture
+The fingerprint is computed again by the duplicates scan when the image or the PiFF change
 */
-func DeleteAll(collection *mongo.Collection) error {
-	deleteResult, err := collection.DeleteMany(context.TODO(), bson.D{{}})
+func UpdatePicture(ctx context.Context, id primitive.ObjectID, patch PicturePatch, ifMatch *int64, collection *mongo.Collection, actor string) error {
+	ctx, cancel := withTimeout(ctx, OperationWrite)
+	defer cancel()
+
+	set := bson.D{}
+	changes := map[string]interface{}{}
+	if patch.Url != nil {
+		set = append(set, bson.E{"Url", *patch.Url})
+		changes["Url"] = *patch.Url
+	}
+	if patch.Filename != nil {
+		set = append(set, bson.E{"Filename", *patch.Filename})
+		changes["Filename"] = *patch.Filename
+	}
+	if patch.PiFF != nil {
+		// stored with the keys of its JSON, as when inserted
+		b, err := json.Marshal(patch.PiFF)
+		if err != nil {
+			return errors.New("Could not marshal data")
+		}
+		var piff map[string]interface{}
+		if err := json.Unmarshal(b, &piff); err != nil {
+			return errors.New("Could not unmarshal data")
+		}
+		set = append(set, bson.E{"PiFF", piff})
+		changes["PiFF"] = piff
+	}
+	if len(set) == 0 {
+		return ErrEmptyPatch
+	}
+
+	update := bson.D{{"$set", set}}
+	if patch.Url != nil || patch.PiFF != nil {
+		update = append(update, bson.E{"$unset", bson.D{{"Fingerprint", ""}}})
+	}
+	conflicts := &ConflictError{}
+	updated, err := updateVersioned(ctx, collection, id, ifMatch, update, conflicts)
 	if err != nil {
-		log.Printf("[MONGO-DRIVER] : %v", err.Error())
-		return errors.New("Error during MongoDB deletion")
+		return err
+	} else if len(conflicts.Pictures) > 0 {
+		return conflicts
+	} else if !updated {
+		return ErrPictureNotFound
 	}
-	log.Printf("Deleted %v documents in the trainers collection\n", deleteResult.DeletedCount)
+
+	PublishEvents(ctx, collection, Event{Type: EventUpdated, PictureId: id, Actor: actor, Changes: changes})
 	return nil
 }
 
-func CountSnippets(collection *mongo.Collection) (int64, error) {
+/**
+  Flush the database, after a snapshot of the collection
+  actor : user flushing the database
+  Returns the name of the snapshot collection
+*/
+func DeleteAll(ctx context.Context, collection *mongo.Collection, actor string) (string, error) {
+	// the snapshot is a scan, with its own timeout
+	snapshot, err := Snapshot(ctx, collection)
+	if err != nil {
+		return "", err
+	}
+
+	deleteCtx, cancel := withTimeout(ctx, OperationWrite)
+	defer cancel()
+	deleteResult, err := collection.DeleteMany(deleteCtx, bson.D{{}})
+	if err != nil {
+		return snapshot, mongoError(deleteCtx, err, "Error during MongoDB deletion")
+	}
+	logf(ctx, "Deleted %v documents in the trainers collection\n", deleteResult.DeletedCount)
+	PublishEvents(ctx, collection, Event{
+		Type:    EventDeleted,
+		Actor:   actor,
+		Changes: map[string]interface{}{"Count": deleteResult.DeletedCount, "Snapshot": snapshot},
+	})
+	return snapshot, nil
+}
+
+func CountSnippets(ctx context.Context, collection *mongo.Collection) (int64, error) {
+	ctx, cancel := withTimeout(ctx, OperationRead)
+	defer cancel()
+
 	filter := bson.D{{}}
 	opts := options.Count()
-	res, err := collection.CountDocuments(context.TODO(), filter, opts)
+	res, err := collection.CountDocuments(ctx, filter, opts)
 	return res, err
 }
 
-func CountFlag(collection *mongo.Collection, flag string) (int64, error) {
-	filter := bson.D{{flag, true}}
+func CountFlag(ctx context.Context, collection *mongo.Collection, flag Flag) (int64, error) {
+	ctx, cancel := withTimeout(ctx, OperationRead)
+	defer cancel()
+
+	filter := bson.D{{flag.Field(), true}}
 	opts := options.Count()
-	res, err := collection.CountDocuments(context.TODO(), filter, opts)
+	res, err := collection.CountDocuments(ctx, filter, opts)
 	return res, err
 }
 
-func CountAnnotatedIgnoringRecoOrUnreadable(collection *mongo.Collection) (int64, error) {
-	pipeline := mongo.Pipeline{bson.D{{"$match", bson.D{{"$and",
-		bson.A{
-			bson.D{{"Annotated", true}},
-			bson.D{{"Unreadable", false}},
-			bson.D{{"Annotator", bson.D{{"$not", bson.D{{"$regex", "\\$taliesin_recognizer"}}}}}}},
-	}}}}}
+func CountAnnotatedIgnoringRecoOrUnreadable(ctx context.Context, collection *mongo.Collection) (int64, error) {
+	ctx, cancel := withTimeout(ctx, OperationRead)
+	defer cancel()
 
-	opts := options.Aggregate()
+	filter := bson.D{
+		{"Annotated", true},
+		{"Unreadable", false},
+		{"Annotator", bson.D{{"$ne", RecognizerAnnotator}}},
+	}
+	opts := options.Count()
+	res, err := collection.CountDocuments(ctx, filter, opts)
+	return res, err
+}
 
-	// Passing bson.D{{}} as the filter matches all documents in the collection
-	cur, err := collection.Aggregate(context.TODO(), pipeline, opts)
+// Condition of a status counter, evaluated on each picture
+func statusCondition(conditions ...bson.D) bson.D {
+	return bson.D{{"$sum", bson.D{{"$cond", bson.A{bson.D{{"$and", conditions}}, 1, 0}}}}}
+}
+
+func fieldEquals(field string, value interface{}) bson.D {
+	return bson.D{{"$eq", bson.A{"$" + field, value}}}
+}
+
+/**
+Compute all the counts of the status with a single aggregation grouping the pictures by annotator
+flags : custom flags to count
+byAnnotator : also return the counts of each annotator
+*/
+func ComputeStatus(ctx context.Context, collection *mongo.Collection, flags []Flag, byAnnotator bool) (StatusCounts, map[string]StatusCounts, error) {
+	ctx, cancel := withTimeout(ctx, OperationRead)
+	defer cancel()
+
+	group := bson.D{
+		{"_id", "$Annotator"},
+		{"total", bson.D{{"$sum", 1}}},
+		{"annotated", statusCondition(fieldEquals("Annotated", true), fieldEquals("Unreadable", false), bson.D{{"$ne", bson.A{"$Annotator", RecognizerAnnotator}}})},
+		{"suggested", statusCondition(fieldEquals("Annotated", true), fieldEquals("Unreadable", false), fieldEquals("Annotator", RecognizerAnnotator))},
+		{"pendingForRecognizer", statusCondition(fieldEquals("Annotated", false), fieldEquals("Unreadable", false), fieldEquals("SentToReco", false))},
+		{"leased", statusCondition(fieldEquals("Annotated", false), fieldEquals("Unreadable", false), fieldEquals("SentToReco", true))},
+		{"unreadable", statusCondition(fieldEquals("Unreadable", true))},
+		{"corrected", statusCondition(fieldEquals("Corrected", true))},
+	}
+	// the names of the custom flags are alphanumeric, they can't clash with the counters
+	for _, flag := range flags {
+		group = append(group, bson.E{"flag_" + string(flag), statusCondition(fieldEquals(flag.Field(), true))})
+	}
+
+	cur, err := collection.Aggregate(ctx, mongo.Pipeline{bson.D{{"$group", group}}})
 	if err != nil {
-		return -1, err
+		return StatusCounts{}, nil, mongoError(ctx, err, "Error during MongoDB counting")
 	}
+	defer cur.Close(ctx)
 
-	res := int64(0)
+	var total StatusCounts
+	var annotators map[string]StatusCounts
+	if byAnnotator {
+		annotators = make(map[string]StatusCounts)
+	}
+	for cur.Next(ctx) {
+		var result bson.M
+		if err := cur.Decode(&result); err != nil {
+			logf(ctx, "[DECODE] %v", err)
+			return StatusCounts{}, nil, errors.New("Could not decode data from mongo")
+		}
 
-	// Finding multiple documents returns a cursor
-	// Iterating through the cursor allows us to decode documents one at a time
-	for cur.Next(context.TODO()) {
-		res++
+		count := func(key string) int64 {
+			n, _ := toInt(result[key])
+			return n
+		}
+		counts := StatusCounts{
+			Total:                count("total"),
+			Annotated:            count("annotated"),
+			Suggested:            count("suggested"),
+			PendingForRecognizer: count("pendingForRecognizer"),
+			Leased:               count("leased"),
+			Unreadable:           count("unreadable"),
+			Corrected:            count("corrected"),
+		}
+		for _, flag := range flags {
+			if counts.CustomFlags == nil {
+				counts.CustomFlags = make(map[Flag]int64)
+			}
+			counts.CustomFlags[flag] = count("flag_" + string(flag))
+		}
+
+		total.add(counts)
+		// pictures nobody annotated are only in the total
+		if annotator, ok := result["_id"].(string); ok && annotator != "" && byAnnotator {
+			annotators[annotator] = counts
+		}
+	}
+	if err := cur.Err(); err != nil {
+		logf(ctx, "[CURSOR] %v", err)
+		return StatusCounts{}, nil, errors.New("Error while iterating results")
 	}
 
-	return res, err
+	return total, annotators, nil
 }
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+Description of a route, the paths, methods and path parameters come from the router
+The request and response types are given as a value of the type, their schema is generated from the Go type
+*/
+type apiOperation struct {
+	Summary string
+	// Parameters of the query string and their description
+	Query map[string]string
+	// Value of the type of the JSON body, nil when there is none
+	Body interface{}
+	// Content type of a body which is not JSON
+	BodyType  string
+	Responses map[int]apiResponse
+	// Served by a route replaced by /api/v1, see deprecated
+	Deprecated bool
+	// Only the administrators can use the route
+	Admin bool
+	// Answered without authentication
+	Public bool
+}
+
+type apiResponse struct {
+	Description string
+	// Value of the type of the JSON body, nil when there is none
+	Body interface{}
+	// Content type of a body which is not JSON, alone or as an alternative of the JSON body
+	ContentType string
+}
+
+type openAPIDocument struct {
+	OpenAPI    string                                 `json:"openapi"`
+	Info       openAPIInfo                            `json:"info"`
+	Paths      map[string]map[string]openAPIOperation `json:"paths"`
+	Components openAPIComponents                      `json:"components"`
+	Security   []map[string][]string                  `json:"security"`
+}
+
+type openAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type openAPIComponents struct {
+	Schemas         map[string]*openAPISchema        `json:"schemas"`
+	SecuritySchemes map[string]openAPISecurityScheme `json:"securitySchemes"`
+}
+
+type openAPISecurityScheme struct {
+	Type        string `json:"type"`
+	In          string `json:"in"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+}
+
+type openAPIOperation struct {
+	Summary     string                     `json:"summary,omitempty"`
+	Parameters  []openAPIParameter         `json:"parameters,omitempty"`
+	RequestBody *openAPIRequestBody        `json:"requestBody,omitempty"`
+	Responses   map[string]openAPIResponse `json:"responses"`
+	Deprecated  bool                       `json:"deprecated,omitempty"`
+	// Empty for the public routes, absent to use the security of the document
+	Security *[]map[string][]string `json:"security,omitempty"`
+}
+
+type openAPIParameter struct {
+	Name        string         `json:"name"`
+	In          string         `json:"in"`
+	Description string         `json:"description,omitempty"`
+	Required    bool           `json:"required"`
+	Schema      *openAPISchema `json:"schema"`
+}
+
+type openAPIRequestBody struct {
+	Required bool                        `json:"required"`
+	Content  map[string]openAPIMediaType `json:"content"`
+}
+
+type openAPIResponse struct {
+	Description string                      `json:"description"`
+	Content     map[string]openAPIMediaType `json:"content,omitempty"`
+}
+
+type openAPIMediaType struct {
+	Schema *openAPISchema `json:"schema"`
+}
+
+type openAPISchema struct {
+	Ref                  string                    `json:"$ref,omitempty"`
+	AllOf                []*openAPISchema          `json:"allOf,omitempty"`
+	Type                 string                    `json:"type,omitempty"`
+	Format               string                    `json:"format,omitempty"`
+	Pattern              string                    `json:"pattern,omitempty"`
+	Nullable             bool                      `json:"nullable,omitempty"`
+	Properties           map[string]*openAPISchema `json:"properties,omitempty"`
+	Required             []string                  `json:"required,omitempty"`
+	AdditionalProperties interface{}               `json:"additionalProperties,omitempty"`
+	Items                *openAPISchema            `json:"items,omitempty"`
+	MinItems             *int                      `json:"minItems,omitempty"`
+	MaxItems             *int                      `json:"maxItems,omitempty"`
+}
+
+var (
+	objectIdType = reflect.TypeOf(primitive.ObjectID{})
+	timeType     = reflect.TypeOf(time.Time{})
+)
+
+/**
+Schemas of the Go types as they are marshalled by encoding/json
+The structs are described once in the components and referenced
+*/
+type schemaGenerator struct {
+	schemas map[string]*openAPISchema
+}
+
+func (g *schemaGenerator) schemaOf(t reflect.Type) *openAPISchema {
+	switch t {
+	case objectIdType:
+		return &openAPISchema{Type: "string", Pattern: "^[0-9a-f]{24}$"}
+	case timeType:
+		return &openAPISchema{Type: "string", Format: "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return nullable(g.schemaOf(t.Elem()))
+	case reflect.Bool:
+		return &openAPISchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &openAPISchema{Type: "integer", Format: "int32"}
+	case reflect.Int64, reflect.Uint64:
+		return &openAPISchema{Type: "integer", Format: "int64"}
+	case reflect.Float32, reflect.Float64:
+		return &openAPISchema{Type: "number"}
+	case reflect.String:
+		return &openAPISchema{Type: "string"}
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &openAPISchema{Type: "string", Format: "byte"}
+		}
+		// a nil slice is marshalled as null
+		return &openAPISchema{Type: "array", Items: g.schemaOf(t.Elem()), Nullable: true}
+	case reflect.Array:
+		length := t.Len()
+		return &openAPISchema{Type: "array", Items: g.schemaOf(t.Elem()), MinItems: &length, MaxItems: &length}
+	case reflect.Map:
+		return &openAPISchema{Type: "object", AdditionalProperties: g.schemaOf(t.Elem()), Nullable: true}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.structSchema(t)
+		}
+		if _, ok := g.schemas[t.Name()]; !ok {
+			// registered before its fields for the types referencing themselves
+			g.schemas[t.Name()] = &openAPISchema{}
+			*g.schemas[t.Name()] = *g.structSchema(t)
+		}
+		return &openAPISchema{Ref: "#/components/schemas/" + t.Name()}
+	}
+	// interface{} : any value
+	return &openAPISchema{}
+}
+
+// A $ref can't have siblings, the nullable reference wraps it
+func nullable(schema *openAPISchema) *openAPISchema {
+	if schema.Ref != "" {
+		return &openAPISchema{AllOf: []*openAPISchema{schema}, Nullable: true}
+	}
+	copied := *schema
+	copied.Nullable = true
+	return &copied
+}
+
+func (g *schemaGenerator) structSchema(t reflect.Type) *openAPISchema {
+	schema := &openAPISchema{Type: "object", Properties: map[string]*openAPISchema{}, AdditionalProperties: false}
+	g.addFields(schema, t)
+	sort.Strings(schema.Required)
+	return schema
+}
+
+func (g *schemaGenerator) addFields(schema *openAPISchema, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options := tag, ""
+		if comma := strings.Index(tag, ","); comma >= 0 {
+			name, options = tag[:comma], tag[comma:]
+		}
+		// the fields of an embedded struct are marshalled as the fields of the struct embedding it
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			g.addFields(schema, field.Type)
+			continue
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		schema.Properties[name] = g.schemaOf(field.Type)
+		if !strings.Contains(options, ",omitempty") {
+			schema.Required = append(schema.Required, name)
+		}
+	}
+}
+
+func (g *schemaGenerator) content(value interface{}, other string) map[string]openAPIMediaType {
+	content := map[string]openAPIMediaType{}
+	if value != nil {
+		content["application/json"] = openAPIMediaType{Schema: g.schemaOf(reflect.TypeOf(value))}
+	}
+	if other != "" {
+		schema := &openAPISchema{Type: "string"}
+		if !strings.HasPrefix(other, "text/") {
+			schema.Format = "binary"
+		}
+		content[other] = openAPIMediaType{Schema: schema}
+	}
+	if len(content) == 0 {
+		return nil
+	}
+	return content
+}
+
+var pathVariable = regexp.MustCompile(`\{([^}:]+)(:[^}]*)?\}`)
+
+/**
+OpenAPI 3 document of the routes of the router
+A route without an entry in apiOperations is still listed, with only its error response
+*/
+func OpenAPISpec(router *mux.Router) openAPIDocument {
+	g := &schemaGenerator{schemas: map[string]*openAPISchema{}}
+	doc := openAPIDocument{
+		OpenAPI: "3.0.3",
+		Info:    openAPIInfo{Title: "Taliesin micro-database", Version: "1"},
+		Paths:   map[string]map[string]openAPIOperation{},
+		Components: openAPIComponents{
+			Schemas: g.schemas,
+			SecuritySchemes: map[string]openAPISecurityScheme{
+				"token": {Type: "apiKey", In: "header", Name: "Authorization",
+					Description: "Token of a user, or password of the cluster for the recognizer"},
+			},
+		},
+		Security: []map[string][]string{{"token": {}}},
+	}
+
+	router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			// /metrics, served by prometheus, and the prefix of the /api/v1 routes
+			return nil
+		}
+		path := pathVariable.ReplaceAllString(template, "{$1}")
+		if doc.Paths[path] == nil {
+			doc.Paths[path] = map[string]openAPIOperation{}
+		}
+		for _, method := range methods {
+			doc.Paths[path][strings.ToLower(method)] = g.operation(apiOperations[method+" "+template], path)
+		}
+		return nil
+	})
+	return doc
+}
+
+func (g *schemaGenerator) operation(op apiOperation, path string) openAPIOperation {
+	result := openAPIOperation{
+		Summary:    op.Summary,
+		Deprecated: op.Deprecated,
+		Responses: map[string]openAPIResponse{
+			"default": {Description: "Error, explained by the message", Content: g.content(nil, "text/plain")},
+		},
+	}
+	if op.Admin {
+		result.Summary += " (admin only)"
+	}
+	if op.Public {
+		result.Security = &[]map[string][]string{}
+	}
+
+	for _, match := range pathVariable.FindAllStringSubmatch(path, -1) {
+		result.Parameters = append(result.Parameters, openAPIParameter{
+			Name: match[1], In: "path", Required: true, Schema: &openAPISchema{Type: "string"},
+		})
+	}
+	names := make([]string, 0, len(op.Query))
+	for name := range op.Query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		result.Parameters = append(result.Parameters, openAPIParameter{
+			Name: name, In: "query", Description: op.Query[name], Schema: &openAPISchema{Type: "string"},
+		})
+	}
+
+	if content := g.content(op.Body, op.BodyType); content != nil {
+		result.RequestBody = &openAPIRequestBody{Required: true, Content: content}
+	}
+	for status, response := range op.Responses {
+		result.Responses[strconv.Itoa(status)] = openAPIResponse{
+			Description: response.Description,
+			Content:     g.content(response.Body, response.ContentType),
+		}
+	}
+	return result
+}
+
+// The document only changes with the code, it is generated on the first request
+func serveOpenAPI(router *mux.Router) http.HandlerFunc {
+	var once sync.Once
+	var body []byte
+	return func(w http.ResponseWriter, r *http.Request) {
+		httpRequestsTotal.Inc() // incrementing the httpRequestsTotal counter
+
+		once.Do(func() {
+			var err error
+			body, err = json.Marshal(OpenAPISpec(router))
+			if err != nil {
+				logf(r.Context(), "[ERROR] : %v", err.Error())
+			}
+		})
+		if body == nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("[MICRO-DATABASE] Could not marshal answer data"))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(body)
+	}
+}
+
+func apiDocs(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.Inc() // incrementing the httpRequestsTotal counter
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(apiDocsPage))
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Values of the path variables in the requests of the conformance test
+func routeValues(id string) map[string]string {
+	return map[string]string{"id": id, "amount": "2", "flag": string(FlagUnreadable), "annotator": "test"}
+}
+
+/**
+Differences between a decoded JSON value and a schema of the document
+Only what the generator uses is checked : $ref, allOf, nullable, type, properties, required, additionalProperties and items
+*/
+func schemaErrors(spec map[string]interface{}, schema map[string]interface{}, value interface{}, at string) []string {
+	if ref, ok := schema["$ref"].(string); ok {
+		schemas := spec["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+		return schemaErrors(spec, schemas[strings.TrimPrefix(ref, "#/components/schemas/")].(map[string]interface{}), value, at)
+	}
+	if value == nil {
+		if schema["nullable"] == true || len(schema) == 0 {
+			return nil
+		}
+		return []string{at + " is null"}
+	}
+
+	var errs []string
+	if allOf, ok := schema["allOf"].([]interface{}); ok {
+		for _, sub := range allOf {
+			errs = append(errs, schemaErrors(spec, sub.(map[string]interface{}), value, at)...)
+		}
+	}
+
+	switch schema["type"] {
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return append(errs, at+" is not an object")
+		}
+		properties, _ := schema["properties"].(map[string]interface{})
+		required, _ := schema["required"].([]interface{})
+		for _, name := range required {
+			if _, ok := object[name.(string)]; !ok {
+				errs = append(errs, at+"."+name.(string)+" is missing")
+			}
+		}
+		for name, field := range object {
+			if property, ok := properties[name]; ok {
+				errs = append(errs, schemaErrors(spec, property.(map[string]interface{}), field, at+"."+name)...)
+			} else if additional, ok := schema["additionalProperties"].(map[string]interface{}); ok {
+				errs = append(errs, schemaErrors(spec, additional, field, at+"."+name)...)
+			} else if schema["additionalProperties"] == false {
+				errs = append(errs, at+"."+name+" is not in the schema")
+			}
+		}
+	case "array":
+		array, ok := value.([]interface{})
+		if !ok {
+			return append(errs, at+" is not an array")
+		}
+		for i, item := range array {
+			errs = append(errs, schemaErrors(spec, schema["items"].(map[string]interface{}), item, at+"["+strconv.Itoa(i)+"]")...)
+		}
+	case "string":
+		if _, ok := value.(string); !ok {
+			errs = append(errs, at+" is not a string")
+		}
+	case "integer":
+		if number, ok := value.(float64); !ok || number != math.Trunc(number) {
+			errs = append(errs, at+" is not an integer")
+		}
+	case "number":
+		if _, ok := value.(float64); !ok {
+			errs = append(errs, at+" is not a number")
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			errs = append(errs, at+" is not a boolean")
+		}
+	}
+	return errs
+}
+
+func TestOpenAPIRoutes(t *testing.T) {
+	router := newRouter()
+	routes := map[string]bool{}
+	router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		template, _ := route.GetPathTemplate()
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		for _, method := range methods {
+			routes[method+" "+template] = true
+			_, documented := apiOperations[method+" "+template]
+			assert.True(t, documented, "%v %v is not documented", method, template)
+		}
+		return nil
+	})
+	for operation := range apiOperations {
+		assert.True(t, routes[operation], "%v is documented but not routed", operation)
+	}
+}
+
+/**
+Every route is called, as an annotator then as an administrator, and its answer must be the one of the document :
+a documented status unless it is an error, a body matching its schema, and a Deprecation header only on the deprecated routes
+*/
+func TestOpenAPIConformance(t *testing.T) {
+	Database = Client.Database("taliesin_test").Collection("test_openapi")
+	router := newRouter()
+
+	doc0 := Picture{Id: primitive.NewObjectID(), PiFF: EmptyPiFF, Url: "/temp/none0"}
+	b, _ := json.Marshal([1]Picture{doc0})
+	res, _ := InsertMany(context.Background(), b, Database, "test")
+	values := routeValues(res[0].(primitive.ObjectID).Hex())
+
+	request, _ := http.NewRequest("GET", "/openapi.json", nil)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var spec map[string]interface{}
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &spec))
+	paths := spec["paths"].(map[string]interface{})
+
+	for _, token := range []string{"", "admin_token"} {
+		router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+			template, _ := route.GetPathTemplate()
+			methods, err := route.GetMethods()
+			if err != nil {
+				return nil
+			}
+			for _, method := range methods {
+				operation := paths[template].(map[string]interface{})[strings.ToLower(method)].(map[string]interface{})
+				responses := operation["responses"].(map[string]interface{})
+				// the stream doesn't end
+				if success, ok := responses["200"].(map[string]interface{}); ok {
+					if _, ok := success["content"].(map[string]interface{})["text/event-stream"]; ok {
+						continue
+					}
+				}
+
+				path := template
+				for name, value := range values {
+					path = strings.Replace(path, "{"+name+"}", value, -1)
+				}
+				var body *bytes.Buffer
+				if method == "GET" {
+					body = &bytes.Buffer{}
+				} else {
+					body = bytes.NewBufferString("{}")
+				}
+				request, _ := http.NewRequest(method, path, body)
+				if token != "" {
+					request.Header.Set("Authorization", token)
+				}
+				recorder := httptest.NewRecorder()
+				router.ServeHTTP(recorder, request)
+
+				name := method + " " + template
+				assert.Equal(t, operation["deprecated"] == true, recorder.Header().Get("Deprecation") == "true", "Deprecation header of %v", name)
+
+				response, documented := responses[strconv.Itoa(recorder.Code)].(map[string]interface{})
+				if !documented {
+					assert.True(t, recorder.Code >= 400, "%v answered an undocumented %v", name, recorder.Code)
+					continue
+				}
+				content, _ := response["content"].(map[string]interface{})
+				contentType := strings.Split(recorder.Header().Get("Content-Type"), ";")[0]
+				if contentType == "" {
+					_, hasJSON := content["application/json"]
+					assert.False(t, hasJSON && recorder.Body.Len() > 0, "%v answered %v without a Content-Type", name, recorder.Code)
+					continue
+				}
+				media, ok := content[contentType].(map[string]interface{})
+				if !assert.True(t, ok, "%v answered %v with %v, which is not documented", name, recorder.Code, contentType) || contentType != "application/json" {
+					continue
+				}
+				var value interface{}
+				assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &value), name)
+				errs := schemaErrors(spec, media["schema"].(map[string]interface{}), value, "body")
+				assert.Empty(t, errs, "%v answered %v", name, recorder.Code)
+			}
+			return nil
+		})
+	}
+}
+
+func TestSchemaErrors(t *testing.T) {
+	g := &schemaGenerator{schemas: map[string]*openAPISchema{}}
+	root := g.schemaOf(reflect.TypeOf(UploadResult{}))
+	b, _ := json.Marshal(map[string]interface{}{"components": map[string]interface{}{"schemas": g.schemas}, "root": root})
+	var spec map[string]interface{}
+	json.Unmarshal(b, &spec)
+	schema := spec["root"].(map[string]interface{})
+
+	var value interface{}
+	json.Unmarshal([]byte(`{"Filename":"scan.png","Id":"5e679a2c005e59a282790a76","Url":"/snippets/3f/3f.png","Duplicate":false,
+		"Image":{"Hash":"3f","Format":"png","Width":30,"Height":20,"Size":120}}`), &value)
+	assert.Empty(t, schemaErrors(spec, schema, value, "body"))
+
+	// a handler answering a field the type doesn't have, or forgetting one
+	json.Unmarshal([]byte(`{"Filename":"scan.png","Id":"5e679a2c005e59a282790a76","Url":null,"Duplicate":false,
+		"Image":{"Hash":"3f","Format":"png","Width":30.5,"Size":120,"Depth":8}}`), &value)
+	errs := schemaErrors(spec, schema, value, "body")
+	assert.Contains(t, errs, "body.Url is null")
+	assert.Contains(t, errs, "body.Image.Width is not an integer")
+	assert.Contains(t, errs, "body.Image.Height is missing")
+	assert.Contains(t, errs, "body.Image.Depth is not in the schema")
+}
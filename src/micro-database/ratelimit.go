@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	lib_auth "github.com/taliesin-insa/lib-auth"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Callers sharing the same budgets
+type callerClass string
+
+const (
+	ClassAdmin     callerClass = "admin"
+	ClassAnnotator callerClass = "annotator"
+	// The services of the cluster, authenticated by CLUSTER_INTERNAL_PASSWORD
+	ClassService callerClass = "service"
+	// Callers which could not be authenticated, limited by address
+	ClassAnonymous callerClass = "anonymous"
+)
+
+// Budget of a route, the expensive routes read or write many snippets
+type routeBudget string
+
+const (
+	BudgetDefault   routeBudget = "default"
+	BudgetExpensive routeBudget = "expensive"
+)
+
+/**
+A token bucket : Burst requests at once, then Rate requests per second
+A Rate of 0 disables the limit
+*/
+type RateLimit struct {
+	Rate  float64
+	Burst float64
+}
+
+/**
+Default limits, each can be replaced by RATE_LIMIT_<CLASS> and RATE_LIMIT_<CLASS>_EXPENSIVE set to "<rate>,<burst>",
+for example RATE_LIMIT_ANNOTATOR_EXPENSIVE=0.5,5
+*/
+var rateLimits = map[callerClass]map[routeBudget]RateLimit{
+	ClassAdmin:     {BudgetDefault: {Rate: 20, Burst: 50}, BudgetExpensive: {Rate: 2, Burst: 10}},
+	ClassAnnotator: {BudgetDefault: {Rate: 10, Burst: 30}, BudgetExpensive: {Rate: 1, Burst: 5}},
+	ClassService:   {BudgetDefault: {Rate: 50, Burst: 100}, BudgetExpensive: {Rate: 5, Burst: 20}},
+	ClassAnonymous: {BudgetDefault: {Rate: 5, Burst: 10}, BudgetExpensive: {Rate: 0.2, Burst: 2}},
+}
+
+// Routes reading or writing many snippets, identified by their template
+var expensiveRoutes = map[string]bool{
+	apiV1 + "/pictures":                true,
+	apiV1 + "/queues/annotation":       true,
+	apiV1 + "/queues/recognizer":       true,
+	"/db/retrieve/all":                 true,
+	"/db/retrieve/snippets/{amount}":   true,
+	"/db/retrieve/recognizer/{amount}": true,
+	"/db/retrieve/flag/{flag}":         true,
+	"/db/insert":                       true,
+	"/db/upload":                       true,
+	"/db/delete/filter":                true,
+	"/db/stats/annotators":             true,
+	"/db/stats/annotators/activity":    true,
+	"/db/stats/recognizer":             true,
+	"/db/duplicates/scan":              true,
+	"/db/fsck":                         true,
+	"/db/backup":                       true,
+	"/db/restore":                      true,
+}
+
+// Routes which are never limited, prometheus must always be able to scrape the metrics
+var unlimitedRoutes = map[string]bool{
+	"/metrics": true,
+}
+
+var (
+	throttledRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "throttled_requests_total",
+		Help: "Number of HTTP requests refused by the rate limits, by class of caller and budget",
+	}, []string{"class", "budget"})
+)
+
+func init() {
+	for class, limits := range rateLimits {
+		for budget := range limits {
+			name := "RATE_LIMIT_" + strings.ToUpper(string(class))
+			if budget == BudgetExpensive {
+				name += "_EXPENSIVE"
+			}
+			value := os.Getenv(name)
+			if value == "" {
+				continue
+			}
+			limit, err := parseRateLimit(value)
+			if err != nil {
+				log.Printf("[ERROR] Ignoring %v : %v", name, err.Error())
+				continue
+			}
+			limits[budget] = limit
+		}
+	}
+}
+
+// "<rate>,<burst>", the burst is the rate when omitted
+func parseRateLimit(value string) (RateLimit, error) {
+	parts := strings.SplitN(value, ",", 2)
+	rate, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	if err != nil || rate < 0 {
+		return RateLimit{}, fmt.Errorf("invalid rate %q, expected <rate>,<burst>", value)
+	}
+	burst := math.Max(rate, 1)
+	if len(parts) == 2 {
+		burst, err = strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if err != nil || burst < 1 {
+			return RateLimit{}, fmt.Errorf("invalid burst %q, expected <rate>,<burst>", value)
+		}
+	}
+	return RateLimit{Rate: rate, Burst: burst}, nil
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+/**
+Token buckets of the callers, by caller and budget
+The buckets which are full again are forgotten at each sweep
+*/
+type RateLimiter struct {
+	mutex     sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// Buckets unused for this long are full, they are removed to bound the memory
+const rateLimitSweepInterval = 10 * time.Minute
+
+var Limiter = NewRateLimiter()
+
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{buckets: map[string]*tokenBucket{}, now: time.Now}
+}
+
+/**
+Take a token from the bucket of key
+Returns whether the request is allowed, and otherwise the time until a token is available
+*/
+func (l *RateLimiter) Allow(key string, limit RateLimit) (bool, time.Duration) {
+	if limit.Rate <= 0 {
+		return true, 0
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.now()
+	if now.Sub(l.lastSweep) > rateLimitSweepInterval {
+		for k, bucket := range l.buckets {
+			if now.Sub(bucket.last) > rateLimitSweepInterval {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: limit.Burst, last: now}
+		l.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(limit.Burst, bucket.tokens+now.Sub(bucket.last).Seconds()*limit.Rate)
+	bucket.last = now
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - bucket.tokens) / limit.Rate * float64(time.Second))
+}
+
+/**
+Class and key of the caller of a request
+The users are authenticated as in the handlers, the callers which can't be are keyed by their address
+*/
+func identifyCaller(r *http.Request) (callerClass, string) {
+	if isClusterPassword(r.Header.Get("Authorization")) {
+		return ClassService, "service"
+	}
+
+	if user, err, _ := authenticateUser(r); err == nil {
+		if user.Role == lib_auth.RoleAdmin {
+			return ClassAdmin, "user:" + user.Username
+		}
+		return ClassAnnotator, "user:" + user.Username
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return ClassAnonymous, "address:" + host
+}
+
+/**
+Middleware refusing the requests of the callers over their budget with a status 429
+Retry-After tells when the next request of the caller will be accepted
+*/
+func rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		template := r.URL.Path
+		if route := mux.CurrentRoute(r); route != nil {
+			if t, err := route.GetPathTemplate(); err == nil {
+				template = t
+			}
+		}
+		if unlimitedRoutes[template] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		budget := BudgetDefault
+		if expensiveRoutes[template] {
+			budget = BudgetExpensive
+		}
+		class, key := identifyCaller(r)
+
+		allowed, wait := Limiter.Allow(key+" "+string(budget), rateLimits[class][budget])
+		if !allowed {
+			throttledRequestsTotal.WithLabelValues(string(class), string(budget)).Inc()
+			seconds := int(math.Ceil(wait.Seconds()))
+			logf(r.Context(), "[THROTTLED] %v (%v) on %v %v, retry in %v s", key, class, r.Method, template, seconds)
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(fmt.Sprintf("[MICRO-DATABASE] Too many requests, retry in %v seconds", seconds)))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
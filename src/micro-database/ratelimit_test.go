@@ -0,0 +1,104 @@
+package main
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	clock := time.Date(2020, 4, 20, 10, 0, 0, 0, time.UTC)
+	limiter := NewRateLimiter()
+	limiter.now = func() time.Time { return clock }
+	limit := RateLimit{Rate: 1, Burst: 2}
+
+	allowed, _ := limiter.Allow("user:morpheus", limit)
+	assert.True(t, allowed)
+	allowed, _ = limiter.Allow("user:morpheus", limit)
+	assert.True(t, allowed)
+	allowed, wait := limiter.Allow("user:morpheus", limit)
+	assert.False(t, allowed)
+	assert.Equal(t, time.Second, wait)
+
+	// the other callers have their own bucket
+	allowed, _ = limiter.Allow("user:trinity", limit)
+	assert.True(t, allowed)
+
+	clock = clock.Add(500 * time.Millisecond)
+	allowed, wait = limiter.Allow("user:morpheus", limit)
+	assert.False(t, allowed)
+	assert.Equal(t, 500*time.Millisecond, wait)
+
+	clock = clock.Add(500 * time.Millisecond)
+	allowed, _ = limiter.Allow("user:morpheus", limit)
+	assert.True(t, allowed)
+
+	// the idle buckets are forgotten, they would be full anyway
+	clock = clock.Add(2 * rateLimitSweepInterval)
+	limiter.Allow("user:morpheus", limit)
+	assert.Len(t, limiter.buckets, 1)
+
+	for i := 0; i < 10; i++ {
+		allowed, _ = limiter.Allow("user:morpheus", RateLimit{})
+		assert.True(t, allowed)
+	}
+}
+
+func TestParseRateLimit(t *testing.T) {
+	limit, err := parseRateLimit("0.5,5")
+	assert.Nil(t, err)
+	assert.Equal(t, RateLimit{Rate: 0.5, Burst: 5}, limit)
+
+	limit, err = parseRateLimit("20")
+	assert.Nil(t, err)
+	assert.Equal(t, RateLimit{Rate: 20, Burst: 20}, limit)
+
+	for _, value := range []string{"fast", "-1,5", "2,0", "2,many"} {
+		_, err = parseRateLimit(value)
+		assert.NotNil(t, err, value)
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	previousLimits, previousLimiter, previousPassword := rateLimits, Limiter, os.Getenv("CLUSTER_INTERNAL_PASSWORD")
+	defer func() {
+		rateLimits, Limiter = previousLimits, previousLimiter
+		os.Setenv("CLUSTER_INTERNAL_PASSWORD", previousPassword)
+	}()
+	rateLimits = map[callerClass]map[routeBudget]RateLimit{
+		ClassService: {BudgetDefault: {Rate: 10, Burst: 10}, BudgetExpensive: {Rate: 0.5, Burst: 1}},
+	}
+	Limiter = NewRateLimiter()
+	os.Setenv("CLUSTER_INTERNAL_PASSWORD", "cluster_password")
+
+	router := mux.NewRouter()
+	router.Use(rateLimit)
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+	router.HandleFunc("/db/retrieve/all", ok)
+	router.HandleFunc("/db/status", ok)
+	router.HandleFunc("/metrics", ok)
+
+	call := func(path string) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest("GET", path, nil)
+		request.Header.Set("Authorization", "cluster_password")
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	assert.Equal(t, http.StatusOK, call("/db/retrieve/all").Code)
+	recorder := call("/db/retrieve/all")
+	assert.Equal(t, http.StatusTooManyRequests, recorder.Code)
+	assert.Equal(t, "2", recorder.Header().Get("Retry-After"))
+
+	// the expensive routes have their own budget
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, http.StatusOK, call("/db/status").Code)
+	}
+	assert.Equal(t, http.StatusTooManyRequests, call("/db/status").Code)
+	assert.Equal(t, http.StatusOK, call("/metrics").Code)
+}
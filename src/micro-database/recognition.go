@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**
+Suggestion of the recognizer for a picture and the value humans gave afterwards
+The error counts are edit distances to the human value, in characters and in words
+*/
+type Recognition struct {
+	PictureId   primitive.ObjectID `bson:"_id" json:"PictureId"`
+	Model       string             `bson:"Model" json:"Model"`
+	Suggestion  string             `bson:"Suggestion" json:"Suggestion"`
+	SuggestedAt time.Time          `bson:"SuggestedAt" json:"SuggestedAt"`
+	// Last value given by a human, nil until then
+	Value       *string    `bson:"Value,omitempty" json:"Value,omitempty"`
+	Annotator   string     `bson:"Annotator,omitempty" json:"Annotator,omitempty"`
+	CorrectedAt *time.Time `bson:"CorrectedAt,omitempty" json:"CorrectedAt,omitempty"`
+	// The human value was validated by a review
+	Validated  bool  `bson:"Validated" json:"Validated"`
+	CharErrors int64 `bson:"CharErrors" json:"CharErrors"`
+	Chars      int64 `bson:"Chars" json:"Chars"`
+	WordErrors int64 `bson:"WordErrors" json:"WordErrors"`
+	Words      int64 `bson:"Words" json:"Words"`
+}
+
+/**
+Error rates of a model, over all the corrected suggestions or over a period
+The rates are the total of the edit distances divided by the total length of the human values
+*/
+type RecognizerMetric struct {
+	Model  string `json:"Model"`
+	Period string `json:"Period,omitempty"`
+	Count  int64  `json:"Count"`
+	// Suggestions kept unchanged
+	Exact int64   `json:"Exact"`
+	CER   float64 `json:"CER"`
+	WER   float64 `json:"WER"`
+}
+
+// Model of the suggestions which didn't tell it
+const unknownModel = "unknown"
+
+// Window of the corrections used by the gauges, and their refresh interval
+var (
+	recognizerGaugesWindow   = 7 * 24 * time.Hour
+	recognizerGaugesInterval = time.Minute
+)
+
+var (
+	recognizerCER = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "recognizer_character_error_rate",
+		Help: "Character error rate of the recognizer suggestions corrected during the last week, by model",
+	}, []string{"model"})
+	recognizerWER = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "recognizer_word_error_rate",
+		Help: "Word error rate of the recognizer suggestions corrected during the last week, by model",
+	}, []string{"model"})
+	recognizerCorrections = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "recognizer_corrections",
+		Help: "Number of recognizer suggestions corrected during the last week, by model",
+	}, []string{"model"})
+)
+
+func recognitionsCollection(collection *mongo.Collection) *mongo.Collection {
+	return companionCollection(collection, "recognitions")
+}
+
+/**
+Levenshtein distance between two sequences
+*/
+func editDistance(a []string, b []string) int64 {
+	previous := make([]int64, len(b)+1)
+	current := make([]int64, len(b)+1)
+	for j := range previous {
+		previous[j] = int64(j)
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = int64(i)
+		for j := 1; j <= len(b); j++ {
+			cost := int64(1)
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min64(min64(previous[j]+1, current[j-1]+1), previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+func min64(a int64, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func characters(s string) []string {
+	chars := make([]string, 0, len(s))
+	for _, r := range s {
+		chars = append(chars, string(r))
+	}
+	return chars
+}
+
+/**
+Record a suggestion of the recognizer, it replaces the previous one of the picture
+*/
+func RecordSuggestion(ctx context.Context, id primitive.ObjectID, model string, suggestion string, collection *mongo.Collection) error {
+	ctx, cancel := withTimeout(ctx, OperationWrite)
+	defer cancel()
+
+	if model == "" {
+		model = unknownModel
+	}
+	recognition := Recognition{PictureId: id, Model: model, Suggestion: suggestion, SuggestedAt: time.Now().UTC()}
+	opts := options.Replace().SetUpsert(true)
+	_, err := recognitionsCollection(collection).ReplaceOne(ctx, bson.D{{"_id", id}}, recognition, opts)
+	if err != nil {
+		return mongoError(ctx, err, "Error during MongoDB update")
+	}
+	return nil
+}
+
+/**
+Compare the value given by a human with the suggestion of the recognizer, if the picture had one
+*/
+func RecordHumanValue(ctx context.Context, id primitive.ObjectID, annotator string, value string, collection *mongo.Collection) error {
+	ctx, cancel := withTimeout(ctx, OperationWrite)
+	defer cancel()
+
+	var recognition Recognition
+	err := recognitionsCollection(collection).FindOne(ctx, bson.D{{"_id", id}}).Decode(&recognition)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	} else if err != nil {
+		return mongoError(ctx, err, "Error during MongoDB selection")
+	}
+
+	reference, words := characters(value), strings.Fields(value)
+	update := bson.D{{"$set", bson.D{
+		{"Value", value},
+		{"Annotator", annotator},
+		{"CorrectedAt", time.Now().UTC()},
+		// a new value has to be validated again
+		{"Validated", false},
+		{"CharErrors", editDistance(characters(recognition.Suggestion), reference)},
+		{"Chars", int64(len(reference))},
+		{"WordErrors", editDistance(strings.Fields(recognition.Suggestion), words)},
+		{"Words", int64(len(words))},
+	}}}
+	_, err = recognitionsCollection(collection).UpdateOne(ctx, bson.D{{"_id", id}}, update)
+	if err != nil {
+		return mongoError(ctx, err, "Error during MongoDB update")
+	}
+	return nil
+}
+
+/**
+Mark the human value compared with the suggestion as validated by a review
+*/
+func RecordValidation(ctx context.Context, id primitive.ObjectID, collection *mongo.Collection) error {
+	ctx, cancel := withTimeout(ctx, OperationWrite)
+	defer cancel()
+
+	filter := bson.D{{"_id", id}, {"Value", bson.D{{"$exists", true}}}}
+	_, err := recognitionsCollection(collection).UpdateOne(ctx, filter, bson.D{{"$set", bson.D{{"Validated", true}}}})
+	if err != nil {
+		return mongoError(ctx, err, "Error during MongoDB update")
+	}
+	return nil
+}
+
+/**
+Error rates of each model for the suggestions corrected between from (included) and to (excluded)
+period : "" for a single metric per model, PeriodDay or PeriodWeek for a metric per model and period
+validatedOnly : only use the human values validated by a review
+*/
+func RecognizerMetrics(ctx context.Context, from time.Time, to time.Time, period string, validatedOnly bool, collection *mongo.Collection) ([]RecognizerMetric, error) {
+	ctx, cancel := withTimeout(ctx, OperationScan)
+	defer cancel()
+
+	if period != "" && period != PeriodDay && period != PeriodWeek {
+		return nil, fmt.Errorf("%w : unknown period %q", ErrInvalidRange, period)
+	}
+
+	filter := bson.D{{"CorrectedAt", bson.D{{"$gte", from}, {"$lt", to}}}}
+	if validatedOnly {
+		filter = append(filter, bson.E{"Validated", true})
+	}
+	cur, err := recognitionsCollection(collection).Find(ctx, filter)
+	if err != nil {
+		return nil, mongoError(ctx, err, "Error during MongoDB selection")
+	}
+	defer cur.Close(ctx)
+
+	type totals struct {
+		count, exact, charErrors, chars, wordErrors, words int64
+	}
+	groups := make(map[RecognizerMetric]*totals)
+	for cur.Next(ctx) {
+		var recognition Recognition
+		if err := cur.Decode(&recognition); err != nil {
+			logf(ctx, "[DECODE] %v", err)
+			return nil, errors.New("Could not decode data from mongo")
+		}
+
+		key := RecognizerMetric{Model: recognition.Model}
+		if period != "" {
+			key.Period = periodOf(*recognition.CorrectedAt, period)
+		}
+		if groups[key] == nil {
+			groups[key] = &totals{}
+		}
+		group := groups[key]
+		group.count++
+		if recognition.CharErrors == 0 {
+			group.exact++
+		}
+		group.charErrors += recognition.CharErrors
+		group.chars += recognition.Chars
+		group.wordErrors += recognition.WordErrors
+		group.words += recognition.Words
+	}
+	if err := cur.Err(); err != nil {
+		logf(ctx, "[CURSOR] %v", err)
+		return nil, errors.New("Error while iterating results")
+	}
+
+	results := []RecognizerMetric{}
+	for key, group := range groups {
+		key.Count, key.Exact = group.count, group.exact
+		// an empty human value is entirely wrong unless the suggestion was empty too
+		key.CER = float64(group.charErrors) / float64(max64(group.chars, 1))
+		key.WER = float64(group.wordErrors) / float64(max64(group.words, 1))
+		results = append(results, key)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Model != results[j].Model {
+			return results[i].Model < results[j].Model
+		}
+		return results[i].Period < results[j].Period
+	})
+
+	return results, nil
+}
+
+func max64(a int64, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+/**
+Set the gauges to the error rates of the suggestions corrected during the window
+*/
+func RefreshRecognizerGauges(collection *mongo.Collection) error {
+	now := time.Now().UTC()
+	metrics, err := RecognizerMetrics(context.Background(), now.Add(-recognizerGaugesWindow), now, "", false, collection)
+	if err != nil {
+		return err
+	}
+
+	// models without recent corrections disappear
+	recognizerCER.Reset()
+	recognizerWER.Reset()
+	recognizerCorrections.Reset()
+	for _, metric := range metrics {
+		recognizerCER.WithLabelValues(metric.Model).Set(metric.CER)
+		recognizerWER.WithLabelValues(metric.Model).Set(metric.WER)
+		recognizerCorrections.WithLabelValues(metric.Model).Set(float64(metric.Count))
+	}
+	return nil
+}
+
+func RefreshRecognizerGaugesPeriodically(collection *mongo.Collection) {
+	for {
+		err := RefreshRecognizerGauges(collection)
+		if err != nil {
+			log.Printf("[ERROR] Recognizer gauges : %v", err.Error())
+		}
+		time.Sleep(recognizerGaugesInterval)
+	}
+}
+
+func recognizerStats(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.Inc() // incrementing the httpRequestsTotal counter
+
+	if !authenticateStatsAdmin(w, r) {
+		return
+	}
+
+	from, to, err := parseStatsRange(r)
+	if err != nil {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("[MICRO-DATABASE] %v", err.Error())))
+		return
+	}
+	validatedOnly := r.URL.Query().Get("validated") == "true"
+
+	metrics, err := RecognizerMetrics(r.Context(), from, to, r.URL.Query().Get("period"), validatedOnly, Database)
+	if errors.Is(err, ErrInvalidRange) {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("[MICRO-DATABASE] %v", err.Error())))
+		return
+	} else if err != nil {
+		writeDatabaseError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	if wantsCSV(r) {
+		rows := make([][]string, 0, len(metrics))
+		for _, m := range metrics {
+			rows = append(rows, []string{
+				m.Model,
+				m.Period,
+				strconv.FormatInt(m.Count, 10),
+				strconv.FormatInt(m.Exact, 10),
+				strconv.FormatFloat(m.CER, 'f', 4, 64),
+				strconv.FormatFloat(m.WER, 'f', 4, 64),
+			})
+		}
+		writeCSV(w, "recognizer.csv", []string{"Model", "Period", "Count", "Exact", "CER", "WER"}, rows)
+		return
+	}
+
+	body, err := json.Marshal(metrics)
+	if err != nil {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("[MICRO-DATABASE] Could not marshal answer data"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"testing"
+	"time"
+)
+
+func TestEditDistance(t *testing.T) {
+	assert.Equal(t, int64(0), editDistance(characters("Arlequin"), characters("Arlequin")))
+	assert.Equal(t, int64(2), editDistance(characters("Arlequin"), characters("Harlequin")))
+	assert.Equal(t, int64(3), editDistance(characters("Poirier"), characters("Poiré")))
+	assert.Equal(t, int64(1), editDistance([]string{"le", "tableau", "parlant"}, []string{"le", "tableau", "parlent"}))
+	assert.Equal(t, int64(3), editDistance(nil, characters("abc")))
+}
+
+func TestRecognizerMetrics(t *testing.T) {
+	coll := Client.Database("taliesin_test").Collection("test_recognizer_metrics")
+	recognitionsCollection(coll).Drop(context.TODO())
+	doc0 := Picture{Id: primitive.NewObjectID(), PiFF: EmptyPiFF, Url: "/temp/none0"}
+	doc1 := Picture{Id: primitive.NewObjectID(), PiFF: EmptyPiFF, Url: "/temp/none1"}
+	b, _ := json.Marshal([2]Picture{doc0, doc1})
+	res, _ := InsertMany(context.Background(), b, coll, "test")
+	id0, id1 := res[0].(primitive.ObjectID), res[1].(primitive.ObjectID)
+
+	body, _ := json.Marshal([2]Annotation{{Id: id0, Value: "le tableau parlent", Model: "v2"}, {Id: id1, Value: "Poirier", Model: "v2"}})
+	assert.Nil(t, UpdateValue(context.Background(), body, coll, RecognizerAnnotator, nil))
+	body, _ = json.Marshal([2]Annotation{{Id: id0, Value: "le tableau parlant"}, {Id: id1, Value: "Poirier"}})
+	assert.Nil(t, UpdateValue(context.Background(), body, coll, "morpheus", nil))
+
+	metrics, err := RecognizerMetrics(context.Background(), time.Now().Add(-time.Hour), time.Now().Add(time.Hour), "", false, coll)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(metrics))
+	assert.Equal(t, "v2", metrics[0].Model)
+	assert.Equal(t, int64(2), metrics[0].Count)
+	assert.Equal(t, int64(1), metrics[0].Exact)
+	assert.InDelta(t, 1.0/25, metrics[0].CER, 1e-9)
+	assert.InDelta(t, 1.0/4, metrics[0].WER, 1e-9)
+
+	// only id1 is validated
+	body, _ = json.Marshal([1]Modification{{Id: id1, Flag: FlagCorrected, Value: true}})
+	assert.Nil(t, UpdateFlags(context.Background(), body, coll, nil, "neo"))
+	metrics, err = RecognizerMetrics(context.Background(), time.Now().Add(-time.Hour), time.Now().Add(time.Hour), PeriodDay, true, coll)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(metrics))
+	assert.Equal(t, int64(1), metrics[0].Count)
+	assert.Equal(t, 0.0, metrics[0].CER)
+	assert.Equal(t, time.Now().UTC().Format("2006-01-02"), metrics[0].Period)
+
+	_, err = RecognizerMetrics(context.Background(), time.Now().Add(-time.Hour), time.Now(), "month", false, coll)
+	assert.NotNil(t, err)
+}
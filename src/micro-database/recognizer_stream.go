@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"time"
+)
+
+// Types of the messages of the recognizer stream
+const (
+	// from the recognizer
+	StreamCapacity = "capacity"
+	StreamResult   = "result"
+	StreamRelease  = "release"
+	// from the database
+	StreamPicture  = "picture"
+	StreamAck      = "ack"
+	StreamConflict = "conflict"
+	StreamError    = "error"
+	StreamPing     = "ping"
+)
+
+/**
+A line of the recognizer stream, in both directions
+The recognizer declares its Capacity, then sends a result, or a release when it can't read the snippet, for each picture received
+*/
+type StreamMessage struct {
+	Type string
+	// Pictures the recognizer can hold without acknowledging them, 0 pauses the stream
+	Capacity int                 `json:",omitempty"`
+	Id       *primitive.ObjectID `json:",omitempty"`
+	// Suggestion of a result, and version of the model which made it
+	Value string `json:",omitempty"`
+	Model string `json:",omitempty"`
+	// Expected version of the picture, the result is rejected if it changed
+	Version *int64   `json:",omitempty"`
+	Picture *Picture `json:",omitempty"`
+	Error   string   `json:",omitempty"`
+}
+
+var ErrNotInFlight = errors.New("Picture not sent on this stream, or already acknowledged")
+
+var (
+	recognizerInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "recognizer_stream_in_flight",
+		Help: "Number of pictures sent on the recognizer streams and not acknowledged yet",
+	})
+)
+
+/**
+Put pictures sent to the recognizer back in its queue, unless they were annotated in the meantime
+*/
+func ReleaseFromReco(ctx context.Context, ids []primitive.ObjectID, collection *mongo.Collection) (int, error) {
+	ctx, cancel := withTimeout(ctx, OperationWrite)
+	defer cancel()
+
+	released := 0
+	for _, id := range ids {
+		filter := bson.D{{"_id", id}, {"SentToReco", true}, {"Annotated", false}}
+		update := bson.D{{"$set", bson.D{{"SentToReco", false}}}, incrementVersion()}
+		res, err := collection.UpdateOne(ctx, filter, update)
+		if err != nil {
+			return released, mongoError(ctx, err, "Error during MongoDB update")
+		}
+		if res.ModifiedCount > 0 {
+			released++
+			PublishEvents(ctx, collection, Event{
+				Type:      EventFlagged,
+				PictureId: id,
+				Actor:     RecognizerAnnotator,
+				Changes:   map[string]interface{}{string(FlagSentToReco): false},
+			})
+		}
+	}
+	return released, nil
+}
+
+/**
+A recognizer connected to the stream, and the pictures it didn't acknowledge
+ctx : context of the stream request, for the operations made on behalf of the recognizer
+*/
+type recognizerSession struct {
+	ctx        context.Context
+	collection *mongo.Collection
+	out        io.Writer
+	flush      func() error
+	capacity   int
+	inFlight   map[primitive.ObjectID]bool
+	lastWrite  time.Time
+}
+
+func (s *recognizerSession) send(message StreamMessage) error {
+	line, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	if _, err := s.out.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	s.lastWrite = time.Now()
+	return s.flush()
+}
+
+func (s *recognizerSession) sendError(id *primitive.ObjectID, err error) error {
+	return s.send(StreamMessage{Type: StreamError, Id: id, Error: err.Error()})
+}
+
+/**
+Send pictures until the capacity of the recognizer is used
+Returns whether the queue had enough pictures
+*/
+func (s *recognizerSession) fill() (bool, error) {
+	want := s.capacity - len(s.inFlight)
+	if want <= 0 {
+		return true, nil
+	}
+	if want > maxAmount {
+		want = maxAmount
+	}
+
+	pictures, err := FindManyForSuggestion(s.ctx, want, s.collection)
+	if err != nil {
+		return false, err
+	}
+	for i := range pictures {
+		s.inFlight[pictures[i].Id] = true
+		recognizerInFlight.Inc()
+		if err := s.send(StreamMessage{Type: StreamPicture, Id: &pictures[i].Id, Picture: &pictures[i]}); err != nil {
+			return false, err
+		}
+	}
+	return len(pictures) == want, nil
+}
+
+// Stop waiting for an acknowledgement, the picture is put back in the queue if release is set
+func (s *recognizerSession) done(id primitive.ObjectID, release bool) error {
+	delete(s.inFlight, id)
+	recognizerInFlight.Dec()
+	if release {
+		_, err := ReleaseFromReco(s.ctx, []primitive.ObjectID{id}, s.collection)
+		return err
+	}
+	return nil
+}
+
+func (s *recognizerSession) handle(message StreamMessage) error {
+	switch message.Type {
+	case StreamCapacity:
+		if message.Capacity < 0 || message.Capacity > maxAmount {
+			return s.sendError(nil, fmt.Errorf("%w : capacity %v, expected a number between 0 and %v", ErrInvalidBody, message.Capacity, maxAmount))
+		}
+		s.capacity = message.Capacity
+		return nil
+
+	case StreamResult, StreamRelease:
+		if message.Id == nil || !s.inFlight[*message.Id] {
+			return s.sendError(message.Id, ErrNotInFlight)
+		}
+		id := *message.Id
+		if message.Type == StreamRelease {
+			if err := s.done(id, true); err != nil {
+				return err
+			}
+			return s.send(StreamMessage{Type: StreamAck, Id: &id})
+		}
+
+		if message.Value == "" {
+			return s.sendError(&id, fmt.Errorf("%w : Value is required", ErrInvalidBody))
+		}
+		b, _ := json.Marshal([]Annotation{{Id: id, Value: message.Value, Model: message.Model, Version: message.Version}})
+		err := UpdateValue(s.ctx, b, s.collection, RecognizerAnnotator, nil)
+		var conflict *ConflictError
+		if errors.As(err, &conflict) {
+			// modified by someone else, the picture goes back to the queue if it still needs a suggestion
+			if err := s.done(id, true); err != nil {
+				return err
+			}
+			return s.send(StreamMessage{Type: StreamConflict, Id: &id, Picture: &conflict.Pictures[0]})
+		} else if err != nil {
+			logf(s.ctx, "[ERROR] : %v", err.Error())
+			return s.sendError(&id, err)
+		}
+		if err := s.done(id, false); err != nil {
+			return err
+		}
+		return s.send(StreamMessage{Type: StreamAck, Id: &id})
+	}
+	return s.sendError(message.Id, fmt.Errorf("%w : unknown type %q", ErrInvalidBody, message.Type))
+}
+
+// The pictures still in flight when the recognizer leaves go back to the queue, even if its request is canceled
+func (s *recognizerSession) close() {
+	ids := make([]primitive.ObjectID, 0, len(s.inFlight))
+	for id := range s.inFlight {
+		ids = append(ids, id)
+	}
+	recognizerInFlight.Sub(float64(len(ids)))
+	released, err := ReleaseFromReco(context.Background(), ids, s.collection)
+	if err != nil {
+		logf(s.ctx, "[ERROR] Releasing the pictures of a recognizer stream : %v", err.Error())
+	}
+	logf(s.ctx, "Recognizer stream closed, %v picture(s) put back in the queue", released)
+}
+
+/**
+Long-lived stream of the recognizer : the request and the response are both NDJSON, sent in chunks on the same connection
+The connection is taken from the HTTP server, which can't read a request while it answers it, so the stream only works over HTTP/1.1 :
+HTTP/2 connections can't be taken and are answered 505
+*/
+func recognizerStream(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.Inc() // incrementing the httpRequestsTotal counter
+
+	if !isClusterPassword(r.Header.Get("Authorization")) {
+		logf(r.Context(), "[ERROR] : Wrong password for the recognizer stream")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("[MICRO-DATABASE] Recognizer didn't have correct password"))
+		return
+	}
+
+	if contentType := r.Header.Get("Content-Type"); contentType != "" && !strings.HasPrefix(contentType, "application/x-ndjson") {
+		writeRequestError(w, r, fmt.Errorf("%w : %q, expected application/x-ndjson", ErrUnsupportedContentType, contentType))
+		return
+	}
+
+	if r.ProtoMajor != 1 {
+		logf(r.Context(), "[ERROR] : Recognizer stream asked over %v", r.Proto)
+		w.WriteHeader(http.StatusHTTPVersionNotSupported)
+		w.Write([]byte("[MICRO-DATABASE] The recognizer stream needs HTTP/1.1"))
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		logf(r.Context(), "[ERROR] : Streaming is not supported by the response writer")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("[MICRO-DATABASE] Streaming unsupported"))
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		return
+	}
+	defer conn.Close()
+
+	// without a length, the body goes until the recognizer closes its side of the connection
+	var body io.Reader = rw.Reader
+	if len(r.TransferEncoding) > 0 && r.TransferEncoding[0] == "chunked" {
+		body = httputil.NewChunkedReader(rw.Reader)
+	} else if r.ContentLength >= 0 {
+		body = io.LimitReader(rw.Reader, r.ContentLength)
+	}
+
+	rw.WriteString("HTTP/1.1 200 OK\r\nContent-Type: application/x-ndjson\r\nCache-Control: no-cache\r\nTransfer-Encoding: chunked\r\n\r\n")
+	// the recognizer waits for the headers before sending more than its capacity
+	rw.Flush()
+	out := httputil.NewChunkedWriter(rw.Writer)
+	defer func() {
+		out.Close()
+		rw.WriteString("\r\n")
+		rw.Flush()
+	}()
+
+	session := &recognizerSession{
+		ctx:        r.Context(),
+		collection: Database,
+		out:        out,
+		flush:      rw.Flush,
+		inFlight:   map[primitive.ObjectID]bool{},
+		lastWrite:  time.Now(),
+	}
+	defer session.close()
+
+	// the messages of the recognizer are read while the pictures are sent
+	messages := make(chan StreamMessage)
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		defer close(messages)
+		scanner := bufio.NewScanner(body)
+		scanner.Buffer(make([]byte, 64*1024), int(maxBodyBytes))
+		for scanner.Scan() {
+			if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+				continue
+			}
+			var message StreamMessage
+			decoder := json.NewDecoder(bytes.NewReader(scanner.Bytes()))
+			decoder.DisallowUnknownFields()
+			if err := decoder.Decode(&message); err != nil {
+				message = StreamMessage{Type: StreamError, Error: fmt.Errorf("%w : %v", ErrInvalidBody, err.Error()).Error()}
+			}
+			select {
+			case messages <- message:
+			case <-stopped:
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(eventsPollInterval)
+	defer ticker.Stop()
+	// the queue is only read again after a tick once it was empty
+	queueEmpty := false
+
+	for {
+		if !queueEmpty {
+			full, err := session.fill()
+			if err != nil {
+				logf(r.Context(), "[ERROR] : %v", err.Error())
+				session.sendError(nil, err)
+				return
+			}
+			queueEmpty = !full
+		}
+
+		select {
+		case message, ok := <-messages:
+			if !ok {
+				return
+			}
+			if message.Type == StreamError {
+				// a line which could not be read
+				err = session.send(message)
+			} else {
+				err = session.handle(message)
+			}
+			if err != nil {
+				logf(r.Context(), "[ERROR] : %v", err.Error())
+				return
+			}
+		case <-ticker.C:
+			queueEmpty = false
+			if time.Since(session.lastWrite) > eventsKeepAlive {
+				if err := session.send(StreamMessage{Type: StreamPing}); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
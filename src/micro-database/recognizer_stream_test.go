@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestRecognizerStream(t *testing.T) {
+	Database = Client.Database("taliesin_test").Collection("test_recognizer_stream")
+	previousPassword := os.Getenv("CLUSTER_INTERNAL_PASSWORD")
+	os.Setenv("CLUSTER_INTERNAL_PASSWORD", "cluster_password")
+	defer os.Setenv("CLUSTER_INTERNAL_PASSWORD", previousPassword)
+
+	server := httptest.NewServer(newRouter())
+	defer server.Close()
+
+	var pics [3]Picture
+	for i := range pics {
+		pics[i] = Picture{Id: primitive.NewObjectID(), PiFF: EmptyPiFF, Url: "/temp/none" + strconv.Itoa(i)}
+	}
+	b, _ := json.Marshal(pics)
+	_, err := InsertMany(context.Background(), b, Database, "test")
+	assert.Nil(t, err)
+
+	request, _ := http.NewRequest("POST", server.URL+"/api/v1/queues/recognizer/stream", nil)
+	res, err := http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+	res.Body.Close()
+
+	body, requests := io.Pipe()
+	request, _ = http.NewRequest("POST", server.URL+"/api/v1/queues/recognizer/stream", body)
+	request.Header.Set("Authorization", "cluster_password")
+	request.Header.Set("Content-Type", "application/x-ndjson")
+	encoder := json.NewEncoder(requests)
+	// the response only starts once the body is being sent
+	go encoder.Encode(StreamMessage{Type: StreamCapacity, Capacity: 2})
+	res, err = http.DefaultClient.Do(request)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "application/x-ndjson", res.Header.Get("Content-Type"))
+
+	responses := bufio.NewScanner(res.Body)
+	next := func() StreamMessage {
+		var message StreamMessage
+		for responses.Scan() {
+			json.Unmarshal(responses.Bytes(), &message)
+			if message.Type != StreamPing {
+				return message
+			}
+		}
+		return StreamMessage{}
+	}
+
+	// only the declared capacity is sent
+	first, second := next(), next()
+	assert.Equal(t, StreamPicture, first.Type)
+	assert.Equal(t, StreamPicture, second.Type)
+	assert.True(t, first.Picture.SentToReco)
+
+	encoder.Encode(StreamMessage{Type: StreamResult, Id: first.Id, Value: "Recognized", Model: "v2"})
+	ack := next()
+	assert.Equal(t, StreamAck, ack.Type)
+	assert.Equal(t, *first.Id, *ack.Id)
+	third := next()
+	assert.Equal(t, StreamPicture, third.Type)
+
+	unknown := primitive.NewObjectID()
+	encoder.Encode(StreamMessage{Type: StreamResult, Id: &unknown, Value: "Recognized"})
+	message := next()
+	assert.Equal(t, StreamError, message.Type)
+	assert.Equal(t, unknown, *message.Id)
+
+	// the recognizer leaves without answering for the other pictures
+	requests.Close()
+	for responses.Scan() {
+	}
+
+	pic, _ := FindOne(context.Background(), *first.Id, Database)
+	assert.True(t, pic.Annotated)
+	assert.Equal(t, "Recognized", pic.PiFF.Data[0].Value)
+	assert.Equal(t, RecognizerAnnotator, pic.Annotator)
+	for _, id := range []*primitive.ObjectID{second.Id, third.Id} {
+		pic, _ = FindOne(context.Background(), *id, Database)
+		assert.False(t, pic.SentToReco)
+		assert.False(t, pic.Annotated)
+	}
+}
+
+func TestRecognizerStreamHTTP2(t *testing.T) {
+	previousPassword := os.Getenv("CLUSTER_INTERNAL_PASSWORD")
+	os.Setenv("CLUSTER_INTERNAL_PASSWORD", "cluster_password")
+	defer os.Setenv("CLUSTER_INTERNAL_PASSWORD", previousPassword)
+
+	// the connection of an HTTP/2 request can't be taken
+	request, _ := http.NewRequest("POST", "/api/v1/queues/recognizer/stream", nil)
+	request.Proto, request.ProtoMajor, request.ProtoMinor = "HTTP/2.0", 2, 0
+	request.Header.Set("Authorization", "cluster_password")
+	recorder := httptest.NewRecorder()
+	recognizerStream(recorder, request)
+	assert.Equal(t, http.StatusHTTPVersionNotSupported, recorder.Code)
+}
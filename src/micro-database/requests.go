@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Largest JSON bodies accepted, the insertions carry the PiFF of many pictures
+const (
+	maxBodyBytes   int64 = 1 << 20
+	maxInsertBytes int64 = 32 << 20
+)
+
+// Most pictures given at once by the queues
+const maxAmount = 500
+
+var ErrBodyTooLarge = errors.New("Request body too large")
+var ErrUnsupportedContentType = errors.New("Unsupported content type")
+var ErrInvalidBody = errors.New("Invalid request body")
+var ErrInvalidAmount = errors.New("Invalid amount")
+
+/**
+Read the JSON body of a request into target, which must be a pointer
+The body is rejected when it is larger than limit, has fields target doesn't have,
+or misses the fields tagged validate:"required"
+Returns the body, for the functions taking the raw JSON
+*/
+func decodeBody(r *http.Request, limit int64, target interface{}) ([]byte, error) {
+	// the clients which don't tell the type send JSON
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil || mediaType != "application/json" {
+			return nil, fmt.Errorf("%w : %q, expected application/json", ErrUnsupportedContentType, contentType)
+		}
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > limit {
+		return nil, fmt.Errorf("%w : at most %v bytes", ErrBodyTooLarge, limit)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(target); err != nil {
+		return nil, fmt.Errorf("%w : %v", ErrInvalidBody, err.Error())
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, fmt.Errorf("%w : data after the JSON value", ErrInvalidBody)
+	}
+
+	var raw interface{}
+	json.Unmarshal(body, &raw)
+	if err := checkRequired(reflect.TypeOf(target).Elem(), raw, "body"); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+/**
+Check that the fields tagged validate:"required" are in the decoded JSON value, and not null
+*/
+func checkRequired(t reflect.Type, raw interface{}, at string) error {
+	if raw == nil {
+		return nil
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Slice, reflect.Array:
+		items, _ := raw.([]interface{})
+		for i, item := range items {
+			if err := checkRequired(t.Elem(), item, at+"["+strconv.Itoa(i)+"]"); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		values, _ := raw.(map[string]interface{})
+		for key, value := range values {
+			if err := checkRequired(t.Elem(), value, at+"."+key); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		object, ok := raw.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name := strings.Split(field.Tag.Get("json"), ",")[0]
+			if name == "" {
+				name = field.Name
+			}
+			value, present := jsonField(object, name)
+			if field.Tag.Get("validate") == "required" && (!present || value == nil) {
+				return fmt.Errorf("%w : %v.%v is required", ErrInvalidBody, at, name)
+			}
+			if err := checkRequired(field.Type, value, at+"."+name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// encoding/json matches the keys without case, as the decoded body did
+func jsonField(object map[string]interface{}, name string) (interface{}, bool) {
+	if value, ok := object[name]; ok {
+		return value, true
+	}
+	for key, value := range object {
+		if strings.EqualFold(key, name) {
+			return value, true
+		}
+	}
+	return nil, false
+}
+
+/**
+Number of pictures asked to a queue, between 1 and maxAmount
+*/
+func parseAmount(raw string) (int, error) {
+	amount, err := strconv.Atoi(raw)
+	if err != nil || amount < 1 || amount > maxAmount {
+		return 0, fmt.Errorf("%w : %q, expected a number between 1 and %v", ErrInvalidAmount, raw, maxAmount)
+	}
+	return amount, nil
+}
+
+/**
+Answer a request whose body or parameters could not be read
+*/
+func writeRequestError(w http.ResponseWriter, r *http.Request, err error) {
+	logf(r.Context(), "[ERROR] : %v", err.Error())
+	switch {
+	case errors.Is(err, ErrBodyTooLarge):
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+	case errors.Is(err, ErrUnsupportedContentType):
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+	case errors.Is(err, ErrInvalidBody), errors.Is(err, ErrInvalidAmount):
+		w.WriteHeader(http.StatusBadRequest)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("[MICRO-DATABASE] Could not read request"))
+		return
+	}
+	w.Write([]byte(fmt.Sprintf("[MICRO-DATABASE] %v", err.Error())))
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDecodeBody(t *testing.T) {
+	var annotations []Annotation
+
+	request, _ := http.NewRequest("PUT", "/", bytes.NewBufferString(`[{"Value": "Annotated"}]`))
+	_, err := decodeBody(request, maxBodyBytes, &annotations)
+	assert.Nil(t, err)
+	assert.Equal(t, "Annotated", annotations[0].Value)
+
+	request, _ = http.NewRequest("PUT", "/", bytes.NewBufferString(`[{"Value": "Annotated"}]`))
+	request.Header.Set("Content-Type", "text/plain")
+	_, err = decodeBody(request, maxBodyBytes, &annotations)
+	assert.True(t, errors.Is(err, ErrUnsupportedContentType))
+
+	request, _ = http.NewRequest("PUT", "/", bytes.NewBufferString(`[{"Value": "`+strings.Repeat("a", 64)+`"}]`))
+	_, err = decodeBody(request, 32, &annotations)
+	assert.True(t, errors.Is(err, ErrBodyTooLarge))
+
+	// unknown field, missing required field, and two values
+	for _, body := range []string{`[{"Value": "a", "Valeu": "b"}]`, `[{"Id": "5e679a2c005e59a282790a76"}]`, `[{"Value": null}]`, `[] []`} {
+		request, _ = http.NewRequest("PUT", "/", bytes.NewBufferString(body))
+		request.Header.Set("Content-Type", "application/json; charset=utf-8")
+		_, err = decodeBody(request, maxBodyBytes, &annotations)
+		assert.True(t, errors.Is(err, ErrInvalidBody), body)
+	}
+}
+
+func TestParseAmount(t *testing.T) {
+	for _, raw := range []string{"1", "10", "500"} {
+		_, err := parseAmount(raw)
+		assert.Nil(t, err, raw)
+	}
+	for _, raw := range []string{"0", "-1", "501", "100000", "ten", ""} {
+		_, err := parseAmount(raw)
+		assert.True(t, errors.Is(err, ErrInvalidAmount), raw)
+	}
+}
+
+func TestRequestLimits(t *testing.T) {
+	for _, amount := range []string{"-1", "100000"} {
+		request, _ := http.NewRequest("GET", "/db/retrieve/snippets/"+amount, nil)
+		request = mux.SetURLVars(request, map[string]string{"amount": amount})
+		recorder := httptest.NewRecorder()
+		newPageWithSuggestions(recorder, request)
+		assert.Equal(t, http.StatusBadRequest, recorder.Code, amount)
+	}
+
+	router := newRouter()
+	request, _ := http.NewRequest("PUT", "/db/update/value", bytes.NewBufferString(`[{"Value": "Annotated"}]`))
+	request.Header.Set("Content-Type", "text/plain")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusUnsupportedMediaType, recorder.Code)
+
+	request, _ = http.NewRequest("PUT", "/db/update/value", bytes.NewBufferString(`[{"Value": "`+strings.Repeat("a", int(maxBodyBytes))+`"}]`))
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, recorder.Code)
+
+	request, _ = http.NewRequest("PUT", "/db/update/value", bytes.NewBufferString(`[{"Id": "5e679a2c005e59a282790a76"}]`))
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus"
@@ -12,7 +13,6 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/readpref"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
@@ -30,16 +30,48 @@ var (
 	})
 )
 
-type Status struct {
-	DbUp       bool  `json:"isDBUp"`
-	Total      int64 `json:"total"`
-	Annotated  int64 `json:"annotated"`
+type StatusCounts struct {
+	Total int64 `json:"total"`
+	// Annotated by humans
+	Annotated int64 `json:"annotated"`
+	// Annotated by the recognizer, waiting for a human
+	Suggested int64 `json:"suggested"`
+	// Not annotated and not sent to the recognizer yet
+	PendingForRecognizer int64 `json:"pendingForRecognizer"`
+	// Sent to the recognizer and not answered yet, they go back to the queue when released
+	Leased     int64 `json:"leased"`
 	Unreadable int64 `json:"unreadable"`
+	Corrected  int64 `json:"corrected"`
+	// Counts of the custom flags declared in the settings
+	CustomFlags map[Flag]int64 `json:"customFlags,omitempty"`
+}
+
+func (counts *StatusCounts) add(other StatusCounts) {
+	counts.Total += other.Total
+	counts.Annotated += other.Annotated
+	counts.Suggested += other.Suggested
+	counts.PendingForRecognizer += other.PendingForRecognizer
+	counts.Leased += other.Leased
+	counts.Unreadable += other.Unreadable
+	counts.Corrected += other.Corrected
+	for flag, count := range other.CustomFlags {
+		if counts.CustomFlags == nil {
+			counts.CustomFlags = make(map[Flag]int64)
+		}
+		counts.CustomFlags[flag] += count
+	}
+}
+
+type Status struct {
+	DbUp bool `json:"isDBUp"`
+	StatusCounts
+	// Counts of the pictures of each annotator, only with ?by=annotator
+	Annotators map[string]StatusCounts `json:"annotators,omitempty"`
 }
 
 func homeLink(w http.ResponseWriter, r *http.Request) {
 	httpRequestsTotal.Inc() // incrementing the httpRequestsTotal counter
-	log.Printf("Homelink Joined")
+	logf(r.Context(), "Homelink Joined")
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("[MICRO-DATABASE] Homelink Joined"))
 }
@@ -47,40 +79,41 @@ func homeLink(w http.ResponseWriter, r *http.Request) {
 func createEntry(w http.ResponseWriter, r *http.Request) {
 	httpRequestsTotal.Inc() // incrementing the httpRequestsTotal counter
 
-	_, err, authStatusCode := lib_auth.AuthenticateUser(r)
+	user, err, authStatusCode := authenticateUser(r)
 
 	// check if there was an error during the authentication or if the user wasn't authenticated
 	if err != nil {
-		log.Printf("[ERROR] Check authentication: %v", err.Error())
+		logf(r.Context(), "[ERROR] Check authentication: %v", err.Error())
 		w.WriteHeader(authStatusCode)
 		w.Write([]byte("[MICRO-DATABASE] Couldn't verify identity"))
 		return
 	}
 
-	reqBody, err := ioutil.ReadAll(r.Body)
+	var pictures []Picture
+	reqBody, err := decodeBody(r, maxInsertBytes, &pictures)
 	if err != nil {
-		log.Printf("[ERROR] : %v", err.Error())
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("[MICRO-DATABASE] Could not read request"))
+		writeRequestError(w, r, err)
 		return
 	}
 
-	ids, err := InsertMany(reqBody, Database)
-	if err != nil {
-		log.Printf("[ERROR] : %v", err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(fmt.Sprintf("[MICRO-DATABASE] %v", err.Error())))
+	ids, err := InsertMany(r.Context(), reqBody, Database, user.Username)
+	if errors.Is(err, ErrUnknownFlag) || errors.Is(err, ErrInvalidFlagValue) {
+		writeDatabaseError(w, r, err, http.StatusBadRequest)
+		return
+	} else if err != nil {
+		writeDatabaseError(w, r, err, http.StatusInternalServerError)
 		return
 	}
 
 	body, err := json.Marshal(ids)
 	if err != nil {
-		log.Printf("[ERROR] : %v", err.Error())
+		logf(r.Context(), "[ERROR] : %v", err.Error())
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte("[MICRO-DATABASE] Could not marshal answer data"))
 		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	w.Write(body)
 }
@@ -88,11 +121,11 @@ func createEntry(w http.ResponseWriter, r *http.Request) {
 func selectById(w http.ResponseWriter, r *http.Request) {
 	httpRequestsTotal.Inc() // incrementing the httpRequestsTotal counter
 
-	_, err, authStatusCode := lib_auth.AuthenticateUser(r)
+	_, err, authStatusCode := authenticateUser(r)
 
 	// check if there was an error during the authentication or if the user wasn't authenticated
 	if err != nil {
-		log.Printf("[ERROR] Check authentication: %v", err.Error())
+		logf(r.Context(), "[ERROR] Check authentication: %v", err.Error())
 		w.WriteHeader(authStatusCode)
 		w.Write([]byte("[MICRO-DATABASE] Couldn't verify identity"))
 		return
@@ -100,27 +133,26 @@ func selectById(w http.ResponseWriter, r *http.Request) {
 
 	entryId, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
 	if err != nil {
-		log.Printf("[ERROR] : %v", err.Error())
+		logf(r.Context(), "[ERROR] : %v", err.Error())
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte("[MICRO-DATABASE] Could not decode ID"))
 		return
 	}
 
-	entry, err := FindOne(entryId, Database)
+	entry, err := FindOne(r.Context(), entryId, Database)
 	if err != nil {
-		log.Printf("[ERROR] : %v", err.Error())
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte(fmt.Sprintf("[MICRO-DATABASE] %v", err.Error())))
+		writeDatabaseError(w, r, err, http.StatusNotFound)
 		return
 	}
 	body, err := json.Marshal(entry)
 	if err != nil {
-		log.Printf("[ERROR] : %v", err.Error())
+		logf(r.Context(), "[ERROR] : %v", err.Error())
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte("[MICRO-DATABASE] Could not marshal answer data"))
 		return
 	}
 
+	w.Header().Set("ETag", ETag(entry.Version))
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	w.Write(body)
@@ -129,38 +161,32 @@ func selectById(w http.ResponseWriter, r *http.Request) {
 func newPageWithSuggestions(w http.ResponseWriter, r *http.Request) {
 	httpRequestsTotal.Inc() // incrementing the httpRequestsTotal counter
 
-	_, err, authStatusCode := lib_auth.AuthenticateUser(r)
+	_, err, authStatusCode := authenticateUser(r)
 
 	// check if there was an error during the authentication or if the user wasn't authenticated
 	if err != nil {
-		log.Printf("[ERROR] Check authentication: %v", err.Error())
+		logf(r.Context(), "[ERROR] Check authentication: %v", err.Error())
 		w.WriteHeader(authStatusCode)
 		w.Write([]byte("[MICRO-DATABASE] Couldn't verify identity"))
 		return
 	}
 
-	entryAmnt := mux.Vars(r)["amount"]
-	amount, err := strconv.Atoi(entryAmnt)
+	amount, err := parseAmount(mux.Vars(r)["amount"])
 	if err != nil {
-		log.Printf("[ERROR] : %v", err.Error())
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("[MICRO-DATABASE] Could not read specified amount"))
+		writeRequestError(w, r, err)
+		return
 	}
 
-	entry, err := FindManyWithSuggestion(amount, Database)
+	entry, err := FindManyWithSuggestion(r.Context(), amount, Database)
 	if err != nil {
-		log.Printf("[ERROR] : %v", err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(fmt.Sprintf("[MICRO-DATABASE] %v", err.Error())))
+		writeDatabaseError(w, r, err, http.StatusInternalServerError)
 		return
 	}
 
 	if len(entry) < amount {
-		unsused, err := FindManyUnused(amount-len(entry), Database)
+		unsused, err := FindManyUnused(r.Context(), amount-len(entry), Database)
 		if err != nil {
-			log.Printf("[ERROR] : %v", err.Error())
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(fmt.Sprintf("[MICRO-DATABASE] %v", err.Error())))
+			writeDatabaseError(w, r, err, http.StatusInternalServerError)
 			return
 		}
 		for _, pic := range unsused {
@@ -169,7 +195,7 @@ func newPageWithSuggestions(w http.ResponseWriter, r *http.Request) {
 	}
 	body, err := json.Marshal(entry)
 	if err != nil {
-		log.Printf("[ERROR] : %v", err.Error())
+		logf(r.Context(), "[ERROR] : %v", err.Error())
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte("[MICRO-DATABASE] Could not marshal answer data"))
 		return
@@ -183,36 +209,28 @@ func newPageWithSuggestions(w http.ResponseWriter, r *http.Request) {
 func newBatchForReco(w http.ResponseWriter, r *http.Request) {
 	httpRequestsTotal.Inc() // incrementing the httpRequestsTotal counter
 
-	password := r.Header.Get("Authorization")
-	expectedPassword := os.Getenv("CLUSTER_INTERNAL_PASSWORD")
-
-	if password != expectedPassword {
-		log.Printf("[ERROR] : Wrong password, expected %v but got %v", expectedPassword, password)
+	if !isClusterPassword(r.Header.Get("Authorization")) {
+		logf(r.Context(), "[ERROR] : Wrong password for the recognizer queue")
 		w.WriteHeader(http.StatusForbidden)
 		w.Write([]byte("[MICRO-DATABASE] Recognizer didn't have correct password"))
 		return
 	}
 
-	entryAmnt := mux.Vars(r)["amount"]
-	amount, err := strconv.Atoi(entryAmnt)
+	amount, err := parseAmount(mux.Vars(r)["amount"])
 	if err != nil {
-		log.Printf("[ERROR] : %v", err.Error())
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("[MICRO-DATABASE] Could not read specified amount"))
+		writeRequestError(w, r, err)
 		return
 	}
 
-	entry, err := FindManyForSuggestion(amount, Database)
+	entry, err := FindManyForSuggestion(r.Context(), amount, Database)
 	if err != nil {
-		log.Printf("[ERROR] : %v", err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(fmt.Sprintf("[MICRO-DATABASE] %v", err.Error())))
+		writeDatabaseError(w, r, err, http.StatusInternalServerError)
 		return
 	}
 
 	body, err := json.Marshal(entry)
 	if err != nil {
-		log.Printf("[ERROR] : %v", err.Error())
+		logf(r.Context(), "[ERROR] : %v", err.Error())
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte("[MICRO-DATABASE] Could not marshal answer data"))
 		return
@@ -226,11 +244,11 @@ func newBatchForReco(w http.ResponseWriter, r *http.Request) {
 func getAll(w http.ResponseWriter, r *http.Request) {
 	httpRequestsTotal.Inc() // incrementing the httpRequestsTotal counter
 
-	user, err, authStatusCode := lib_auth.AuthenticateUser(r)
+	user, err, authStatusCode := authenticateUser(r)
 
 	// check if there was an error during the authentication or if the user wasn't authenticated
 	if err != nil {
-		log.Printf("[ERROR] Check authentication: %v", err.Error())
+		logf(r.Context(), "[ERROR] Check authentication: %v", err.Error())
 		w.WriteHeader(authStatusCode)
 		w.Write([]byte("[MICRO-DATABASE] Couldn't verify identity"))
 		return
@@ -238,23 +256,21 @@ func getAll(w http.ResponseWriter, r *http.Request) {
 
 	// check if the authenticated user has sufficient permissions to
 	if user.Role != lib_auth.RoleAdmin {
-		log.Printf("[WRONG_ROLE] Insufficient permission: want %v, was %v", lib_auth.RoleAdmin, user.Role)
+		logf(r.Context(), "[WRONG_ROLE] Insufficient permission: want %v, was %v", lib_auth.RoleAdmin, user.Role)
 		w.WriteHeader(http.StatusUnauthorized)
 		w.Write([]byte("[MICRO-DATABASE] Insufficient permissions to delete"))
 		return
 	}
 
-	entry, err := FindAll(Database)
+	entry, err := FindAll(r.Context(), Database)
 	if err != nil {
-		log.Printf("[ERROR] : %v", err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(fmt.Sprintf("[MICRO-DATABASE] %v", err.Error())))
+		writeDatabaseError(w, r, err, http.StatusInternalServerError)
 		return
 	}
 
 	body, err := json.Marshal(entry)
 	if err != nil {
-		log.Printf("[ERROR] : %v", err.Error())
+		logf(r.Context(), "[ERROR] : %v", err.Error())
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte("[MICRO-DATABASE] Could not marshal answer data"))
 		return
@@ -268,64 +284,92 @@ func getAll(w http.ResponseWriter, r *http.Request) {
 func updateFlags(w http.ResponseWriter, r *http.Request) {
 	httpRequestsTotal.Inc() // incrementing the httpRequestsTotal counter
 
-	_, err, authStatusCode := lib_auth.AuthenticateUser(r)
+	user, err, authStatusCode := authenticateUser(r)
 
 	// check if there was an error during the authentication or if the user wasn't authenticated
 	if err != nil {
-		log.Printf("[ERROR] Check authentication: %v", err.Error())
+		logf(r.Context(), "[ERROR] Check authentication: %v", err.Error())
 		w.WriteHeader(authStatusCode)
 		w.Write([]byte("[MICRO-DATABASE] Couldn't verify identity"))
 		return
 	}
 
-	reqBody, err := ioutil.ReadAll(r.Body)
+	var modifications []Modification
+	reqBody, err := decodeBody(r, maxBodyBytes, &modifications)
 	if err != nil {
-		log.Printf("[ERROR] : %v", err.Error())
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("[MICRO-DATABASE] Could not read request"))
+		writeRequestError(w, r, err)
 		return
 	}
 
-	err = UpdateFlags(reqBody, Database)
+	ifMatch, err := ParseIfMatch(r.Header.Get("If-Match"))
 	if err != nil {
-		log.Printf("[ERROR] : %v", err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(fmt.Sprintf("[MICRO-DATABASE] %v", err.Error())))
 		return
 	}
 
+	err = UpdateFlags(r.Context(), reqBody, Database, ifMatch, user.Username)
+	var conflict *ConflictError
+	if errors.As(err, &conflict) {
+		writeConflict(w, r, conflict, ifMatch != nil)
+		return
+	} else if errors.Is(err, ErrUnknownFlag) || errors.Is(err, ErrPreconditionScope) {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("[MICRO-DATABASE] %v", err.Error())))
+		return
+	} else if err != nil {
+		writeDatabaseError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
 	w.WriteHeader(http.StatusNoContent)
 }
 
 func updateValue(w http.ResponseWriter, r *http.Request) {
 	httpRequestsTotal.Inc() // incrementing the httpRequestsTotal counter
 
-	_, err, authStatusCode := lib_auth.AuthenticateUser(r)
+	_, err, authStatusCode := authenticateUser(r)
 
 	// check if there was an error during the authentication or if the user wasn't authenticated
 	if err != nil {
-		log.Printf("[ERROR] Check authentication: %v", err.Error())
+		logf(r.Context(), "[ERROR] Check authentication: %v", err.Error())
 		w.WriteHeader(authStatusCode)
 		w.Write([]byte("[MICRO-DATABASE] Couldn't verify identity"))
 		return
 	}
 
-	log.Println("Update value : ")
+	debugf(r.Context(), "Update value")
 
-	reqBody, err := ioutil.ReadAll(r.Body)
+	var annotations []Annotation
+	reqBody, err := decodeBody(r, maxBodyBytes, &annotations)
 	if err != nil {
-		log.Printf("[ERROR] : %v", err.Error())
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("[MICRO-DATABASE] Could not read request"))
+		writeRequestError(w, r, err)
 		return
 	}
 
-	err = UpdateValue(reqBody, Database, "unspecified")
+	ifMatch, err := ParseIfMatch(r.Header.Get("If-Match"))
 	if err != nil {
-		log.Printf("[ERROR] : %v", err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("[MICRO-DATABASE] %v", err.Error())))
+		return
+	}
+
+	err = UpdateValue(r.Context(), reqBody, Database, "unspecified", ifMatch)
+	var conflict *ConflictError
+	if errors.As(err, &conflict) {
+		writeConflict(w, r, conflict, ifMatch != nil)
+		return
+	} else if errors.Is(err, ErrPreconditionScope) {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(fmt.Sprintf("[MICRO-DATABASE] %v", err.Error())))
 		return
+	} else if err != nil {
+		writeDatabaseError(w, r, err, http.StatusInternalServerError)
+		return
 	}
 
 	w.WriteHeader(http.StatusNoContent)
@@ -334,15 +378,12 @@ func updateValue(w http.ResponseWriter, r *http.Request) {
 func updateValueWithAnnotator(w http.ResponseWriter, r *http.Request) {
 	httpRequestsTotal.Inc() // incrementing the httpRequestsTotal counter
 
-	password := r.Header.Get("Authorization")
-	expectedPassword := os.Getenv("CLUSTER_INTERNAL_PASSWORD")
-
-	if password != expectedPassword {
-		_, err, authStatusCode := lib_auth.AuthenticateUser(r)
+	if !isClusterPassword(r.Header.Get("Authorization")) {
+		_, err, authStatusCode := authenticateUser(r)
 
 		// check if there was an error during the authentication or if the user wasn't authenticated
 		if err != nil {
-			log.Printf("[ERROR] Check authentication: %v", err.Error())
+			logf(r.Context(), "[ERROR] Check authentication: %v", err.Error())
 			w.WriteHeader(authStatusCode)
 			w.Write([]byte("[MICRO-DATABASE] Couldn't verify identity"))
 			return
@@ -350,99 +391,260 @@ func updateValueWithAnnotator(w http.ResponseWriter, r *http.Request) {
 	}
 
 	annotator := mux.Vars(r)["annotator"]
-	log.Println("Update value by " + annotator + " : ")
+	debugf(r.Context(), "Update value by %v", annotator)
 
-	reqBody, err := ioutil.ReadAll(r.Body)
+	var annotations []Annotation
+	reqBody, err := decodeBody(r, maxBodyBytes, &annotations)
 	if err != nil {
-		log.Printf("[ERROR] : %v", err.Error())
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("[MICRO-DATABASE] Could not read request"))
+		writeRequestError(w, r, err)
 		return
 	}
 
-	err = UpdateValue(reqBody, Database, annotator)
+	ifMatch, err := ParseIfMatch(r.Header.Get("If-Match"))
 	if err != nil {
-		log.Printf("[ERROR] : %v", err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(fmt.Sprintf("[MICRO-DATABASE] %v", err.Error())))
 		return
 	}
 
+	err = UpdateValue(r.Context(), reqBody, Database, annotator, ifMatch)
+	var conflict *ConflictError
+	if errors.As(err, &conflict) {
+		writeConflict(w, r, conflict, ifMatch != nil)
+		return
+	} else if errors.Is(err, ErrPreconditionScope) {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("[MICRO-DATABASE] %v", err.Error())))
+		return
+	} else if err != nil {
+		writeDatabaseError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
 	w.WriteHeader(http.StatusNoContent)
 }
 
 func status(w http.ResponseWriter, r *http.Request) {
 	httpRequestsTotal.Inc() // incrementing the httpRequestsTotal counter
 
-	_, err, authStatusCode := lib_auth.AuthenticateUser(r)
+	_, err, authStatusCode := authenticateUser(r)
 
 	// check if there was an error during the authentication or if the user wasn't authenticated
 	if err != nil {
-		log.Printf("[ERROR] Check authentication: %v", err.Error())
+		logf(r.Context(), "[ERROR] Check authentication: %v", err.Error())
 		w.WriteHeader(authStatusCode)
 		w.Write([]byte("[MICRO-DATABASE] Couldn't verify identity"))
 		return
 	}
 
-	ctx, _ := context.WithTimeout(context.Background(), 3*time.Second)
+	// each project has its own collection, its status is the one of the service using it
+	by := r.URL.Query().Get("by")
+	if by != "" && by != "annotator" {
+		logf(r.Context(), "[ERROR] : Unknown breakdown %q", by)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("[MICRO-DATABASE] The status can only be broken down by annotator, not %q", by)))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+	defer cancel()
 	res := new(Status)
 	err = Client.Ping(ctx, readpref.Primary())
 	if err != nil {
-		log.Printf("[ERROR] : %v", err.Error())
+		logf(r.Context(), "[ERROR] : %v", err.Error())
 		w.Write([]byte("{ 'isDBUp': false }"))
 		return
 	} else {
 		res.DbUp = true
 	}
 
-	total, err := CountSnippets(Database)
+	settings, err := GetSettings(r.Context(), Database)
+	if err != nil {
+		writeDatabaseError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	byAnnotator := by == "annotator"
+	res.StatusCounts, res.Annotators, err = ComputeStatus(r.Context(), Database, settings.CustomFlags, byAnnotator)
 	if err != nil {
-		log.Printf("[ERROR] : %v", err.Error())
+		logf(r.Context(), "[ERROR] : %v", err.Error())
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte("[MICRO-DATABASE] Error during MongoDB counting"))
 		return
 	}
-	res.Total = total
 
-	annotated, err := CountAnnotatedIgnoringRecoOrUnreadable(Database)
+	body, err := json.Marshal(res)
 	if err != nil {
-		log.Printf("[ERROR] : %v", err.Error())
+		logf(r.Context(), "[ERROR] : %v", err.Error())
 		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("[MICRO-DATABASE] Error during MongoDB counting"))
+		w.Write([]byte("[MICRO-DATABASE] Could not marshal answer data"))
 		return
 	}
-	res.Annotated = annotated
 
-	unreadable, err := CountFlag(Database, "Unreadable")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+
+}
+
+func selectByFlag(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.Inc() // incrementing the httpRequestsTotal counter
+
+	_, err, authStatusCode := authenticateUser(r)
+
+	// check if there was an error during the authentication or if the user wasn't authenticated
 	if err != nil {
-		log.Printf("[ERROR] : %v", err.Error())
+		logf(r.Context(), "[ERROR] Check authentication: %v", err.Error())
+		w.WriteHeader(authStatusCode)
+		w.Write([]byte("[MICRO-DATABASE] Couldn't verify identity"))
+		return
+	}
+
+	// the value defaults to true, ?value=false selects the pictures without the flag
+	value := true
+	if rawValue := r.URL.Query().Get("value"); rawValue != "" {
+		value, err = strconv.ParseBool(rawValue)
+		if err != nil {
+			logf(r.Context(), "[ERROR] : %v", err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("[MICRO-DATABASE] Could not read specified value"))
+			return
+		}
+	}
+
+	entry, err := FindManyByFlag(r.Context(), Flag(mux.Vars(r)["flag"]), value, Database)
+	if errors.Is(err, ErrUnknownFlag) {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("[MICRO-DATABASE] %v", err.Error())))
+		return
+	} else if err != nil {
+		writeDatabaseError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	body, err := json.Marshal(entry)
+	if err != nil {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
 		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("[MICRO-DATABASE] Error during MongoDB counting"))
+		w.Write([]byte("[MICRO-DATABASE] Could not marshal answer data"))
 		return
 	}
-	res.Unreadable = unreadable
 
-	body, err := json.Marshal(res)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+func getSettings(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.Inc() // incrementing the httpRequestsTotal counter
+
+	_, err, authStatusCode := authenticateUser(r)
+
+	// check if there was an error during the authentication or if the user wasn't authenticated
+	if err != nil {
+		logf(r.Context(), "[ERROR] Check authentication: %v", err.Error())
+		w.WriteHeader(authStatusCode)
+		w.Write([]byte("[MICRO-DATABASE] Couldn't verify identity"))
+		return
+	}
+
+	settings, err := GetSettings(r.Context(), Database)
+	if err != nil {
+		writeDatabaseError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	body, err := json.Marshal(settings)
 	if err != nil {
-		log.Printf("[ERROR] : %v", err.Error())
+		logf(r.Context(), "[ERROR] : %v", err.Error())
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte("[MICRO-DATABASE] Could not marshal answer data"))
 		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	w.Write(body)
+}
+
+func updateCustomFlags(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.Inc() // incrementing the httpRequestsTotal counter
+
+	user, err, authStatusCode := authenticateUser(r)
+
+	// check if there was an error during the authentication or if the user wasn't authenticated
+	if err != nil {
+		logf(r.Context(), "[ERROR] Check authentication: %v", err.Error())
+		w.WriteHeader(authStatusCode)
+		w.Write([]byte("[MICRO-DATABASE] Couldn't verify identity"))
+		return
+	}
 
+	// check if the authenticated user has sufficient permissions to
+	if user.Role != lib_auth.RoleAdmin {
+		logf(r.Context(), "[WRONG_ROLE] Insufficient permission: want %v, was %v", lib_auth.RoleAdmin, user.Role)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("[MICRO-DATABASE] Insufficient permissions to change settings"))
+		return
+	}
+
+	var flags []Flag
+	_, err = decodeBody(r, maxBodyBytes, &flags)
+	if err != nil {
+		writeRequestError(w, r, err)
+		return
+	}
+
+	err = UpdateCustomFlags(r.Context(), flags, Database)
+	if errors.Is(err, ErrInvalidFlagName) {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("[MICRO-DATABASE] %v", err.Error())))
+		return
+	} else if err != nil {
+		writeDatabaseError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/**
+Answer a write request conflicting with another writer, with the current state of the pictures
+precondition : the conflict comes from an If-Match header and not from the versions in the body
+*/
+func writeConflict(w http.ResponseWriter, r *http.Request, conflict *ConflictError, precondition bool) {
+	logf(r.Context(), "[CONFLICT] : %v", conflict.Error())
+
+	body, err := json.Marshal(conflict.Pictures)
+	if err != nil {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("[MICRO-DATABASE] Could not marshal answer data"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if precondition {
+		w.Header().Set("ETag", ETag(conflict.Pictures[0].Version))
+		w.WriteHeader(http.StatusPreconditionFailed)
+	} else {
+		w.WriteHeader(http.StatusConflict)
+	}
+	w.Write(body)
 }
 
 func deleteAll(w http.ResponseWriter, r *http.Request) {
 	httpRequestsTotal.Inc() // incrementing the httpRequestsTotal counter
 
-	user, err, authStatusCode := lib_auth.AuthenticateUser(r)
+	user, err, authStatusCode := authenticateUser(r)
 
 	// check if there was an error during the authentication or if the user wasn't authenticated
 	if err != nil {
-		log.Printf("[ERROR] Check authentication: %v", err.Error())
+		logf(r.Context(), "[ERROR] Check authentication: %v", err.Error())
 		w.WriteHeader(authStatusCode)
 		w.Write([]byte("[MICRO-DATABASE] Couldn't verify identity"))
 		return
@@ -450,45 +652,173 @@ func deleteAll(w http.ResponseWriter, r *http.Request) {
 
 	// check if the authenticated user has sufficient permissions to
 	if user.Role != lib_auth.RoleAdmin {
-		log.Printf("[WRONG_ROLE] Insufficient permission: want %v, was %v", lib_auth.RoleAdmin, user.Role)
+		logf(r.Context(), "[WRONG_ROLE] Insufficient permission: want %v, was %v", lib_auth.RoleAdmin, user.Role)
 		w.WriteHeader(http.StatusUnauthorized)
 		w.Write([]byte("[MICRO-DATABASE] Insufficient permissions to delete"))
 		return
 	}
 
-	err = DeleteAll(Database)
+	// emptying the database needs a token asked for just before, see deleteAllConfirmation
+	token := r.Header.Get("X-Confirmation-Token")
+	if token == "" {
+		w.WriteHeader(http.StatusPreconditionRequired)
+		w.Write([]byte("[MICRO-DATABASE] A confirmation token is needed to delete everything"))
+		return
+	}
+	err = ConsumeConfirmation(r.Context(), token, Database)
+	if errors.Is(err, ErrInvalidConfirmation) {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(fmt.Sprintf("[MICRO-DATABASE] %v", err.Error())))
+		return
+	} else if err != nil {
+		writeDatabaseError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	snapshot, err := DeleteAll(r.Context(), Database, user.Username)
+	if err != nil {
+		writeDatabaseError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	body, err := json.Marshal(map[string]string{"Snapshot": snapshot})
 	if err != nil {
-		log.Printf("[ERROR] : %v", err.Error())
+		logf(r.Context(), "[ERROR] : %v", err.Error())
 		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(fmt.Sprintf("[MICRO-DATABASE] %v", err.Error())))
+		w.Write([]byte("[MICRO-DATABASE] Could not marshal answer data"))
+		return
 	}
+
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
+	w.Write(body)
 }
 
 // Actual API
 func main() {
 
-	// Define the routing
+	// administration subcommands, e.g. micro-database backup <file>
+	if len(os.Args) > 1 {
+		err := runCommand(os.Args[1:], os.Stdin, os.Stdout)
+		if err != nil {
+			log.Fatalf("[ERROR] : %v", err.Error())
+		}
+		return
+	}
+
+	if migrateOnStartup {
+		_, err := Migrate(context.Background(), Database, false)
+		if err != nil {
+			// the service still starts, the pending migrations are run again at the next start or with the migrate command
+			log.Printf("[ERROR] Migrations : %v", err.Error())
+		}
+	}
+
+	_, _, err := EnsureIndexes(context.Background(), Database)
+	if err != nil {
+		log.Printf("[WARNING] Indexes not reconciled : %v", err.Error())
+	}
+
+	err = EnsureEventsRetention(context.Background(), Database)
+	if err != nil {
+		log.Printf("[WARNING] Events will not expire : %v", err.Error())
+	}
+
+	go PurgeTrashPeriodically(Database)
+	go RefreshRecognizerGaugesPeriodically(Database)
+	go ScanDuplicatesPeriodically(Database)
+	go EvictThumbnailsPeriodically()
+
+	if serveGRPC != nil {
+		go func() {
+			log.Fatal(serveGRPC(":" + grpcPort))
+		}()
+	}
+
+	log.Fatal(http.ListenAndServe(":8080", newRouter()))
+}
+
+/**
+Routes of the service, the verb-style routes under /db replaced by /api/v1 answer as deprecated
+*/
+func newRouter() *mux.Router {
 	router := mux.NewRouter().StrictSlash(true)
+	router.Use(traceRequests, requestContext, rateLimit)
 
 	// metrics route for monitoring
 	router.Path("/metrics").Handler(promhttp.Handler())
 
-	router.HandleFunc("/db/", homeLink).Methods("GET")
+	// description of these routes
+	router.HandleFunc("/openapi.json", serveOpenAPI(router)).Methods("GET")
+	router.HandleFunc("/docs", apiDocs).Methods("GET")
+
+	v1 := router.PathPrefix(apiV1).Subrouter()
+	v1.HandleFunc("/pictures", listPictures).Methods("GET")
+	v1.HandleFunc("/pictures", createEntry).Methods("POST")
+	v1.HandleFunc("/pictures", deleteAll).Methods("DELETE")
+	v1.HandleFunc("/pictures/{id}", getPicture).Methods("GET")
+	v1.HandleFunc("/pictures/{id}", patchPicture).Methods("PATCH")
+	v1.HandleFunc("/pictures/{id}", softDeletePicture).Methods("DELETE")
+	v1.HandleFunc("/pictures/{id}/image", getPictureImage).Methods("GET")
+	v1.HandleFunc("/pictures/{id}/annotations", addAnnotation).Methods("POST")
+	v1.HandleFunc("/pictures/{id}/flags", patchFlags).Methods("PATCH")
+	v1.HandleFunc("/queues/annotation", annotationQueue).Methods("GET")
+	v1.HandleFunc("/queues/recognizer", recognizerQueue).Methods("POST")
+	v1.HandleFunc("/queues/recognizer/stream", recognizerStream).Methods("POST")
+	v1.HandleFunc("/tickets", createTicket).Methods("POST")
 
-	router.HandleFunc("/db/select/{id}", selectById).Methods("GET")
-	router.HandleFunc("/db/retrieve/all", getAll).Methods("GET")
-	router.HandleFunc("/db/retrieve/snippets/{amount}", newPageWithSuggestions).Methods("GET")
-	router.HandleFunc("/db/retrieve/recognizer/{amount}", newBatchForReco).Methods("GET")
+	router.HandleFunc("/db/", homeLink).Methods("GET")
+	router.HandleFunc("/db/auth/invalidate", invalidateToken).Methods("POST")
+
+	router.HandleFunc("/db/select/{id}", deprecated(selectById, apiV1+"/pictures/{id}")).Methods("GET")
+	router.HandleFunc("/db/retrieve/all", deprecated(getAll, apiV1+"/pictures")).Methods("GET")
+	router.HandleFunc("/db/retrieve/snippets/{amount}", deprecated(newPageWithSuggestions, apiV1+"/queues/annotation?amount={amount}")).Methods("GET")
+	router.HandleFunc("/db/retrieve/recognizer/{amount}", deprecated(newBatchForReco, apiV1+"/queues/recognizer?amount={amount}")).Methods("GET")
+	router.HandleFunc("/db/retrieve/flag/{flag}", deprecated(selectByFlag, apiV1+"/pictures?flag={flag}")).Methods("GET")
+	router.HandleFunc("/db/picture/{id}/image", deprecated(getPictureImage, apiV1+"/pictures/{id}/image")).Methods("GET")
 	router.HandleFunc("/db/status", status).Methods("GET")
+	router.HandleFunc("/db/settings", getSettings).Methods("GET")
+
+	router.HandleFunc("/db/insert", deprecated(createEntry, apiV1+"/pictures")).Methods("POST")
+	router.HandleFunc("/db/upload", uploadImages).Methods("POST")
+
+	// batches of pictures, replaced by a route per picture : no successor to link to
+	router.HandleFunc("/db/update/flags", deprecated(updateFlags, "")).Methods("PUT")
+	router.HandleFunc("/db/update/value", deprecated(updateValue, "")).Methods("PUT")
+	router.HandleFunc("/db/update/value/{annotator}", deprecated(updateValueWithAnnotator, "")).Methods("PUT")
+	router.HandleFunc("/db/settings/flags", updateCustomFlags).Methods("PUT")
+
+	router.HandleFunc("/db/delete/all", deprecated(deleteAll, apiV1+"/pictures")).Methods("DELETE")
+	router.HandleFunc("/db/delete/all/confirmation", deleteAllConfirmation).Methods("POST")
+	router.HandleFunc("/db/delete/picture/{id}", deprecated(softDeletePicture, apiV1+"/pictures/{id}")).Methods("DELETE")
+	router.HandleFunc("/db/delete/filter", softDeleteFilter).Methods("POST")
+
+	router.HandleFunc("/db/trash", getTrash).Methods("GET")
+	router.HandleFunc("/db/trash/{id}/restore", restorePicture).Methods("POST")
+
+	router.HandleFunc("/db/stats/annotators", annotatorStats).Methods("GET")
+	router.HandleFunc("/db/stats/annotators/activity", annotatorActivity).Methods("GET")
+	router.HandleFunc("/db/stats/recognizer", recognizerStats).Methods("GET")
+
+	router.HandleFunc("/db/duplicates", getDuplicates).Methods("GET")
+	router.HandleFunc("/db/duplicates/scan", scanDuplicates).Methods("POST")
+	router.HandleFunc("/db/duplicates/{id}", unlinkDuplicate).Methods("DELETE")
+
+	router.HandleFunc("/db/fsck", fsck).Methods("GET", "POST")
 
-	router.HandleFunc("/db/insert", createEntry).Methods("POST")
+	router.HandleFunc("/db/indexes", getIndexes).Methods("GET")
+	router.HandleFunc("/db/indexes", reconcileIndexes).Methods("PUT")
 
-	router.HandleFunc("/db/update/flags", updateFlags).Methods("PUT")
-	router.HandleFunc("/db/update/value", updateValue).Methods("PUT")
-	router.HandleFunc("/db/update/value/{annotator}", updateValueWithAnnotator).Methods("PUT")
+	router.HandleFunc("/db/backup", backup).Methods("GET")
+	router.HandleFunc("/db/restore", restore).Methods("POST")
 
-	router.HandleFunc("/db/delete/all", deleteAll).Methods("DELETE")
+	router.HandleFunc("/db/events", streamEvents).Methods("GET")
+	router.HandleFunc("/db/webhooks", listWebhooks).Methods("GET")
+	router.HandleFunc("/db/webhooks", registerWebhook).Methods("POST")
+	router.HandleFunc("/db/webhooks/deadletters", listDeadLetters).Methods("GET")
+	router.HandleFunc("/db/webhooks/deadletters/{id}/retry", retryDeadLetter).Methods("POST")
+	router.HandleFunc("/db/webhooks/{id}", deleteWebhook).Methods("DELETE")
 
-	log.Fatal(http.ListenAndServe(":8080", router))
+	return router
 }
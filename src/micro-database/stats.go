@@ -0,0 +1,446 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	lib_auth "github.com/taliesin-insa/lib-auth"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+/**
+Statistics of an annotator, computed from the events of a date range
+The statistics only see the events of the range, which are kept for eventsRetention
+*/
+type AnnotatorStats struct {
+	Annotator string `json:"Annotator"`
+	// Annotations made
+	Annotated int64 `json:"Annotated"`
+	// Median of the intervals between two consecutive annotations less than sessionGap apart, not the time spent on a snippet :
+	// the snippets have no checkout time, an interval also holds the idle time and the skipped snippets
+	MedianIntervalSeconds *float64 `json:"MedianIntervalSeconds"`
+	// Suggestions of the recognizer the annotator annotated, and those kept as they were
+	Suggestions    int64    `json:"Suggestions"`
+	Accepted       int64    `json:"Accepted"`
+	AcceptanceRate *float64 `json:"AcceptanceRate"`
+	// Annotations of a snippet also annotated by another human, and those with the same value
+	Compared      int64    `json:"Compared"`
+	Agreed        int64    `json:"Agreed"`
+	AgreementRate *float64 `json:"AgreementRate"`
+	// Annotations validated by a review, and those replaced by another human with a different value
+	Reviewed      int64    `json:"Reviewed"`
+	Rejected      int64    `json:"Rejected"`
+	RejectionRate *float64 `json:"RejectionRate"`
+	// Reviews made by the annotator
+	Reviews int64 `json:"Reviews"`
+}
+
+type ActivityStats struct {
+	Annotator string `json:"Annotator"`
+	// Day (2006-01-02) or ISO week (2006-W01)
+	Period    string `json:"Period"`
+	Annotated int64  `json:"Annotated"`
+}
+
+const (
+	PeriodDay  = "day"
+	PeriodWeek = "week"
+)
+
+// Two annotations further apart are not in the same session
+const sessionGap = 15 * time.Minute
+
+var ErrInvalidRange = errors.New("Invalid date range")
+
+func findEventsBetween(ctx context.Context, from time.Time, to time.Time, types []EventType, collection *mongo.Collection) ([]Event, error) {
+	ctx, cancel := withTimeout(ctx, OperationScan)
+	defer cancel()
+
+	filter := bson.D{
+		{"Type", bson.D{{"$in", types}}},
+		{"Time", bson.D{{"$gte", from}, {"$lt", to}}},
+		// transcriptions copied to duplicates are not the work of the annotator
+		{"Changes.DuplicateOf", bson.D{{"$exists", false}}},
+	}
+	cur, err := eventsCollection(collection).Find(ctx, filter, options.Find().SetSort(bson.D{{"_id", 1}}))
+	if err != nil {
+		return nil, mongoError(ctx, err, "Error during MongoDB selection")
+	}
+	defer cur.Close(ctx)
+
+	events := []Event{}
+	for cur.Next(ctx) {
+		var event Event
+		if err := cur.Decode(&event); err != nil {
+			logf(ctx, "[DECODE] %v", err)
+			return nil, errors.New("Could not decode data from mongo")
+		}
+		events = append(events, event)
+	}
+	if err := cur.Err(); err != nil {
+		logf(ctx, "[CURSOR] %v", err)
+		return nil, errors.New("Error while iterating results")
+	}
+	return events, nil
+}
+
+func rate(count int64, total int64) *float64 {
+	if total == 0 {
+		return nil
+	}
+	r := float64(count) / float64(total)
+	return &r
+}
+
+func median(values []float64) *float64 {
+	if len(values) == 0 {
+		return nil
+	}
+	sort.Float64s(values)
+	m := values[len(values)/2]
+	if len(values)%2 == 0 {
+		m = (values[len(values)/2-1] + m) / 2
+	}
+	return &m
+}
+
+/**
+Statistics of each human annotator between from (included) and to (excluded), sorted by annotator
+*/
+func AnnotatorStatistics(ctx context.Context, from time.Time, to time.Time, collection *mongo.Collection) ([]AnnotatorStats, error) {
+	ctx, cancel := withTimeout(ctx, OperationScan)
+	defer cancel()
+
+	events, err := findEventsBetween(ctx, from, to, []EventType{EventAnnotated, EventReviewed}, collection)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := make(map[string]*AnnotatorStats)
+	get := func(annotator string) *AnnotatorStats {
+		if stats[annotator] == nil {
+			stats[annotator] = &AnnotatorStats{Annotator: annotator}
+		}
+		return stats[annotator]
+	}
+
+	type annotation struct {
+		annotator string
+		value     string
+	}
+	// last annotation of each snippet
+	last := make(map[string]annotation)
+	times := make(map[string][]time.Time)
+
+	for _, event := range events {
+		picture := event.PictureId.Hex()
+		previous, annotated := last[picture]
+
+		if event.Type == EventReviewed {
+			get(event.Actor).Reviews++
+			if annotated && previous.annotator != RecognizerAnnotator {
+				get(previous.annotator).Reviewed++
+			}
+			continue
+		}
+
+		value := fmt.Sprint(event.Changes["Value"])
+		last[picture] = annotation{event.Actor, value}
+		if event.Actor == RecognizerAnnotator {
+			continue
+		}
+
+		current := get(event.Actor)
+		current.Annotated++
+		times[event.Actor] = append(times[event.Actor], event.Time)
+		if !annotated || previous.annotator == event.Actor {
+			continue
+		}
+
+		if previous.annotator == RecognizerAnnotator {
+			current.Suggestions++
+			if value == previous.value {
+				current.Accepted++
+			}
+			continue
+		}
+
+		other := get(previous.annotator)
+		current.Compared++
+		other.Compared++
+		if value == previous.value {
+			current.Agreed++
+			other.Agreed++
+		} else {
+			other.Rejected++
+		}
+	}
+
+	results := []AnnotatorStats{}
+	for annotator, s := range stats {
+		var intervals []float64
+		for i := 1; i < len(times[annotator]); i++ {
+			if gap := times[annotator][i].Sub(times[annotator][i-1]); gap < sessionGap {
+				intervals = append(intervals, gap.Seconds())
+			}
+		}
+		s.MedianIntervalSeconds = median(intervals)
+		s.AcceptanceRate = rate(s.Accepted, s.Suggestions)
+		s.AgreementRate = rate(s.Agreed, s.Compared)
+		s.RejectionRate = rate(s.Rejected, s.Rejected+s.Reviewed)
+		results = append(results, *s)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Annotator < results[j].Annotator })
+
+	return results, nil
+}
+
+func periodOf(t time.Time, period string) string {
+	if period == PeriodWeek {
+		year, week := t.UTC().ISOWeek()
+		return fmt.Sprintf("%04d-W%02d", year, week)
+	}
+	return t.UTC().Format("2006-01-02")
+}
+
+/**
+Number of annotations of each human annotator per day or per week, sorted by annotator then period
+*/
+func AnnotatorActivity(ctx context.Context, from time.Time, to time.Time, period string, collection *mongo.Collection) ([]ActivityStats, error) {
+	ctx, cancel := withTimeout(ctx, OperationScan)
+	defer cancel()
+
+	if period != PeriodDay && period != PeriodWeek {
+		return nil, fmt.Errorf("%w : unknown period %q", ErrInvalidRange, period)
+	}
+	events, err := findEventsBetween(ctx, from, to, []EventType{EventAnnotated}, collection)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[ActivityStats]int64)
+	for _, event := range events {
+		if event.Actor != RecognizerAnnotator {
+			counts[ActivityStats{Annotator: event.Actor, Period: periodOf(event.Time, period)}]++
+		}
+	}
+
+	results := []ActivityStats{}
+	for key, count := range counts {
+		key.Annotated = count
+		results = append(results, key)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Annotator != results[j].Annotator {
+			return results[i].Annotator < results[j].Annotator
+		}
+		return results[i].Period < results[j].Period
+	})
+
+	return results, nil
+}
+
+// Dates of the statistics are RFC 3339 times or days, a day as upper bound is included
+func parseStatsDate(raw string, upper bool) (time.Time, error) {
+	if day, err := time.Parse("2006-01-02", raw); err == nil {
+		if upper {
+			return day.Add(24 * time.Hour), nil
+		}
+		return day, nil
+	}
+	t, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w : %q is neither a day nor an RFC 3339 time", ErrInvalidRange, raw)
+	}
+	return t, nil
+}
+
+/**
+Range given by the from and to parameters, by default the events which were not expired yet
+*/
+func parseStatsRange(r *http.Request) (time.Time, time.Time, error) {
+	to := time.Now().UTC()
+	from := to.Add(-eventsRetention)
+	var err error
+
+	if raw := r.URL.Query().Get("from"); raw != "" {
+		if from, err = parseStatsDate(raw, false); err != nil {
+			return from, to, err
+		}
+	}
+	if raw := r.URL.Query().Get("to"); raw != "" {
+		if to, err = parseStatsDate(raw, true); err != nil {
+			return from, to, err
+		}
+	}
+	if !from.Before(to) {
+		return from, to, fmt.Errorf("%w : from must be before to", ErrInvalidRange)
+	}
+	return from, to, nil
+}
+
+func wantsCSV(r *http.Request) bool {
+	return r.URL.Query().Get("format") == "csv" || r.Header.Get("Accept") == "text/csv"
+}
+
+func writeCSV(w http.ResponseWriter, filename string, header []string, rows [][]string) {
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.WriteHeader(http.StatusOK)
+
+	writer := csv.NewWriter(w)
+	writer.Write(header)
+	writer.WriteAll(rows)
+	if err := writer.Error(); err != nil {
+		log.Printf("[ERROR] CSV export interrupted : %v", err.Error())
+	}
+}
+
+func formatRate(value *float64) string {
+	if value == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*value, 'f', 4, 64)
+}
+
+// Authenticate an admin, writes the error and returns false otherwise
+func authenticateStatsAdmin(w http.ResponseWriter, r *http.Request) bool {
+	user, err, authStatusCode := authenticateUser(r)
+
+	// check if there was an error during the authentication or if the user wasn't authenticated
+	if err != nil {
+		logf(r.Context(), "[ERROR] Check authentication: %v", err.Error())
+		w.WriteHeader(authStatusCode)
+		w.Write([]byte("[MICRO-DATABASE] Couldn't verify identity"))
+		return false
+	}
+
+	// check if the authenticated user has sufficient permissions to
+	if user.Role != lib_auth.RoleAdmin {
+		logf(r.Context(), "[WRONG_ROLE] Insufficient permission: want %v, was %v", lib_auth.RoleAdmin, user.Role)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("[MICRO-DATABASE] Insufficient permissions to see the statistics"))
+		return false
+	}
+	return true
+}
+
+func annotatorStats(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.Inc() // incrementing the httpRequestsTotal counter
+
+	if !authenticateStatsAdmin(w, r) {
+		return
+	}
+
+	from, to, err := parseStatsRange(r)
+	if err != nil {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("[MICRO-DATABASE] %v", err.Error())))
+		return
+	}
+
+	stats, err := AnnotatorStatistics(r.Context(), from, to, Database)
+	if err != nil {
+		writeDatabaseError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	if wantsCSV(r) {
+		rows := make([][]string, 0, len(stats))
+		for _, s := range stats {
+			rows = append(rows, []string{
+				s.Annotator,
+				strconv.FormatInt(s.Annotated, 10),
+				formatRate(s.MedianIntervalSeconds),
+				strconv.FormatInt(s.Suggestions, 10),
+				strconv.FormatInt(s.Accepted, 10),
+				formatRate(s.AcceptanceRate),
+				strconv.FormatInt(s.Compared, 10),
+				strconv.FormatInt(s.Agreed, 10),
+				formatRate(s.AgreementRate),
+				strconv.FormatInt(s.Reviewed, 10),
+				strconv.FormatInt(s.Rejected, 10),
+				formatRate(s.RejectionRate),
+				strconv.FormatInt(s.Reviews, 10),
+			})
+		}
+		header := []string{"Annotator", "Annotated", "MedianIntervalSeconds", "Suggestions", "Accepted", "AcceptanceRate",
+			"Compared", "Agreed", "AgreementRate", "Reviewed", "Rejected", "RejectionRate", "Reviews"}
+		writeCSV(w, "annotators.csv", header, rows)
+		return
+	}
+
+	body, err := json.Marshal(stats)
+	if err != nil {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("[MICRO-DATABASE] Could not marshal answer data"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+func annotatorActivity(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.Inc() // incrementing the httpRequestsTotal counter
+
+	if !authenticateStatsAdmin(w, r) {
+		return
+	}
+
+	from, to, err := parseStatsRange(r)
+	if err != nil {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("[MICRO-DATABASE] %v", err.Error())))
+		return
+	}
+	period := r.URL.Query().Get("period")
+	if period == "" {
+		period = PeriodDay
+	}
+
+	activity, err := AnnotatorActivity(r.Context(), from, to, period, Database)
+	if errors.Is(err, ErrInvalidRange) {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("[MICRO-DATABASE] %v", err.Error())))
+		return
+	} else if err != nil {
+		writeDatabaseError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	if wantsCSV(r) {
+		rows := make([][]string, 0, len(activity))
+		for _, a := range activity {
+			rows = append(rows, []string{a.Annotator, a.Period, strconv.FormatInt(a.Annotated, 10)})
+		}
+		writeCSV(w, "activity.csv", []string{"Annotator", "Period", "Annotated"}, rows)
+		return
+	}
+
+	body, err := json.Marshal(activity)
+	if err != nil {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("[MICRO-DATABASE] Could not marshal answer data"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAnnotatorStatistics(t *testing.T) {
+	Database = Client.Database("taliesin_test").Collection("test_annotator_stats")
+	eventsCollection(Database).Drop(context.TODO())
+	doc0 := Picture{Id: primitive.NewObjectID(), PiFF: EmptyPiFF, Url: "/temp/none0"}
+	doc1 := Picture{Id: primitive.NewObjectID(), PiFF: EmptyPiFF, Url: "/temp/none1"}
+	b, _ := json.Marshal([2]Picture{doc0, doc1})
+	res, _ := InsertMany(context.Background(), b, Database, "test")
+	id0, id1 := res[0].(primitive.ObjectID), res[1].(primitive.ObjectID)
+
+	annotate := func(id primitive.ObjectID, value string, annotator string) {
+		body, _ := json.Marshal([1]Annotation{{Id: id, Value: value}})
+		assert.Nil(t, UpdateValue(context.Background(), body, Database, annotator, nil))
+	}
+	// morpheus accepts a suggestion, trinity replaces the annotation of morpheus
+	annotate(id0, "Arlequin", RecognizerAnnotator)
+	annotate(id0, "Arlequin", "morpheus")
+	annotate(id0, "Harlequin", "trinity")
+	// trinity agrees with morpheus, and neo reviews it
+	annotate(id1, "Poirier", "morpheus")
+	annotate(id1, "Poirier", "trinity")
+	body, _ := json.Marshal([1]Modification{{Id: id1, Flag: FlagCorrected, Value: true}})
+	assert.Nil(t, UpdateFlags(context.Background(), body, Database, nil, "neo"))
+
+	stats, err := AnnotatorStatistics(context.Background(), time.Now().Add(-time.Hour), time.Now().Add(time.Hour), Database)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(stats))
+
+	morpheus, neo, trinity := stats[0], stats[1], stats[2]
+	assert.Equal(t, "morpheus", morpheus.Annotator)
+	assert.Equal(t, int64(2), morpheus.Annotated)
+	assert.Equal(t, int64(1), morpheus.Suggestions)
+	assert.Equal(t, 1.0, *morpheus.AcceptanceRate)
+	assert.Equal(t, int64(2), morpheus.Compared)
+	assert.Equal(t, 0.5, *morpheus.AgreementRate)
+	assert.Equal(t, int64(1), morpheus.Rejected)
+	assert.NotNil(t, morpheus.MedianIntervalSeconds)
+
+	assert.Equal(t, int64(1), neo.Reviews)
+	assert.Equal(t, int64(1), trinity.Reviewed)
+	assert.Equal(t, 0.0, *trinity.RejectionRate)
+	assert.Nil(t, trinity.AcceptanceRate)
+
+	activity, err := AnnotatorActivity(context.Background(), time.Now().Add(-time.Hour), time.Now().Add(time.Hour), PeriodWeek, Database)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(activity))
+	assert.Equal(t, int64(2), activity[0].Annotated)
+
+	request, _ := http.NewRequest("GET", "/db/stats/annotators/activity?period=day&format=csv", nil)
+	request.Header.Set("Authorization", "admin_token")
+	recorder := httptest.NewRecorder()
+	annotatorActivity(recorder, request)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	lines := strings.Split(strings.TrimSpace(recorder.Body.String()), "\n")
+	assert.Equal(t, "Annotator,Period,Annotated", lines[0])
+	assert.Equal(t, 3, len(lines))
+
+	request, _ = http.NewRequest("GET", "/db/stats/annotators?from=2020-04-08&to=2020-04-07", nil)
+	request.Header.Set("Authorization", "admin_token")
+	recorder = httptest.NewRecorder()
+	annotatorStats(recorder, request)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	lib_auth "github.com/taliesin-insa/lib-auth"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+type TicketPurpose string
+
+/**
+Tickets replace the token in the URLs of the clients which can't set headers, as EventSource or <img>
+A ticket is only accepted by the routes of its purpose, and for a short time
+*/
+const (
+	TicketEvents TicketPurpose = "events"
+	TicketImages TicketPurpose = "images"
+)
+
+/**
+Lifetime of the tickets : long enough to open the stream, an EventSource reconnecting later asks for a new one
+The images of a page are loaded with the same ticket, the page asks for a new one before it expires
+*/
+var ticketLifetimes = map[TicketPurpose]time.Duration{
+	TicketEvents: time.Minute,
+	TicketImages: 5 * time.Minute,
+}
+
+var ErrInvalidTicket = errors.New("Invalid or expired ticket")
+
+/**
+Key signing the tickets, TICKET_SECRET must be the same for every replica
+Without it each replica has its own key, and only accepts the tickets it issued
+*/
+var ticketKey []byte
+
+func init() {
+	if secret := os.Getenv("TICKET_SECRET"); secret != "" {
+		ticketKey = []byte(secret)
+		return
+	}
+	ticketKey = make([]byte, 32)
+	if _, err := rand.Read(ticketKey); err != nil {
+		log.Printf("[RAND] : %v", err.Error())
+	}
+	log.Printf("[WARNING] TICKET_SECRET is not set, the tickets are only accepted by the replica which issued them")
+}
+
+type TicketRequest struct {
+	Purpose TicketPurpose `validate:"required"`
+}
+
+type TicketResponse struct {
+	// Sent as ?ticket=
+	Ticket  string    `json:"Ticket"`
+	Expires time.Time `json:"Expires"`
+}
+
+// What a ticket holds, signed
+type ticketClaims struct {
+	Purpose  TicketPurpose `json:"p"`
+	Username string        `json:"u"`
+	Role     int           `json:"r"`
+	Expires  int64         `json:"e"`
+}
+
+func signTicket(payload string) string {
+	mac := hmac.New(sha256.New, ticketKey)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+/**
+Ticket of a user for a purpose, it needs no storage : it is signed with ticketKey
+*/
+func IssueTicket(user *lib_auth.UserData, purpose TicketPurpose, now time.Time) (TicketResponse, error) {
+	lifetime, ok := ticketLifetimes[purpose]
+	if !ok {
+		return TicketResponse{}, fmt.Errorf("%w : unknown purpose %q", ErrInvalidBody, purpose)
+	}
+	expires := now.Add(lifetime).UTC().Truncate(time.Second)
+	claims, err := json.Marshal(ticketClaims{Purpose: purpose, Username: user.Username, Role: user.Role, Expires: expires.Unix()})
+	if err != nil {
+		return TicketResponse{}, err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(claims)
+	return TicketResponse{Ticket: payload + "." + signTicket(payload), Expires: expires}, nil
+}
+
+/**
+User a ticket was issued to, if it was issued for this purpose and has not expired
+*/
+func VerifyTicket(ticket string, purpose TicketPurpose, now time.Time) (*lib_auth.UserData, error) {
+	parts := strings.Split(ticket, ".")
+	if len(parts) != 2 || !hmac.Equal([]byte(signTicket(parts[0])), []byte(parts[1])) {
+		return nil, ErrInvalidTicket
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidTicket
+	}
+	var claims ticketClaims
+	if err := json.Unmarshal(raw, &claims); err != nil {
+		return nil, ErrInvalidTicket
+	}
+	if claims.Purpose != purpose || now.Unix() >= claims.Expires {
+		return nil, ErrInvalidTicket
+	}
+	return &lib_auth.UserData{Username: claims.Username, Role: claims.Role}, nil
+}
+
+/**
+Authenticate a request by the ticket of its ?ticket= parameter
+Returns false once the error was answered
+*/
+func authenticateTicket(w http.ResponseWriter, r *http.Request, purpose TicketPurpose) (*lib_auth.UserData, bool) {
+	user, err := VerifyTicket(r.URL.Query().Get("ticket"), purpose, time.Now())
+	if err != nil {
+		logf(r.Context(), "[ERROR] Check ticket: %v", err.Error())
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(fmt.Sprintf("[MICRO-DATABASE] %v", err.Error())))
+		return nil, false
+	}
+	return user, true
+}
+
+func createTicket(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.Inc() // incrementing the httpRequestsTotal counter
+
+	user, err, authStatusCode := authenticateUser(r)
+
+	// check if there was an error during the authentication or if the user wasn't authenticated
+	if err != nil {
+		logf(r.Context(), "[ERROR] Check authentication: %v", err.Error())
+		w.WriteHeader(authStatusCode)
+		w.Write([]byte("[MICRO-DATABASE] Couldn't verify identity"))
+		return
+	}
+
+	var request TicketRequest
+	if _, err := decodeBody(r, maxBodyBytes, &request); err != nil {
+		writeRequestError(w, r, err)
+		return
+	}
+
+	ticket, err := IssueTicket(user, request.Purpose, time.Now())
+	if err != nil {
+		writeRequestError(w, r, err)
+		return
+	}
+
+	body, err := json.Marshal(ticket)
+	if err != nil {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("[MICRO-DATABASE] Could not marshal answer data"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(body)
+}
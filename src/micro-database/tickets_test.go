@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	lib_auth "github.com/taliesin-insa/lib-auth"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTickets(t *testing.T) {
+	now := time.Now()
+	user := &lib_auth.UserData{Username: "morpheus", Role: lib_auth.RoleAnnotator}
+	ticket, err := IssueTicket(user, TicketEvents, now)
+	assert.Nil(t, err)
+	assert.Equal(t, now.Add(time.Minute).Unix(), ticket.Expires.Unix())
+
+	verified, err := VerifyTicket(ticket.Ticket, TicketEvents, now)
+	assert.Nil(t, err)
+	assert.Equal(t, user, verified)
+
+	// only for its purpose, and for a short time
+	_, err = VerifyTicket(ticket.Ticket, "backup", now)
+	assert.Equal(t, ErrInvalidTicket, err)
+	_, err = VerifyTicket(ticket.Ticket, TicketEvents, now.Add(time.Minute+time.Second))
+	assert.Equal(t, ErrInvalidTicket, err)
+
+	// the claims can't be changed
+	admin, _ := IssueTicket(&lib_auth.UserData{Username: "morpheus", Role: lib_auth.RoleAdmin}, TicketEvents, now)
+	forged := admin.Ticket[:bytes.IndexByte([]byte(admin.Ticket), '.')] + ticket.Ticket[bytes.IndexByte([]byte(ticket.Ticket), '.'):]
+	_, err = VerifyTicket(forged, TicketEvents, now)
+	assert.Equal(t, ErrInvalidTicket, err)
+
+	_, err = IssueTicket(user, "backup", now)
+	assert.NotNil(t, err)
+}
+
+func TestCreateTicket(t *testing.T) {
+	router := newRouter()
+
+	request, _ := http.NewRequest("POST", "/api/v1/tickets", bytes.NewBufferString(`{"Purpose": "events"}`))
+	request.Header.Set("Authorization", "invalid_token")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	request, _ = http.NewRequest("POST", "/api/v1/tickets", bytes.NewBufferString(`{"Purpose": "events"}`))
+	request.Header.Set("Authorization", "annotator_token")
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+
+	var ticket TicketResponse
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &ticket))
+	user, err := VerifyTicket(ticket.Ticket, TicketEvents, time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, "morpheus", user.Username)
+
+	// the stream refuses a ticket it can't verify before reaching the database
+	request, _ = http.NewRequest("GET", "/db/events?ticket="+ticket.Ticket+"x", nil)
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kinds of operations on MongoDB, each with its own timeout
+type operationKind string
+
+const (
+	// a document or a page of documents
+	OperationRead operationKind = "read"
+	// insertions, updates and deletions
+	OperationWrite operationKind = "write"
+	// whole collections : exports, checks, migrations
+	OperationScan operationKind = "scan"
+)
+
+/**
+Default timeouts, each can be replaced by MONGO_<KIND>_TIMEOUT_SECONDS,
+for example MONGO_SCAN_TIMEOUT_SECONDS=600
+*/
+var mongoTimeouts = map[operationKind]time.Duration{
+	OperationRead:  5 * time.Second,
+	OperationWrite: 10 * time.Second,
+	OperationScan:  2 * time.Minute,
+}
+
+// Nginx's status for the requests whose client left before the answer, nobody reads it
+const statusClientClosedRequest = 499
+
+var (
+	ErrTimeout     = errors.New("MongoDB operation timed out")
+	ErrUnavailable = errors.New("MongoDB unavailable")
+	ErrCanceled    = errors.New("MongoDB operation canceled")
+)
+
+var (
+	mongoInterruptedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongo_operations_interrupted_total",
+		Help: "Number of MongoDB operations which did not complete, by reason : timeout, unavailable, or canceled",
+	}, []string{"reason"})
+)
+
+func init() {
+	for kind := range mongoTimeouts {
+		name := "MONGO_" + strings.ToUpper(string(kind)) + "_TIMEOUT_SECONDS"
+		if seconds, err := strconv.Atoi(os.Getenv(name)); err == nil && seconds > 0 {
+			mongoTimeouts[kind] = time.Duration(seconds) * time.Second
+		}
+	}
+}
+
+/**
+Context of an operation of the data layer : canceled with ctx, and after the timeout of its kind
+The returned function must be called when the operation is done
+*/
+func withTimeout(ctx context.Context, kind operationKind) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, mongoTimeouts[kind])
+}
+
+/**
+Error returned by the data layer when the driver fails, the interruptions are told apart so that
+the handlers can answer with the right status
+ctx : context of the operation which failed
+*/
+func mongoError(ctx context.Context, err error, message string) error {
+	logf(ctx, "[MONGO-DRIVER] : %v", err.Error())
+	switch {
+	case errors.Is(ctx.Err(), context.Canceled) || errors.Is(err, context.Canceled):
+		mongoInterruptedTotal.WithLabelValues("canceled").Inc()
+		return fmt.Errorf("%w : %v", ErrCanceled, message)
+	case errors.Is(ctx.Err(), context.DeadlineExceeded) || errors.Is(err, context.DeadlineExceeded):
+		mongoInterruptedTotal.WithLabelValues("timeout").Inc()
+		return fmt.Errorf("%w : %v", ErrTimeout, message)
+	case strings.Contains(err.Error(), "server selection"):
+		// no server answered before the timeout of the driver
+		mongoInterruptedTotal.WithLabelValues("unavailable").Inc()
+		return fmt.Errorf("%w : %v", ErrUnavailable, message)
+	}
+	return errors.New(message)
+}
+
+/**
+Answer a request whose data layer call failed
+status : answered when the operation was not interrupted
+*/
+func writeDatabaseError(w http.ResponseWriter, r *http.Request, err error, status int) {
+	logf(r.Context(), "[ERROR] : %v", err.Error())
+	switch {
+	case errors.Is(err, ErrCanceled):
+		w.WriteHeader(statusClientClosedRequest)
+		return
+	case errors.Is(err, ErrTimeout):
+		w.WriteHeader(http.StatusGatewayTimeout)
+	case errors.Is(err, ErrUnavailable):
+		w.WriteHeader(http.StatusServiceUnavailable)
+	default:
+		w.WriteHeader(status)
+	}
+	w.Write([]byte(fmt.Sprintf("[MICRO-DATABASE] %v", err.Error())))
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMongoError(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancel := context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+
+	err := mongoError(canceled, context.Canceled, "Error during MongoDB selection")
+	assert.True(t, errors.Is(err, ErrCanceled))
+	err = mongoError(expired, context.DeadlineExceeded, "Error during MongoDB selection")
+	assert.True(t, errors.Is(err, ErrTimeout))
+	err = mongoError(context.Background(), errors.New("server selection error: server selection timeout"), "Error during MongoDB selection")
+	assert.True(t, errors.Is(err, ErrUnavailable))
+	err = mongoError(context.Background(), errors.New("duplicate key"), "Error during MongoDB insertion")
+	assert.Equal(t, "Error during MongoDB insertion", err.Error())
+}
+
+func TestWriteDatabaseError(t *testing.T) {
+	statuses := map[error]int{
+		ErrTimeout:                   http.StatusGatewayTimeout,
+		ErrUnavailable:               http.StatusServiceUnavailable,
+		ErrCanceled:                  statusClientClosedRequest,
+		errors.New("Error : select"): http.StatusNotFound,
+	}
+	request := httptest.NewRequest("GET", "/db/retrieve/all", nil)
+	for err, status := range statuses {
+		recorder := httptest.NewRecorder()
+		writeDatabaseError(recorder, request, err, http.StatusNotFound)
+		assert.Equal(t, status, recorder.Code, err.Error())
+	}
+}
+
+func TestCanceledOperation(t *testing.T) {
+	Database = Client.Database("taliesin_test").Collection("test_timeouts")
+
+	// the client left before the operation started
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := FindOne(ctx, primitive.NewObjectID(), Database)
+	assert.True(t, errors.Is(err, ErrCanceled))
+
+	ctx, cancel = context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+	_, err = FindAll(ctx, Database)
+	assert.True(t, errors.Is(err, ErrTimeout))
+}
+
+func TestSnapshotOutsideWriteTimeout(t *testing.T) {
+	Database = Client.Database("taliesin_test").Collection("test_timeouts")
+	_, err := Database.InsertOne(context.Background(), bson.D{{"Url", "/snippets/timeouts.png"}})
+	assert.Nil(t, err)
+
+	previous := mongoTimeouts[OperationWrite]
+	mongoTimeouts[OperationWrite] = time.Nanosecond
+	defer func() { mongoTimeouts[OperationWrite] = previous }()
+
+	// the snapshot is a scan, only the deletion runs out of time
+	snapshot, err := DeleteAll(context.Background(), Database, "admin")
+	assert.NotEmpty(t, snapshot)
+	assert.True(t, errors.Is(err, ErrTimeout))
+
+	Database.Database().Collection(snapshot).Drop(context.Background())
+	Database.Drop(context.Background())
+}
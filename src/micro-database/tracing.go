@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/event"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// Exporters of the spans, chosen by OTEL_TRACES_EXPORTER
+const (
+	ExporterNone    = "none"
+	ExporterConsole = "console"
+	ExporterStdout  = "stdout"
+	ExporterFile    = "file"
+	ExporterOTLP    = "otlp"
+)
+
+// Scope of the spans started by the service itself, the instrumentations of the libraries have their own
+const tracerName = "MongoGo/src/micro-database"
+
+/**
+Provider of the spans when they are exported, nil with the "none" exporter
+The trace context of the callers is propagated in both cases
+*/
+var Traces *sdktrace.TracerProvider
+
+func init() {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	exporter, err := newSpanExporter(os.Getenv("OTEL_TRACES_EXPORTER"))
+	if err != nil {
+		log.Printf("[ERROR] Traces not exported : %v", err.Error())
+		return
+	}
+	if exporter == nil {
+		return
+	}
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the name of the service
+	res, err := resource.New(context.Background(),
+		resource.WithAttributes(attribute.String("service.name", "micro-database")),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		log.Printf("[WARNING] Resource of the traces : %v", err.Error())
+	}
+	// the sampler and the batches are set by the OTEL_TRACES_SAMPLER and OTEL_BSP_* variables
+	Traces = sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(Traces)
+}
+
+/**
+Exporter named by OTEL_TRACES_EXPORTER, nil for none
+otlp sends OTLP over HTTP to OTEL_EXPORTER_OTLP_ENDPOINT (http://localhost:4318 by default),
+console (or stdout) and file write the spans as JSON lines, the file being OTEL_TRACES_FILE
+*/
+func newSpanExporter(name string) (sdktrace.SpanExporter, error) {
+	switch name {
+	case "", ExporterNone:
+		return nil, nil
+	case ExporterConsole, ExporterStdout:
+		return stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case ExporterFile:
+		path := os.Getenv("OTEL_TRACES_FILE")
+		if path == "" {
+			path = "traces.json"
+		}
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		return stdouttrace.New(stdouttrace.WithWriter(file))
+	case ExporterOTLP:
+		return otlptracehttp.New(context.Background())
+	default:
+		return nil, fmt.Errorf("unknown exporter %v", name)
+	}
+}
+
+// Tracer of the spans started by the service, from the provider set at the time
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+/**
+Context whose spans are children of the span of ctx, without being canceled with it, and logged with its request id
+For the work going on after a request, as the events and the webhooks
+*/
+func detachedContext(ctx context.Context) context.Context {
+	detached := trace.ContextWithSpanContext(context.Background(), trace.SpanContextFromContext(ctx))
+	if lc, ok := ctx.Value(logContextKey{}).(logContext); ok {
+		detached = context.WithValue(detached, logContextKey{}, lc)
+	}
+	return detached
+}
+
+// Template of the route of the request, its path can hold ids and tokens
+func requestRoute(r *http.Request) string {
+	if current := mux.CurrentRoute(r); current != nil {
+		if template, err := current.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+	return r.URL.Path
+}
+
+/**
+Middleware starting a span for each request, child of the trace context of the caller
+The span is named after the template of the route
+*/
+func traceRequests(next http.Handler) http.Handler {
+	routed := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("http.route", requestRoute(r)))
+		next.ServeHTTP(w, r)
+	})
+	return otelhttp.NewHandler(routed, "request", otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+		return r.Method + " " + requestRoute(r)
+	}))
+}
+
+/**
+Spans of the commands sent to MongoDB, children of the span of the operation which sent them
+The commands sent outside of a trace are not traced, and the documents are never written in the spans
+otelmongo does the same for the drivers from 1.13
+*/
+type mongoCommandSpans struct {
+	mutex sync.Mutex
+	spans map[int64]trace.Span
+}
+
+func newMongoMonitor() *event.CommandMonitor {
+	commands := &mongoCommandSpans{spans: map[int64]trace.Span{}}
+	return &event.CommandMonitor{
+		Started: commands.started,
+		Succeeded: func(ctx context.Context, e *event.CommandSucceededEvent) {
+			commands.finished(e.RequestID, "")
+		},
+		Failed: func(ctx context.Context, e *event.CommandFailedEvent) {
+			commands.finished(e.RequestID, e.Failure)
+		},
+	}
+}
+
+func (c *mongoCommandSpans) started(ctx context.Context, e *event.CommandStartedEvent) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return
+	}
+	attributes := []attribute.KeyValue{
+		attribute.String("db.system", "mongodb"),
+		attribute.String("db.name", e.DatabaseName),
+		attribute.String("db.operation", e.CommandName),
+	}
+	if collection, ok := e.Command.Lookup(e.CommandName).StringValueOK(); ok {
+		attributes = append(attributes, attribute.String("db.mongodb.collection", collection))
+	}
+	_, span := tracer().Start(ctx, "mongo."+e.CommandName, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attributes...))
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.spans[e.RequestID] = span
+}
+
+func (c *mongoCommandSpans) finished(requestId int64, failure string) {
+	c.mutex.Lock()
+	span, ok := c.spans[requestId]
+	delete(c.spans, requestId)
+	c.mutex.Unlock()
+	if !ok {
+		return
+	}
+	if failure != "" {
+		span.SetStatus(codes.Error, redact(failure))
+	}
+	span.End()
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/event"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Spans ended until restore is called, the provider of the service is set back then
+func recordSpans() (spans *tracetest.InMemoryExporter, restore func()) {
+	spans = tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(spans)))
+	return spans, func() {
+		if Traces != nil {
+			otel.SetTracerProvider(Traces)
+		} else {
+			otel.SetTracerProvider(noop.NewTracerProvider())
+		}
+	}
+}
+
+func spanAttribute(span tracetest.SpanStub, key attribute.Key) attribute.Value {
+	for _, kv := range span.Attributes {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestTraceRequests(t *testing.T) {
+	spans, restore := recordSpans()
+	defer restore()
+
+	monitor := newMongoMonitor()
+	command, _ := bson.Marshal(bson.D{{Key: "find", Value: "pictures"}})
+	router := mux.NewRouter()
+	router.Use(traceRequests, requestContext)
+	router.HandleFunc("/db/retrieve/{id}", func(w http.ResponseWriter, r *http.Request) {
+		monitor.Started(r.Context(), &event.CommandStartedEvent{Command: command, DatabaseName: "taliesin", CommandName: "find", RequestID: 1})
+		monitor.Succeeded(r.Context(), &event.CommandSucceededEvent{CommandFinishedEvent: event.CommandFinishedEvent{CommandName: "find", RequestID: 1}})
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	request, _ := http.NewRequest("GET", "/db/retrieve/5e8b2f7d", nil)
+	request.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	router.ServeHTTP(httptest.NewRecorder(), request)
+
+	ended := spans.GetSpans()
+	if !assert.Len(t, ended, 2) {
+		return
+	}
+	operation, served := ended[0], ended[1]
+	assert.Equal(t, "mongo.find", operation.Name)
+	assert.Equal(t, trace.SpanKindClient, operation.SpanKind)
+	assert.Equal(t, "pictures", spanAttribute(operation, "db.mongodb.collection").AsString())
+	assert.Equal(t, "GET /db/retrieve/{id}", served.Name)
+	assert.Equal(t, trace.SpanKindServer, served.SpanKind)
+	assert.Equal(t, "/db/retrieve/{id}", spanAttribute(served, "http.route").AsString())
+
+	// the request continues the trace of the caller, and the operations are its children
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", served.SpanContext.TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", served.Parent.SpanID().String())
+	assert.Equal(t, served.SpanContext.TraceID(), operation.SpanContext.TraceID())
+	assert.Equal(t, served.SpanContext.SpanID(), operation.Parent.SpanID())
+	assert.Equal(t, codes.Error, served.Status.Code)
+
+	// the commands sent outside of a trace are not traced
+	spans.Reset()
+	monitor.Started(context.Background(), &event.CommandStartedEvent{Command: command, CommandName: "find", RequestID: 2})
+	monitor.Succeeded(context.Background(), &event.CommandSucceededEvent{CommandFinishedEvent: event.CommandFinishedEvent{CommandName: "find", RequestID: 2}})
+	assert.Empty(t, spans.GetSpans())
+}
+
+func TestWebhookTraceContext(t *testing.T) {
+	spans, restore := recordSpans()
+	defer restore()
+
+	var traceparent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+	}))
+	defer server.Close()
+
+	ctx, span := tracer().Start(context.Background(), "PUT /db/update/value")
+	webhook := Webhook{Id: primitive.NewObjectID(), URL: server.URL}
+	err := Webhooks.post(detachedContext(ctx), webhook, Event{Id: primitive.NewObjectID(), Type: EventAnnotated}, []byte("{}"))
+	span.End()
+	assert.Nil(t, err)
+
+	ended := spans.GetSpans()
+	if !assert.Len(t, ended, 2) {
+		return
+	}
+	sent := ended[0]
+	assert.Equal(t, "POST webhook", sent.Name)
+	assert.Equal(t, span.SpanContext().SpanID(), sent.Parent.SpanID())
+	// the webhook is sent the span of the attempt, in the trace of the modification
+	assert.Equal(t, "00-"+sent.SpanContext.TraceID().String()+"-"+sent.SpanContext.SpanID().String()+"-01", traceparent)
+}
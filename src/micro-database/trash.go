@@ -0,0 +1,627 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	lib_auth "github.com/taliesin-insa/lib-auth"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**
+A picture in the trash, it can be restored until it is purged
+*/
+type TrashedPicture struct {
+	Picture   `bson:",inline"`
+	DeletedAt time.Time `bson:"DeletedAt" json:"DeletedAt"`
+	DeletedBy string    `bson:"DeletedBy" json:"DeletedBy"`
+}
+
+/**
+Selection of the pictures to delete, the criteria are combined
+*/
+type DeleteFilter struct {
+	Ids       []primitive.ObjectID `json:"Ids,omitempty"`
+	Flags     map[Flag]bool        `json:"Flags,omitempty"`
+	Annotator *string              `json:"Annotator,omitempty"`
+}
+
+// A token allowing to empty the whole collection
+type Confirmation struct {
+	Token   string    `bson:"_id" json:"Token"`
+	Expires time.Time `bson:"Expires" json:"Expires"`
+}
+
+// Pictures stay in the trash for this long, TRASH_RETENTION_DAYS overrides it
+var trashRetention = 30 * 24 * time.Hour
+
+// Snapshots taken before emptying the collection are dropped after this long, SNAPSHOT_RETENTION_DAYS overrides it
+var snapshotRetention = 7 * 24 * time.Hour
+
+const trashPurgeInterval = time.Hour
+
+const snapshotTimeFormat = "20060102T150405Z"
+
+const confirmationValidity = 5 * time.Minute
+
+var ErrEmptyFilter = errors.New("The filter must have at least one criterion")
+var ErrInvalidConfirmation = errors.New("Invalid or expired confirmation token")
+var ErrNotInTrash = errors.New("No picture with this id in the trash")
+var ErrPictureExists = errors.New("A picture with this id already exists")
+
+func init() {
+	if days, err := strconv.Atoi(os.Getenv("TRASH_RETENTION_DAYS")); err == nil && days > 0 {
+		trashRetention = time.Duration(days) * 24 * time.Hour
+	}
+	if days, err := strconv.Atoi(os.Getenv("SNAPSHOT_RETENTION_DAYS")); err == nil && days > 0 {
+		snapshotRetention = time.Duration(days) * 24 * time.Hour
+	}
+}
+
+func trashCollection(collection *mongo.Collection) *mongo.Collection {
+	return companionCollection(collection, "trash")
+}
+
+func confirmationsCollection(collection *mongo.Collection) *mongo.Collection {
+	return companionCollection(collection, "confirmations")
+}
+
+/**
+Translate the filter into a MongoDB filter, the flags must be declared in the settings
+*/
+func (f DeleteFilter) bson(settings Settings) (bson.D, error) {
+	var filter bson.D
+	if len(f.Ids) > 0 {
+		filter = append(filter, bson.E{"_id", bson.D{{"$in", f.Ids}}})
+	}
+	for flag, value := range f.Flags {
+		if err := settings.ValidateFlag(flag); err != nil {
+			return nil, err
+		}
+		if value {
+			filter = append(filter, bson.E{flag.Field(), true})
+		} else {
+			filter = append(filter, bson.E{flag.Field(), bson.D{{"$ne", true}}})
+		}
+	}
+	if f.Annotator != nil {
+		filter = append(filter, bson.E{"Annotator", *f.Annotator})
+	}
+
+	if len(filter) == 0 {
+		return nil, ErrEmptyFilter
+	}
+	return filter, nil
+}
+
+/**
+Move the pictures matching the filter to the trash
+Returns the ids of the deleted pictures
+*/
+func SoftDelete(ctx context.Context, filter DeleteFilter, collection *mongo.Collection, actor string) ([]primitive.ObjectID, error) {
+	settings, err := GetSettings(ctx, collection)
+	if err != nil {
+		return nil, err
+	}
+	mongoFilter, err := filter.bson(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	// the ids first, the filter can match the whole collection
+	scanCtx, cancel := withTimeout(ctx, OperationScan)
+	defer cancel()
+	cur, err := collection.Find(scanCtx, mongoFilter, options.Find().SetProjection(bson.D{{"_id", 1}}))
+	if err != nil {
+		return nil, mongoError(scanCtx, err, "Error during MongoDB selection")
+	}
+	var ids []primitive.ObjectID
+	for cur.Next(scanCtx) {
+		var doc struct {
+			Id primitive.ObjectID `bson:"_id"`
+		}
+		if err := cur.Decode(&doc); err != nil {
+			cur.Close(scanCtx)
+			logf(ctx, "[DECODE] %v", err)
+			return nil, errors.New("Error while iterating results")
+		}
+		ids = append(ids, doc.Id)
+	}
+	if err := cur.Err(); err != nil {
+		cur.Close(scanCtx)
+		logf(ctx, "[CURSOR] %v", err)
+		return nil, errors.New("Error while iterating results")
+	}
+	cur.Close(scanCtx)
+
+	// each picture is moved with its own timeout
+	deleted := []primitive.ObjectID{}
+	now := time.Now().UTC()
+	for _, id := range ids {
+		moved, err := softDeleteOne(ctx, id, mongoFilter, collection, actor, now)
+		if err != nil {
+			return deleted, err
+		}
+		if !moved {
+			continue
+		}
+		deleted = append(deleted, id)
+
+		PublishEvents(ctx, collection, Event{
+			Type:      EventDeleted,
+			PictureId: id,
+			Actor:     actor,
+			Changes:   map[string]interface{}{"Trashed": true},
+		})
+	}
+
+	logf(ctx, "Moved %v documents to the trash\n", len(deleted))
+	return deleted, nil
+}
+
+/**
+Move a picture listed by SoftDelete to the trash, if it still matches the filter
+*/
+func softDeleteOne(ctx context.Context, id primitive.ObjectID, mongoFilter bson.D, collection *mongo.Collection, actor string, now time.Time) (bool, error) {
+	ctx, cancel := withTimeout(ctx, OperationWrite)
+	defer cancel()
+
+	// raw documents are moved so that no field is lost
+	var doc bson.M
+	err := collection.FindOne(ctx, bson.D{{"$and", bson.A{bson.D{{"_id", id}}, mongoFilter}}}).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	} else if err != nil {
+		return false, mongoError(ctx, err, "Error during MongoDB selection")
+	}
+	doc["DeletedAt"] = now
+	doc["DeletedBy"] = actor
+
+	if err := movePicture(ctx, id, doc, collection, trashCollection(collection)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+/**
+Put a document back from the trash
+*/
+func Restore(ctx context.Context, id primitive.ObjectID, collection *mongo.Collection, actor string) error {
+	ctx, cancel := withTimeout(ctx, OperationWrite)
+	defer cancel()
+
+	var doc bson.M
+	err := trashCollection(collection).FindOne(ctx, bson.D{{"_id", id}}).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return ErrNotInTrash
+	} else if err != nil {
+		return mongoError(ctx, err, "Error during MongoDB selection")
+	}
+	delete(doc, "DeletedAt")
+	delete(doc, "DeletedBy")
+
+	if err := movePicture(ctx, id, doc, trashCollection(collection), collection); err != nil {
+		return err
+	}
+
+	PublishEvents(ctx, collection, Event{Type: EventRestored, PictureId: id, Actor: actor})
+	logf(ctx, "Restored document %v\n", id.Hex())
+	return nil
+}
+
+/**
+Copy a document to another collection then remove it from its collection
+The copy is removed if the deletion fails so that the document is never in both
+Returns an ErrPictureExists when the other collection already has a document with this id
+*/
+func movePicture(ctx context.Context, id primitive.ObjectID, doc bson.M, from *mongo.Collection, to *mongo.Collection) error {
+	_, err := to.InsertOne(ctx, doc)
+	if isDuplicateKey(err) {
+		return fmt.Errorf("%w in %v : %v", ErrPictureExists, to.Name(), id.Hex())
+	} else if err != nil {
+		return mongoError(ctx, err, "Error during MongoDB insertion")
+	}
+
+	_, err = from.DeleteOne(ctx, bson.D{{"_id", id}})
+	if err != nil {
+		logf(ctx, "[MONGO-DRIVER] : %v", err.Error())
+		to.DeleteOne(ctx, bson.D{{"_id", id}})
+		return errors.New("Error during MongoDB deletion")
+	}
+	return nil
+}
+
+func FindTrash(ctx context.Context, collection *mongo.Collection) ([]TrashedPicture, error) {
+	ctx, cancel := withTimeout(ctx, OperationRead)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{"DeletedAt", -1}})
+	cur, err := trashCollection(collection).Find(ctx, bson.D{}, opts)
+	if err != nil {
+		return nil, mongoError(ctx, err, "Error during MongoDB selection")
+	}
+	defer cur.Close(ctx)
+
+	results := []TrashedPicture{}
+	for cur.Next(ctx) {
+		var elem TrashedPicture
+		if err := cur.Decode(&elem); err != nil {
+			logf(ctx, "[DECODE] %v", err)
+			return nil, errors.New("Error while iterating results")
+		}
+		results = append(results, elem)
+	}
+
+	if err := cur.Err(); err != nil {
+		logf(ctx, "[CURSOR] %v", err)
+		return nil, errors.New("Error while iterating results")
+	}
+	return results, nil
+}
+
+/**
+Definitively remove the pictures deleted before the given date
+*/
+func PurgeTrash(ctx context.Context, before time.Time, collection *mongo.Collection) (int64, error) {
+	ctx, cancel := withTimeout(ctx, OperationWrite)
+	defer cancel()
+
+	filter := bson.D{{"DeletedAt", bson.D{{"$lt", before}}}}
+	deleteResult, err := trashCollection(collection).DeleteMany(ctx, filter)
+	if err != nil {
+		return 0, mongoError(ctx, err, "Error during MongoDB deletion")
+	}
+	if deleteResult.DeletedCount > 0 {
+		logf(ctx, "Purged %v documents from the trash\n", deleteResult.DeletedCount)
+	}
+	return deleteResult.DeletedCount, nil
+}
+
+/**
+Purge the trash of the pictures older than the retention period, until the program stops
+*/
+func PurgeTrashPeriodically(collection *mongo.Collection) {
+	for {
+		_, err := PurgeTrash(context.Background(), time.Now().Add(-trashRetention), collection)
+		if err != nil {
+			log.Printf("[ERROR] Trash purge : %v", err.Error())
+		}
+		_, err = PurgeSnapshots(context.Background(), time.Now().Add(-snapshotRetention), collection)
+		if err != nil {
+			log.Printf("[ERROR] Snapshots purge : %v", err.Error())
+		}
+		time.Sleep(trashPurgeInterval)
+	}
+}
+
+/**
+Create a single-use token needed to empty the whole collection
+*/
+func NewConfirmation(ctx context.Context, collection *mongo.Collection) (Confirmation, error) {
+	ctx, cancel := withTimeout(ctx, OperationWrite)
+	defer cancel()
+
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		logf(ctx, "[RAND] : %v", err.Error())
+		return Confirmation{}, errors.New("Could not generate a token")
+	}
+
+	confirmation := Confirmation{Token: hex.EncodeToString(token), Expires: time.Now().UTC().Add(confirmationValidity)}
+	_, err := confirmationsCollection(collection).InsertOne(ctx, confirmation)
+	if err != nil {
+		return Confirmation{}, mongoError(ctx, err, "Error during MongoDB insertion")
+	}
+	return confirmation, nil
+}
+
+/**
+Check a confirmation token and make sure it can't be used again
+*/
+func ConsumeConfirmation(ctx context.Context, token string, collection *mongo.Collection) error {
+	ctx, cancel := withTimeout(ctx, OperationWrite)
+	defer cancel()
+
+	filter := bson.D{{"_id", token}, {"Expires", bson.D{{"$gt", time.Now().UTC()}}}}
+	deleteResult, err := confirmationsCollection(collection).DeleteOne(ctx, filter)
+	if err != nil {
+		return mongoError(ctx, err, "Error during MongoDB deletion")
+	}
+	if deleteResult.DeletedCount == 0 {
+		return ErrInvalidConfirmation
+	}
+	return nil
+}
+
+/**
+Copy the whole collection to a new collection named after it, the current time and a random suffix
+so that two snapshots taken in the same second don't overwrite each other
+Returns the name of the snapshot collection
+*/
+func Snapshot(ctx context.Context, collection *mongo.Collection) (string, error) {
+	ctx, cancel := withTimeout(ctx, OperationScan)
+	defer cancel()
+
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		logf(ctx, "[RAND] : %v", err.Error())
+		return "", errors.New("Could not name the snapshot")
+	}
+	name := fmt.Sprintf("%v_snapshot_%v_%v", collection.Name(), time.Now().UTC().Format(snapshotTimeFormat), hex.EncodeToString(suffix))
+	pipeline := mongo.Pipeline{bson.D{{"$out", name}}}
+
+	cur, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return "", mongoError(ctx, err, "Error during MongoDB snapshot")
+	}
+	cur.Close(ctx)
+
+	logf(ctx, "Snapshot of %v written to %v\n", collection.Name(), name)
+	return name, nil
+}
+
+/**
+Drop the snapshots of the collection taken before the given date
+Returns the names of the dropped snapshots
+*/
+func PurgeSnapshots(ctx context.Context, before time.Time, collection *mongo.Collection) ([]string, error) {
+	ctx, cancel := withTimeout(ctx, OperationWrite)
+	defer cancel()
+
+	prefix := collection.Name() + "_snapshot_"
+	filter := bson.D{{"name", bson.D{{"$regex", "^" + regexp.QuoteMeta(prefix)}}}}
+	names, err := collection.Database().ListCollectionNames(ctx, filter)
+	if err != nil {
+		return nil, mongoError(ctx, err, "Error during MongoDB selection")
+	}
+
+	dropped := []string{}
+	for _, name := range names {
+		// the time, then the suffix of the snapshots which have one
+		taken, err := time.Parse(snapshotTimeFormat, strings.SplitN(strings.TrimPrefix(name, prefix), "_", 2)[0])
+		if err != nil || !taken.Before(before) {
+			continue
+		}
+		if err := collection.Database().Collection(name).Drop(ctx); err != nil {
+			return dropped, mongoError(ctx, err, "Error during MongoDB drop")
+		}
+		dropped = append(dropped, name)
+	}
+	if len(dropped) > 0 {
+		logf(ctx, "Dropped the snapshots %v\n", dropped)
+	}
+	return dropped, nil
+}
+
+func softDeletePicture(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.Inc() // incrementing the httpRequestsTotal counter
+
+	user, err, authStatusCode := authenticateUser(r)
+
+	// check if there was an error during the authentication or if the user wasn't authenticated
+	if err != nil {
+		logf(r.Context(), "[ERROR] Check authentication: %v", err.Error())
+		w.WriteHeader(authStatusCode)
+		w.Write([]byte("[MICRO-DATABASE] Couldn't verify identity"))
+		return
+	}
+
+	// check if the authenticated user has sufficient permissions to
+	if user.Role != lib_auth.RoleAdmin {
+		logf(r.Context(), "[WRONG_ROLE] Insufficient permission: want %v, was %v", lib_auth.RoleAdmin, user.Role)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("[MICRO-DATABASE] Insufficient permissions to delete"))
+		return
+	}
+
+	entryId, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("[MICRO-DATABASE] Could not decode ID"))
+		return
+	}
+
+	deleted, err := SoftDelete(r.Context(), DeleteFilter{Ids: []primitive.ObjectID{entryId}}, Database, user.Username)
+	if err != nil {
+		writeDatabaseError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	if len(deleted) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("[MICRO-DATABASE] No picture with this id"))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func softDeleteFilter(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.Inc() // incrementing the httpRequestsTotal counter
+
+	user, err, authStatusCode := authenticateUser(r)
+
+	// check if there was an error during the authentication or if the user wasn't authenticated
+	if err != nil {
+		logf(r.Context(), "[ERROR] Check authentication: %v", err.Error())
+		w.WriteHeader(authStatusCode)
+		w.Write([]byte("[MICRO-DATABASE] Couldn't verify identity"))
+		return
+	}
+
+	// check if the authenticated user has sufficient permissions to
+	if user.Role != lib_auth.RoleAdmin {
+		logf(r.Context(), "[WRONG_ROLE] Insufficient permission: want %v, was %v", lib_auth.RoleAdmin, user.Role)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("[MICRO-DATABASE] Insufficient permissions to delete"))
+		return
+	}
+
+	var filter DeleteFilter
+	_, err = decodeBody(r, maxBodyBytes, &filter)
+	if err != nil {
+		writeRequestError(w, r, err)
+		return
+	}
+
+	deleted, err := SoftDelete(r.Context(), filter, Database, user.Username)
+	if errors.Is(err, ErrEmptyFilter) || errors.Is(err, ErrUnknownFlag) {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("[MICRO-DATABASE] %v", err.Error())))
+		return
+	} else if err != nil {
+		writeDatabaseError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	body, err := json.Marshal(deleted)
+	if err != nil {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("[MICRO-DATABASE] Could not marshal answer data"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+func getTrash(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.Inc() // incrementing the httpRequestsTotal counter
+
+	user, err, authStatusCode := authenticateUser(r)
+
+	// check if there was an error during the authentication or if the user wasn't authenticated
+	if err != nil {
+		logf(r.Context(), "[ERROR] Check authentication: %v", err.Error())
+		w.WriteHeader(authStatusCode)
+		w.Write([]byte("[MICRO-DATABASE] Couldn't verify identity"))
+		return
+	}
+
+	// check if the authenticated user has sufficient permissions to
+	if user.Role != lib_auth.RoleAdmin {
+		logf(r.Context(), "[WRONG_ROLE] Insufficient permission: want %v, was %v", lib_auth.RoleAdmin, user.Role)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("[MICRO-DATABASE] Insufficient permissions to see the trash"))
+		return
+	}
+
+	trash, err := FindTrash(r.Context(), Database)
+	if err != nil {
+		writeDatabaseError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	body, err := json.Marshal(trash)
+	if err != nil {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("[MICRO-DATABASE] Could not marshal answer data"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+func restorePicture(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.Inc() // incrementing the httpRequestsTotal counter
+
+	user, err, authStatusCode := authenticateUser(r)
+
+	// check if there was an error during the authentication or if the user wasn't authenticated
+	if err != nil {
+		logf(r.Context(), "[ERROR] Check authentication: %v", err.Error())
+		w.WriteHeader(authStatusCode)
+		w.Write([]byte("[MICRO-DATABASE] Couldn't verify identity"))
+		return
+	}
+
+	// check if the authenticated user has sufficient permissions to
+	if user.Role != lib_auth.RoleAdmin {
+		logf(r.Context(), "[WRONG_ROLE] Insufficient permission: want %v, was %v", lib_auth.RoleAdmin, user.Role)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("[MICRO-DATABASE] Insufficient permissions to restore"))
+		return
+	}
+
+	entryId, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("[MICRO-DATABASE] Could not decode ID"))
+		return
+	}
+
+	err = Restore(r.Context(), entryId, Database, user.Username)
+	if errors.Is(err, ErrNotInTrash) {
+		writeDatabaseError(w, r, err, http.StatusNotFound)
+		return
+	} else if errors.Is(err, ErrPictureExists) {
+		writeDatabaseError(w, r, err, http.StatusConflict)
+		return
+	} else if err != nil {
+		writeDatabaseError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func deleteAllConfirmation(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.Inc() // incrementing the httpRequestsTotal counter
+
+	user, err, authStatusCode := authenticateUser(r)
+
+	// check if there was an error during the authentication or if the user wasn't authenticated
+	if err != nil {
+		logf(r.Context(), "[ERROR] Check authentication: %v", err.Error())
+		w.WriteHeader(authStatusCode)
+		w.Write([]byte("[MICRO-DATABASE] Couldn't verify identity"))
+		return
+	}
+
+	// check if the authenticated user has sufficient permissions to
+	if user.Role != lib_auth.RoleAdmin {
+		logf(r.Context(), "[WRONG_ROLE] Insufficient permission: want %v, was %v", lib_auth.RoleAdmin, user.Role)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("[MICRO-DATABASE] Insufficient permissions to delete"))
+		return
+	}
+
+	confirmation, err := NewConfirmation(r.Context(), Database)
+	if err != nil {
+		writeDatabaseError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	body, err := json.Marshal(confirmation)
+	if err != nil {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("[MICRO-DATABASE] Could not marshal answer data"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(body)
+}
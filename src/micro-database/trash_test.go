@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSoftDeleteAndRestore(t *testing.T) {
+	coll := Client.Database("taliesin_test").Collection("test_soft_delete")
+	doc0 := Picture{Id: primitive.NewObjectID(), PiFF: EmptyPiFF, Url: "/temp/none0"}
+	doc1 := Picture{Id: primitive.NewObjectID(), PiFF: EmptyPiFF, Url: "/temp/none1"}
+	b, _ := json.Marshal([2]Picture{doc0, doc1})
+	res, _ := InsertMany(context.Background(), b, coll, "test")
+	doc0.Id = res[0].(primitive.ObjectID)
+
+	deleted, err := SoftDelete(context.Background(), DeleteFilter{Ids: []primitive.ObjectID{doc0.Id}}, coll, "morpheus")
+	assert.Nil(t, err)
+	assert.Equal(t, []primitive.ObjectID{doc0.Id}, deleted)
+
+	_, err = FindOne(context.Background(), doc0.Id, coll)
+	assert.NotNil(t, err)
+	pics, _ := FindAll(context.Background(), coll)
+	assert.Equal(t, 1, len(pics))
+
+	trash, err := FindTrash(context.Background(), coll)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(trash))
+	assert.Equal(t, doc0.Id, trash[0].Id)
+	assert.Equal(t, "/temp/none0", trash[0].Url)
+	assert.Equal(t, "morpheus", trash[0].DeletedBy)
+
+	err = Restore(context.Background(), doc0.Id, coll, "morpheus")
+	assert.Nil(t, err)
+
+	pic, err := FindOne(context.Background(), doc0.Id, coll)
+	assert.Nil(t, err)
+	assert.Equal(t, "/temp/none0", pic.Url)
+	trash, _ = FindTrash(context.Background(), coll)
+	assert.Equal(t, 0, len(trash))
+
+	err = Restore(context.Background(), doc0.Id, coll, "morpheus")
+	assert.NotNil(t, err)
+}
+
+func TestSoftDeleteFilter(t *testing.T) {
+	coll := Client.Database("taliesin_test").Collection("test_soft_delete_filter")
+	doc0 := Picture{Id: primitive.NewObjectID(), PiFF: EmptyPiFF, Url: "/temp/none0", Unreadable: true}
+	doc1 := Picture{Id: primitive.NewObjectID(), PiFF: EmptyPiFF, Url: "/temp/none1"}
+	b, _ := json.Marshal([2]Picture{doc0, doc1})
+	InsertMany(context.Background(), b, coll, "test")
+
+	_, err := SoftDelete(context.Background(), DeleteFilter{}, coll, "morpheus")
+	assert.Equal(t, ErrEmptyFilter, err)
+
+	_, err = SoftDelete(context.Background(), DeleteFilter{Flags: map[Flag]bool{"PiFF": true}}, coll, "morpheus")
+	assert.NotNil(t, err)
+
+	deleted, err := SoftDelete(context.Background(), DeleteFilter{Flags: map[Flag]bool{FlagUnreadable: true}}, coll, "morpheus")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(deleted))
+
+	pics, _ := FindAll(context.Background(), coll)
+	assert.Equal(t, 1, len(pics))
+	assert.Equal(t, "/temp/none1", pics[0].Url)
+
+	purged, err := PurgeTrash(context.Background(), time.Now().Add(-time.Hour), coll)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), purged)
+
+	purged, err = PurgeTrash(context.Background(), time.Now().Add(time.Second), coll)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), purged)
+}
+
+func TestDeleteAllConfirmation(t *testing.T) {
+	Database = Client.Database("taliesin_test").Collection("test_delete_all_confirmation")
+	doc0 := Picture{Id: primitive.NewObjectID(), PiFF: EmptyPiFF, Url: "/temp/none0"}
+	b, _ := json.Marshal([1]Picture{doc0})
+	InsertMany(context.Background(), b, Database, "test")
+
+	request, _ := http.NewRequest("DELETE", "/db/delete/all", nil)
+	request.Header.Set("Authorization", "admin_token")
+	recorder := httptest.NewRecorder()
+	deleteAll(recorder, request)
+	assert.Equal(t, http.StatusPreconditionRequired, recorder.Code)
+
+	request.Header.Set("X-Confirmation-Token", "guessed")
+	recorder = httptest.NewRecorder()
+	deleteAll(recorder, request)
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+
+	pics, _ := FindAll(context.Background(), Database)
+	assert.Equal(t, 1, len(pics))
+
+	request, _ = http.NewRequest("POST", "/db/delete/all/confirmation", nil)
+	request.Header.Set("Authorization", "admin_token")
+	recorder = httptest.NewRecorder()
+	deleteAllConfirmation(recorder, request)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+
+	var confirmation Confirmation
+	err := json.Unmarshal(recorder.Body.Bytes(), &confirmation)
+	assert.Nil(t, err)
+
+	request, _ = http.NewRequest("DELETE", "/db/delete/all", nil)
+	request.Header.Set("Authorization", "admin_token")
+	request.Header.Set("X-Confirmation-Token", confirmation.Token)
+	recorder = httptest.NewRecorder()
+	deleteAll(recorder, request)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	pics, _ = FindAll(context.Background(), Database)
+	assert.Equal(t, 0, len(pics))
+
+	// a token can only be used once
+	recorder = httptest.NewRecorder()
+	deleteAll(recorder, request)
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+}
+
+func TestRestoreExistingPicture(t *testing.T) {
+	Database = Client.Database("taliesin_test").Collection("test_restore_existing")
+	doc0 := Picture{Id: primitive.NewObjectID(), PiFF: EmptyPiFF, Url: "/temp/none0"}
+	b, _ := json.Marshal([1]Picture{doc0})
+	res, _ := InsertMany(context.Background(), b, Database, "test")
+	id := res[0].(primitive.ObjectID)
+
+	_, err := SoftDelete(context.Background(), DeleteFilter{Ids: []primitive.ObjectID{id}}, Database, "morpheus")
+	assert.Nil(t, err)
+	// the same picture is imported again
+	_, err = Database.InsertOne(context.Background(), bson.D{{"_id", id}, {"Url", "/temp/none0"}})
+	assert.Nil(t, err)
+
+	restore := func(id string) int {
+		request, _ := http.NewRequest("POST", "/db/trash/"+id+"/restore", nil)
+		request.Header.Set("Authorization", "admin_token")
+		request = mux.SetURLVars(request, map[string]string{"id": id})
+		recorder := httptest.NewRecorder()
+		restorePicture(recorder, request)
+		return recorder.Code
+	}
+	assert.Equal(t, http.StatusConflict, restore(id.Hex()))
+	trash, _ := FindTrash(context.Background(), Database)
+	assert.Equal(t, 1, len(trash))
+
+	assert.Equal(t, http.StatusNotFound, restore(primitive.NewObjectID().Hex()))
+
+	trashCollection(Database).Drop(context.Background())
+	Database.Drop(context.Background())
+}
+
+func TestPurgeSnapshots(t *testing.T) {
+	coll := Client.Database("taliesin_test").Collection("test_purge_snapshots")
+	_, err := coll.InsertOne(context.Background(), bson.D{{"Url", "/temp/none0"}})
+	assert.Nil(t, err)
+
+	// taken in the same second, they don't overwrite each other
+	first, err := Snapshot(context.Background(), coll)
+	assert.Nil(t, err)
+	second, err := Snapshot(context.Background(), coll)
+	assert.Nil(t, err)
+	assert.NotEqual(t, first, second)
+
+	dropped, err := PurgeSnapshots(context.Background(), time.Now().Add(-time.Hour), coll)
+	assert.Nil(t, err)
+	assert.Empty(t, dropped)
+
+	dropped, err = PurgeSnapshots(context.Background(), time.Now().Add(time.Second), coll)
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{first, second}, dropped)
+	names, _ := coll.Database().ListCollectionNames(context.Background(), bson.D{{"name", bson.D{{"$regex", "^test_purge_snapshots_snapshot_"}}}})
+	assert.Empty(t, names)
+
+	coll.Drop(context.Background())
+}
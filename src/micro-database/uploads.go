@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"image"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// Largest upload request, and part of it kept in memory while parsing
+const (
+	uploadMaxBytes  = 64 << 20
+	uploadMaxMemory = 16 << 20
+)
+
+// Formats accepted, with the extension of their files
+var uploadFormats = map[string]string{"png": ".png", "jpeg": ".jpg", "gif": ".gif"}
+
+var ErrUnsupportedFormat = errors.New("Unsupported image format")
+var ErrInvalidUpload = errors.New("Invalid upload")
+
+type UploadResult struct {
+	Filename string             `json:"Filename"`
+	Id       primitive.ObjectID `json:"Id"`
+	Url      string             `json:"Url"`
+	// The same file was already uploaded, Id is the existing picture
+	Duplicate bool      `json:"Duplicate"`
+	Image     ImageInfo `json:"Image"`
+}
+
+type upload struct {
+	filename string
+	data     []byte
+	info     ImageInfo
+	piff     *PiFFStruct
+}
+
+/**
+Check an uploaded file and describe it, only the formats of uploadFormats are accepted
+*/
+func InspectImage(data []byte) (ImageInfo, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return ImageInfo{}, fmt.Errorf("%w : %v", ErrUnsupportedFormat, err.Error())
+	}
+	if _, ok := uploadFormats[format]; !ok {
+		return ImageInfo{}, fmt.Errorf("%w : %q", ErrUnsupportedFormat, format)
+	}
+
+	hash := sha256.Sum256(data)
+	return ImageInfo{
+		Hash:   hex.EncodeToString(hash[:]),
+		Format: format,
+		Width:  config.Width,
+		Height: config.Height,
+		Size:   int64(len(data)),
+	}, nil
+}
+
+// Content-addressed location of a file, relative to the snippets root, e.g. /3f/3f1a....png
+func imageRelativePath(info ImageInfo) string {
+	return path.Join("/", info.Hash[:2], info.Hash+uploadFormats[info.Format])
+}
+
+/**
+Store a file on the snippets volume under its hash, a file already stored is kept as it has the same content
+Returns the Url of the file
+*/
+func StoreImage(data []byte, info ImageInfo) (string, error) {
+	relative := imageRelativePath(info)
+	file := filepath.Join(snippetsRoot, filepath.FromSlash(relative))
+
+	if _, err := os.Stat(file); err == nil {
+		return "/snippets" + relative, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return "", err
+	}
+	// written aside then renamed so that no one reads a partial file
+	tmp, err := ioutil.TempFile(filepath.Dir(file), info.Hash+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return "/snippets" + relative, nil
+}
+
+func FindByImageHash(ctx context.Context, hash string, collection *mongo.Collection) (Picture, error) {
+	ctx, cancel := withTimeout(ctx, OperationRead)
+	defer cancel()
+
+	var result Picture
+	err := collection.FindOne(ctx, bson.D{{"Image.Hash", hash}}).Decode(&result)
+	if err == mongo.ErrNoDocuments {
+		return Picture{}, err
+	} else if err != nil {
+		return Picture{}, mongoError(ctx, err, "Error during MongoDB selection")
+	}
+	return result, nil
+}
+
+// PiFF of an image without one : a single line covering the whole image, not annotated yet
+func defaultPiFF(info ImageInfo, url string) PiFFStruct {
+	return PiFFStruct{
+		Meta: Meta{Type: "line", URL: url},
+		Location: []Location{{
+			Type:    "line",
+			Polygon: [][2]int{{0, 0}, {info.Width, 0}, {info.Width, info.Height}, {0, info.Height}},
+			Id:      "loc_0",
+		}},
+		Data: []Data{{Type: "line", LocationId: "loc_0", Value: "", Id: "0"}},
+	}
+}
+
+/**
+Store the uploaded images and insert a picture for each of them, unless the same file was already uploaded
+actor : user uploading the images
+*/
+func InsertUploads(ctx context.Context, uploads []upload, collection *mongo.Collection, actor string) ([]UploadResult, error) {
+	results := make([]UploadResult, 0, len(uploads))
+	inserted := make(map[string]primitive.ObjectID)
+
+	for _, up := range uploads {
+		result := UploadResult{Filename: up.filename, Image: up.info}
+
+		// uploaded earlier, or twice in this request
+		if id, ok := inserted[up.info.Hash]; ok {
+			result.Id, result.Url, result.Duplicate = id, "/snippets"+imageRelativePath(up.info), true
+			results = append(results, result)
+			continue
+		}
+		existing, err := FindByImageHash(ctx, up.info.Hash, collection)
+		if err == nil {
+			result.Id, result.Url, result.Duplicate = existing.Id, existing.Url, true
+			results = append(results, result)
+			continue
+		} else if err != mongo.ErrNoDocuments {
+			return results, err
+		}
+
+		url, err := StoreImage(up.data, up.info)
+		if err != nil {
+			logf(ctx, "[ERROR] Storing %v : %v", up.filename, err.Error())
+			return results, errors.New("Could not store the image")
+		}
+
+		info := up.info
+		pic := Picture{PiFF: defaultPiFF(info, url), Url: url, Filename: up.filename, Image: &info}
+		if up.piff != nil {
+			pic.PiFF = *up.piff
+		}
+		// inserted as JSON, as the other pictures, with the Image the clients can't set
+		b, err := json.Marshal([1]Picture{pic})
+		if err != nil {
+			return results, errors.New("Could not marshal data")
+		}
+		docs, err := decodePictures(ctx, b)
+		if err != nil {
+			return results, err
+		}
+		ids, err := insertPictures(ctx, docs, collection, actor)
+		if err != nil {
+			// the unique index refused a concurrent upload of the same file
+			if existing, findErr := FindByImageHash(ctx, up.info.Hash, collection); findErr == nil {
+				result.Id, result.Url, result.Duplicate = existing.Id, existing.Url, true
+				results = append(results, result)
+				continue
+			}
+			return results, err
+		}
+
+		result.Id, _ = ids[0].(primitive.ObjectID)
+		result.Url = url
+		inserted[up.info.Hash] = result.Id
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+/**
+Read the files of the form, every file is checked before any is stored
+The "piff" values, when given, are the PiFF of the files in the same order
+*/
+func readUploads(form *multipart.Form) ([]upload, error) {
+	headers := form.File["file"]
+	if len(headers) == 0 {
+		return nil, fmt.Errorf("%w : no file", ErrInvalidUpload)
+	}
+	piffs := form.Value["piff"]
+	if len(piffs) > 0 && len(piffs) != len(headers) {
+		return nil, fmt.Errorf("%w : %v PiFF for %v files", ErrInvalidUpload, len(piffs), len(headers))
+	}
+
+	uploads := make([]upload, 0, len(headers))
+	for i, header := range headers {
+		f, err := header.Open()
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(io.LimitReader(f, uploadMaxBytes))
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		info, err := InspectImage(data)
+		if err != nil {
+			return nil, fmt.Errorf("%v : %w", header.Filename, err)
+		}
+		up := upload{filename: filepath.Base(header.Filename), data: data, info: info}
+		if len(piffs) > 0 {
+			var piff PiFFStruct
+			if err := json.Unmarshal([]byte(piffs[i]), &piff); err != nil {
+				return nil, fmt.Errorf("%w : PiFF of %v : %v", ErrInvalidUpload, header.Filename, err.Error())
+			}
+			up.piff = &piff
+		}
+		uploads = append(uploads, up)
+	}
+	return uploads, nil
+}
+
+func uploadImages(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.Inc() // incrementing the httpRequestsTotal counter
+
+	user, err, authStatusCode := authenticateUser(r)
+
+	// check if there was an error during the authentication or if the user wasn't authenticated
+	if err != nil {
+		logf(r.Context(), "[ERROR] Check authentication: %v", err.Error())
+		w.WriteHeader(authStatusCode)
+		w.Write([]byte("[MICRO-DATABASE] Couldn't verify identity"))
+		return
+	}
+
+	if r.ContentLength > uploadMaxBytes {
+		writeRequestError(w, r, fmt.Errorf("%w : at most %v bytes", ErrBodyTooLarge, uploadMaxBytes))
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, uploadMaxBytes)
+	err = r.ParseMultipartForm(uploadMaxMemory)
+	if err == http.ErrNotMultipart || err == http.ErrMissingBoundary {
+		writeRequestError(w, r, fmt.Errorf("%w : %v, expected multipart/form-data", ErrUnsupportedContentType, err.Error()))
+		return
+	} else if err != nil {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("[MICRO-DATABASE] Could not read the multipart form (at most %v bytes)", uploadMaxBytes)))
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	uploads, err := readUploads(r.MultipartForm)
+	if errors.Is(err, ErrUnsupportedFormat) {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		w.Write([]byte(fmt.Sprintf("[MICRO-DATABASE] %v", err.Error())))
+		return
+	} else if err != nil {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("[MICRO-DATABASE] %v", err.Error())))
+		return
+	}
+
+	results, err := InsertUploads(r.Context(), uploads, Database, user.Username)
+	if err != nil {
+		writeDatabaseError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	body, err := json.Marshal(results)
+	if err != nil {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("[MICRO-DATABASE] Could not marshal answer data"))
+		return
+	}
+
+	// only duplicates : nothing was created
+	status := http.StatusConflict
+	for _, result := range results {
+		if !result.Duplicate {
+			status = http.StatusCreated
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
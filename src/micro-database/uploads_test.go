@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func uploadRequest(files map[string][]byte) *http.Request {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for name, data := range files {
+		part, _ := writer.CreateFormFile("file", name)
+		part.Write(data)
+	}
+	writer.Close()
+
+	request, _ := http.NewRequest("POST", "/db/upload", &body)
+	request.Header.Set("Content-Type", writer.FormDataContentType())
+	return request
+}
+
+func TestUploadImages(t *testing.T) {
+	defer setupSnippets(t)()
+	Database = Client.Database("taliesin_test").Collection("test_upload")
+	Database.Drop(context.TODO())
+	EnsureIndexes(context.Background(), Database)
+
+	var scan bytes.Buffer
+	png.Encode(&scan, image.NewGray(image.Rect(0, 0, 30, 20)))
+
+	recorder := httptest.NewRecorder()
+	uploadImages(recorder, uploadRequest(map[string][]byte{"scan.png": scan.Bytes()}))
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+
+	var results []UploadResult
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &results))
+	assert.Equal(t, 1, len(results))
+	assert.False(t, results[0].Duplicate)
+	assert.Equal(t, "png", results[0].Image.Format)
+	assert.Equal(t, 30, results[0].Image.Width)
+	assert.Equal(t, "/snippets/"+results[0].Image.Hash[:2]+"/"+results[0].Image.Hash+".png", results[0].Url)
+
+	// the file is on the volume and the picture can be annotated
+	_, err := os.Stat(filepath.Join(snippetsRoot, results[0].Image.Hash[:2], results[0].Image.Hash+".png"))
+	assert.Nil(t, err)
+	pic, err := FindOne(context.Background(), results[0].Id, Database)
+	assert.Nil(t, err)
+	assert.Equal(t, results[0].Image.Hash, pic.Image.Hash)
+	assert.Equal(t, "scan.png", pic.Filename)
+	assert.Equal(t, "loc_0", pic.PiFF.Data[0].LocationId)
+
+	// the same scan under another name
+	recorder = httptest.NewRecorder()
+	uploadImages(recorder, uploadRequest(map[string][]byte{"copy.png": scan.Bytes()}))
+	assert.Equal(t, http.StatusConflict, recorder.Code)
+	json.Unmarshal(recorder.Body.Bytes(), &results)
+	assert.True(t, results[0].Duplicate)
+	assert.Equal(t, pic.Id, results[0].Id)
+	pics, _ := FindAll(context.Background(), Database)
+	assert.Equal(t, 1, len(pics))
+
+	recorder = httptest.NewRecorder()
+	uploadImages(recorder, uploadRequest(map[string][]byte{"notes.txt": []byte("not an image")}))
+	assert.Equal(t, http.StatusUnsupportedMediaType, recorder.Code)
+}
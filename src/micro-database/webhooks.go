@@ -0,0 +1,665 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	lib_auth "github.com/taliesin-insa/lib-auth"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/**
+A consumer notified of the events by an HTTP POST
+Each request body is signed with the secret, see SignPayload
+*/
+type Webhook struct {
+	Id     primitive.ObjectID `bson:"_id" json:"Id"`
+	URL    string             `bson:"URL" json:"URL" validate:"required"`
+	Secret string             `bson:"Secret,omitempty" json:"Secret,omitempty"`
+	// Only these types of events are sent, all of them if empty
+	Types []EventType `bson:"Types" json:"Types"`
+}
+
+/**
+An event that could not be delivered to a webhook after all the attempts
+*/
+type DeadLetter struct {
+	Id        primitive.ObjectID `bson:"_id" json:"Id"`
+	WebhookId primitive.ObjectID `bson:"WebhookId" json:"WebhookId"`
+	URL       string             `bson:"URL" json:"URL"`
+	Event     Event              `bson:"Event" json:"Event"`
+	Attempts  int                `bson:"Attempts" json:"Attempts"`
+	LastError string             `bson:"LastError" json:"LastError"`
+	Time      time.Time          `bson:"Time" json:"Time"`
+}
+
+const signatureHeader = "X-Taliesin-Signature"
+
+var ErrInvalidWebhook = errors.New("Invalid webhook")
+var ErrWebhookNotFound = errors.New("No webhook with this id")
+var ErrDeadLetterNotFound = errors.New("No dead letter with this id")
+
+// The webhooks are read again after this delay, the other replicas see a registration or a deletion after it
+const webhooksCacheTTL = 30 * time.Second
+
+// Deliveries made at the same time, and deliveries waiting for a worker, unless WEBHOOK_WORKERS and WEBHOOK_QUEUE_SIZE are set
+var (
+	webhookWorkers   = 8
+	webhookQueueSize = 1000
+)
+
+var errWebhookQueueFull = errors.New("too many deliveries waiting, the event was not sent")
+
+func init() {
+	if workers, err := strconv.Atoi(os.Getenv("WEBHOOK_WORKERS")); err == nil && workers > 0 {
+		webhookWorkers = workers
+	}
+	if size, err := strconv.Atoi(os.Getenv("WEBHOOK_QUEUE_SIZE")); err == nil && size > 0 {
+		webhookQueueSize = size
+	}
+}
+
+/**
+Sends the events to the webhooks of their collection, in the background
+The deliveries are queued for a fixed number of workers, when the queue is full they go straight to the dead letters
+Each delivery is retried with an exponential backoff before being put in the dead letters
+*/
+type WebhookDispatcher struct {
+	client      *http.Client
+	maxAttempts int
+	retryDelay  time.Duration
+	pending     sync.WaitGroup
+	// created with the workers, on the first delivery
+	queue chan webhookDelivery
+	start sync.Once
+	// webhooks by name of their collection
+	mutex  sync.Mutex
+	cached map[string]cachedWebhooks
+}
+
+type webhookDelivery struct {
+	ctx        context.Context
+	collection *mongo.Collection
+	webhook    Webhook
+	event      Event
+}
+
+type cachedWebhooks struct {
+	webhooks []Webhook
+	expires  time.Time
+}
+
+var Webhooks = &WebhookDispatcher{
+	client:      &http.Client{Timeout: 10 * time.Second},
+	maxAttempts: 5,
+	retryDelay:  time.Second,
+	cached:      map[string]cachedWebhooks{},
+}
+
+func webhooksCollection(collection *mongo.Collection) *mongo.Collection {
+	return companionCollection(collection, "webhooks")
+}
+
+func deadLettersCollection(collection *mongo.Collection) *mongo.Collection {
+	return companionCollection(collection, "deadletters")
+}
+
+/**
+Signature of a webhook request body, sent in the X-Taliesin-Signature header as "sha256=<hex>"
+*/
+func SignPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (wh Webhook) accepts(eventType EventType) bool {
+	if len(wh.Types) == 0 {
+		return true
+	}
+	for _, t := range wh.Types {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+Register a webhook on the collection, a secret is generated if none is given
+*/
+func InsertWebhook(ctx context.Context, webhook Webhook, collection *mongo.Collection) (Webhook, error) {
+	ctx, cancel := withTimeout(ctx, OperationWrite)
+	defer cancel()
+
+	target, err := url.Parse(webhook.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return Webhook{}, fmt.Errorf("%w : URL must be an absolute http(s) URL", ErrInvalidWebhook)
+	}
+
+	if webhook.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			logf(ctx, "[RAND] : %v", err.Error())
+			return Webhook{}, errors.New("Could not generate a secret")
+		}
+		webhook.Secret = hex.EncodeToString(secret)
+	}
+	webhook.Id = primitive.NewObjectID()
+
+	_, err = webhooksCollection(collection).InsertOne(ctx, webhook)
+	if err != nil {
+		return Webhook{}, mongoError(ctx, err, "Error during MongoDB insertion")
+	}
+	Webhooks.invalidate(collection)
+
+	logf(ctx, "Registered webhook %v on %v\n", webhook.Id.Hex(), webhook.URL)
+	return webhook, nil
+}
+
+func FindWebhooks(ctx context.Context, collection *mongo.Collection) ([]Webhook, error) {
+	ctx, cancel := withTimeout(ctx, OperationRead)
+	defer cancel()
+
+	cur, err := webhooksCollection(collection).Find(ctx, bson.D{})
+	if err != nil {
+		return nil, mongoError(ctx, err, "Error during MongoDB selection")
+	}
+	defer cur.Close(ctx)
+
+	results := []Webhook{}
+	for cur.Next(ctx) {
+		var elem Webhook
+		if err := cur.Decode(&elem); err != nil {
+			logf(ctx, "[DECODE] %v", err)
+			return nil, errors.New("Error while iterating results")
+		}
+		results = append(results, elem)
+	}
+
+	if err := cur.Err(); err != nil {
+		logf(ctx, "[CURSOR] %v", err)
+		return nil, errors.New("Error while iterating results")
+	}
+	return results, nil
+}
+
+func DeleteWebhook(ctx context.Context, id primitive.ObjectID, collection *mongo.Collection) error {
+	ctx, cancel := withTimeout(ctx, OperationWrite)
+	defer cancel()
+
+	deleteResult, err := webhooksCollection(collection).DeleteOne(ctx, bson.D{{"_id", id}})
+	if err != nil {
+		return mongoError(ctx, err, "Error during MongoDB deletion")
+	}
+	Webhooks.invalidate(collection)
+	if deleteResult.DeletedCount == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+func FindDeadLetters(ctx context.Context, collection *mongo.Collection) ([]DeadLetter, error) {
+	ctx, cancel := withTimeout(ctx, OperationRead)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{"_id", 1}})
+	cur, err := deadLettersCollection(collection).Find(ctx, bson.D{}, opts)
+	if err != nil {
+		return nil, mongoError(ctx, err, "Error during MongoDB selection")
+	}
+	defer cur.Close(ctx)
+
+	results := []DeadLetter{}
+	for cur.Next(ctx) {
+		var elem DeadLetter
+		if err := cur.Decode(&elem); err != nil {
+			logf(ctx, "[DECODE] %v", err)
+			return nil, errors.New("Error while iterating results")
+		}
+		results = append(results, elem)
+	}
+
+	if err := cur.Err(); err != nil {
+		logf(ctx, "[CURSOR] %v", err)
+		return nil, errors.New("Error while iterating results")
+	}
+	return results, nil
+}
+
+/**
+Try to deliver the event of a dead letter again, the letter is removed once the delivery is queued
+*/
+func RetryDeadLetter(ctx context.Context, id primitive.ObjectID, collection *mongo.Collection) error {
+	ctx, cancel := withTimeout(ctx, OperationWrite)
+	defer cancel()
+
+	var letter DeadLetter
+	err := deadLettersCollection(collection).FindOne(ctx, bson.D{{"_id", id}}).Decode(&letter)
+	if err == mongo.ErrNoDocuments {
+		return ErrDeadLetterNotFound
+	} else if err != nil {
+		return mongoError(ctx, err, "Error during MongoDB selection")
+	}
+
+	var webhook Webhook
+	err = webhooksCollection(collection).FindOne(ctx, bson.D{{"_id", letter.WebhookId}}).Decode(&webhook)
+	if err == mongo.ErrNoDocuments {
+		return fmt.Errorf("%w : the webhook of this dead letter was deleted", ErrWebhookNotFound)
+	} else if err != nil {
+		return mongoError(ctx, err, "Error during MongoDB selection")
+	}
+
+	// the delivery goes on after the request, a new dead letter is stored if it fails again
+	Webhooks.enqueue(detachedContext(ctx), collection, webhook, letter.Event)
+
+	// only removed once the delivery is queued, so that the event can't be lost in between
+	_, err = deadLettersCollection(collection).DeleteOne(ctx, bson.D{{"_id", id}})
+	if err != nil {
+		return mongoError(ctx, err, "Error during MongoDB deletion")
+	}
+	return nil
+}
+
+func webhooksCacheKey(collection *mongo.Collection) string {
+	webhooks := webhooksCollection(collection)
+	return webhooks.Database().Name() + "." + webhooks.Name()
+}
+
+/**
+Webhooks of the collection, read again once webhooksCacheTTL has passed or after a modification made by this replica
+*/
+func (d *WebhookDispatcher) webhooksOf(ctx context.Context, collection *mongo.Collection) ([]Webhook, error) {
+	key := webhooksCacheKey(collection)
+	d.mutex.Lock()
+	entry, ok := d.cached[key]
+	d.mutex.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.webhooks, nil
+	}
+
+	webhooks, err := FindWebhooks(ctx, collection)
+	if err != nil {
+		return nil, err
+	}
+	d.mutex.Lock()
+	d.cached[key] = cachedWebhooks{webhooks: webhooks, expires: time.Now().Add(webhooksCacheTTL)}
+	d.mutex.Unlock()
+	return webhooks, nil
+}
+
+func (d *WebhookDispatcher) invalidate(collection *mongo.Collection) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	delete(d.cached, webhooksCacheKey(collection))
+}
+
+/**
+Send the events to every webhook of the collection interested in them
+*/
+func (d *WebhookDispatcher) Dispatch(ctx context.Context, collection *mongo.Collection, events []Event) {
+	webhooks, err := d.webhooksOf(ctx, collection)
+	if err != nil {
+		logf(ctx, "[WEBHOOK] Could not load webhooks : %v", err.Error())
+		return
+	}
+
+	for _, webhook := range webhooks {
+		for _, event := range events {
+			if webhook.accepts(event.Type) {
+				d.enqueue(ctx, collection, webhook, event)
+			}
+		}
+	}
+}
+
+/**
+Queue a delivery for the workers, or put it in the dead letters if too many are waiting
+*/
+func (d *WebhookDispatcher) enqueue(ctx context.Context, collection *mongo.Collection, webhook Webhook, event Event) {
+	d.start.Do(func() {
+		d.queue = make(chan webhookDelivery, webhookQueueSize)
+		for i := 0; i < webhookWorkers; i++ {
+			go d.work()
+		}
+	})
+
+	d.pending.Add(1)
+	select {
+	case d.queue <- webhookDelivery{ctx: ctx, collection: collection, webhook: webhook, event: event}:
+	default:
+		logf(ctx, "[WEBHOOK] Delivery queue full, event %v put in the dead letters of %v", event.Id.Hex(), webhook.URL)
+		d.storeDeadLetter(ctx, collection, webhook, event, 0, errWebhookQueueFull)
+		d.pending.Done()
+	}
+}
+
+func (d *WebhookDispatcher) work() {
+	for delivery := range d.queue {
+		d.deliver(delivery.ctx, delivery.collection, delivery.webhook, delivery.event)
+		d.pending.Done()
+	}
+}
+
+/**
+Wait until every delivery in progress succeeded or was put in the dead letters
+*/
+func (d *WebhookDispatcher) Wait() {
+	d.pending.Wait()
+}
+
+func (d *WebhookDispatcher) deliver(ctx context.Context, collection *mongo.Collection, webhook Webhook, event Event) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		logf(ctx, "[WEBHOOK] Could not marshal event %v : %v", event.Id.Hex(), err.Error())
+		return
+	}
+
+	var lastErr error
+	delay := d.retryDelay
+	for attempt := 1; attempt <= d.maxAttempts; attempt++ {
+		lastErr = d.post(ctx, webhook, event, payload)
+		if lastErr == nil {
+			return
+		}
+		logf(ctx, "[WEBHOOK] Attempt %v/%v to deliver event %v to %v failed : %v", attempt, d.maxAttempts, event.Id.Hex(), webhook.URL, lastErr.Error())
+
+		if attempt < d.maxAttempts {
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+	d.storeDeadLetter(ctx, collection, webhook, event, d.maxAttempts, lastErr)
+}
+
+func (d *WebhookDispatcher) storeDeadLetter(ctx context.Context, collection *mongo.Collection, webhook Webhook, event Event, attempts int, lastErr error) {
+	letter := DeadLetter{
+		Id:        primitive.NewObjectID(),
+		WebhookId: webhook.Id,
+		URL:       webhook.URL,
+		Event:     event,
+		Attempts:  attempts,
+		LastError: lastErr.Error(),
+		Time:      time.Now().UTC(),
+	}
+	insertCtx, cancel := withTimeout(ctx, OperationWrite)
+	defer cancel()
+	_, err := deadLettersCollection(collection).InsertOne(insertCtx, letter)
+	if err != nil {
+		logf(ctx, "[MONGO-DRIVER] Could not store dead letter for event %v : %v", event.Id.Hex(), err.Error())
+	}
+}
+
+// Each attempt has its own span, the trace context of the modification is sent with it
+func (d *WebhookDispatcher) post(ctx context.Context, webhook Webhook, event Event, payload []byte) error {
+	request, err := http.NewRequestWithContext(ctx, "POST", webhook.URL, bytes.NewBuffer(payload))
+	if err != nil {
+		return err
+	}
+	ctx, span := tracer().Start(ctx, "POST webhook", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("http.request.method", "POST"),
+		attribute.String("server.address", request.URL.Hostname()),
+		attribute.String("webhook.event", string(event.Type)),
+	))
+	defer span.End()
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(request.Header))
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Taliesin-Event", string(event.Type))
+	request.Header.Set("X-Taliesin-Delivery", event.Id.Hex())
+	request.Header.Set(signatureHeader, SignPayload(webhook.Secret, payload))
+
+	response, err := d.client.Do(request)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	defer response.Body.Close()
+	ioutil.ReadAll(response.Body)
+
+	span.SetAttributes(attribute.Int("http.response.status_code", response.StatusCode))
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		span.SetStatus(codes.Error, response.Status)
+		return fmt.Errorf("webhook answered %v", response.Status)
+	}
+	return nil
+}
+
+func registerWebhook(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.Inc() // incrementing the httpRequestsTotal counter
+
+	user, err, authStatusCode := authenticateUser(r)
+
+	// check if there was an error during the authentication or if the user wasn't authenticated
+	if err != nil {
+		logf(r.Context(), "[ERROR] Check authentication: %v", err.Error())
+		w.WriteHeader(authStatusCode)
+		w.Write([]byte("[MICRO-DATABASE] Couldn't verify identity"))
+		return
+	}
+
+	// check if the authenticated user has sufficient permissions to
+	if user.Role != lib_auth.RoleAdmin {
+		logf(r.Context(), "[WRONG_ROLE] Insufficient permission: want %v, was %v", lib_auth.RoleAdmin, user.Role)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("[MICRO-DATABASE] Insufficient permissions to manage webhooks"))
+		return
+	}
+
+	var webhook Webhook
+	_, err = decodeBody(r, maxBodyBytes, &webhook)
+	if err != nil {
+		writeRequestError(w, r, err)
+		return
+	}
+
+	webhook, err = InsertWebhook(r.Context(), webhook, Database)
+	if errors.Is(err, ErrInvalidWebhook) {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("[MICRO-DATABASE] %v", err.Error())))
+		return
+	} else if err != nil {
+		writeDatabaseError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	// the secret is only sent back once, at creation
+	body, err := json.Marshal(webhook)
+	if err != nil {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("[MICRO-DATABASE] Could not marshal answer data"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(body)
+}
+
+func listWebhooks(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.Inc() // incrementing the httpRequestsTotal counter
+
+	user, err, authStatusCode := authenticateUser(r)
+
+	// check if there was an error during the authentication or if the user wasn't authenticated
+	if err != nil {
+		logf(r.Context(), "[ERROR] Check authentication: %v", err.Error())
+		w.WriteHeader(authStatusCode)
+		w.Write([]byte("[MICRO-DATABASE] Couldn't verify identity"))
+		return
+	}
+
+	// check if the authenticated user has sufficient permissions to
+	if user.Role != lib_auth.RoleAdmin {
+		logf(r.Context(), "[WRONG_ROLE] Insufficient permission: want %v, was %v", lib_auth.RoleAdmin, user.Role)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("[MICRO-DATABASE] Insufficient permissions to manage webhooks"))
+		return
+	}
+
+	webhooks, err := FindWebhooks(r.Context(), Database)
+	if err != nil {
+		writeDatabaseError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	for i := range webhooks {
+		webhooks[i].Secret = ""
+	}
+
+	body, err := json.Marshal(webhooks)
+	if err != nil {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("[MICRO-DATABASE] Could not marshal answer data"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+func deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.Inc() // incrementing the httpRequestsTotal counter
+
+	user, err, authStatusCode := authenticateUser(r)
+
+	// check if there was an error during the authentication or if the user wasn't authenticated
+	if err != nil {
+		logf(r.Context(), "[ERROR] Check authentication: %v", err.Error())
+		w.WriteHeader(authStatusCode)
+		w.Write([]byte("[MICRO-DATABASE] Couldn't verify identity"))
+		return
+	}
+
+	// check if the authenticated user has sufficient permissions to
+	if user.Role != lib_auth.RoleAdmin {
+		logf(r.Context(), "[WRONG_ROLE] Insufficient permission: want %v, was %v", lib_auth.RoleAdmin, user.Role)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("[MICRO-DATABASE] Insufficient permissions to manage webhooks"))
+		return
+	}
+
+	webhookId, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("[MICRO-DATABASE] Could not decode ID"))
+		return
+	}
+
+	err = DeleteWebhook(r.Context(), webhookId, Database)
+	if errors.Is(err, ErrWebhookNotFound) {
+		writeDatabaseError(w, r, err, http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeDatabaseError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func listDeadLetters(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.Inc() // incrementing the httpRequestsTotal counter
+
+	user, err, authStatusCode := authenticateUser(r)
+
+	// check if there was an error during the authentication or if the user wasn't authenticated
+	if err != nil {
+		logf(r.Context(), "[ERROR] Check authentication: %v", err.Error())
+		w.WriteHeader(authStatusCode)
+		w.Write([]byte("[MICRO-DATABASE] Couldn't verify identity"))
+		return
+	}
+
+	// check if the authenticated user has sufficient permissions to
+	if user.Role != lib_auth.RoleAdmin {
+		logf(r.Context(), "[WRONG_ROLE] Insufficient permission: want %v, was %v", lib_auth.RoleAdmin, user.Role)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("[MICRO-DATABASE] Insufficient permissions to manage webhooks"))
+		return
+	}
+
+	letters, err := FindDeadLetters(r.Context(), Database)
+	if err != nil {
+		writeDatabaseError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	body, err := json.Marshal(letters)
+	if err != nil {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("[MICRO-DATABASE] Could not marshal answer data"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+func retryDeadLetter(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.Inc() // incrementing the httpRequestsTotal counter
+
+	user, err, authStatusCode := authenticateUser(r)
+
+	// check if there was an error during the authentication or if the user wasn't authenticated
+	if err != nil {
+		logf(r.Context(), "[ERROR] Check authentication: %v", err.Error())
+		w.WriteHeader(authStatusCode)
+		w.Write([]byte("[MICRO-DATABASE] Couldn't verify identity"))
+		return
+	}
+
+	// check if the authenticated user has sufficient permissions to
+	if user.Role != lib_auth.RoleAdmin {
+		logf(r.Context(), "[WRONG_ROLE] Insufficient permission: want %v, was %v", lib_auth.RoleAdmin, user.Role)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("[MICRO-DATABASE] Insufficient permissions to manage webhooks"))
+		return
+	}
+
+	letterId, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		logf(r.Context(), "[ERROR] : %v", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("[MICRO-DATABASE] Could not decode ID"))
+		return
+	}
+
+	err = RetryDeadLetter(r.Context(), letterId, Database)
+	if errors.Is(err, ErrDeadLetterNotFound) || errors.Is(err, ErrWebhookNotFound) {
+		writeDatabaseError(w, r, err, http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeDatabaseError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}